@@ -0,0 +1,135 @@
+package controller
+
+import (
+	"chainqa_offchain_demo/models"
+	"chainqa_offchain_demo/service"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 一次批量查询最多包含的查询数
+const maxBatchQueries = 20
+
+// BatchQueryHandler 批量查询：每个不同的CID只获取、解密一次，所有查询共享解密后的数据集
+// 返回每个查询的结果，并为每个查询上链一条查询日志
+func BatchQueryHandler(c *gin.Context) {
+	type BatchQueryItemDTO struct {
+		QueryItem string              `json:"queryItem"` // 查询项（与sql二选一）
+		Sql       string              `json:"sql"`       // SQL语句
+		Datasets  map[string][]string `json:"datasets"`  // SQL的数据集绑定
+	}
+	type BatchQueryDTO struct {
+		Uid     string              `json:"uId"`     // 用户ID
+		Queries []BatchQueryItemDTO `json:"queries"` // 查询列表
+		ApiUrl  ApiUrlDTO           `json:"apiUrl"`  // API地址
+		QueryAccessDTO
+		QueryRunDTO
+	}
+
+	var batchDTO BatchQueryDTO
+	// 绑定JSON数据到结构体
+	if err := c.ShouldBindJSON(&batchDTO); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	batchDTO.Uid = strings.TrimSpace(batchDTO.Uid)
+	if len(batchDTO.Queries) == 0 {
+		models.ResponseError400(c, http.StatusBadRequest, "queries 不能为空", nil)
+		return
+	}
+	if len(batchDTO.Queries) > maxBatchQueries {
+		models.ResponseError400(c, http.StatusBadRequest, fmt.Sprintf("一次最多批量查询%d个", maxBatchQueries), nil)
+		return
+	}
+
+	// 确定每个查询的查询项，SQL编译失败时整批返回出错的序号
+	queryItems := make([]string, len(batchDTO.Queries))
+	FilePoses := make([]string, 0)
+	for i, query := range batchDTO.Queries {
+		queryItems[i] = strings.TrimSpace(query.QueryItem)
+		if strings.TrimSpace(query.Sql) != "" {
+			queryItemData, err := service.CompileSQL(query.Sql, query.Datasets)
+			if err != nil {
+				models.ResponseError400(c, http.StatusBadRequest, fmt.Sprintf("第%d个查询: %s", i, err.Error()), err)
+				return
+			}
+			queryItemJSON, _ := json.Marshal(queryItemData)
+			queryItems[i] = string(queryItemJSON)
+		}
+		if queryItems[i] == "" {
+			models.ResponseError400(c, http.StatusBadRequest, fmt.Sprintf("第%d个查询: queryItem 和 sql 不能同时为空", i), nil)
+			return
+		}
+		// 差分隐私查询需要逐个使用隐私预算，不支持批量执行
+		if privacy, _, _ := service.PrivacyQuery(queryItems[i]); privacy != "" {
+			models.ResponseError400(c, http.StatusBadRequest, fmt.Sprintf("第%d个查询: 批量查询不支持差分隐私查询，请通过queryData执行", i), nil)
+			return
+		}
+		// 格式错误的查询项在执行时单独返回错误
+		var queryItemData service.QueryItem
+		if err := json.Unmarshal([]byte(queryItems[i]), &queryItemData); err == nil {
+			for _, pos := range queryItemData.FilePos {
+				FilePoses = append(FilePoses, pos...)
+			}
+		}
+	}
+
+	// 按所有查询的分片确定数据域，检查权限和列权限（整批检查一次）
+	domainName, ok := resolveQueryDomain(c, batchDTO.DomainName, FilePoses)
+	if !ok {
+		return
+	}
+	batchDTO.DomainName = domainName
+	var columnPolicy *service.ColumnPolicy
+	if batchDTO.DomainName != "" {
+		if !checkQueryAccess(c, batchDTO.ApiUrl, batchDTO.QueryAccessDTO) {
+			return
+		}
+		policy, ok := queryColumnPolicy(c, batchDTO.ApiUrl, batchDTO.DomainName, batchDTO.OrgId, batchDTO.Role)
+		if !ok {
+			return
+		}
+		columnPolicy = policy
+	}
+	// 检查过权限的查询才使用结果缓存
+	cacheKeys := make([]string, len(batchDTO.Queries))
+	if batchDTO.DomainName != "" && !batchDTO.NoCache {
+		for i := range queryItems {
+			cacheKeys[i] = columnPolicyCacheKey(queryCacheKey(queryItems[i], batchDTO.DomainName), columnPolicy)
+		}
+	}
+
+	// 整批登记为一个执行中的查询，超时或取消时尚未完成的查询返回对应错误码
+	ctx, release, ok := startQueryRun(c, batchDTO.RunId, batchDTO.Uid)
+	if !ok {
+		return
+	}
+	defer release()
+	ctx = service.WithColumnPolicy(ctx, columnPolicy)
+	results := service.RunBatchQuery(ctx, queryItems, cacheKeys, service.ConfiguredQueryLimits(), newShardPruner(batchDTO.DomainName), newShardLoader(batchDTO.ApiUrl))
+
+	// 每个查询上链一条查询日志（查询ID按秒生成，逐条间隔1s）
+	failedCount := 0
+	logOptions := service.QueryLogOptions{ColumnMasks: columnPolicy.Summary()}
+	for _, result := range results {
+		if result.Counts == -1 {
+			failedCount++
+		}
+		time.Sleep(1000 * time.Millisecond) // 延时1s
+		err := service.UpdateQueryLogWithOptions(batchDTO.ApiUrl.ContractName, batchDTO.ApiUrl.ChainServiceUrl, batchDTO.Uid, result.QueryItem, result.Counts, result.Result, logOptions.WithAnonymity(result.Result))
+		if err != nil {
+			fmt.Println("上链查询日志失败", err)
+		}
+	}
+
+	if failedCount > 0 {
+		models.ResponseOK(c, fmt.Sprintf("批量查询完成，%d个查询出现错误", failedCount), results)
+		return
+	}
+	models.ResponseOK(c, "批量查询成功", results)
+}
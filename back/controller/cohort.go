@@ -0,0 +1,473 @@
+package controller
+
+import (
+	"chainqa_offchain_demo/indexer"
+	"chainqa_offchain_demo/models"
+	"chainqa_offchain_demo/service"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cohortStore 队列存储：索引服务已初始化时保存在Redis，否则保存在内存中
+func cohortStore() service.CohortStore {
+	if indexer.GlobalIndexerService == nil {
+		return service.MemoryCohortStore
+	}
+	return indexer.GlobalIndexerService
+}
+
+// cohortPoseLookup 获取交易上传的分片，索引服务未初始化时为nil
+func cohortPoseLookup() service.CohortPoseLookup {
+	if indexer.GlobalIndexerService == nil {
+		return nil
+	}
+	return indexer.GlobalIndexerService.GetPosesByTxIDs
+}
+
+// CreateCohortFromSearchHandler 按字段在数据域的索引中查询，把匹配的交易ID保存为组织的队列（txId队列），并锚定到链上
+// 需要数据域的读权限；上链一条操作类型为cohort的日志
+func CreateCohortFromSearchHandler(c *gin.Context) {
+	type CohortFromSearchDTO struct {
+		Uid        string    `json:"uId"`        // 用户ID
+		ApiUrl     ApiUrlDTO `json:"apiUrl"`     // API地址
+		Name       string    `json:"name"`       // 队列名称
+		DomainName string    `json:"domainName"` // 必须：数据域名称
+		OrgId      string    `json:"orgId"`      // 组织ID（队列属于该组织）
+		Role       string    `json:"role"`       // 角色
+		QueryFieldsDTO
+	}
+
+	var cohortDTO CohortFromSearchDTO
+	// 绑定JSON数据到结构体
+	if err := c.ShouldBindJSON(&cohortDTO); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	cohortDTO.Uid = strings.TrimSpace(cohortDTO.Uid)
+	cohortDTO.Name = strings.TrimSpace(cohortDTO.Name)
+	cohortDTO.DomainName = strings.TrimSpace(cohortDTO.DomainName)
+	if cohortDTO.DomainName == "" {
+		models.ResponseError400(c, http.StatusBadRequest, "domainName为必填项", nil)
+		return
+	}
+	access := QueryAccessDTO{DomainName: cohortDTO.DomainName, OrgId: cohortDTO.OrgId, Role: cohortDTO.Role}
+	if !checkQueryAccess(c, cohortDTO.ApiUrl, access) {
+		return
+	}
+	if indexer.GlobalIndexerService == nil {
+		models.ResponseError400(c, http.StatusInternalServerError, "索引服务未初始化", nil)
+		return
+	}
+
+	cohortDTO.QueryFieldsDTO.normalize()
+	searchReq := newFieldsSearchRequest(cohortDTO.DomainName, cohortDTO.QueryFieldsDTO)
+	searchReqJSON, _ := json.Marshal(searchReq)
+	searchResult, err := indexer.GlobalIndexerService.ExecuteQuery(searchReq)
+	if err != nil {
+		models.ResponseError400(c, http.StatusInternalServerError, "索引查询失败: "+err.Error(), err)
+		return
+	}
+	definition := service.CohortDefinition{Source: service.CohortSourceSearch, DomainName: cohortDTO.DomainName, Search: string(searchReqJSON)}
+	cohort, err := service.CreateCohort(cohortStore(), cohortDTO.Name, cohortDTO.OrgId, cohortDTO.Uid, service.CohortKindTxId, "", searchResult.TxIDs, definition)
+	if err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	// 上链队列日志：查询项为索引查询请求，结果为队列的摘要
+	summaryJSON, _ := json.Marshal(cohortSummary(cohort))
+	time.Sleep(1000 * time.Millisecond) // 延时1s
+	err = service.UpdateQueryLogWithOptions(cohortDTO.ApiUrl.ContractName, cohortDTO.ApiUrl.ChainServiceUrl, cohortDTO.Uid, string(searchReqJSON), cohort.Counts, string(summaryJSON), service.QueryLogOptions{Action: "cohort", Cohort: cohort.Ref()})
+	if err != nil {
+		fmt.Println("上链队列日志失败", err)
+	}
+	anchorCohort(c, cohortDTO.ApiUrl, cohortDTO.Uid, cohort)
+}
+
+// CreateCohortFromQueryHandler 执行查询项，把结果中keyField列的值保存为组织的队列（rowKey队列），并锚定到链上
+// 需要数据域的读权限（列权限照常生效）；差分隐私查询的结果不能保存为队列；上链一条操作类型为cohort的日志
+func CreateCohortFromQueryHandler(c *gin.Context) {
+	type CohortFromQueryDTO struct {
+		Uid       string    `json:"uId"`       // 用户ID
+		ApiUrl    ApiUrlDTO `json:"apiUrl"`    // API地址
+		Name      string    `json:"name"`      // 队列名称
+		QueryItem string    `json:"queryItem"` // 查询项
+		KeyField  string    `json:"keyField"`  // 成员所在的列（查询结果中的列名，如患者ID）
+		QueryAccessDTO
+		QueryRunDTO
+	}
+
+	var cohortDTO CohortFromQueryDTO
+	// 绑定JSON数据到结构体
+	if err := c.ShouldBindJSON(&cohortDTO); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	cohortDTO.Uid = strings.TrimSpace(cohortDTO.Uid)
+	cohortDTO.Name = strings.TrimSpace(cohortDTO.Name)
+	cohortDTO.KeyField = strings.TrimSpace(cohortDTO.KeyField)
+	cohortDTO.QueryItem = strings.TrimSpace(cohortDTO.QueryItem)
+	cohortDTO.DomainName = strings.TrimSpace(cohortDTO.DomainName)
+	if cohortDTO.DomainName == "" {
+		models.ResponseError400(c, http.StatusBadRequest, "domainName为必填项", nil)
+		return
+	}
+	if cohortDTO.KeyField == "" {
+		models.ResponseError400(c, http.StatusBadRequest, "keyField为必填项", nil)
+		return
+	}
+	var queryItemData service.QueryItem
+	if err := json.Unmarshal([]byte(cohortDTO.QueryItem), &queryItemData); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "QueryItem 格式错误", err)
+		return
+	}
+	if queryItemData.Privacy != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "差分隐私查询的结果不能保存为队列", nil)
+		return
+	}
+	FilePoses := make([]string, 0)
+	for _, pos := range queryItemData.FilePos {
+		FilePoses = append(FilePoses, pos...)
+	}
+	if len(FilePoses) == 0 {
+		models.ResponseError400(c, http.StatusBadRequest, "filePos 不能为空", nil)
+		return
+	}
+
+	if !checkQueryAccess(c, cohortDTO.ApiUrl, cohortDTO.QueryAccessDTO) {
+		return
+	}
+	columnPolicy, ok := queryColumnPolicy(c, cohortDTO.ApiUrl, cohortDTO.DomainName, cohortDTO.OrgId, cohortDTO.Role)
+	if !ok {
+		return
+	}
+	ctx, release, ok := startQueryRun(c, cohortDTO.RunId, cohortDTO.Uid)
+	if !ok {
+		return
+	}
+	defer release()
+	ctx = service.WithColumnPolicy(ctx, columnPolicy)
+
+	cacheKey := ""
+	if !cohortDTO.NoCache {
+		cacheKey = columnPolicyCacheKey(queryCacheKey(cohortDTO.QueryItem, cohortDTO.DomainName), columnPolicy)
+	}
+	queryResult, code, queryErr := cachedQueryResult(c, ctx, cacheKey, cohortDTO.QueryItem, FilePoses, newShardPruner(cohortDTO.DomainName), newShardLoader(cohortDTO.ApiUrl))
+	if queryErr != nil && service.QueryAbortCode(queryErr) == 0 {
+		models.ResponseError400(c, http.StatusBadRequest, queryErr.Error(), queryErr)
+		return
+	}
+	var cohort *service.Cohort
+	cohortErr := queryErr
+	if queryErr == nil {
+		var keys []string
+		if keys, cohortErr = service.CohortRowKeys(queryResult, cohortDTO.KeyField); cohortErr == nil {
+			definition := service.CohortDefinition{Source: service.CohortSourceQuery, DomainName: cohortDTO.DomainName, QueryItem: cohortDTO.QueryItem}
+			cohort, cohortErr = service.CreateCohort(cohortStore(), cohortDTO.Name, cohortDTO.OrgId, cohortDTO.Uid, service.CohortKindRowKey, cohortDTO.KeyField, keys, definition)
+		}
+	}
+
+	// 上链队列日志：查询项和查询结果，创建成功时记录队列
+	logOptions := service.QueryLogOptions{Action: "cohort", ColumnMasks: columnPolicy.Summary()}.WithAnonymity(queryResult)
+	if cohort != nil {
+		logOptions.Cohort = cohort.Ref()
+	}
+	time.Sleep(1000 * time.Millisecond) // 延时1s
+	err := service.UpdateQueryLogWithOptions(cohortDTO.ApiUrl.ContractName, cohortDTO.ApiUrl.ChainServiceUrl, cohortDTO.Uid, cohortDTO.QueryItem, code, queryResult, logOptions)
+	if err != nil {
+		fmt.Println("上链队列日志失败", err)
+	}
+
+	if queryErr != nil {
+		models.ResponseError400(c, service.QueryAbortCode(queryErr), queryErr.Error(), queryErr)
+		return
+	}
+	if cohortErr != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "保存队列失败: "+cohortErr.Error(), cohortErr)
+		return
+	}
+	anchorCohort(c, cohortDTO.ApiUrl, cohortDTO.Uid, cohort)
+}
+
+// CombineCohortsHandler 对组织的rowKey队列做集合运算（union/intersect/difference），结果保存为新队列并锚定到链上
+// 差集为第一个队列减去其余队列；新队列的定义记录操作数的名称和哈希
+// 操作数须属于调用者的组织和同一数据域，需要该数据域的读权限；上链一条操作类型为cohort的日志
+func CombineCohortsHandler(c *gin.Context) {
+	type CombineCohortsDTO struct {
+		Uid     string    `json:"uId"`     // 用户ID
+		ApiUrl  ApiUrlDTO `json:"apiUrl"`  // API地址
+		OrgId   string    `json:"orgId"`   // 组织ID（队列属于该组织）
+		Role    string    `json:"role"`    // 角色
+		Name    string    `json:"name"`    // 新队列的名称
+		Op      string    `json:"op"`      // 集合运算：union/intersect/difference
+		Cohorts []string  `json:"cohorts"` // 参与运算的队列名称（至少两个）
+	}
+
+	var combineDTO CombineCohortsDTO
+	// 绑定JSON数据到结构体
+	if err := c.ShouldBindJSON(&combineDTO); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	combineDTO.Uid = strings.TrimSpace(combineDTO.Uid)
+	combineDTO.OrgId = strings.TrimSpace(combineDTO.OrgId)
+	combineDTO.Op = strings.TrimSpace(combineDTO.Op)
+	combineDTO.Name = strings.TrimSpace(combineDTO.Name)
+	// 检查每个操作数：属于调用者的组织，且有其数据域的读权限
+	for _, operandName := range combineDTO.Cohorts {
+		if _, ok := ownedCohort(c, combineDTO.ApiUrl, combineDTO.OrgId, combineDTO.Role, operandName); !ok {
+			return
+		}
+	}
+	cohort, err := service.CombineCohorts(cohortStore(), combineDTO.Op, combineDTO.Name, combineDTO.OrgId, combineDTO.Uid, combineDTO.Cohorts)
+	if err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	logCohortAction(combineDTO.ApiUrl, combineDTO.Uid, gin.H{"op": combineDTO.Op, "cohorts": combineDTO.Cohorts}, cohort.Counts, cohortSummary(cohort), cohort)
+	anchorCohort(c, combineDTO.ApiUrl, combineDTO.Uid, cohort)
+}
+
+// AnchorCohortHandler 重新锚定队列（创建时锚定失败的队列）
+func AnchorCohortHandler(c *gin.Context) {
+	type AnchorCohortDTO struct {
+		Uid    string    `json:"uId"`    // 用户ID
+		ApiUrl ApiUrlDTO `json:"apiUrl"` // API地址
+		OrgId  string    `json:"orgId"`  // 组织ID
+		Role   string    `json:"role"`   // 角色
+		Name   string    `json:"name"`   // 队列名称
+	}
+	var anchorDTO AnchorCohortDTO
+	if err := c.ShouldBindJSON(&anchorDTO); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	cohort, ok := ownedCohort(c, anchorDTO.ApiUrl, anchorDTO.OrgId, anchorDTO.Role, anchorDTO.Name)
+	if !ok {
+		return
+	}
+	if cohort.Anchored {
+		models.ResponseOK(c, "队列已锚定", cohortSummary(cohort))
+		return
+	}
+	anchorCohort(c, anchorDTO.ApiUrl, strings.TrimSpace(anchorDTO.Uid), cohort)
+}
+
+// GetCohortHandler 获取组织的队列（含成员）
+// 需要队列所属数据域的读权限；上链一条操作类型为cohort的日志
+func GetCohortHandler(c *gin.Context) {
+	type GetCohortDTO struct {
+		Uid    string    `json:"uId"`    // 用户ID
+		ApiUrl ApiUrlDTO `json:"apiUrl"` // API地址
+		OrgId  string    `json:"orgId"`  // 组织ID
+		Role   string    `json:"role"`   // 角色
+		Name   string    `json:"name"`   // 队列名称
+	}
+	var getDTO GetCohortDTO
+	if err := c.ShouldBindJSON(&getDTO); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	cohort, ok := ownedCohort(c, getDTO.ApiUrl, getDTO.OrgId, getDTO.Role, getDTO.Name)
+	if !ok {
+		return
+	}
+	logCohortAction(getDTO.ApiUrl, strings.TrimSpace(getDTO.Uid), gin.H{"op": "get", "name": cohort.Name}, cohort.Counts, cohortSummary(cohort), cohort)
+	models.ResponseOK(c, "获取队列成功", cohort)
+}
+
+// ListCohortsHandler 列出组织的队列（按名称排序，不含成员），只列出有所属数据域读权限的队列
+// 上链一条操作类型为cohort的日志
+func ListCohortsHandler(c *gin.Context) {
+	type ListCohortsDTO struct {
+		Uid    string    `json:"uId"`    // 用户ID
+		ApiUrl ApiUrlDTO `json:"apiUrl"` // API地址
+		OrgId  string    `json:"orgId"`  // 组织ID
+		Role   string    `json:"role"`   // 角色
+	}
+	var listDTO ListCohortsDTO
+	if err := c.ShouldBindJSON(&listDTO); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	listDTO.OrgId = strings.TrimSpace(listDTO.OrgId)
+	cohorts, err := service.ListCohorts(cohortStore(), listDTO.OrgId)
+	if err != nil {
+		models.ResponseError400(c, http.StatusInternalServerError, "获取队列列表失败", err)
+		return
+	}
+	// 每个数据域只检查一次读权限
+	readable := make(map[string]bool)
+	visible := make([]*service.Cohort, 0, len(cohorts))
+	for _, cohort := range cohorts {
+		domainName := cohort.Definition.DomainName
+		allowed, checked := readable[domainName]
+		if !checked && domainName != "" {
+			allowed, err = service.CheckAccess(listDTO.ApiUrl.ContractName, listDTO.ApiUrl.ChainServiceUrl, domainName, "read", listDTO.OrgId, listDTO.Role)
+			if err != nil {
+				models.ResponseError400(c, http.StatusBadRequest, "检查权限失败", err)
+				return
+			}
+			readable[domainName] = allowed
+		}
+		if allowed {
+			visible = append(visible, cohort)
+		}
+	}
+	logCohortAction(listDTO.ApiUrl, strings.TrimSpace(listDTO.Uid), gin.H{"op": "list", "orgId": listDTO.OrgId}, len(visible), visible, nil)
+	models.ResponseOK(c, "获取队列列表成功", visible)
+}
+
+// DeleteCohortHandler 删除组织的队列；已上链的哈希和查询日志不受影响
+// 队列须属于调用者的组织，需要队列所属数据域的读权限；上链一条操作类型为cohort的日志
+func DeleteCohortHandler(c *gin.Context) {
+	type DeleteCohortDTO struct {
+		Uid    string    `json:"uId"`    // 用户ID
+		ApiUrl ApiUrlDTO `json:"apiUrl"` // API地址
+		OrgId  string    `json:"orgId"`  // 组织ID
+		Role   string    `json:"role"`   // 角色
+		Name   string    `json:"name"`   // 队列名称
+	}
+	var deleteDTO DeleteCohortDTO
+	if err := c.ShouldBindJSON(&deleteDTO); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	cohort, ok := ownedCohort(c, deleteDTO.ApiUrl, deleteDTO.OrgId, deleteDTO.Role, deleteDTO.Name)
+	if !ok {
+		return
+	}
+	if err := service.DeleteCohort(cohortStore(), cohort.OrgId, cohort.Name); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	logCohortAction(deleteDTO.ApiUrl, strings.TrimSpace(deleteDTO.Uid), gin.H{"op": "delete", "name": cohort.Name}, cohort.Counts, cohortSummary(cohort), cohort)
+	models.ResponseOK(c, "删除队列成功", nil)
+}
+
+// QueryCohortHandler 把查询项限定在组织的队列内执行，然后按queryData的流程执行
+// 需要队列所属数据域的读权限（查询的分片另按其数据域检查）
+// 队列已锚定时先校验队列与链上哈希一致；上链的查询日志记录队列的名称和哈希
+func QueryCohortHandler(c *gin.Context) {
+	type CohortFilterDTO struct {
+		Name  string `json:"name"`  // 队列名称
+		Pos   string `json:"pos"`   // 选填：限定的数据集（主CID），为空时为第一个数据集
+		Field string `json:"field"` // 选填：rowKey队列匹配的列，为空时为队列的keyField
+	}
+	type QueryCohortDTO struct {
+		Uid       string          `json:"uId"`       // 用户ID
+		QueryItem string          `json:"queryItem"` // 查询项
+		Cohort    CohortFilterDTO `json:"cohort"`    // 限定的队列
+		ApiUrl    ApiUrlDTO       `json:"apiUrl"`    // API地址
+		Stream    string          `json:"stream"`    // 流式返回格式（ndjson/sse）
+		QueryAccessDTO
+		QueryRunDTO
+		PageDTO
+	}
+
+	var queryDTO QueryCohortDTO
+	if err := c.ShouldBindJSON(&queryDTO); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	queryDTO.Uid = strings.TrimSpace(queryDTO.Uid)
+	if queryDTO.Cursor != "" {
+		serveQueryPage(c, queryDTO.Uid, queryDTO.ApiUrl, queryDTO.Cursor)
+		return
+	}
+
+	cohort, ok := ownedCohort(c, queryDTO.ApiUrl, queryDTO.OrgId, queryDTO.Role, queryDTO.Cohort.Name)
+	if !ok {
+		return
+	}
+	if cohort.Anchored {
+		if err := service.VerifyCohortAnchor(queryDTO.ApiUrl.ContractName, queryDTO.ApiUrl.ChainServiceUrl, cohort); err != nil {
+			models.ResponseError400(c, http.StatusConflict, err.Error(), err)
+			return
+		}
+	}
+	queryItem, err := service.RestrictQueryToCohort(strings.TrimSpace(queryDTO.QueryItem), cohort, strings.TrimSpace(queryDTO.Cohort.Pos), strings.TrimSpace(queryDTO.Cohort.Field), cohortPoseLookup())
+	if err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	var queryItemData service.QueryItem
+	if err := json.Unmarshal([]byte(queryItem), &queryItemData); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "QueryItem 格式错误", err)
+		return
+	}
+	FilePoses := make([]string, 0)
+	for _, pos := range queryItemData.FilePos {
+		FilePoses = append(FilePoses, pos...)
+	}
+
+	logOptions := service.QueryLogOptions{Cohort: cohort.Ref()}
+	runQueryItem(c, queryDTO.Uid, queryItem, FilePoses, queryDTO.ApiUrl, queryDTO.QueryAccessDTO, queryDTO.RunId, queryDTO.Stream, queryDTO.PageSize, logOptions)
+}
+
+// anchorCohort 把队列的定义和哈希锚定到链上并返回队列的摘要
+// 锚定失败时队列已保存，返回队列和错误，可通过/api/cohort/anchor重新锚定
+func anchorCohort(c *gin.Context, apiUrl ApiUrlDTO, uid string, cohort *service.Cohort) {
+	err := service.AnchorCohort(apiUrl.ContractName, apiUrl.ChainServiceUrl, uid, cohort.OrgId, cohort.Name, cohort.Hash, cohort.AnchorDefinition(), cohort.Counts)
+	// 删除后重新创建的相同队列（定义和成员都相同）在链上已有锚定
+	if err != nil && service.VerifyCohortAnchor(apiUrl.ContractName, apiUrl.ChainServiceUrl, cohort) != nil {
+		models.ResponseError400(c, http.StatusBadGateway, "队列已保存，但锚定哈希失败: "+err.Error(), cohortSummary(cohort))
+		return
+	}
+	if err := service.MarkCohortAnchored(cohortStore(), cohort.OrgId, cohort.Name); err != nil {
+		models.ResponseError400(c, http.StatusInternalServerError, "哈希已锚定，但保存锚定状态失败: "+err.Error(), err)
+		return
+	}
+	cohort.Anchored = true
+	models.ResponseOK(c, fmt.Sprintf("保存队列成功（%d个成员）", cohort.Counts), cohortSummary(cohort))
+}
+
+// ownedCohort 获取调用者组织的队列，并检查队列所属数据域的读权限，失败时返回错误响应
+func ownedCohort(c *gin.Context, apiUrl ApiUrlDTO, orgId string, role string, name string) (*service.Cohort, bool) {
+	orgId = strings.TrimSpace(orgId)
+	cohort, err := service.GetCohort(cohortStore(), orgId, strings.TrimSpace(name))
+	if err != nil {
+		models.ResponseError400(c, http.StatusNotFound, err.Error(), err)
+		return nil, false
+	}
+	if cohort.OrgId != orgId {
+		models.ResponseError400(c, http.StatusForbidden, "队列不属于调用者的组织", nil)
+		return nil, false
+	}
+	if cohort.Definition.DomainName == "" {
+		models.ResponseError400(c, http.StatusForbidden, "队列没有所属的数据域，不能使用", nil)
+		return nil, false
+	}
+	access := QueryAccessDTO{DomainName: cohort.Definition.DomainName, OrgId: orgId, Role: role}
+	if !checkQueryAccess(c, apiUrl, access) {
+		return nil, false
+	}
+	return cohort, true
+}
+
+// logCohortAction 上链一条操作类型为cohort的日志：查询项为请求（JSON），结果为队列的摘要；cohort不为nil时记录队列
+func logCohortAction(apiUrl ApiUrlDTO, uid string, request interface{}, status int, result interface{}, cohort *service.Cohort) {
+	requestJSON, _ := json.Marshal(request)
+	resultJSON, _ := json.Marshal(result)
+	logOptions := service.QueryLogOptions{Action: "cohort"}
+	if cohort != nil {
+		logOptions.Cohort = cohort.Ref()
+	}
+	time.Sleep(1000 * time.Millisecond) // 延时1s
+	err := service.UpdateQueryLogWithOptions(apiUrl.ContractName, apiUrl.ChainServiceUrl, uid, string(requestJSON), status, string(resultJSON), logOptions)
+	if err != nil {
+		fmt.Println("上链队列日志失败", err)
+	}
+}
+
+// cohortSummary 队列的摘要（不含成员）
+func cohortSummary(cohort *service.Cohort) service.Cohort {
+	summary := *cohort
+	summary.Members = nil
+	return summary
+}
@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"chainqa_offchain_demo/models"
+	"chainqa_offchain_demo/service"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DatasetSchemaHandler 查看数据集的表结构：列名、推断的列类型、总行数和分片列表，用于构建查询项（无需下载整个文件）
+// 需要数据域的metadata、read或dpQuery权限，无权访问的列不返回；表结构在分片第一次解密后缓存
+// 上链一条操作类型为metadata的日志
+func DatasetSchemaHandler(c *gin.Context) {
+	type DatasetSchemaDTO struct {
+		Uid       string    `json:"uId"`       // 用户ID
+		ApiUrl    ApiUrlDTO `json:"apiUrl"`    // API地址
+		Cid       string    `json:"cid"`       // 分片CID（与filePoses二选一）
+		FilePoses []string  `json:"filePoses"` // 数据集的分片CID（第一个为主CID）
+		QueryAccessDTO
+		QueryRunDTO
+	}
+
+	var schemaDTO DatasetSchemaDTO
+	// 绑定JSON数据到结构体
+	if err := c.ShouldBindJSON(&schemaDTO); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	schemaDTO.Uid = strings.TrimSpace(schemaDTO.Uid)
+	schemaDTO.DomainName = strings.TrimSpace(schemaDTO.DomainName)
+	FilePoses := make([]string, 0, len(schemaDTO.FilePoses)+1)
+	if cid := strings.TrimSpace(schemaDTO.Cid); cid != "" {
+		FilePoses = append(FilePoses, cid)
+	}
+	for _, filePos := range schemaDTO.FilePoses {
+		if filePos = strings.TrimSpace(filePos); filePos != "" {
+			FilePoses = append(FilePoses, filePos)
+		}
+	}
+	if len(FilePoses) == 0 {
+		models.ResponseError400(c, http.StatusBadRequest, "cid 和 filePoses 不能同时为空", nil)
+		return
+	}
+	if schemaDTO.DomainName == "" {
+		models.ResponseError400(c, http.StatusBadRequest, "domainName为必填项", nil)
+		return
+	}
+
+	// 检查权限，无权访问的列不返回
+	if !checkDomainAccess(c, schemaDTO.ApiUrl, schemaDTO.QueryAccessDTO, []string{"metadata", "read", "dpQuery"}) {
+		return
+	}
+	columnPolicy, ok := queryColumnPolicy(c, schemaDTO.ApiUrl, schemaDTO.DomainName, schemaDTO.OrgId, schemaDTO.Role)
+	if !ok {
+		return
+	}
+	ctx, release, ok := startQueryRun(c, schemaDTO.RunId, schemaDTO.Uid)
+	if !ok {
+		return
+	}
+	defer release()
+	ctx = service.WithColumnPolicy(ctx, columnPolicy)
+
+	description, describeErr := service.DescribeDataset(ctx, FilePoses, newShardLoader(schemaDTO.ApiUrl))
+
+	// 上链元数据访问日志：查询项为访问的分片，结果为返回的列
+	queryItemJSON, _ := json.Marshal(service.QueryItem{FilePos: [][]string{FilePoses}})
+	logStatus, logResult := -1, ""
+	if describeErr != nil {
+		logResult = describeErr.Error()
+	} else {
+		logStatus = len(description.Columns)
+		columnsJSON, _ := json.Marshal(description.Columns)
+		logResult = string(columnsJSON)
+	}
+	time.Sleep(1000 * time.Millisecond) // 延时1s
+	err := service.UpdateQueryLogWithAction(schemaDTO.ApiUrl.ContractName, schemaDTO.ApiUrl.ChainServiceUrl, schemaDTO.Uid, string(queryItemJSON), logStatus, logResult, "metadata")
+	if err != nil {
+		fmt.Println("上链元数据访问日志失败", err)
+	}
+
+	if describeErr != nil {
+		if code := service.QueryAbortCode(describeErr); code != 0 {
+			models.ResponseError400(c, code, describeErr.Error(), describeErr)
+			return
+		}
+		models.ResponseError400(c, http.StatusBadRequest, "获取表结构失败: "+describeErr.Error(), describeErr)
+		return
+	}
+	models.ResponseOK(c, "获取表结构成功", description)
+}
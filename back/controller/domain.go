@@ -117,3 +117,18 @@ func queryDomainInfo(req DomainDTO, c *gin.Context) {
 	}
 	models.ResponseOK(c, "查询数据域成功", queryResult)
 }
+
+// QueryPrivacyBudgetHandler 查询组织在数据域中的隐私预算使用情况
+func QueryPrivacyBudgetHandler(c *gin.Context) {
+	var req DomainDTO
+	if err := c.ShouldBindJSON(&req); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	budget, err := service.GetPrivacyBudget(req.ApiUrl.ContractName, req.ApiUrl.ChainServiceUrl, req.DomainName, req.OrgId)
+	if err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "查询隐私预算失败", err)
+		return
+	}
+	models.ResponseOK(c, "查询隐私预算成功", budget)
+}
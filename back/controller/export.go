@@ -0,0 +1,175 @@
+package controller
+
+import (
+	"chainqa_offchain_demo/models"
+	"chainqa_offchain_demo/service"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ExportQueryHandler 导出查询结果为文件（CSV/XLSX/NDJSON）
+// 重新执行查询项（queryItem、sql，或queryId对应的链上查询日志中的查询项），以附件形式返回，并上链一条export操作的查询日志
+func ExportQueryHandler(c *gin.Context) {
+	type ExportQueryDTO struct {
+		Uid       string              `json:"uId"`       // 用户ID
+		QueryItem string              `json:"queryItem"` // 查询项（queryItem/sql/queryId三选一）
+		Sql       string              `json:"sql"`       // SQL语句
+		Datasets  map[string][]string `json:"datasets"`  // SQL的数据集绑定
+		QueryId   string              `json:"queryId"`   // 链上查询日志ID：重新执行该次查询
+		ApiUrl    ApiUrlDTO           `json:"apiUrl"`    // API地址
+		Format    string              `json:"format"`    // 导出格式：csv（默认）/xlsx/ndjson
+		FileName  string              `json:"fileName"`  // 选填：文件名（不含扩展名）
+		QueryAccessDTO
+		QueryRunDTO
+	}
+
+	var exportDTO ExportQueryDTO
+	// 绑定JSON数据到结构体
+	if err := c.ShouldBindJSON(&exportDTO); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	exportDTO.Uid = strings.TrimSpace(exportDTO.Uid)
+	exportDTO.QueryId = strings.TrimSpace(exportDTO.QueryId)
+
+	// 确定查询项
+	queryItem := strings.TrimSpace(exportDTO.QueryItem)
+	switch {
+	case exportDTO.QueryId != "":
+		queryLog, err := service.FindQueryLog(exportDTO.ApiUrl.ContractName, exportDTO.ApiUrl.ChainServiceUrl, exportDTO.Uid, exportDTO.QueryId)
+		if err != nil {
+			models.ResponseError400(c, http.StatusBadRequest, "获取查询日志失败: "+err.Error(), err)
+			return
+		}
+		queryItem = queryLog.QueryItem
+	case strings.TrimSpace(exportDTO.Sql) != "":
+		queryItemData, err := service.CompileSQL(exportDTO.Sql, exportDTO.Datasets)
+		if err != nil {
+			models.ResponseError400(c, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+		queryItemJSON, _ := json.Marshal(queryItemData)
+		queryItem = string(queryItemJSON)
+	}
+	if queryItem == "" {
+		models.ResponseError400(c, http.StatusBadRequest, "queryItem、sql 和 queryId 不能同时为空", nil)
+		return
+	}
+
+	var queryItemData service.QueryItem
+	if err := json.Unmarshal([]byte(queryItem), &queryItemData); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "QueryItem 格式错误", err)
+		return
+	}
+	if len(queryItemData.FilePos) == 0 {
+		models.ResponseError400(c, http.StatusBadRequest, "filePos 不能为空", nil)
+		return
+	}
+	// 差分隐私查询需要检查权限并使用隐私预算，只能通过queryData执行
+	if queryItemData.Privacy != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "导出不支持差分隐私查询，请通过queryData执行", nil)
+		return
+	}
+	FilePoses := make([]string, 0)
+	for _, pos := range queryItemData.FilePos {
+		FilePoses = append(FilePoses, pos...)
+	}
+
+	// 按分片所属的数据域检查读权限，导出的结果同样按列权限过滤和脱敏
+	domainName, ok := resolveQueryDomain(c, exportDTO.DomainName, FilePoses)
+	if !ok {
+		return
+	}
+	exportDTO.DomainName = domainName
+	var columnPolicy *service.ColumnPolicy
+	if exportDTO.DomainName != "" {
+		if !checkQueryAccess(c, exportDTO.ApiUrl, exportDTO.QueryAccessDTO) {
+			return
+		}
+		policy, ok := queryColumnPolicy(c, exportDTO.ApiUrl, exportDTO.DomainName, exportDTO.OrgId, exportDTO.Role)
+		if !ok {
+			return
+		}
+		columnPolicy = policy
+	}
+
+	ctx, release, ok := startQueryRun(c, exportDTO.RunId, exportDTO.Uid)
+	if !ok {
+		return
+	}
+	defer release()
+	ctx = service.WithColumnPolicy(ctx, columnPolicy)
+
+	// 获取分片并查询
+	fileDataMap, err := service.LoadShards(ctx, FilePoses, newShardLoader(exportDTO.ApiUrl))
+	if err != nil {
+		if code := service.QueryAbortCode(err); code != 0 {
+			models.ResponseError400(c, code, err.Error(), err)
+			return
+		}
+		models.ResponseError400(c, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	queryResult, code, queryErr := service.GetQueryResultContext(ctx, queryItem, fileDataMap, service.ConfiguredQueryLimits())
+	var file service.ExportFile
+	exportErr := queryErr
+	if queryErr == nil {
+		file, exportErr = service.ExportQueryResult(queryItem, queryResult, exportDTO.Format, exportDTO.FileName)
+	}
+	if exportErr == nil {
+		// 以附件形式流式写出，文件名含中文时按RFC 2231编码（filename*=utf-8''...）
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.FileName}))
+		c.Header("Content-Type", file.ContentType)
+		c.Header("X-Result-Counts", fmt.Sprint(file.Counts))
+		c.Status(http.StatusOK)
+		exportErr = file.Stream(c.Writer)
+		if exportErr != nil && !c.Writer.Written() {
+			// 尚未写出内容时仍可返回错误响应
+			for _, header := range []string{"Content-Disposition", "Content-Type", "X-Result-Counts"} {
+				c.Writer.Header().Del(header)
+			}
+		}
+	}
+
+	// 上链查询日志（export操作）：结果只记录导出摘要（含写出的文件的SHA256），不记录数据
+	logResult := queryResult
+	if exportErr == nil {
+		summary, _ := json.Marshal(gin.H{
+			"format":        file.Format,
+			"fileName":      file.FileName,
+			"counts":        file.Counts,
+			"sha256":        file.Sha256,
+			"sourceQueryId": exportDTO.QueryId,
+		})
+		logResult = string(summary)
+	} else {
+		code = -1
+	}
+	time.Sleep(1000 * time.Millisecond) // 延时1s
+	logOptions := service.QueryLogOptions{Action: "export", ColumnMasks: columnPolicy.Summary()}
+	err = service.UpdateQueryLogWithOptions(exportDTO.ApiUrl.ContractName, exportDTO.ApiUrl.ChainServiceUrl, exportDTO.Uid, queryItem, code, logResult, logOptions.WithAnonymity(queryResult))
+	if err != nil {
+		fmt.Println("上链查询日志失败", err)
+	}
+
+	if queryErr != nil {
+		// 超时、取消或超出资源限制
+		models.ResponseError400(c, service.QueryAbortCode(queryErr), "导出失败: "+queryErr.Error(), queryErr)
+		return
+	}
+	if exportErr != nil {
+		if c.Writer.Written() {
+			// 写出中途失败（如客户端断开），响应已无法修改
+			fmt.Println("导出文件写出失败", exportErr)
+			return
+		}
+		models.ResponseError400(c, http.StatusBadRequest, "导出失败: "+exportErr.Error(), nil)
+		return
+	}
+}
@@ -0,0 +1,143 @@
+package controller
+
+import (
+	"chainqa_offchain_demo/models"
+	"chainqa_offchain_demo/service"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 一次联邦查询最多包含的数据域数
+const maxFederatedDomains = 10
+
+// FederatedQueryHandler 跨数据域联邦查询：按字段在多个数据域中查询，合并结果并在每行标注来源数据域（_domain）
+// 各数据域分别检查读权限、获取列权限并查询索引（并发），无权访问的数据域作为部分结果说明，不影响其它数据域
+// 每个执行了查询的数据域上链一条查询日志
+func FederatedQueryHandler(c *gin.Context) {
+	type FederatedQueryDTO struct {
+		Uid         string    `json:"uId"`         // 用户ID
+		ApiUrl      ApiUrlDTO `json:"apiUrl"`      // API地址
+		DomainNames []string  `json:"domainNames"` // 必须：数据域名称列表
+		OrgId       string    `json:"orgId"`       // 组织ID
+		Role        string    `json:"role"`        // 角色
+		NoCache     bool      `json:"noCache"`     // 选填：不使用结果缓存
+		QueryFieldsDTO
+		QueryRunDTO
+	}
+
+	var federatedDTO FederatedQueryDTO
+	// 绑定JSON数据到结构体
+	if err := c.ShouldBindJSON(&federatedDTO); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	federatedDTO.Uid = strings.TrimSpace(federatedDTO.Uid)
+	domainNames := make([]string, 0, len(federatedDTO.DomainNames))
+	for _, domainName := range federatedDTO.DomainNames {
+		domainName = strings.TrimSpace(domainName)
+		if domainName != "" && !slices.Contains(domainNames, domainName) {
+			domainNames = append(domainNames, domainName)
+		}
+	}
+	if len(domainNames) == 0 {
+		models.ResponseError400(c, http.StatusBadRequest, "domainNames 不能为空", nil)
+		return
+	}
+	if len(domainNames) > maxFederatedDomains {
+		models.ResponseError400(c, http.StatusBadRequest, fmt.Sprintf("一次最多查询%d个数据域", maxFederatedDomains), nil)
+		return
+	}
+	federatedDTO.QueryFieldsDTO.normalize()
+
+	// 各数据域并发检查权限、查询索引
+	queries := make([]service.FederatedDomainQuery, len(domainNames))
+	var wg sync.WaitGroup
+	for i, domainName := range domainNames {
+		wg.Add(1)
+		go func(i int, domainName string) {
+			defer wg.Done()
+			queries[i] = prepareFederatedDomain(federatedDTO.ApiUrl, domainName, federatedDTO.OrgId, federatedDTO.Role, federatedDTO.QueryFieldsDTO, federatedDTO.NoCache)
+		}(i, domainName)
+	}
+	wg.Wait()
+
+	ctx, release, ok := startQueryRun(c, federatedDTO.RunId, federatedDTO.Uid)
+	if !ok {
+		return
+	}
+	defer release()
+	result, queryErr := service.RunFederatedQuery(ctx, queries, service.ConfiguredQueryLimits(), newShardLoader(federatedDTO.ApiUrl))
+
+	// 每个执行了查询的数据域上链一条查询日志（查询ID按秒生成，逐条间隔1s）
+	for i, domain := range result.Domains {
+		if domain.QueryItem == "" {
+			continue
+		}
+		time.Sleep(1000 * time.Millisecond) // 延时1s
+		logOptions := service.QueryLogOptions{ColumnMasks: queries[i].Policy.Summary()}.WithAnonymity(domain.Result)
+		err := service.UpdateQueryLogWithOptions(federatedDTO.ApiUrl.ContractName, federatedDTO.ApiUrl.ChainServiceUrl, federatedDTO.Uid, domain.QueryItem, domain.Counts, domain.Result, logOptions)
+		if err != nil {
+			fmt.Println("上链查询日志失败", err)
+		}
+	}
+
+	if queryErr != nil {
+		models.ResponseError400(c, service.QueryAbortCode(queryErr), queryErr.Error(), result)
+		return
+	}
+	for _, domain := range result.Domains {
+		if domain.Status == service.FederatedStatusOK || domain.Status == service.FederatedStatusEmpty {
+			models.ResponseOK(c, result.Message, result)
+			return
+		}
+	}
+	models.ResponseError400(c, http.StatusBadRequest, "所有数据域均无权访问或查询失败", result)
+}
+
+// prepareFederatedDomain 准备联邦查询中单个数据域的查询：检查读权限、获取列权限、在索引中按字段查询并构建查询项
+// 无权访问、失败或没有匹配记录时返回不执行的查询，并记录状态和原因
+func prepareFederatedDomain(apiUrl ApiUrlDTO, domainName string, orgId string, role string, fields QueryFieldsDTO, noCache bool) service.FederatedDomainQuery {
+	query := service.FederatedDomainQuery{DomainName: domainName}
+	allowed, err := service.CheckAccess(apiUrl.ContractName, apiUrl.ChainServiceUrl, domainName, "read", orgId, role)
+	if err != nil {
+		query.Status, query.Message = service.FederatedStatusError, "检查权限失败: "+err.Error()
+		return query
+	}
+	if !allowed {
+		query.Status, query.Message = service.FederatedStatusDenied, "没有权限"
+		return query
+	}
+	query.Policy, err = service.FetchColumnPolicy(apiUrl.ContractName, apiUrl.ChainServiceUrl, domainName, orgId, role)
+	if err != nil {
+		query.Status, query.Message = service.FederatedStatusError, "获取列权限失败: "+err.Error()
+		return query
+	}
+
+	FilePoses, err := searchFieldsFilePoses(domainName, fields)
+	if err != nil {
+		query.Status, query.Message = service.FederatedStatusError, err.Error()
+		return query
+	}
+	if len(FilePoses) == 0 {
+		query.Status, query.Message = service.FederatedStatusEmpty, "未找到匹配的文件位置"
+		return query
+	}
+	queryItemJSON, err := json.Marshal(buildFieldsQueryItem(FilePoses, fields))
+	if err != nil {
+		query.Status, query.Message = service.FederatedStatusError, "构建查询项结构体失败: "+err.Error()
+		return query
+	}
+	query.QueryItem = string(queryItemJSON)
+	if !noCache {
+		query.CacheKey = columnPolicyCacheKey(queryCacheKey(query.QueryItem, ""), query.Policy)
+	}
+	query.Pruner = newShardPruner("")
+	return query
+}
@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"chainqa_offchain_demo/indexer"
+	"chainqa_offchain_demo/models"
+	"chainqa_offchain_demo/service"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 索引查询不指定pageSize时的每页交易ID数
+const defaultSearchPageSize = 100
+
+// PageDTO 分页参数：第一次查询时指定pageSize，之后把返回的nextCursor作为cursor请求下一页（提供cursor时忽略其余查询参数）
+type PageDTO struct {
+	PageSize int    `json:"pageSize"` // 选填：每页数量，为0时不分页
+	Cursor   string `json:"cursor"`   // 选填：下一页的游标
+}
+
+// SearchIndexHandler 按字段在数据域的索引中查询，分页返回匹配的交易ID及其所在的文件位置（不获取、不解密分片）
+// 需要数据域的读权限；每页重新执行索引查询，每一页上链一条操作类型为search的查询日志（分页查询ID相同）
+func SearchIndexHandler(c *gin.Context) {
+	type SearchIndexDTO struct {
+		Uid        string    `json:"uId"`        // 用户ID
+		ApiUrl     ApiUrlDTO `json:"apiUrl"`     // API地址
+		DomainName string    `json:"domainName"` // 必须：数据域名称
+		OrgId      string    `json:"orgId"`      // 组织ID
+		Role       string    `json:"role"`       // 角色
+		QueryFieldsDTO
+		PageDTO
+	}
+
+	var searchDTO SearchIndexDTO
+	// 绑定JSON数据到结构体
+	if err := c.ShouldBindJSON(&searchDTO); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	searchDTO.Uid = strings.TrimSpace(searchDTO.Uid)
+	if searchDTO.Cursor != "" {
+		serveQueryPage(c, searchDTO.Uid, searchDTO.ApiUrl, searchDTO.Cursor)
+		return
+	}
+	searchDTO.DomainName = strings.TrimSpace(searchDTO.DomainName)
+	if searchDTO.DomainName == "" {
+		models.ResponseError400(c, http.StatusBadRequest, "domainName为必填项", nil)
+		return
+	}
+	if err := service.ValidatePageSize(searchDTO.PageSize); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	if searchDTO.PageSize == 0 {
+		searchDTO.PageSize = defaultSearchPageSize
+	}
+
+	access := QueryAccessDTO{DomainName: searchDTO.DomainName, OrgId: searchDTO.OrgId, Role: searchDTO.Role}
+	if !checkQueryAccess(c, searchDTO.ApiUrl, access) {
+		return
+	}
+	index := pageIndex()
+	if index == nil {
+		models.ResponseError400(c, http.StatusInternalServerError, "索引服务未初始化", nil)
+		return
+	}
+
+	searchDTO.QueryFieldsDTO.normalize()
+	searchReq := newFieldsSearchRequest(searchDTO.DomainName, searchDTO.QueryFieldsDTO)
+	searchReqJSON, _ := json.Marshal(searchReq)
+	page, query, err := service.StartIndexPagedQuery(searchDTO.Uid, string(searchReqJSON), searchReq, searchDTO.PageSize, service.QueryLogOptions{Action: "search"}, index)
+	if err != nil {
+		models.ResponseError400(c, http.StatusInternalServerError, err.Error(), err)
+		return
+	}
+	logQueryPage(searchDTO.ApiUrl, searchDTO.Uid, query, page)
+	models.ResponseOK(c, "查询成功", page)
+}
+
+// serveQueryPage 按游标返回分页查询的下一页，并上链查询日志（分页查询ID与第一页相同）
+// 分页查询已过期时返回410，客户端须重新查询
+func serveQueryPage(c *gin.Context, uid string, apiUrl ApiUrlDTO, cursor string) {
+	page, query, err := service.NextQueryPage(cursor, uid, pageIndex())
+	if err != nil {
+		if errors.Is(err, service.ErrPagedQueryExpired) {
+			models.ResponseError400(c, http.StatusGone, err.Error(), err)
+			return
+		}
+		models.ResponseError400(c, http.StatusBadRequest, "游标无效: "+err.Error(), err)
+		return
+	}
+	logQueryPage(apiUrl, uid, query, page)
+	models.ResponseOK(c, "查询成功", page)
+}
+
+// logQueryPage 上链一页的查询日志：查询项为分页查询的查询项，结果为本页，并记录分页查询ID和本页的偏移量
+func logQueryPage(apiUrl ApiUrlDTO, uid string, query *service.PagedQuery, page *service.QueryPage) {
+	logOptions := query.LogOptions
+	logOptions.PageOffset = page.Offset
+	pageJSON, _ := json.Marshal(page)
+	time.Sleep(1000 * time.Millisecond) // 延时1s
+	err := service.UpdateQueryLogWithOptions(apiUrl.ContractName, apiUrl.ChainServiceUrl, uid, query.QueryItem, page.Counts, string(pageJSON), logOptions)
+	if err != nil {
+		fmt.Println("上链查询日志失败", err)
+	}
+}
+
+// pageIndex 分页索引查询使用的索引服务，未初始化时为nil
+func pageIndex() service.PageIndex {
+	if indexer.GlobalIndexerService == nil {
+		return nil
+	}
+	return indexer.GlobalIndexerService
+}
@@ -4,7 +4,9 @@ import (
 	"chainqa_offchain_demo/indexer"
 	"chainqa_offchain_demo/models"
 	"chainqa_offchain_demo/service"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"slices"
@@ -15,11 +17,31 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// QueryAccessDTO 查询的权限信息：查询前按分片所属的数据域检查读权限，且只有检查过权限的查询才使用结果缓存
+// 未提供domainName时从索引服务的上传记录确定分片所属的数据域，无法确定时拒绝查询
+type QueryAccessDTO struct {
+	DomainName string `json:"domainName"` // 选填：数据域名称（未填写时按分片确定）
+	OrgId      string `json:"orgId"`      // 组织ID
+	Role       string `json:"role"`       // 角色
+	NoCache    bool   `json:"noCache"`    // 选填：不使用结果缓存
+}
+
+// QueryRunDTO 查询执行ID：执行中的查询可以通过/api/query/cancel按该ID取消（区别于链上查询日志的queryId）
+// 不填写时自动生成，通过X-Query-Run-Id响应头返回
+type QueryRunDTO struct {
+	RunId string `json:"runId"` // 选填：查询执行ID
+}
+
 func QueryDataHandler(c *gin.Context) {
 	type QueryDataDTO struct {
-		Uid       string    `json:"uId"`       // 用户ID
-		QueryItem string    `json:"queryItem"` // 查询项
-		ApiUrl    ApiUrlDTO `json:"apiUrl"`    // API地址
+		Uid            string    `json:"uId"`            // 用户ID
+		QueryItem      string    `json:"queryItem"`      // 查询项
+		ApiUrl         ApiUrlDTO `json:"apiUrl"`         // API地址
+		Stream         string    `json:"stream"`         // 流式返回格式（ndjson/sse），为空时一次性返回JSON；也可通过Accept请求头指定
+		WithProvenance bool      `json:"withProvenance"` // 选填：每个结果行附带来源（也可在查询项中设置）
+		QueryAccessDTO
+		QueryRunDTO
+		PageDTO
 		// FilePoses []string  `json:"filePoses"` // 文件位置（废弃，直接从QueryItem解析）
 	}
 
@@ -31,6 +53,10 @@ func QueryDataHandler(c *gin.Context) {
 	}
 	queryDataDTO.Uid = strings.TrimSpace(queryDataDTO.Uid)             // 去除空格
 	queryDataDTO.QueryItem = strings.TrimSpace(queryDataDTO.QueryItem) // 去除空格
+	if queryDataDTO.Cursor != "" {
+		serveQueryPage(c, queryDataDTO.Uid, queryDataDTO.ApiUrl, queryDataDTO.Cursor)
+		return
+	}
 
 	// 提取filePos
 	// 解析 QueryItem 字段中的 JSON
@@ -55,66 +81,256 @@ func QueryDataHandler(c *gin.Context) {
 			FilePoses = append(FilePoses, p)
 		}
 	}
-
-	// 查询每个文件位置的数据，用map[string]string存储
-	fileDataMap := make(map[string]string)
-	for _, filePos := range FilePoses {
-		fileCiperData, err := service.HandleGetIPFSFile(filePos, queryDataDTO.ApiUrl.IpfsServiceUrl)
+	if queryDataDTO.WithProvenance {
+		queryItem, err := withProvenanceQueryItem(queryDataDTO.QueryItem)
 		if err != nil {
-			models.ResponseError400(c, http.StatusBadRequest, "请求IPFS错误:"+err.Error(), err)
+			models.ResponseError400(c, http.StatusBadRequest, "QueryItem 格式错误", err)
 			return
 		}
-		// 等待2s
-		time.Sleep(2000 * time.Millisecond) // 延时2s
-		// 从区块链中获取AES密钥
-		aesKey, err := service.GetAesKeyFromBlockchain(queryDataDTO.ApiUrl.ContractName, queryDataDTO.ApiUrl.ChainServiceUrl, filePos)
+		queryDataDTO.QueryItem = queryItem
+	}
+
+	runQueryItem(c, queryDataDTO.Uid, queryDataDTO.QueryItem, FilePoses, queryDataDTO.ApiUrl, queryDataDTO.QueryAccessDTO, queryDataDTO.RunId, queryDataDTO.Stream, queryDataDTO.PageSize, service.QueryLogOptions{})
+}
+
+// QuerySQLHandler 通过SQL语句查询数据：将SQL编译为查询项后按queryData的流程执行
+func QuerySQLHandler(c *gin.Context) {
+	type QuerySQLDTO struct {
+		Uid            string              `json:"uId"`            // 用户ID
+		Sql            string              `json:"sql"`            // SQL语句
+		Datasets       map[string][]string `json:"datasets"`       // 数据集绑定：FROM/JOIN中的名称 -> 分片CID数组（未绑定的名称视为单个CID）
+		ApiUrl         ApiUrlDTO           `json:"apiUrl"`         // API地址
+		Stream         string              `json:"stream"`         // 流式返回格式（ndjson/sse）
+		WithProvenance bool                `json:"withProvenance"` // 选填：每个结果行附带来源
+		QueryAccessDTO
+		QueryRunDTO
+		PageDTO
+	}
+
+	var querySQLDTO QuerySQLDTO
+	// 绑定JSON数据到结构体
+	if err := c.ShouldBindJSON(&querySQLDTO); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	querySQLDTO.Uid = strings.TrimSpace(querySQLDTO.Uid) // 去除空格
+	if querySQLDTO.Cursor != "" {
+		serveQueryPage(c, querySQLDTO.Uid, querySQLDTO.ApiUrl, querySQLDTO.Cursor)
+		return
+	}
+	if strings.TrimSpace(querySQLDTO.Sql) == "" {
+		models.ResponseError400(c, http.StatusBadRequest, "sql 不能为空", nil)
+		return
+	}
+
+	// 编译SQL，语法错误时返回出错位置（offset/line/column/near/message）
+	queryItem, err := service.CompileSQL(querySQLDTO.Sql, querySQLDTO.Datasets)
+	if err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	queryItem.WithProvenance = querySQLDTO.WithProvenance
+	queryItemJSON, err := json.Marshal(queryItem)
+	if err != nil {
+		models.ResponseError400(c, http.StatusInternalServerError, "构建查询项结构体失败: "+err.Error(), err)
+		return
+	}
+
+	FilePoses := make([]string, 0)
+	for _, pos := range queryItem.FilePos {
+		FilePoses = append(FilePoses, pos...)
+	}
+	runQueryItem(c, querySQLDTO.Uid, string(queryItemJSON), FilePoses, querySQLDTO.ApiUrl, querySQLDTO.QueryAccessDTO, querySQLDTO.RunId, querySQLDTO.Stream, querySQLDTO.PageSize, service.QueryLogOptions{})
+}
+
+// ExplainQueryHandler 校验查询项并返回查询计划（联表顺序、估计行数、错误信息）
+// 只使用已缓存或请求中提供的表头，不获取分片、不获取AES密钥、不上链查询日志
+func ExplainQueryHandler(c *gin.Context) {
+	type ExplainQueryDTO struct {
+		QueryItem string              `json:"queryItem"` // 查询项
+		Sql       string              `json:"sql"`       // SQL语句（与queryItem二选一）
+		Datasets  map[string][]string `json:"datasets"`  // SQL的数据集绑定
+		Schemas   map[string][]string `json:"schemas"`   // 选填：分片CID -> 列名，用于未缓存表头的分片
+	}
+
+	var explainDTO ExplainQueryDTO
+	// 绑定JSON数据到结构体
+	if err := c.ShouldBindJSON(&explainDTO); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	queryItem := strings.TrimSpace(explainDTO.QueryItem)
+	if strings.TrimSpace(explainDTO.Sql) != "" {
+		queryItemData, err := service.CompileSQL(explainDTO.Sql, explainDTO.Datasets)
 		if err != nil {
-			models.ResponseError400(c, http.StatusBadRequest, "获取AES密钥失败:"+err.Error(), err)
+			models.ResponseError400(c, http.StatusBadRequest, err.Error(), err)
 			return
 		}
-		// 解密
-		fileData, err := service.AesDecrypt(fileCiperData, aesKey) // 解密文件
+		queryItemJSON, _ := json.Marshal(queryItemData)
+		queryItem = string(queryItemJSON)
+	}
+	if queryItem == "" {
+		models.ResponseError400(c, http.StatusBadRequest, "queryItem 和 sql 不能同时为空", nil)
+		return
+	}
+
+	result := service.ExplainQuery(queryItem, explainDTO.Schemas)
+	if !result.Valid {
+		models.ResponseOK(c, "查询项校验未通过", result)
+		return
+	}
+	models.ResponseOK(c, "查询项校验通过", result)
+}
+
+// runQueryItem 执行查询项：检查权限、获取并解密分片、查询（或流式返回）、上链查询日志
+// 检查过权限的非流式查询使用结果缓存：命中时不获取分片，但照常上链查询日志
+// 数据域未提供时按分片确定（不受数据域管控的分片不检查权限）；有数据域时，条件中的索引字段下推到索引服务；再按分片统计信息跳过不可能满足条件的分片（上链的查询项为跳过分片前的查询项）
+// 查询登记为执行中（可按runId取消），超时、取消或超出资源限制时返回对应错误码，中止的查询同样上链查询日志
+// pageSize大于0时分页返回（不能与流式返回同时使用）
+func runQueryItem(c *gin.Context, uid string, queryItem string, FilePoses []string, apiUrl ApiUrlDTO, access QueryAccessDTO, runId string, stream string, pageSize int, logOptions service.QueryLogOptions) {
+	domainName, ok := resolveQueryDomain(c, access.DomainName, FilePoses)
+	if !ok {
+		return
+	}
+	access.DomainName = domainName
+	if err := service.ValidatePageSize(pageSize); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	if pageSize > 0 && resolveStreamFormat(c, stream) != "" {
+		models.ResponseError400(c, http.StatusBadRequest, "流式返回不支持分页", nil)
+		return
+	}
+	// 差分隐私查询：只被授予dpQuery的角色也可以执行，隐私预算按数据域和组织记录在链上
+	privacy, epsilon, err := service.PrivacyQuery(queryItem)
+	if err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	if privacy != "" && access.DomainName == "" {
+		models.ResponseError400(c, http.StatusBadRequest, "差分隐私查询须提供 domainName（隐私预算按数据域和组织记录）", nil)
+		return
+	}
+	// 隐私预算在查询成功后、返回结果前使用，流式返回在使用预算前就会输出结果
+	if privacy != "" && resolveStreamFormat(c, stream) != "" {
+		models.ResponseError400(c, http.StatusBadRequest, "差分隐私查询不支持流式返回", nil)
+		return
+	}
+	var columnPolicy *service.ColumnPolicy
+	if access.DomainName != "" {
+		if privacy != "" && !checkPrivacyAccess(c, apiUrl, access) {
+			return
+		}
+		if privacy == "" && !checkQueryAccess(c, apiUrl, access) {
+			return
+		}
+		policy, ok := queryColumnPolicy(c, apiUrl, access.DomainName, access.OrgId, access.Role)
+		if !ok {
+			return
+		}
+		columnPolicy = policy
+		logOptions.ColumnMasks = columnPolicy.Summary()
+	}
+	ctx, release, ok := startQueryRun(c, runId, uid)
+	if !ok {
+		return
+	}
+	defer release()
+	ctx = service.WithColumnPolicy(ctx, columnPolicy)
+	logOptions.Privacy = privacy
+	loader := newShardLoader(apiUrl)
+	pruner := newShardPruner(access.DomainName)
+
+	// 流式返回：各分片过滤完成后立即输出
+	if streamFormat := resolveStreamFormat(c, stream); streamFormat != "" {
+		execQueryItem := queryItem
+		if pruner != nil {
+			execQueryItem, _ = pruner(queryItem)
+		}
+		queryResult, code := writeQueryStream(c, ctx, streamFormat, execQueryItem, loader)
+		time.Sleep(1000 * time.Millisecond)                                                                                                                             // 延时1s
+		err := service.UpdateQueryLogWithOptions(apiUrl.ContractName, apiUrl.ChainServiceUrl, uid, queryItem, code, queryResult, logOptions.WithAnonymity(queryResult)) // 上链查询日志
 		if err != nil {
-			models.ResponseError400(c, http.StatusBadRequest, "解密失败:"+err.Error(), err)
+			fmt.Println("上链查询日志失败", err)
+		}
+		return
+	}
+
+	// 差分隐私查询每次重新加噪，不使用结果缓存
+	cacheKey := ""
+	if access.DomainName != "" && !access.NoCache && privacy == "" {
+		cacheKey = columnPolicyCacheKey(queryCacheKey(queryItem, access.DomainName), columnPolicy)
+	}
+	queryResult, code, queryErr := cachedQueryResult(c, ctx, cacheKey, queryItem, FilePoses, pruner, loader)
+	if queryErr != nil && service.QueryAbortCode(queryErr) == 0 {
+		models.ResponseError400(c, http.StatusBadRequest, queryErr.Error(), queryErr)
+		return
+	}
+	if privacy != "" && queryErr == nil && code != -1 {
+		// 查询成功后在链上使用隐私预算，超过预算时不返回结果（失败、中止的查询不消耗预算）
+		if _, err := service.ConsumePrivacyBudget(apiUrl.ContractName, apiUrl.ChainServiceUrl, access.DomainName, access.OrgId, access.Role, uid, epsilon); err != nil {
+			errMsg := "隐私预算不足或无权执行差分隐私查询: " + err.Error()
+			// 被拒绝的查询同样上链查询日志（不记录未返回的结果）
+			time.Sleep(1000 * time.Millisecond)                                                                                              // 延时1s
+			logErr := service.UpdateQueryLogWithOptions(apiUrl.ContractName, apiUrl.ChainServiceUrl, uid, queryItem, -1, errMsg, logOptions) // 上链查询日志
+			if logErr != nil {
+				fmt.Println("上链查询日志失败", logErr)
+			}
+			models.ResponseError400(c, http.StatusForbidden, errMsg, err)
 			return
 		}
-		fileDataMap[filePos] = fileData
 	}
+	respondQueryResult(c, apiUrl, uid, queryItem, queryResult, code, queryErr, pageSize, logOptions.WithAnonymity(queryResult))
+}
 
-	// 调用查询函数
-	queryResult, code := service.GetQueryResult(queryDataDTO.QueryItem, fileDataMap) // 返回查询结果
+// respondQueryResult 上链查询日志并返回查询结果
+// pageSize大于0且查询成功时保存结果、只返回第一页和下一页的游标，上链的查询结果为第一页（日志记录分页查询ID）
+func respondQueryResult(c *gin.Context, apiUrl ApiUrlDTO, uid string, queryItem string, queryResult string, code int, queryErr error, pageSize int, logOptions service.QueryLogOptions) {
+	var page *service.QueryPage
+	logStatus, logResult := code, queryResult
+	if pageSize > 0 && queryErr == nil && code != -1 {
+		var err error
+		page, _, err = service.StartRowsPagedQuery(uid, queryItem, queryResult, pageSize, logOptions)
+		if err != nil {
+			models.ResponseError400(c, http.StatusInternalServerError, "分页失败: "+err.Error(), err)
+			return
+		}
+		logOptions.PagedQueryId = page.PagedQueryId
+		pageJSON, _ := json.Marshal(page)
+		logStatus, logResult = page.Counts, string(pageJSON)
+	}
 
-	time.Sleep(1000 * time.Millisecond)                                                                                                                               // 延时1s
-	err := service.UpdateQueryLog(queryDataDTO.ApiUrl.ContractName, queryDataDTO.ApiUrl.ChainServiceUrl, queryDataDTO.Uid, queryDataDTO.QueryItem, code, queryResult) // 上链查询日志
+	time.Sleep(1000 * time.Millisecond)                                                                                                     // 延时1s
+	err := service.UpdateQueryLogWithOptions(apiUrl.ContractName, apiUrl.ChainServiceUrl, uid, queryItem, logStatus, logResult, logOptions) // 上链查询日志
 	if err != nil {
 		fmt.Println("上链查询日志失败", err)
 	}
+	if queryErr != nil {
+		models.ResponseError400(c, service.QueryAbortCode(queryErr), queryErr.Error(), queryErr)
+		return
+	}
 	if code == -1 {
 		models.ResponseOK(c, "查询完成，但出现错误", queryResult)
 		return
-	} else {
-		models.ResponseOK(c, "查询成功", queryResult)
 	}
-
-	// TODO: 缓存
-
+	if page != nil {
+		models.ResponseOK(c, "查询成功", page)
+		return
+	}
+	models.ResponseOK(c, "查询成功", queryResult)
 }
 
 // QueryByFieldsHandler 通过字段查询数据
 func QueryByFieldsHandler(c *gin.Context) {
 	type QueryByFieldsDTO struct {
-		Uid         string    `json:"uId"`         // 用户ID
-		ApiUrl      ApiUrlDTO `json:"apiUrl"`      // API地址
-		DomainName  string    `json:"domainName"`  // 必须：数据域名称
-		OrgId       string    `json:"orgId"`       // 组织ID
-		Role        string    `json:"role"`        // 角色
-		Name        string    `json:"name"`        // 选填：姓名
-		AgeStart    int       `json:"ageStart"`    // 选填：起始年龄
-		AgeEnd      int       `json:"ageEnd"`      // 选填：结束年龄
-		Gender      string    `json:"gender"`      // 选填：性别
-		Hospital    string    `json:"hospital"`    // 选填：医院
-		Department  string    `json:"department"`  // 选填：科室
-		DiseaseCode string    `json:"diseaseCode"` // 选填：疾病代码
+		Uid        string    `json:"uId"`        // 用户ID
+		ApiUrl     ApiUrlDTO `json:"apiUrl"`     // API地址
+		DomainName string    `json:"domainName"` // 必须：数据域名称
+		OrgId      string    `json:"orgId"`      // 组织ID
+		Role       string    `json:"role"`       // 角色
+		QueryFieldsDTO
+		QueryRunDTO
+		PageDTO
 	}
 
 	var queryDTO QueryByFieldsDTO
@@ -123,6 +339,14 @@ func QueryByFieldsHandler(c *gin.Context) {
 		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
 		return
 	}
+	if queryDTO.Cursor != "" {
+		serveQueryPage(c, strings.TrimSpace(queryDTO.Uid), queryDTO.ApiUrl, queryDTO.Cursor)
+		return
+	}
+	if err := service.ValidatePageSize(queryDTO.PageSize); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, err.Error(), err)
+		return
+	}
 
 	// 验证必填字段
 	queryDTO.DomainName = strings.TrimSpace(queryDTO.DomainName)
@@ -141,55 +365,85 @@ func QueryByFieldsHandler(c *gin.Context) {
 		models.ResponseError400(c, http.StatusBadRequest, "没有权限", nil)
 		return
 	}
+	// 列权限：禁止的列不返回，脱敏的列返回脱敏后的值
+	columnPolicy, ok := queryColumnPolicy(c, queryDTO.ApiUrl, queryDTO.DomainName, queryDTO.OrgId, queryDTO.Role)
+	if !ok {
+		return
+	}
 
-	// 将domainName转换为domainID（格式：DOMAIN_ + domainName）
-	domainID := "DOMAIN_" + queryDTO.DomainName
+	// 在索引中按字段查询，得到匹配记录所在的文件位置
+	queryDTO.QueryFieldsDTO.normalize()
+	FilePoses, err := searchFieldsFilePoses(queryDTO.DomainName, queryDTO.QueryFieldsDTO)
+	if err != nil {
+		models.ResponseError400(c, http.StatusInternalServerError, err.Error(), err)
+		return
+	}
 
-	// 清理其他字段的空格
-	queryDTO.Name = strings.TrimSpace(queryDTO.Name)
-	queryDTO.Gender = strings.TrimSpace(queryDTO.Gender)
-	queryDTO.Hospital = strings.TrimSpace(queryDTO.Hospital)
-	queryDTO.Department = strings.TrimSpace(queryDTO.Department)
-	queryDTO.DiseaseCode = strings.TrimSpace(queryDTO.DiseaseCode)
+	// 检查FilePoses是否为空
+	if len(FilePoses) == 0 {
+		models.ResponseError400(c, http.StatusBadRequest, "未找到匹配的文件位置", nil)
+		return
+	}
 
-	// 检查索引服务是否可用
-	if indexer.GlobalIndexerService == nil {
-		models.ResponseError400(c, http.StatusInternalServerError, "索引服务未初始化", nil)
+	queryItemDTO := buildFieldsQueryItem(FilePoses, queryDTO.QueryFieldsDTO)
+	queryItemJSON, err := json.Marshal(queryItemDTO)
+	if err != nil {
+		models.ResponseError400(c, http.StatusInternalServerError, "构建查询项结构体失败: "+err.Error(), err)
 		return
 	}
 
-	// 构建查询请求
-	searchReq := indexer.SearchRequest{
-		DomainID:    domainID,
-		Name:        queryDTO.Name,
-		AgeStart:    queryDTO.AgeStart,
-		AgeEnd:      queryDTO.AgeEnd,
-		Gender:      queryDTO.Gender,
-		Hospital:    queryDTO.Hospital,
-		Department:  queryDTO.Department,
-		DiseaseCode: queryDTO.DiseaseCode,
+	ctx, release, ok := startQueryRun(c, queryDTO.RunId, queryDTO.Uid)
+	if !ok {
+		return
 	}
+	defer release()
+	ctx = service.WithColumnPolicy(ctx, columnPolicy)
 
-	// 如果年龄范围未设置，则设为0表示不设置年龄条件
-	if queryDTO.AgeStart <= 0 && queryDTO.AgeEnd <= 0 {
-		searchReq.AgeStart = 0
-		searchReq.AgeEnd = 0
-	} else if queryDTO.AgeStart > 0 && queryDTO.AgeEnd <= 0 {
-		// 只设置了起始年龄，作为精确匹配
-		searchReq.AgeEnd = queryDTO.AgeStart
-	} else if queryDTO.AgeStart <= 0 && queryDTO.AgeEnd > 0 {
-		// 只设置了结束年龄，起始年龄设为0
-		searchReq.AgeStart = 0
-	} else if queryDTO.AgeStart > queryDTO.AgeEnd {
-		// 起始年龄大于结束年龄，交换它们
-		searchReq.AgeStart, searchReq.AgeEnd = queryDTO.AgeEnd, queryDTO.AgeStart
+	// 已检查权限，使用结果缓存（按列权限区分）
+	cacheKey := columnPolicyCacheKey(queryCacheKey(string(queryItemJSON), ""), columnPolicy)
+	queryResult, code, queryErr := cachedQueryResult(c, ctx, cacheKey, string(queryItemJSON), FilePoses, newShardPruner(""), newShardLoader(queryDTO.ApiUrl))
+	if queryErr != nil && service.QueryAbortCode(queryErr) == 0 {
+		models.ResponseError400(c, http.StatusBadRequest, queryErr.Error(), queryErr)
+		return
+	}
+
+	logOptions := service.QueryLogOptions{ColumnMasks: columnPolicy.Summary()}.WithAnonymity(queryResult)
+	respondQueryResult(c, queryDTO.ApiUrl, queryDTO.Uid, string(queryItemJSON), queryResult, code, queryErr, queryDTO.PageSize, logOptions)
+}
+
+// QueryFieldsDTO 按字段查询的条件（queryByFields和federatedQuery共用）
+type QueryFieldsDTO struct {
+	Name        string `json:"name"`        // 选填：姓名
+	AgeStart    int    `json:"ageStart"`    // 选填：起始年龄
+	AgeEnd      int    `json:"ageEnd"`      // 选填：结束年龄
+	Gender      string `json:"gender"`      // 选填：性别
+	Hospital    string `json:"hospital"`    // 选填：医院
+	Department  string `json:"department"`  // 选填：科室
+	DiseaseCode string `json:"diseaseCode"` // 选填：疾病代码
+
+	WithProvenance bool `json:"withProvenance"` // 选填：每个结果行附带来源
+}
+
+// normalize 清理字段的空格
+func (fields *QueryFieldsDTO) normalize() {
+	fields.Name = strings.TrimSpace(fields.Name)
+	fields.Gender = strings.TrimSpace(fields.Gender)
+	fields.Hospital = strings.TrimSpace(fields.Hospital)
+	fields.Department = strings.TrimSpace(fields.Department)
+	fields.DiseaseCode = strings.TrimSpace(fields.DiseaseCode)
+}
+
+// searchFieldsFilePoses 在数据域的索引中按字段查询，返回匹配记录所在的文件位置（去重）
+func searchFieldsFilePoses(domainName string, fields QueryFieldsDTO) ([]string, error) {
+	// 检查索引服务是否可用
+	if indexer.GlobalIndexerService == nil {
+		return nil, errors.New("索引服务未初始化")
 	}
 
 	// 执行查询
-	searchResult, err := indexer.GlobalIndexerService.ExecuteQuery(searchReq)
+	searchResult, err := indexer.GlobalIndexerService.ExecuteQuery(newFieldsSearchRequest(domainName, fields))
 	if err != nil {
-		models.ResponseError400(c, http.StatusInternalServerError, "查询失败: "+err.Error(), err)
-		return
+		return nil, errors.New("查询失败: " + err.Error())
 	}
 
 	// 根据txIDs查询区块链上的pos列表，并对filePoses去重
@@ -197,46 +451,49 @@ func QueryByFieldsHandler(c *gin.Context) {
 	for _, txID := range searchResult.TxIDs {
 		pos, err := indexer.GlobalIndexerService.GetPosByTxID(txID)
 		if err != nil {
-			models.ResponseError400(c, http.StatusInternalServerError, "获取pos信息失败: "+err.Error(), err)
-			return
+			return nil, errors.New("获取pos信息失败: " + err.Error())
 		}
 		if !slices.Contains(FilePoses, pos) {
 			FilePoses = append(FilePoses, pos)
 		}
 	}
+	return FilePoses, nil
+}
 
-	// 检查FilePoses是否为空
-	if len(FilePoses) == 0 {
-		models.ResponseError400(c, http.StatusBadRequest, "未找到匹配的文件位置", nil)
-		return
+// newFieldsSearchRequest 构建按字段查询的索引查询请求
+func newFieldsSearchRequest(domainName string, fields QueryFieldsDTO) indexer.SearchRequest {
+	// 构建查询请求，将domainName转换为domainID（格式：DOMAIN_ + domainName）
+	searchReq := indexer.SearchRequest{
+		DomainID:    "DOMAIN_" + domainName,
+		Name:        fields.Name,
+		AgeStart:    fields.AgeStart,
+		AgeEnd:      fields.AgeEnd,
+		Gender:      fields.Gender,
+		Hospital:    fields.Hospital,
+		Department:  fields.Department,
+		DiseaseCode: fields.DiseaseCode,
 	}
 
-	// 查询每个文件位置的数据，用map[string]string存储
-	fileDataMap := make(map[string]string)
-	for _, filePos := range FilePoses {
-		fileCiperData, err := service.HandleGetIPFSFile(filePos, queryDTO.ApiUrl.IpfsServiceUrl)
-		if err != nil {
-			models.ResponseError400(c, http.StatusBadRequest, "请求IPFS错误:"+err.Error(), err)
-			return
-		}
-		// 等待2s
-		time.Sleep(2000 * time.Millisecond) // 延时2s
-		// 从区块链中获取AES密钥
-		aesKey, err := service.GetAesKeyFromBlockchain(queryDTO.ApiUrl.ContractName, queryDTO.ApiUrl.ChainServiceUrl, filePos)
-		if err != nil {
-			models.ResponseError400(c, http.StatusBadRequest, "获取AES密钥失败:"+err.Error(), err)
-			return
-		}
-		// 解密
-		fileData, err := service.AesDecrypt(fileCiperData, aesKey) // 解密文件
-		if err != nil {
-			models.ResponseError400(c, http.StatusBadRequest, "解密失败:"+err.Error(), err)
-			return
-		}
-		fileDataMap[filePos] = fileData
+	// 如果年龄范围未设置，则设为0表示不设置年龄条件
+	if fields.AgeStart <= 0 && fields.AgeEnd <= 0 {
+		searchReq.AgeStart = 0
+		searchReq.AgeEnd = 0
+	} else if fields.AgeStart > 0 && fields.AgeEnd <= 0 {
+		// 只设置了起始年龄，作为精确匹配
+		searchReq.AgeEnd = fields.AgeStart
+	} else if fields.AgeStart <= 0 && fields.AgeEnd > 0 {
+		// 只设置了结束年龄，起始年龄设为0
+		searchReq.AgeStart = 0
+	} else if fields.AgeStart > fields.AgeEnd {
+		// 起始年龄大于结束年龄，交换它们
+		searchReq.AgeStart, searchReq.AgeEnd = fields.AgeEnd, fields.AgeStart
 	}
+	return searchReq
+}
 
-	// 构建queryItemDTO查询项结构体, 示例：
+// buildFieldsQueryItem 构建按字段查询的查询项（FilePoses为同一数据集的分片）
+func buildFieldsQueryItem(FilePoses []string, fields QueryFieldsDTO) service.QueryItem {
+	// 查询项示例：
 	// {
 	//   "queryConcatType" : "single",
 	//   "filePos" : [ [ "QmbPxKceAFixY3Kn4DHUokVVvmXzy1p2iA5nSQ89118TaW" ] ],
@@ -262,84 +519,335 @@ func QueryByFieldsHandler(c *gin.Context) {
 	//   } ] ]
 	// }
 
-	queryItemDTO := service.QueryItem{
+	// 未填写的字段（字符串为空、年龄为0）不作为查询条件
+	conditions := make([]service.QueryCondition, 0, 7)
+	addCondition := func(field string, compare string, val string, cellType string) {
+		if val == "" || (cellType == "int" && val == "0") {
+			return
+		}
+		conditions = append(conditions, service.QueryCondition{
+			Field:   field,
+			Pos:     FilePoses[0],
+			Compare: compare,
+			Val:     val,
+			Type:    cellType,
+		})
+	}
+	addCondition("name", "eq", fields.Name, "string")
+	addCondition("age", "ge", strconv.Itoa(fields.AgeStart), "int")
+	addCondition("age", "le", strconv.Itoa(fields.AgeEnd), "int")
+	addCondition("gender", "eq", fields.Gender, "string")
+	addCondition("hospital", "eq", fields.Hospital, "string")
+	addCondition("department", "eq", fields.Department, "string")
+	addCondition("diseaseCode", "eq", fields.DiseaseCode, "string")
+
+	return service.QueryItem{
 		QueryConcatType: "single",
 		FilePos:         [][]string{FilePoses},
 		ReturnField:     []string{FilePoses[0] + "_*"},
-		QueryConditions: [][]service.QueryCondition{
-			{
-				{
-					Field:   "name",
-					Pos:     FilePoses[0],
-					Compare: "eq",
-					Val:     queryDTO.Name,
-					Type:    "string",
-				},
-				{
-					Field:   "age",
-					Pos:     FilePoses[0],
-					Compare: "ge",
-					Val:     strconv.Itoa(queryDTO.AgeStart),
-					Type:    "int",
-				},
-				{
-					Field:   "age",
-					Pos:     FilePoses[0],
-					Compare: "le",
-					Val:     strconv.Itoa(queryDTO.AgeEnd),
-					Type:    "int",
-				},
-				{
-					Field:   "gender",
-					Pos:     FilePoses[0],
-					Compare: "eq",
-					Val:     queryDTO.Gender,
-					Type:    "string",
-				},
-				{
-					Field:   "hospital",
-					Pos:     FilePoses[0],
-					Compare: "eq",
-					Val:     queryDTO.Hospital,
-					Type:    "string",
-				},
-				{
-					Field:   "department",
-					Pos:     FilePoses[0],
-					Compare: "eq",
-					Val:     queryDTO.Department,
-					Type:    "string",
-				},
-				{
-					Field:   "diseaseCode",
-					Pos:     FilePoses[0],
-					Compare: "eq",
-					Val:     queryDTO.DiseaseCode,
-					Type:    "string",
-				},
-			},
-		},
+		WithProvenance:  fields.WithProvenance,
+		QueryConditions: [][]service.QueryCondition{conditions},
 	}
+}
 
-	queryItemJSON, err := json.Marshal(queryItemDTO)
+// checkQueryAccess 检查数据域的读权限，没有权限时返回错误响应
+func checkQueryAccess(c *gin.Context, apiUrl ApiUrlDTO, access QueryAccessDTO) bool {
+	allowed, err := service.CheckAccess(apiUrl.ContractName, apiUrl.ChainServiceUrl, access.DomainName, "read", access.OrgId, access.Role)
 	if err != nil {
-		models.ResponseError400(c, http.StatusInternalServerError, "构建查询项结构体失败: "+err.Error(), err)
-		return
+		models.ResponseError400(c, http.StatusBadRequest, "检查权限失败", err)
+		return false
 	}
+	if !allowed {
+		models.ResponseError400(c, http.StatusBadRequest, "没有权限", nil)
+		return false
+	}
+	return true
+}
 
-	// 调用查询函数
-	queryResult, code := service.GetQueryResult(string(queryItemJSON), fileDataMap) // 返回查询结果
+// checkPrivacyAccess 检查差分隐私查询的权限：dpQuery或read，没有权限时返回错误响应
+func checkPrivacyAccess(c *gin.Context, apiUrl ApiUrlDTO, access QueryAccessDTO) bool {
+	return checkDomainAccess(c, apiUrl, access, []string{"dpQuery", "read"})
+}
 
-	time.Sleep(1000 * time.Millisecond)                                                                                                                 // 延时1s
-	err = service.UpdateQueryLog(queryDTO.ApiUrl.ContractName, queryDTO.ApiUrl.ChainServiceUrl, queryDTO.Uid, string(queryItemJSON), code, queryResult) // 上链查询日志
+// checkDomainAccess 检查数据域的权限：具有actions中任一权限即可，没有权限时返回错误响应
+func checkDomainAccess(c *gin.Context, apiUrl ApiUrlDTO, access QueryAccessDTO, actions []string) bool {
+	for _, action := range actions {
+		allowed, err := service.CheckAccess(apiUrl.ContractName, apiUrl.ChainServiceUrl, access.DomainName, action, access.OrgId, access.Role)
+		if err != nil {
+			models.ResponseError400(c, http.StatusBadRequest, "检查权限失败", err)
+			return false
+		}
+		if allowed {
+			return true
+		}
+	}
+	models.ResponseError400(c, http.StatusBadRequest, "没有权限", nil)
+	return false
+}
+
+// queryColumnPolicy 获取调用者在数据域中生效的列权限（没有限制时为nil），失败时返回错误响应
+func queryColumnPolicy(c *gin.Context, apiUrl ApiUrlDTO, domainName string, orgId string, role string) (*service.ColumnPolicy, bool) {
+	columnPolicy, err := service.FetchColumnPolicy(apiUrl.ContractName, apiUrl.ChainServiceUrl, domainName, orgId, role)
 	if err != nil {
-		fmt.Println("上链查询日志失败", err)
+		models.ResponseError400(c, http.StatusBadRequest, "获取列权限失败", err)
+		return nil, false
 	}
-	if code == -1 {
-		models.ResponseOK(c, "查询完成，但出现错误", queryResult)
+	return columnPolicy, true
+}
+
+// columnPolicyCacheKey 不同列权限下的查询结果不同，缓存键附加列权限的指纹
+func columnPolicyCacheKey(cacheKey string, columnPolicy *service.ColumnPolicy) string {
+	if cacheKey == "" || columnPolicy.IsEmpty() {
+		return cacheKey
+	}
+	return cacheKey + ":" + columnPolicy.Fingerprint()
+}
+
+// startQueryRun 登记执行中的查询：创建带超时（配置文件 query.timeout_seconds）的context，并通过X-Query-Run-Id响应头返回执行ID
+// 执行ID已在执行中时返回错误响应；查询结束后需调用release
+func startQueryRun(c *gin.Context, runId string, uid string) (context.Context, func(), bool) {
+	ctx, runId, release, err := service.StartQuery(c.Request.Context(), strings.TrimSpace(runId), uid, service.ConfiguredQueryLimits().Timeout)
+	if err != nil {
+		models.ResponseError400(c, http.StatusConflict, err.Error(), nil)
+		return nil, nil, false
+	}
+	c.Header("X-Query-Run-Id", runId)
+	// withProvenance的查询从索引服务获取分片的上传交易
+	ctx = service.WithPosRecordLookup(ctx, posRecordLookup())
+	return ctx, release, true
+}
+
+// posRecordLookup 从索引服务获取分片上传记录的函数，索引服务未初始化时为nil
+func posRecordLookup() service.PosRecordLookup {
+	if indexer.GlobalIndexerService == nil {
+		return nil
+	}
+	return indexer.GlobalIndexerService.GetPosRecords
+}
+
+// resolveQueryDomain 确定查询的分片所属的数据域（列权限和脱敏按该数据域生效），无法确定或分片属于其他数据域时返回错误响应
+func resolveQueryDomain(c *gin.Context, domainName string, FilePoses []string) (string, bool) {
+	domainName, err := service.ResolveQueryDomain(domainName, FilePoses, posRecordLookup())
+	if err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, err.Error(), err)
+		return "", false
+	}
+	return domainName, true
+}
+
+// withProvenanceQueryItem 在查询项中设置withProvenance（请求中的withProvenance为true时使用）
+func withProvenanceQueryItem(queryItem string) (string, error) {
+	var queryItemData service.QueryItem
+	if err := json.Unmarshal([]byte(queryItem), &queryItemData); err != nil {
+		return "", err
+	}
+	queryItemData.WithProvenance = true
+	queryItemJSON, err := json.Marshal(queryItemData)
+	if err != nil {
+		return "", err
+	}
+	return string(queryItemJSON), nil
+}
+
+// CancelQueryHandler 取消执行中的查询（只能取消自己发起的查询），被取消的查询返回错误码49901
+func CancelQueryHandler(c *gin.Context) {
+	type CancelQueryDTO struct {
+		Uid   string `json:"uId"`   // 用户ID
+		RunId string `json:"runId"` // 查询执行ID（X-Query-Run-Id响应头）
+	}
+
+	var cancelDTO CancelQueryDTO
+	// 绑定JSON数据到结构体
+	if err := c.ShouldBindJSON(&cancelDTO); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	cancelDTO.RunId = strings.TrimSpace(cancelDTO.RunId)
+	if cancelDTO.RunId == "" {
+		models.ResponseError400(c, http.StatusBadRequest, "runId 不能为空", nil)
+		return
+	}
+	if err := service.CancelQuery(cancelDTO.RunId, strings.TrimSpace(cancelDTO.Uid)); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, err.Error(), nil)
 		return
+	}
+	models.ResponseOK(c, "已取消查询", gin.H{"runId": cancelDTO.RunId})
+}
+
+// queryCacheKey 查询项的缓存键，未启用缓存或查询项无法解析时返回空字符串（不使用缓存）
+// pruneDomain 为未命中时分片裁剪（newShardPruner）使用的数据域：按不同数据域的索引下推得到的结果不同，缓存键包含该数据域
+func queryCacheKey(queryItem string, pruneDomain string) string {
+	if !service.QueryCacheEnabled() {
+		return ""
+	}
+	key, err := service.QueryCacheKey(queryItem, pruneDomain)
+	if err != nil {
+		return ""
+	}
+	return key
+}
+
+// cachedQueryResult 获取查询结果：缓存键不为空时先查缓存，未命中时（谓词下推后）获取分片并查询，再写入缓存
+// 通过X-Query-Cache响应头（HIT/MISS）告知是否命中
+// 查询超时、取消或超出资源限制时，返回的error为*service.QueryAbortError，查询结果为失败信息（用于上链）
+func cachedQueryResult(c *gin.Context, ctx context.Context, cacheKey string, queryItem string, FilePoses []string, pruner service.ShardPruner, loader service.ShardLoader) (string, int, error) {
+	if cacheKey != "" {
+		if queryResult, code, ok := service.GetCachedQueryResult(cacheKey); ok {
+			c.Header("X-Query-Cache", "HIT")
+			return queryResult, code, nil
+		}
+	}
+
+	// 谓词下推：跳过的分片不获取
+	if pruner != nil {
+		prunedQueryItem, skipped := pruner(queryItem)
+		if len(skipped) > 0 {
+			queryItem = prunedQueryItem
+			remaining := make([]string, 0, len(FilePoses))
+			for _, filePos := range FilePoses {
+				if !slices.Contains(skipped, filePos) {
+					remaining = append(remaining, filePos)
+				}
+			}
+			FilePoses = remaining
+		}
+	}
+
+	// 并发查询每个文件位置的数据，用map[string]string存储
+	fileDataMap, err := service.LoadShards(ctx, FilePoses, loader)
+	if err != nil {
+		if service.QueryAbortCode(err) != 0 {
+			return "查询失败: " + err.Error(), -1, err
+		}
+		return "", -1, err
+	}
+	// 调用查询函数
+	queryResult, code, err := service.GetQueryResultContext(ctx, queryItem, fileDataMap, service.ConfiguredQueryLimits()) // 返回查询结果
+	if err != nil {
+		return queryResult, code, err
+	}
+
+	if cacheKey != "" {
+		service.CacheQueryResult(cacheKey, queryResult, code)
+		c.Header("X-Query-Cache", "MISS")
+	}
+	return queryResult, code, nil
+}
+
+// newShardPruner 创建分片裁剪函数：提供了数据域且索引服务可用时先通过索引下推查询条件，再按分片统计信息（zone map）跳过不可能满足条件的分片
+func newShardPruner(domainName string) service.ShardPruner {
+	domainName = strings.TrimSpace(domainName)
+	return func(queryItem string) (string, []string) {
+		skipped := make([]string, 0)
+		if domainName != "" && indexer.GlobalIndexerService != nil {
+			prunedQueryItem, pushdownSkipped, err := service.PushdownShards(queryItem, "DOMAIN_"+domainName, indexer.GlobalIndexerService)
+			if err != nil {
+				// 索引服务出错时不下推，照常读取所有分片
+				fmt.Println("谓词下推失败", err)
+			} else {
+				queryItem = prunedQueryItem
+				skipped = append(skipped, pushdownSkipped...)
+			}
+		}
+		prunedQueryItem, zoneMapSkipped, err := service.ZoneMapShards(queryItem, zoneMapStore())
+		if err != nil {
+			fmt.Println("按分片统计信息跳过分片失败", err)
+		} else {
+			queryItem = prunedQueryItem
+			skipped = append(skipped, zoneMapSkipped...)
+		}
+		return queryItem, skipped
+	}
+}
+
+// newShardLoader 创建分片获取函数：从IPFS获取密文，从区块链获取AES密钥并解密；查询结束（超时、取消）时中断
+func newShardLoader(apiUrl ApiUrlDTO) service.ShardLoader {
+	return func(ctx context.Context, filePos string) (string, error) {
+		fileCiperData, err := service.HandleGetIPFSFileContext(ctx, filePos, apiUrl.IpfsServiceUrl)
+		if err != nil {
+			return "", fmt.Errorf("请求IPFS错误:%s", err)
+		}
+		// 等待2s
+		select {
+		case <-time.After(2000 * time.Millisecond): // 延时2s
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		// 从区块链中获取AES密钥
+		aesKey, err := service.GetAesKeyFromBlockchainContext(ctx, apiUrl.ContractName, apiUrl.ChainServiceUrl, filePos)
+		if err != nil {
+			return "", fmt.Errorf("获取AES密钥失败:%s", err)
+		}
+		// 解密
+		fileData, err := service.AesDecrypt(fileCiperData, aesKey) // 解密文件
+		if err != nil {
+			return "", fmt.Errorf("解密失败:%s", err)
+		}
+		return fileData, nil
+	}
+}
+
+// resolveStreamFormat 确定流式返回格式：请求体的stream字段优先，其次为Accept请求头；返回空字符串表示不流式返回
+func resolveStreamFormat(c *gin.Context, stream string) string {
+	switch strings.ToLower(strings.TrimSpace(stream)) {
+	case "ndjson":
+		return "ndjson"
+	case "sse":
+		return "sse"
+	}
+	accept := c.GetHeader("Accept")
+	if strings.Contains(accept, "text/event-stream") {
+		return "sse"
+	}
+	if strings.Contains(accept, "application/x-ndjson") {
+		return "ndjson"
+	}
+	return ""
+}
+
+// writeQueryStream 以NDJSON或SSE格式流式输出查询结果：每行一个row事件，最后一个end事件（出错时为error事件）
+// 返回完整的查询结果和数量，用于上链查询日志
+func writeQueryStream(c *gin.Context, ctx context.Context, format string, queryItem string, loader service.ShardLoader) (string, int) {
+	if format == "sse" {
+		c.Header("Content-Type", "text/event-stream")
 	} else {
-		models.ResponseOK(c, "查询成功", queryResult)
+		c.Header("Content-Type", "application/x-ndjson")
 	}
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // 关闭反向代理缓冲
+	c.Status(http.StatusOK)
 
+	writeEvent := func(eventType string, data gin.H) {
+		if format == "sse" {
+			c.SSEvent(eventType, data)
+		} else {
+			data["type"] = eventType
+			line, _ := json.Marshal(data)
+			c.Writer.Write(append(line, '\n'))
+		}
+		c.Writer.Flush()
+	}
+
+	emit := func(row interface{}) error {
+		writeEvent("row", gin.H{"data": row})
+		// 客户端断开时停止查询
+		return c.Request.Context().Err()
+	}
+	queryResult, code, queryErr := service.StreamQuery(ctx, queryItem, service.ConfiguredQueryLimits(), loader, emit)
+
+	// 结束事件：携带结果数量和信息
+	var queryResultData service.QueryResult
+	message := queryResult
+	if err := json.Unmarshal([]byte(queryResult), &queryResultData); err == nil {
+		message = queryResultData.Message
+	}
+	if queryErr != nil {
+		// 超时、取消或超出资源限制
+		writeEvent("error", gin.H{"counts": -1, "code": service.QueryAbortCode(queryErr), "message": message})
+	} else if code == -1 {
+		writeEvent("error", gin.H{"counts": -1, "message": message})
+	} else {
+		writeEvent("end", gin.H{"counts": code, "message": message})
+	}
+	return queryResult, code
 }
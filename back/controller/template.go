@@ -0,0 +1,191 @@
+package controller
+
+import (
+	"chainqa_offchain_demo/indexer"
+	"chainqa_offchain_demo/models"
+	"chainqa_offchain_demo/service"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// QueryTemplateDTO 创建、修改查询模板的请求
+type QueryTemplateDTO struct {
+	Uid         string                       `json:"uId"`         // 用户ID
+	Name        string                       `json:"name"`        // 模板名称
+	Description string                       `json:"description"` // 说明
+	QueryItem   string                       `json:"queryItem"`   // 带占位符（如 {{diseaseCode}}）的查询项
+	Params      []service.QueryTemplateParam `json:"params"`      // 参数定义
+	Anchor      bool                         `json:"anchor"`      // 选填：是否把该版本的哈希锚定到链上
+	ApiUrl      ApiUrlDTO                    `json:"apiUrl"`      // API地址（锚定时使用）
+}
+
+// queryTemplateStore 模板存储：索引服务已初始化时保存在Redis，否则保存在内存中
+func queryTemplateStore() service.QueryTemplateStore {
+	if indexer.GlobalIndexerService == nil {
+		return service.MemoryQueryTemplateStore
+	}
+	return indexer.GlobalIndexerService
+}
+
+// CreateTemplateHandler 创建查询模板（版本1）
+func CreateTemplateHandler(c *gin.Context) {
+	saveTemplate(c, true)
+}
+
+// UpdateTemplateHandler 修改查询模板：生成新版本，旧版本保留，仍可按版本号执行
+func UpdateTemplateHandler(c *gin.Context) {
+	saveTemplate(c, false)
+}
+
+// saveTemplate 创建模板或增加版本，需要时锚定哈希
+func saveTemplate(c *gin.Context, create bool) {
+	var templateDTO QueryTemplateDTO
+	if err := c.ShouldBindJSON(&templateDTO); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	templateDTO.Uid = strings.TrimSpace(templateDTO.Uid)
+	templateDTO.Name = strings.TrimSpace(templateDTO.Name)
+	templateDTO.QueryItem = strings.TrimSpace(templateDTO.QueryItem)
+
+	store := queryTemplateStore()
+	template, version, err := service.SaveQueryTemplateVersion(store, templateDTO.Name, templateDTO.Description, templateDTO.Uid, templateDTO.QueryItem, templateDTO.Params, create)
+	if err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	if templateDTO.Anchor {
+		err := service.AnchorQueryTemplate(templateDTO.ApiUrl.ContractName, templateDTO.ApiUrl.ChainServiceUrl, templateDTO.Uid, template.Name, version.Version, version.Hash)
+		if err != nil {
+			// 模板已保存，锚定失败时返回模板和错误，可重新修改后再锚定
+			models.ResponseError400(c, http.StatusBadGateway, "模板已保存，但锚定哈希失败: "+err.Error(), template)
+			return
+		}
+		if err := service.MarkQueryTemplateAnchored(store, template.Name, version.Version); err != nil {
+			models.ResponseError400(c, http.StatusInternalServerError, "哈希已锚定，但保存锚定状态失败: "+err.Error(), err)
+			return
+		}
+		template, _ = service.GetQueryTemplate(store, template.Name)
+	}
+	models.ResponseOK(c, fmt.Sprintf("保存模板成功（版本 %d）", version.Version), template)
+}
+
+// GetTemplateHandler 获取查询模板（含所有版本）
+func GetTemplateHandler(c *gin.Context) {
+	type GetTemplateDTO struct {
+		Name string `json:"name"` // 模板名称
+	}
+	var getDTO GetTemplateDTO
+	if err := c.ShouldBindJSON(&getDTO); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	template, err := service.GetQueryTemplate(queryTemplateStore(), strings.TrimSpace(getDTO.Name))
+	if err != nil {
+		models.ResponseError400(c, http.StatusNotFound, err.Error(), err)
+		return
+	}
+	models.ResponseOK(c, "获取模板成功", template)
+}
+
+// ListTemplatesHandler 列出所有查询模板（按名称排序）
+func ListTemplatesHandler(c *gin.Context) {
+	templates, err := service.ListQueryTemplates(queryTemplateStore())
+	if err != nil {
+		models.ResponseError400(c, http.StatusInternalServerError, "获取模板列表失败", err)
+		return
+	}
+	models.ResponseOK(c, "获取模板列表成功", templates)
+}
+
+// DeleteTemplateHandler 删除查询模板（只有创建者可以删除）；已上链的哈希和查询日志不受影响
+func DeleteTemplateHandler(c *gin.Context) {
+	type DeleteTemplateDTO struct {
+		Uid  string `json:"uId"`  // 用户ID
+		Name string `json:"name"` // 模板名称
+	}
+	var deleteDTO DeleteTemplateDTO
+	if err := c.ShouldBindJSON(&deleteDTO); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	if err := service.DeleteQueryTemplate(queryTemplateStore(), strings.TrimSpace(deleteDTO.Name), strings.TrimSpace(deleteDTO.Uid)); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	models.ResponseOK(c, "删除模板成功", nil)
+}
+
+// RunTemplateHandler 执行查询模板：绑定参数并按类型校验，然后按queryData的流程执行
+// 上链的查询日志记录模板名称和版本；版本已锚定时先校验模板内容与链上哈希一致
+func RunTemplateHandler(c *gin.Context) {
+	type RunTemplateDTO struct {
+		Uid            string                 `json:"uId"`            // 用户ID
+		Name           string                 `json:"name"`           // 模板名称
+		Version        int                    `json:"version"`        // 选填：模板版本，为0时执行最新版本
+		Params         map[string]interface{} `json:"params"`         // 参数值（字符串、数字，列表类型为数组）
+		ApiUrl         ApiUrlDTO              `json:"apiUrl"`         // API地址
+		Stream         string                 `json:"stream"`         // 流式返回格式（ndjson/sse）
+		WithProvenance bool                   `json:"withProvenance"` // 选填：每个结果行附带来源
+		QueryAccessDTO
+		QueryRunDTO
+		PageDTO
+	}
+
+	var runDTO RunTemplateDTO
+	if err := c.ShouldBindJSON(&runDTO); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "请求格式错误", err)
+		return
+	}
+	runDTO.Uid = strings.TrimSpace(runDTO.Uid)
+	if runDTO.Cursor != "" {
+		serveQueryPage(c, runDTO.Uid, runDTO.ApiUrl, runDTO.Cursor)
+		return
+	}
+
+	template, err := service.GetQueryTemplate(queryTemplateStore(), strings.TrimSpace(runDTO.Name))
+	if err != nil {
+		models.ResponseError400(c, http.StatusNotFound, err.Error(), err)
+		return
+	}
+	version, err := template.FindVersion(runDTO.Version)
+	if err != nil {
+		models.ResponseError400(c, http.StatusNotFound, err.Error(), err)
+		return
+	}
+	if version.Anchored {
+		if err := service.VerifyQueryTemplateAnchor(runDTO.ApiUrl.ContractName, runDTO.ApiUrl.ChainServiceUrl, template.Name, version); err != nil {
+			models.ResponseError400(c, http.StatusConflict, err.Error(), err)
+			return
+		}
+	}
+
+	queryItem, err := service.BindQueryTemplate(version, runDTO.Params)
+	if err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	if runDTO.WithProvenance {
+		if queryItem, err = withProvenanceQueryItem(queryItem); err != nil {
+			models.ResponseError400(c, http.StatusBadRequest, "绑定参数后的查询项格式错误", err)
+			return
+		}
+	}
+	var queryItemData service.QueryItem
+	if err := json.Unmarshal([]byte(queryItem), &queryItemData); err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "绑定参数后的查询项格式错误", err)
+		return
+	}
+	FilePoses := make([]string, 0)
+	for _, pos := range queryItemData.FilePos {
+		FilePoses = append(FilePoses, pos...)
+	}
+
+	logOptions := service.QueryLogOptions{TemplateName: template.Name, TemplateVersion: version.Version}
+	runQueryItem(c, runDTO.Uid, queryItem, FilePoses, runDTO.ApiUrl, runDTO.QueryAccessDTO, runDTO.RunId, runDTO.Stream, runDTO.PageSize, logOptions)
+}
@@ -2,6 +2,7 @@ package controller
 
 import (
 	"bytes"
+	"chainqa_offchain_demo/indexer"
 	"chainqa_offchain_demo/models"
 	"chainqa_offchain_demo/service"
 	"encoding/csv"
@@ -75,6 +76,14 @@ type RecordInfo struct {
 	DiseaseCode string
 }
 
+// zoneMapStore 分片统计信息的存储（索引服务未初始化时为nil，只缓存在内存中）
+func zoneMapStore() service.ZoneMapStore {
+	if indexer.GlobalIndexerService == nil {
+		return nil
+	}
+	return indexer.GlobalIndexerService
+}
+
 // hello
 func HelloHandler(c *gin.Context) {
 	// 延时300ms
@@ -159,6 +168,14 @@ func uploadHandler(req UploadFileDTO, c *gin.Context) {
 		return
 	}
 	fmt.Println("cid:", cid)
+	// 记录表结构（表头与行数），用于不解密地校验查询
+	if err := service.RememberSchemaFromContent(cid, req.FileContent); err != nil {
+		fmt.Println("记录表结构失败", err)
+	}
+	// 记录分片的统计信息（zone map），查询时用于跳过不可能满足条件的分片
+	if err := service.SaveZoneMapFromContent(cid, req.FileContent, zoneMapStore()); err != nil {
+		fmt.Println("记录分片统计信息失败", err)
+	}
 
 	// 3. 上传数字信封
 	// 从区块链中获取公钥
@@ -236,8 +253,8 @@ func uploadHandlerWithDomain(req UploadFileDTOWithDomain, c *gin.Context) {
 		return
 	}
 
-	// 2. 解析FileContent为记录列表
-	records, err := parseFileContentToRecords(req.FileContent)
+	// 2. 解析FileContent为表（兼容旧的空格分隔格式），统一序列化为表格式后再加密，并从表中解析记录列表
+	fileContent, records, err := encodeDomainFileContent(req.FileContent)
 	if err != nil {
 		type UploadFileErrorVO struct {
 			FileName string `json:"fileName"` // 文件名
@@ -252,7 +269,7 @@ func uploadHandlerWithDomain(req UploadFileDTOWithDomain, c *gin.Context) {
 	fmt.Printf("解析到 %d 条记录\n", len(records))
 
 	// 3. 使用AES密钥加密文件内容
-	cipherText, err := service.AesEncrypt(req.FileContent, req.AesKey)
+	cipherText, err := service.AesEncrypt(fileContent, req.AesKey)
 
 	type UploadFileErrorVO struct {
 		FileName string `json:"fileName"` // 文件名
@@ -275,6 +292,14 @@ func uploadHandlerWithDomain(req UploadFileDTOWithDomain, c *gin.Context) {
 		return
 	}
 	fmt.Println("cid:", cid)
+	// 记录表结构（表头与行数），用于不解密地校验查询
+	if err := service.RememberSchemaFromContent(cid, fileContent); err != nil {
+		fmt.Println("记录表结构失败", err)
+	}
+	// 记录分片的统计信息（zone map），查询时用于跳过不可能满足条件的分片
+	if err := service.SaveZoneMapFromContent(cid, fileContent, zoneMapStore()); err != nil {
+		fmt.Println("记录分片统计信息失败", err)
+	}
 
 	// 5. 从区块链中获取公钥
 	publicKey, err := service.GetPublicKeyFromBlockchain(req.ApiUrl.ContractName, req.ApiUrl.ChainServiceUrl)
@@ -460,7 +485,12 @@ func UploadDataFileWithoutCheckHandler(c *gin.Context) {
 		return
 	}
 
-	fileContent := changeToFileContentString(records)
+	// 序列化为表格式（不检查表头；保留空格、Unicode列名和空值）
+	fileContent, err := service.EncodeTable(records[0], uncheckedRows(records))
+	if err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "文件内容序列化失败: "+err.Error(), nil)
+		return
+	}
 
 	uploadHandler(UploadFileDTO{
 		ApiUrl: ApiUrlDTO{
@@ -548,7 +578,12 @@ func UploadCSVFileHandler(c *gin.Context) {
 		return
 	}
 
-	fileContent := changeToFileContentString(records)
+	// 序列化为表格式（保留空格、Unicode列名和空值）
+	fileContent, err := service.EncodeTable(records[0], records[1:])
+	if err != nil {
+		models.ResponseError400(c, http.StatusBadRequest, "文件内容序列化失败: "+err.Error(), nil)
+		return
+	}
 
 	uploadHandler(UploadFileDTO{
 		ApiUrl: ApiUrlDTO{
@@ -606,7 +641,7 @@ func parseExcelFile(fileBytes []byte) ([][]string, error) {
 	return rows, nil
 }
 
-// 检查文件是否合法
+// 检查文件是否合法，返回规范化后的表（单元格首尾空格去掉，内部空格保留，空单元格为空值）
 func checkAndParseFile(fileContent [][]string) ([][]string, error) {
 
 	if len(fileContent) == 0 {
@@ -619,7 +654,7 @@ func checkAndParseFile(fileContent [][]string) ([][]string, error) {
 		return nil, fmt.Errorf("表头信息为空")
 	}
 
-	// 检查表头是否全为非空+（只允许英文、下划线、字母）+不允许纯为*
+	// 检查表头是否全为非空+不允许纯为*+不重复（允许中文等Unicode字符和空格）
 	colSet := make(map[string]bool)
 
 	for idx, col := range header {
@@ -632,12 +667,6 @@ func checkAndParseFile(fileContent [][]string) ([][]string, error) {
 		if col == "*" {
 			return nil, fmt.Errorf("表头存在*列，位置: %d", idx+1)
 		}
-		// col不能包含中文
-		for _, r := range col {
-			if r >= 0x4E00 && r <= 0x9FA5 {
-				return nil, fmt.Errorf("表头列名 %s 不能包含中文，位置: %d", col, idx+1)
-			}
-		}
 		// col不能以_开头或结尾
 		if strings.HasPrefix(col, "_") || strings.HasSuffix(col, "_") {
 			return nil, fmt.Errorf("表头列名 %s 不能以_开头或结尾，位置: %d", col, idx+1)
@@ -648,72 +677,86 @@ func checkAndParseFile(fileContent [][]string) ([][]string, error) {
 			return nil, fmt.Errorf("表头列名存在重复: %s，位置: %d", col, idx+1)
 		}
 		colSet[col] = true
-	}
-
-	// 将header的首尾空格去掉，空格转为_，
-	for i, col := range header {
-		header[i] = strings.TrimSpace(col)
-		header[i] = strings.ReplaceAll(header[i], " ", "_")
+		header[idx] = col
 	}
 
 	// 检查每一行
+	rows := make([][]string, 0, len(fileContent))
+	rows = append(rows, header)
 	for i, row := range fileContent[1:] {
-		// 如果row的列数为0，那么删除这个row
-		if len(row) != len(header) {
+		if len(row) > len(header) {
 			return nil, fmt.Errorf("第 %d 行数据列数不匹配", i+2)
 		}
-		// 列内容不能纯空
-		for j, val := range row {
-			val = strings.TrimSpace(val)
+		// Excel会省略行尾的空单元格，补齐为空值
+		cells := make([]string, len(header))
+		emptyRow := true
+		for j := range cells {
+			if j >= len(row) {
+				cells[j] = service.NullCell
+				continue
+			}
+			// 去掉首尾空格，内容中的空格保留
+			val := strings.TrimSpace(row[j])
 			if val == "" {
-				return nil, fmt.Errorf("第 %d 行第 %d 列数据为空", i+2, j+1)
+				cells[j] = service.NullCell
+				continue
 			}
+			cells[j] = val
+			emptyRow = false
 		}
-	}
-
-	// 将单元格内容的首尾空格去掉，并将内容中的空格替换为_
-	for i, row := range fileContent {
-		for j, val := range row {
-			val = strings.TrimSpace(val)
-			val = strings.ReplaceAll(val, " ", "_")
-			row[j] = val
+		// 整行为空的行跳过
+		if emptyRow {
+			continue
 		}
-		fileContent[i] = row
+		rows = append(rows, cells)
 	}
 
-	return fileContent, nil
+	return rows, nil
 }
 
-func changeToFileContentString(fileContent [][]string) string {
-	var sb strings.Builder
-	for idx, row := range fileContent {
-		for i, col := range row {
-			sb.WriteString(col)
-			if i < len(row)-1 {
-				sb.WriteString(" ")
-			}
+// uncheckedRows 不检查内容时的数据行：跳过空行，行尾缺少的单元格补为空值（列数多于表头的行由EncodeTable报错）
+func uncheckedRows(fileContent [][]string) [][]string {
+	rows := make([][]string, 0, len(fileContent))
+	for _, row := range fileContent[1:] {
+		if len(row) == 0 || (len(row) == 1 && strings.TrimSpace(row[0]) == "") {
+			continue
 		}
-		if idx < len(fileContent)-1 {
-			sb.WriteString("\n")
+		for len(row) < len(fileContent[0]) {
+			row = append(row, service.NullCell)
 		}
+		rows = append(rows, row)
 	}
-	s := sb.String()
-	// 去除空格
-	s = strings.TrimSpace(s)
-	return s
+	return rows
 }
 
-// 解析FileContent字符串为记录列表
-// FileContent格式：第一行是表头（name age gender hospital department diseasecode），后续行是数据
-func parseFileContentToRecords(fileContent string) ([]RecordInfo, error) {
-	lines := strings.Split(strings.TrimSpace(fileContent), "\n")
-	if len(lines) == 0 {
-		return nil, fmt.Errorf("文件内容为空")
+// encodeDomainFileContent 解析带数据域上传的FileContent（表格式或旧的空格分隔格式），返回序列化为表格式的内容和记录列表
+func encodeDomainFileContent(fileContent string) (string, []RecordInfo, error) {
+	// 列名前缀为空，解析后的列名为 _field
+	table, err := service.DecodeTable("", fileContent)
+	if err != nil {
+		return "", nil, err
 	}
+	columns := make([]string, len(table.Columns))
+	for i, column := range table.Columns {
+		columns[i] = strings.TrimPrefix(column, "_")
+	}
+	records, err := parseTableToRecords(columns, table.Rows)
+	if err != nil {
+		return "", nil, err
+	}
+	encoded, err := service.EncodeTable(columns, table.Rows)
+	if err != nil {
+		return "", nil, err
+	}
+	return encoded, records, nil
+}
 
-	// 解析表头，找到各字段的索引位置
-	headerLine := strings.TrimSpace(lines[0])
-	headerFields := strings.Fields(headerLine) // 使用Fields可以处理多个空格
+// 解析表为记录列表
+// 表头需包含 name age gender hospital department diseasecode（否则按该顺序取前6列），空值按空字符串处理
+func parseTableToRecords(headerFields []string, rows [][]string) ([]RecordInfo, error) {
+	if len(headerFields) == 0 {
+		return nil, fmt.Errorf("文件内容为空")
+	}
 
 	// 创建字段名到索引的映射（不区分大小写，并处理下划线和驼峰命名）
 	fieldIndexMap := make(map[string]int)
@@ -756,32 +799,29 @@ func parseFileContentToRecords(fileContent string) ([]RecordInfo, error) {
 		}
 	}
 
-	// 解析数据行
+	// 解析数据行（空值按空字符串处理）
 	var records []RecordInfo
-	for i := 1; i < len(lines); i++ {
-		line := strings.TrimSpace(lines[i])
-		if line == "" {
-			continue // 跳过空行
-		}
-
-		fields := strings.Fields(line)
-		if len(fields) < 6 {
-			return nil, fmt.Errorf("第 %d 行数据字段不足，需要至少6个字段", i+1)
+	for i, row := range rows {
+		fields := make([]string, len(row))
+		for j, cell := range row {
+			if cell != service.NullCell {
+				fields[j] = strings.TrimSpace(cell)
+			}
 		}
 
 		// 解析age字段（转换为整数）
-		age, err := strconv.Atoi(strings.TrimSpace(fields[ageIdx]))
+		age, err := strconv.Atoi(fields[ageIdx])
 		if err != nil {
-			return nil, fmt.Errorf("第 %d 行age字段格式错误: %v", i+1, err)
+			return nil, fmt.Errorf("第 %d 行age字段格式错误: %v", i+2, err)
 		}
 
 		record := RecordInfo{
-			Name:        strings.TrimSpace(fields[nameIdx]),
+			Name:        fields[nameIdx],
 			Age:         age,
-			Gender:      strings.TrimSpace(fields[genderIdx]),
-			Hospital:    strings.TrimSpace(fields[hospitalIdx]),
-			Department:  strings.TrimSpace(fields[departmentIdx]),
-			DiseaseCode: strings.TrimSpace(fields[diseaseCodeIdx]),
+			Gender:      fields[genderIdx],
+			Hospital:    fields[hospitalIdx],
+			Department:  fields[departmentIdx],
+			DiseaseCode: fields[diseaseCodeIdx],
 		}
 
 		records = append(records, record)
@@ -34,6 +34,25 @@ const (
 	GenderBucketNum = 2   // 性别分桶模数
 )
 
+// 分片(pos)相关的索引 Key
+const (
+	TxPosKey           = "idx:tx:pos"         // Hash: TxID -> pos
+	DomainPosKeyFormat = "idx:pos:domain:%s"  // Set: 数据域内已索引的 pos
+	ZoneMapKeyPrefix   = "idx:zonemap:"       // String: 分片的统计信息(JSON)
+	QueryTemplateKey   = "idx:query_template" // Hash: 模板名称 -> 查询模板(JSON，含所有版本)
+	PosRecordKey       = "idx:pos:record"     // Hash: pos -> 上传该分片的数字信封交易(JSON)
+	CohortKey          = "idx:cohort"         // Hash: 组织ID__队列名称 -> 队列(JSON，含成员)
+)
+
+// PosRecord 上传分片(pos)的数字信封交易，用于追溯查询结果行的来源
+type PosRecord struct {
+	TxID        string `json:"txId"`               // 交易ID
+	BlockHeight uint64 `json:"blockHeight"`        // 区块高度
+	Uid         string `json:"uId"`                // 上传者用户ID
+	TimeStamp   string `json:"timeStamp"`          // 上传时间（交易时间戳，Unix秒）
+	DomainID    string `json:"domainID,omitempty"` // 数据域ID（不带数据域上传时为空）
+}
+
 // StartBlockListener 启动监听并处理索引更新
 func (s *IndexerService) StartBlockListener() {
 	// 1. 订阅区块事件 (SDK调用)
@@ -88,6 +107,13 @@ func (s *IndexerService) processBlock(block *common.BlockInfo) {
 	hashIndexCache := make(map[string]map[string][]string)
 
 	for _, tx := range txs {
+		// 记录分片(pos)的上传交易（带或不带数据域），同一分片重新上传时以最新的为准
+		if posRecord, pos, ok := parsePosRecord(tx, blockHeight); ok {
+			if posRecordBytes, err := json.Marshal(posRecord); err == nil {
+				pipe.HSet(s.ctx, PosRecordKey, pos, posRecordBytes)
+			}
+		}
+
 		// 0. 过滤不相关的交易：只处理医疗数据相关的交易
 		if !isMedicalDataTx(tx) {
 			continue
@@ -104,6 +130,12 @@ func (s *IndexerService) processBlock(block *common.BlockInfo) {
 		// 2. 收集 Layer 1 (数据域) 信息
 		activeDomains[record.Metadata.DomainID] = true
 
+		// 记录交易与分片(pos)的对应关系，以及数据域内已索引的分片，供查询时的谓词下推使用
+		if record.Metadata.Pos != "" {
+			pipe.HSet(s.ctx, TxPosKey, record.TxID, record.Metadata.Pos)
+			pipe.SAdd(s.ctx, fmt.Sprintf(DomainPosKeyFormat, record.Metadata.DomainID), record.Metadata.Pos)
+		}
+
 		// 3. 收集 Layer 2 (字段分桶) 信息 & 构建 Layer 3 (区块内索引)
 
 		// --- 处理 Age (范围型/数值型) ---
@@ -353,6 +385,47 @@ func parseTxPayload(tx *common.Transaction) (*models.OnChainRecord, error) {
 	return nil, fmt.Errorf("no medical data found in tx %s", tx.Payload.TxId)
 }
 
+// 辅助函数：解析上传数字信封的交易，返回分片(pos)的上传记录（执行失败的交易不记录）
+func parsePosRecord(tx *common.Transaction, blockHeight uint64) (PosRecord, string, bool) {
+	if tx == nil || tx.Payload == nil {
+		return PosRecord{}, "", false
+	}
+	if tx.Result != nil && (tx.Result.Code != common.TxStatusCode_SUCCESS || (tx.Result.ContractResult != nil && tx.Result.ContractResult.Code != 0)) {
+		return PosRecord{}, "", false
+	}
+	record := PosRecord{TxID: tx.Payload.TxId, BlockHeight: blockHeight, TimeStamp: strconv.FormatInt(tx.Payload.Timestamp, 10)}
+	pos := ""
+	switch tx.Payload.Method {
+	case "updateDataDigtalEnvelop":
+		for _, param := range tx.Payload.Parameters {
+			switch param.Key {
+			case "uId":
+				record.Uid = string(param.Value)
+			case "pos":
+				pos = string(param.Value)
+			}
+		}
+	case "updateDataDigtalEnvelopWithDomain":
+		for _, param := range tx.Payload.Parameters {
+			if param.Key != "envelopJsonStr" {
+				continue
+			}
+			var envelop struct {
+				Uid      string `json:"uId"`
+				Pos      string `json:"pos"`
+				DomainID string `json:"domainID"`
+			}
+			if err := json.Unmarshal(param.Value, &envelop); err != nil {
+				return PosRecord{}, "", false
+			}
+			record.Uid, pos, record.DomainID = envelop.Uid, envelop.Pos, envelop.DomainID
+		}
+	default:
+		return PosRecord{}, "", false
+	}
+	return record, pos, pos != ""
+}
+
 // 辅助函数：字符串哈希分桶
 func hashBucket(val string) int {
 	h := fnv.New32a()
@@ -386,11 +459,34 @@ type SearchRequest struct {
 
 // SearchResult 返回结果
 type SearchResult struct {
-	TxIDs []string `json:"tx_ids"`
+	TxIDs   []string `json:"tx_ids"`
+	HasMore bool     `json:"has_more,omitempty"` // 分页查询：本页之后是否还有结果
 }
 
 // ExecuteQuery 执行多层索引查询
 func (s *IndexerService) ExecuteQuery(req SearchRequest) (*SearchResult, error) {
+	return s.executeQuery(req, 0)
+}
+
+// ExecuteQueryPage 执行多层索引查询并返回第 offset 条起的 limit 个交易ID（按区块高度的顺序，结果是确定的）
+// 凑够本页（及判断是否还有下一页的1条）后不再查询后面的区块
+func (s *IndexerService) ExecuteQueryPage(req SearchRequest, offset int, limit int) (*SearchResult, error) {
+	if offset < 0 || limit <= 0 {
+		return nil, fmt.Errorf("invalid page: offset=%d limit=%d", offset, limit)
+	}
+	result, err := s.executeQuery(req, offset+limit+1)
+	if err != nil {
+		return nil, err
+	}
+	page := &SearchResult{TxIDs: []string{}, HasMore: len(result.TxIDs) > offset+limit}
+	if offset < len(result.TxIDs) {
+		page.TxIDs = result.TxIDs[offset:min(offset+limit, len(result.TxIDs))]
+	}
+	return page, nil
+}
+
+// executeQuery 执行多层索引查询，maxTxIDs 大于0时找到这么多交易ID后停止
+func (s *IndexerService) executeQuery(req SearchRequest, maxTxIDs int) (*SearchResult, error) {
 	// --- 阶段一：粗粒度筛选 (Layer 1 & 2) ---
 	// 1. 获取数据域位图 Key
 	domainKey := fmt.Sprintf("idx:domain:%s", req.DomainID)
@@ -561,6 +657,9 @@ func (s *IndexerService) ExecuteQuery(req SearchRequest) (*SearchResult, error)
 		}
 
 		resultTxIDs = append(resultTxIDs, intersection...)
+		if maxTxIDs > 0 && len(resultTxIDs) >= maxTxIDs {
+			break
+		}
 	}
 
 	return &SearchResult{TxIDs: resultTxIDs}, nil
@@ -589,6 +688,188 @@ func (s *IndexerService) GetPosByTxID(txID string) (string, error) {
 	return record.Metadata.Pos, nil
 }
 
+// GetPosesByTxIDs 根据交易ID批量获取pos（去重），索引中没有记录的交易回退到链上查询
+func (s *IndexerService) GetPosesByTxIDs(txIDs []string) ([]string, error) {
+	poses := make([]string, 0)
+	if len(txIDs) == 0 {
+		return poses, nil
+	}
+	values, err := s.redisClient.HMGet(s.ctx, TxPosKey, txIDs...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pos of txs: %v", err)
+	}
+	seen := make(map[string]bool)
+	for i, value := range values {
+		pos, ok := value.(string)
+		if !ok || pos == "" {
+			pos, err = s.GetPosByTxID(txIDs[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if pos != "" && !seen[pos] {
+			seen[pos] = true
+			poses = append(poses, pos)
+		}
+	}
+	return poses, nil
+}
+
+// IndexedPoses 返回 poses 中已在数据域内建立索引的部分（未索引的分片无法判断是否满足条件）
+func (s *IndexerService) IndexedPoses(domainID string, poses []string) (map[string]bool, error) {
+	key := fmt.Sprintf(DomainPosKeyFormat, domainID)
+	pipe := s.redisClient.Pipeline()
+	cmds := make([]*redis.BoolCmd, len(poses))
+	for i, pos := range poses {
+		cmds[i] = pipe.SIsMember(s.ctx, key, pos)
+	}
+	if _, err := pipe.Exec(s.ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to check indexed poses: %v", err)
+	}
+	indexed := make(map[string]bool)
+	for i, cmd := range cmds {
+		if cmd.Val() {
+			indexed[poses[i]] = true
+		}
+	}
+	return indexed, nil
+}
+
+// SaveZoneMap 保存分片的统计信息（上传时计算）
+func (s *IndexerService) SaveZoneMap(pos string, data []byte) error {
+	if err := s.redisClient.Set(s.ctx, ZoneMapKeyPrefix+pos, data, 0).Err(); err != nil {
+		return fmt.Errorf("failed to save zone map of %s: %v", pos, err)
+	}
+	return nil
+}
+
+// LoadZoneMaps 批量读取分片的统计信息，没有统计信息的分片不在结果中
+func (s *IndexerService) LoadZoneMaps(poses []string) (map[string][]byte, error) {
+	result := make(map[string][]byte)
+	if len(poses) == 0 {
+		return result, nil
+	}
+	keys := make([]string, len(poses))
+	for i, pos := range poses {
+		keys[i] = ZoneMapKeyPrefix + pos
+	}
+	values, err := s.redisClient.MGet(s.ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load zone maps: %v", err)
+	}
+	for i, value := range values {
+		if data, ok := value.(string); ok {
+			result[poses[i]] = []byte(data)
+		}
+	}
+	return result, nil
+}
+
+// GetPosRecords 批量获取分片(pos)的上传交易，索引中没有记录的分片不在结果中
+func (s *IndexerService) GetPosRecords(poses []string) (map[string]PosRecord, error) {
+	result := make(map[string]PosRecord)
+	if len(poses) == 0 {
+		return result, nil
+	}
+	values, err := s.redisClient.HMGet(s.ctx, PosRecordKey, poses...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get records of poses: %v", err)
+	}
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var record PosRecord
+		if err := json.Unmarshal([]byte(data), &record); err == nil {
+			result[poses[i]] = record
+		}
+	}
+	return result, nil
+}
+
+// SaveQueryTemplate 保存查询模板（含所有版本）
+func (s *IndexerService) SaveQueryTemplate(name string, data []byte) error {
+	if err := s.redisClient.HSet(s.ctx, QueryTemplateKey, name, data).Err(); err != nil {
+		return fmt.Errorf("failed to save query template %s: %v", name, err)
+	}
+	return nil
+}
+
+// LoadQueryTemplate 读取查询模板，不存在时返回nil
+func (s *IndexerService) LoadQueryTemplate(name string) ([]byte, error) {
+	data, err := s.redisClient.HGet(s.ctx, QueryTemplateKey, name).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load query template %s: %v", name, err)
+	}
+	return data, nil
+}
+
+// LoadQueryTemplates 读取所有查询模板
+func (s *IndexerService) LoadQueryTemplates() (map[string][]byte, error) {
+	values, err := s.redisClient.HGetAll(s.ctx, QueryTemplateKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load query templates: %v", err)
+	}
+	result := make(map[string][]byte, len(values))
+	for name, value := range values {
+		result[name] = []byte(value)
+	}
+	return result, nil
+}
+
+// DeleteQueryTemplate 删除查询模板
+func (s *IndexerService) DeleteQueryTemplate(name string) error {
+	if err := s.redisClient.HDel(s.ctx, QueryTemplateKey, name).Err(); err != nil {
+		return fmt.Errorf("failed to delete query template %s: %v", name, err)
+	}
+	return nil
+}
+
+// SaveCohort 保存队列
+func (s *IndexerService) SaveCohort(key string, data []byte) error {
+	if err := s.redisClient.HSet(s.ctx, CohortKey, key, data).Err(); err != nil {
+		return fmt.Errorf("failed to save cohort %s: %v", key, err)
+	}
+	return nil
+}
+
+// LoadCohort 读取队列，不存在时返回nil
+func (s *IndexerService) LoadCohort(key string) ([]byte, error) {
+	data, err := s.redisClient.HGet(s.ctx, CohortKey, key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cohort %s: %v", key, err)
+	}
+	return data, nil
+}
+
+// LoadCohorts 读取所有队列
+func (s *IndexerService) LoadCohorts() (map[string][]byte, error) {
+	values, err := s.redisClient.HGetAll(s.ctx, CohortKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cohorts: %v", err)
+	}
+	result := make(map[string][]byte, len(values))
+	for key, value := range values {
+		result[key] = []byte(value)
+	}
+	return result, nil
+}
+
+// DeleteCohort 删除队列
+func (s *IndexerService) DeleteCohort(key string) error {
+	if err := s.redisClient.HDel(s.ctx, CohortKey, key).Err(); err != nil {
+		return fmt.Errorf("failed to delete cohort %s: %v", key, err)
+	}
+	return nil
+}
+
 // Helper: 获取 Bitmap 中所有为 1 的 Offset
 // 采用将位图获取到本地，本地运算获取所有为1的位
 func (s *IndexerService) getSetBits(key string) ([]int64, error) {
@@ -7,12 +7,16 @@ import (
 	"chainqa_offchain_demo/chain"
 	"chainqa_offchain_demo/indexer"
 	"chainqa_offchain_demo/routers"
+	"chainqa_offchain_demo/service"
 	"chainqa_offchain_demo/setting"
 	"context"
 	"log"
+	"strings"
 
 	"fmt"
 	"os"
+
+	"github.com/go-redis/redis/v8"
 )
 
 const defaultConfFile = "./conf/config.ini"
@@ -53,6 +57,18 @@ func main() {
 	// 启动区块监听
 	go indexerSvc.StartBlockListener()
 
+	// 初始化查询结果缓存
+	var cacheRedisClient *redis.Client
+	if setting.Conf.QueryCache.Enabled && strings.EqualFold(setting.Conf.QueryCache.Backend, "redis") {
+		cacheRedisClient, err = indexer.InitRedisClient(ctx)
+		if err != nil {
+			log.Fatalf("初始化查询缓存的Redis客户端失败: %v", err)
+		}
+	}
+	if err := service.InitQueryCache(cacheRedisClient); err != nil {
+		log.Fatalf("初始化查询缓存失败: %v", err)
+	}
+
 	// 注册路由
 	r := routers.SetupRouter()
 	if err := r.Run(fmt.Sprintf(":%d", setting.Conf.Port)); err != nil {
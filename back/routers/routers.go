@@ -73,6 +73,40 @@ func SetupRouter() *gin.Engine {
 		{
 			queryGroup.POST("/queryData", controller.QueryDataHandler)
 			queryGroup.POST("/queryByFields", controller.QueryByFieldsHandler)
+			queryGroup.POST("/sql", controller.QuerySQLHandler)
+			queryGroup.POST("/explain", controller.ExplainQueryHandler)
+			queryGroup.POST("/export", controller.ExportQueryHandler)
+			queryGroup.POST("/batch", controller.BatchQueryHandler)
+			queryGroup.POST("/federated", controller.FederatedQueryHandler)
+			queryGroup.POST("/searchIndex", controller.SearchIndexHandler)
+			queryGroup.POST("/cancel", controller.CancelQueryHandler)
+		}
+
+		datasetGroup := apiGroup.Group("/dataset")
+		{
+			datasetGroup.POST("/schema", controller.DatasetSchemaHandler)
+		}
+
+		templateGroup := apiGroup.Group("/template")
+		{
+			templateGroup.POST("/createTemplate", controller.CreateTemplateHandler)
+			templateGroup.POST("/updateTemplate", controller.UpdateTemplateHandler)
+			templateGroup.POST("/getTemplate", controller.GetTemplateHandler)
+			templateGroup.POST("/listTemplates", controller.ListTemplatesHandler)
+			templateGroup.POST("/deleteTemplate", controller.DeleteTemplateHandler)
+			templateGroup.POST("/runTemplate", controller.RunTemplateHandler)
+		}
+
+		cohortGroup := apiGroup.Group("/cohort")
+		{
+			cohortGroup.POST("/createFromSearch", controller.CreateCohortFromSearchHandler)
+			cohortGroup.POST("/createFromQuery", controller.CreateCohortFromQueryHandler)
+			cohortGroup.POST("/combine", controller.CombineCohortsHandler)
+			cohortGroup.POST("/anchor", controller.AnchorCohortHandler)
+			cohortGroup.POST("/getCohort", controller.GetCohortHandler)
+			cohortGroup.POST("/listCohorts", controller.ListCohortsHandler)
+			cohortGroup.POST("/deleteCohort", controller.DeleteCohortHandler)
+			cohortGroup.POST("/query", controller.QueryCohortHandler)
 		}
 
 		logGroup := apiGroup.Group("/log")
@@ -88,6 +122,7 @@ func SetupRouter() *gin.Engine {
 			domainGroup.POST("/queryMyDomains", controller.QueryMyDomainsHandler)
 			domainGroup.POST("/queryMyManagedDomains", controller.QueryMyManagedDomainsHandler)
 			domainGroup.POST("/queryDomainInfo", controller.QueryDomainInfoHandler)
+			domainGroup.POST("/queryPrivacyBudget", controller.QueryPrivacyBudgetHandler)
 		}
 	}
 
@@ -0,0 +1,255 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ----------------k-匿名（K-ANONYMITY）-------------------
+// 数据域策略可以设置最小等价类大小k和准标识符列（如医院、科室、疾病代码），随列权限一起下发。
+// 返回原始行时，按结果行在准标识符列上的值划分等价类，少于k行的等价类不返回；generalize模式下先按规则泛化准标识符再划分。
+// 返回分组聚合结果时，分组列或查询条件涉及准标识符的查询中，少于k行的分组不返回。
+// 差分隐私查询由噪声和小分组过滤保护，不再按k-匿名处理。触发时在查询结果中说明，并记录在链上查询日志中。
+
+// k-匿名的处理方式
+const (
+	AnonymityModeSuppress   = "suppress"   // 隐藏少于k行的等价类
+	AnonymityModeGeneralize = "generalize" // 先泛化准标识符，仍少于k行的等价类再隐藏
+)
+
+// AnonymityPolicy k-匿名策略（与合约中的定义一致）
+type AnonymityPolicy struct {
+	K                int          `json:"k"`                    // 最小等价类大小
+	QuasiIdentifiers []string     `json:"quasiIdentifiers"`     // 准标识符列
+	Mode             string       `json:"mode,omitempty"`       // suppress（默认）/generalize
+	Generalize       []ColumnMask `json:"generalize,omitempty"` // generalize：准标识符的泛化规则（ageBand/partial）
+}
+
+// AnonymityReport 查询结果中k-匿名的说明（触发时才返回）
+type AnonymityReport struct {
+	K                 int      `json:"k"`                           // 最小等价类大小
+	QuasiIdentifiers  []string `json:"quasiIdentifiers"`            // 准标识符列
+	Generalized       []string `json:"generalized,omitempty"`       // 泛化的列及规则，如 age:ageBand(10)
+	SuppressedClasses int      `json:"suppressedClasses,omitempty"` // 未返回的等价类数
+	SuppressedRows    int      `json:"suppressedRows,omitempty"`    // 未返回的行数
+	SuppressedGroups  int      `json:"suppressedGroups,omitempty"`  // 未返回的分组数
+}
+
+/**
+ * validate 校验k-匿名策略
+ * @return error 错误信息，策略为nil时不校验
+ */
+func (p *AnonymityPolicy) validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.K < 2 {
+		return errors.New("k-匿名策略的 k 须不小于2")
+	}
+	if len(p.QuasiIdentifiers) == 0 {
+		return errors.New("k-匿名策略须设置准标识符列")
+	}
+	switch p.Mode {
+	case "", AnonymityModeSuppress, AnonymityModeGeneralize:
+	default:
+		return fmt.Errorf("不支持的k-匿名处理方式 %s（suppress/generalize）", p.Mode)
+	}
+	for _, rule := range p.Generalize {
+		if !strIsInSlice(p.QuasiIdentifiers, rule.Column) {
+			return fmt.Errorf("泛化规则的列 %s 不是准标识符", rule.Column)
+		}
+		if rule.Method != MaskMethodAgeBand && rule.Method != MaskMethodPartial {
+			return fmt.Errorf("列 %s 的泛化方式 %s 不支持（ageBand/partial）", rule.Column, rule.Method)
+		}
+		if rule.KeepPrefix < 0 || rule.KeepSuffix < 0 || rule.BandWidth < 0 {
+			return fmt.Errorf("列 %s 的泛化参数不能为负数", rule.Column)
+		}
+	}
+	return nil
+}
+
+// anonymityPlan 一次查询中生效的k-匿名处理
+type anonymityPlan struct {
+	policy         *AnonymityPolicy
+	generalizers   map[string]*ColumnMask // 准标识符列 -> 泛化规则（generalize模式）
+	restrictGroups bool                   // 分组列或查询条件涉及准标识符时，少于k行的分组不返回
+	report         AnonymityReport
+}
+
+/**
+ * newAnonymityPlan 根据查询项上的k-匿名策略生成处理计划
+ * @param queryItemData 查询项（策略随列权限由GetQueryResultContext设置）
+ * @return *anonymityPlan 处理计划，没有策略或为差分隐私查询时为nil
+ */
+func newAnonymityPlan(queryItemData QueryItem) *anonymityPlan {
+	if queryItemData.columnPolicy == nil || queryItemData.columnPolicy.Anonymity == nil || queryItemData.Privacy != nil {
+		return nil
+	}
+	policy := queryItemData.columnPolicy.Anonymity
+	plan := &anonymityPlan{
+		policy:       policy,
+		generalizers: make(map[string]*ColumnMask),
+		report:       AnonymityReport{K: policy.K, QuasiIdentifiers: policy.QuasiIdentifiers},
+	}
+	if policy.Mode == AnonymityModeGeneralize {
+		for i := range policy.Generalize {
+			plan.generalizers[policy.Generalize[i].Column] = &policy.Generalize[i]
+		}
+	}
+	for _, groupBy := range queryItemData.GroupBy {
+		if strIsInSlice(policy.QuasiIdentifiers, groupBy.Field) {
+			plan.restrictGroups = true
+		}
+	}
+	for _, conditions := range queryItemData.QueryConditions {
+		for _, condition := range conditions {
+			if strIsInSlice(policy.QuasiIdentifiers, condition.Field) {
+				plan.restrictGroups = true
+			}
+		}
+	}
+	return plan
+}
+
+/**
+ * suppressRows 泛化结果行的准标识符（generalize模式），并去掉少于k行的等价类
+ * @param table 表（泛化直接修改结果行中准标识符的单元格）
+ * @param rowIdxs 满足条件的行索引（已排序）
+ * @return []int 保留的行索引（保持原顺序）
+ */
+func (p *anonymityPlan) suppressRows(table *Table, rowIdxs []int) []int {
+	keys := make([]string, 0)
+	for key := range table.HeaderMap {
+		if strIsInSlice(p.policy.QuasiIdentifiers, headerField(key)) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return rowIdxs
+	}
+	sort.Strings(keys)
+
+	// 泛化：复制行后修改，不影响其他引用同一行的表
+	generalized := make(map[string]bool)
+	for _, key := range keys {
+		rule := p.generalizers[headerField(key)]
+		if rule == nil {
+			continue
+		}
+		index := table.HeaderMap[key]
+		for _, rowIdx := range rowIdxs {
+			if cell := table.Rows[rowIdx][index]; !isNullCell(cell) {
+				row := append([]string(nil), table.Rows[rowIdx]...)
+				row[index] = rule.apply(cell)
+				table.Rows[rowIdx] = row
+			}
+		}
+		if !generalized[rule.Column] {
+			generalized[rule.Column] = true
+			p.report.Generalized = append(p.report.Generalized, rule.describe())
+		}
+	}
+
+	// 以JSON数组作为等价类的键，避免单元格中的分隔符造成冲突
+	classKeys := make([]string, len(rowIdxs))
+	classSizes := make(map[string]int)
+	values := make([]string, len(keys))
+	for i, rowIdx := range rowIdxs {
+		for j, key := range keys {
+			values[j] = table.Rows[rowIdx][table.HeaderMap[key]]
+		}
+		classKeyBytes, _ := json.Marshal(values)
+		classKeys[i] = string(classKeyBytes)
+		classSizes[classKeys[i]]++
+	}
+	kept := make([]int, 0, len(rowIdxs))
+	for i, rowIdx := range rowIdxs {
+		if classSizes[classKeys[i]] < p.policy.K {
+			p.report.SuppressedRows++
+			continue
+		}
+		kept = append(kept, rowIdx)
+	}
+	for _, size := range classSizes {
+		if size < p.policy.K {
+			p.report.SuppressedClasses++
+		}
+	}
+	return kept
+}
+
+/**
+ * suppressGroup 分组是否因少于k行而不返回（分组列或查询条件涉及准标识符时生效，0行的分组不泄露个体，照常返回）
+ * @param rows 分组的行数
+ * @return bool 是否不返回
+ */
+func (p *anonymityPlan) suppressGroup(rows int) bool {
+	if p == nil || !p.restrictGroups || rows == 0 || rows >= p.policy.K {
+		return false
+	}
+	p.report.SuppressedGroups++
+	return true
+}
+
+/**
+ * fired 是否触发了k-匿名（有泛化或隐藏）
+ * @return bool 是否触发
+ */
+func (p *anonymityPlan) fired() bool {
+	return p != nil && (len(p.report.Generalized) > 0 || p.report.SuppressedRows > 0 || p.report.SuppressedGroups > 0)
+}
+
+/**
+ * note 触发k-匿名时查询结果的说明，附加在查询结果的message中
+ * @return string 说明，未触发时为空
+ */
+func (p *anonymityPlan) note() string {
+	if !p.fired() {
+		return ""
+	}
+	parts := []string{fmt.Sprintf("k-匿名(k=%d)：准标识符 %s", p.policy.K, strings.Join(p.policy.QuasiIdentifiers, ","))}
+	if len(p.report.Generalized) > 0 {
+		parts = append(parts, "已泛化 "+strings.Join(p.report.Generalized, ","))
+	}
+	if p.report.SuppressedRows > 0 {
+		parts = append(parts, fmt.Sprintf("%d个等价类（共%d行）少于%d行，未返回", p.report.SuppressedClasses, p.report.SuppressedRows, p.policy.K))
+	}
+	if p.report.SuppressedGroups > 0 {
+		parts = append(parts, fmt.Sprintf("%d个分组少于%d行，未返回", p.report.SuppressedGroups, p.policy.K))
+	}
+	return "（" + strings.Join(parts, "，") + "）"
+}
+
+/**
+ * Summary k-匿名说明的摘要，记录在查询日志中，如 k=5;qi=hospital,department;generalized=age:ageBand(10);suppressedRows=3
+ * @return string 摘要
+ */
+func (r *AnonymityReport) Summary() string {
+	parts := []string{fmt.Sprintf("k=%d", r.K), "qi=" + strings.Join(r.QuasiIdentifiers, ",")}
+	if len(r.Generalized) > 0 {
+		parts = append(parts, "generalized="+strings.Join(r.Generalized, ","))
+	}
+	if r.SuppressedRows > 0 {
+		parts = append(parts, fmt.Sprintf("suppressedClasses=%d", r.SuppressedClasses), fmt.Sprintf("suppressedRows=%d", r.SuppressedRows))
+	}
+	if r.SuppressedGroups > 0 {
+		parts = append(parts, fmt.Sprintf("suppressedGroups=%d", r.SuppressedGroups))
+	}
+	return strings.Join(parts, ";")
+}
+
+/**
+ * AnonymitySummary 从查询结果中取出触发的k-匿名策略的摘要（记录在链上查询日志中）
+ * @param queryResult 查询结果（JSON字符串）
+ * @return string 摘要，未触发或查询失败时为空
+ */
+func AnonymitySummary(queryResult string) string {
+	var queryResultData QueryResult
+	if err := json.Unmarshal([]byte(queryResult), &queryResultData); err != nil || queryResultData.Anonymity == nil {
+		return ""
+	}
+	return queryResultData.Anonymity.Summary()
+}
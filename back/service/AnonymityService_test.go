@@ -0,0 +1,120 @@
+package service
+
+import (
+	"chainqa_offchain_demo/setting"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAnonymitySuppression(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	shards := map[string]string{"P": "id\thospital\tage\n1\tA\t31\n2\tA\t35\n3\tA\t42\n4\tB\t33\n5\tA\t38\n"}
+	rowsQuery := `{"queryConcatType":"single","filePos":[["P"]],"returnField":["P_id","P_hospital","P_age"]}`
+	groupQuery := `{"queryConcatType":"single","filePos":[["P"]],"groupBy":[{"pos":"P","field":"hospital","type":"string"}],"aggregates":[{"func":"count","alias":"n"}]}`
+	plainGroupQuery := `{"queryConcatType":"single","filePos":[["P"]],"groupBy":[{"pos":"P","field":"id","type":"string"}],"aggregates":[{"func":"count","alias":"n"}]}`
+	cases := []struct {
+		name       string
+		policy     string
+		queryItem  string
+		wantIds    []string // 原始行查询返回的id
+		wantAges   []string // 原始行查询返回的age（泛化后）
+		wantGroups int      // 分组查询返回的分组数
+		wantReport AnonymityReport
+	}{
+		{
+			"隐藏少于k行的等价类",
+			`{"anonymity":{"k":2,"quasiIdentifiers":["hospital"]}}`,
+			rowsQuery, []string{"1", "2", "3", "5"}, []string{"31", "35", "42", "38"}, 0,
+			AnonymityReport{K: 2, QuasiIdentifiers: []string{"hospital"}, SuppressedClasses: 1, SuppressedRows: 1},
+		},
+		{
+			"泛化后再隐藏",
+			`{"anonymity":{"k":2,"quasiIdentifiers":["hospital","age"],"mode":"generalize","generalize":[{"column":"age","method":"ageBand"}]}}`,
+			rowsQuery, []string{"1", "2", "5"}, []string{"30-39", "30-39", "30-39"}, 0,
+			AnonymityReport{K: 2, QuasiIdentifiers: []string{"hospital", "age"}, Generalized: []string{"age:ageBand(10)"}, SuppressedClasses: 2, SuppressedRows: 2},
+		},
+		{
+			"隐藏少于k行的分组",
+			`{"anonymity":{"k":2,"quasiIdentifiers":["hospital"]}}`,
+			groupQuery, nil, nil, 1,
+			AnonymityReport{K: 2, QuasiIdentifiers: []string{"hospital"}, SuppressedGroups: 1},
+		},
+		{
+			"分组不涉及准标识符时不隐藏",
+			`{"anonymity":{"k":2,"quasiIdentifiers":["hospital"]}}`,
+			plainGroupQuery, nil, nil, 5,
+			AnonymityReport{},
+		},
+		{
+			"结果中没有准标识符列时不触发",
+			`{"anonymity":{"k":2,"quasiIdentifiers":["ward"]}}`,
+			rowsQuery, []string{"1", "2", "3", "4", "5"}, []string{"31", "35", "42", "33", "38"}, 0,
+			AnonymityReport{},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var policy ColumnPolicy
+			if err := json.Unmarshal([]byte(tc.policy), &policy); err != nil {
+				t.Fatalf("策略格式错误: %v", err)
+			}
+			ctx := WithColumnPolicy(context.Background(), &policy)
+			queryResult, counts, err := GetQueryResultContext(ctx, tc.queryItem, shards, QueryLimits{})
+			if err != nil || counts == -1 {
+				t.Fatalf("查询失败: %s, %v", queryResult, err)
+			}
+			var queryResultData QueryResult
+			json.Unmarshal([]byte(queryResult), &queryResultData)
+			if tc.wantIds != nil {
+				ids, ages := make([]string, 0), make([]string, 0)
+				for _, row := range queryResultData.Data {
+					rowData := row.(map[string]interface{})
+					ids = append(ids, rowData["id"].(string))
+					ages = append(ages, rowData["age"].(string))
+				}
+				if !reflect.DeepEqual(ids, tc.wantIds) || !reflect.DeepEqual(ages, tc.wantAges) {
+					t.Errorf("结果 id = %v, age = %v，期望 %v, %v", ids, ages, tc.wantIds, tc.wantAges)
+				}
+			} else if len(queryResultData.Data) != tc.wantGroups {
+				t.Errorf("分组数 = %d，期望 %d", len(queryResultData.Data), tc.wantGroups)
+			}
+			if tc.wantReport.K == 0 {
+				if queryResultData.Anonymity != nil {
+					t.Errorf("未触发时返回了k-匿名说明: %+v", queryResultData.Anonymity)
+				}
+				return
+			}
+			if queryResultData.Anonymity == nil || !reflect.DeepEqual(*queryResultData.Anonymity, tc.wantReport) {
+				t.Errorf("k-匿名说明 = %+v，期望 %+v", queryResultData.Anonymity, tc.wantReport)
+			}
+			if summary := AnonymitySummary(queryResult); !strings.HasPrefix(summary, "k=2;") {
+				t.Errorf("AnonymitySummary = %q", summary)
+			}
+		})
+	}
+}
+
+func TestAnonymityPolicyValidate(t *testing.T) {
+	cases := []struct {
+		name    string
+		policy  string
+		wantErr string
+	}{
+		{"k小于2", `{"anonymity":{"k":1,"quasiIdentifiers":["a"]}}`, "不小于2"},
+		{"没有准标识符", `{"anonymity":{"k":2}}`, "须设置准标识符列"},
+		{"不支持的处理方式", `{"anonymity":{"k":2,"quasiIdentifiers":["a"],"mode":"drop"}}`, "不支持的k-匿名处理方式"},
+		{"泛化的列不是准标识符", `{"anonymity":{"k":2,"quasiIdentifiers":["a"],"mode":"generalize","generalize":[{"column":"b","method":"ageBand"}]}}`, "不是准标识符"},
+		{"不支持的泛化方式", `{"anonymity":{"k":2,"quasiIdentifiers":["a"],"mode":"generalize","generalize":[{"column":"a","method":"hash"}]}}`, "泛化方式 hash 不支持"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseColumnPolicy(tc.policy)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("err = %v，期望包含 %q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ----------------批量查询（BATCH QUERY）-------------------
+// 同一批查询中的每个不同CID只获取、解密一次，所有查询共享解密后的分片。
+
+// BatchQueryResult 批量查询中单个查询的结果
+type BatchQueryResult struct {
+	Index     int    `json:"index"`     // 查询在批量请求中的序号（从0开始）
+	QueryItem string `json:"queryItem"` // 查询项（SQL查询为编译后的查询项）
+	Counts    int    `json:"counts"`    // 结果数量，-1表示查询失败
+	Result    string `json:"result"`    // 查询结果（与queryData返回的查询结果格式相同）
+	Cached    bool   `json:"cached"`    // 是否命中结果缓存
+	Code      int    `json:"code"`      // 查询因超时、取消或超出资源限制而中止时的错误码，其余为0
+}
+
+/**
+ * LoadShardsEach 并发获取并解密多个分片，单个分片失败不影响其它分片
+ * @param ctx 查询的context，结束时剩余分片均记为失败
+ * @param filePoses 文件位置（CID）数组，重复的只获取一次
+ * @param loader 分片获取函数
+ * @return map[string]string 获取成功的文件位置和明文的map
+ * @return map[string]error 获取失败的文件位置和错误的map
+ */
+func LoadShardsEach(ctx context.Context, filePoses []string, loader ShardLoader) (map[string]string, map[string]error) {
+	filePosAndDataMap := make(map[string]string)
+	filePosAndErrMap := make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, shardParallelism())
+	started := make(map[string]bool)
+	for _, filePos := range filePoses {
+		if started[filePos] {
+			continue
+		}
+		started[filePos] = true
+		wg.Add(1)
+		go func(filePos string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			data, err := loadShard(ctx, filePos, loader)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				filePosAndErrMap[filePos] = err
+				return
+			}
+			filePosAndDataMap[filePos] = data
+		}(filePos)
+	}
+	wg.Wait()
+	return filePosAndDataMap, filePosAndErrMap
+}
+
+/**
+ * RunBatchQuery 执行一批查询：先查结果缓存，未命中的查询所引用的CID合并去重后一次性获取解密，再逐个查询
+ * 某个分片获取失败时，只有引用该分片的查询失败
+ * @param ctx 整批查询的context（超时、取消）
+ * @param queryItems 查询项数组
+ * @param cacheKeys 各查询项的缓存键（与queryItems一一对应，为空字符串或nil时不使用缓存）
+ * @param limits 资源限制（每个查询分别计算）
+ * @param pruner 谓词下推函数（为nil时不下推），只作用于未命中缓存的查询
+ * @param loader 分片获取函数
+ * @return []BatchQueryResult 各查询的结果（与queryItems顺序一致，queryItem为下推前的查询项）
+ */
+func RunBatchQuery(ctx context.Context, queryItems []string, cacheKeys []string, limits QueryLimits, pruner ShardPruner, loader ShardLoader) []BatchQueryResult {
+	results := make([]BatchQueryResult, len(queryItems))
+	execQueryItems := make([]string, len(queryItems)) // 实际执行的查询项（谓词下推后）
+	queryFilePoses := make([][]string, len(queryItems))
+	pending := make([]int, 0, len(queryItems))
+	allFilePoses := make([]string, 0)
+	for i, queryItem := range queryItems {
+		results[i] = BatchQueryResult{Index: i, QueryItem: queryItem}
+		cacheKey := ""
+		if i < len(cacheKeys) {
+			cacheKey = cacheKeys[i]
+		}
+		if queryResult, counts, ok := GetCachedQueryResult(cacheKey); ok {
+			results[i].Result, results[i].Counts, results[i].Cached = queryResult, counts, true
+			continue
+		}
+
+		execQueryItems[i] = queryItem
+		if pruner != nil {
+			execQueryItems[i], _ = pruner(queryItem)
+		}
+		var queryItemData QueryItem
+		if err := json.Unmarshal([]byte(execQueryItems[i]), &queryItemData); err != nil {
+			results[i].Result, results[i].Counts = errorQueryResult("解析查询条件失败:"+err.Error()), -1
+			continue
+		}
+		if len(queryItemData.FilePos) == 0 {
+			results[i].Result, results[i].Counts = errorQueryResult("filePos 不能为空"), -1
+			continue
+		}
+		queryFilePoses[i] = ShardsToLoad(queryItemData)
+		allFilePoses = append(allFilePoses, queryFilePoses[i]...)
+		pending = append(pending, i)
+	}
+	if len(pending) == 0 {
+		return results
+	}
+
+	// 所有查询共享解密后的分片
+	filePosAndDataMap, filePosAndErrMap := LoadShardsEach(ctx, allFilePoses, loader)
+	for _, i := range pending {
+		// 整批查询已超时或取消
+		if err := contextAbortError(ctx); err != nil {
+			results[i].Result, results[i].Counts, results[i].Code = errorQueryResult(err.Error()), -1, QueryAbortCode(err)
+			continue
+		}
+		failed := make([]string, 0)
+		for _, filePos := range queryFilePoses[i] {
+			if err, ok := filePosAndErrMap[filePos]; ok && !strIsInSlice(failed, filePos+": "+err.Error()) {
+				failed = append(failed, filePos+": "+err.Error())
+			}
+		}
+		if len(failed) > 0 {
+			sort.Strings(failed)
+			results[i].Result, results[i].Counts = errorQueryResult(fmt.Sprintf("获取分片失败（%s）", strings.Join(failed, "；"))), -1
+			continue
+		}
+		queryResult, counts, err := GetQueryResultContext(ctx, execQueryItems[i], filePosAndDataMap, limits)
+		results[i].Result, results[i].Counts, results[i].Code = queryResult, counts, QueryAbortCode(err)
+		if i < len(cacheKeys) {
+			CacheQueryResult(cacheKeys[i], results[i].Result, results[i].Counts)
+		}
+	}
+	return results
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"chainqa_offchain_demo/setting"
+)
+
+func TestRunBatchQuery(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	shards := map[string]string{
+		"BA": "id\tage\n1\t10\n2\t20\n",
+		"BB": "id\tage\n3\t30\n",
+	}
+	var mu sync.Mutex
+	loads := make(map[string]int)
+	loader := func(ctx context.Context, filePos string) (string, error) {
+		mu.Lock()
+		loads[filePos]++
+		mu.Unlock()
+		content, ok := shards[filePos]
+		if !ok {
+			return "", errors.New("分片不存在")
+		}
+		return content, nil
+	}
+	queryItem := func(filePos []string, val string) string {
+		queryItemJSON, _ := json.Marshal(QueryItem{QueryConcatType: "single", FilePos: [][]string{filePos}, ReturnField: []string{filePos[0] + "_id"},
+			QueryConditions: [][]QueryCondition{{{Pos: filePos[0], Field: "age", Val: val, Compare: "ge", Type: "int"}}}})
+		return string(queryItemJSON)
+	}
+	queryItems := []string{
+		queryItem([]string{"BA", "BB"}, "20"),
+		queryItem([]string{"BA"}, "0"),
+		queryItem([]string{"BA", "BX"}, "0"),
+		"{",
+		queryItem([]string{"BB"}, "0"),
+	}
+
+	queryCache = &memoryQueryCache{ttl: time.Minute, maxEntries: 8, maxBytes: 1 << 20, maxEntryBytes: 1 << 20, entries: make(map[string]*list.Element), order: list.New()}
+	defer func() { queryCache = nil }()
+	CacheQueryResult("cachedBB", `{"counts":1,"data":[{"id":"3"}],"message":"查询成功"}`, 1)
+
+	results := RunBatchQuery(context.Background(), queryItems, []string{"", "keyBA", "", "", "cachedBB"}, QueryLimits{}, nil, loader)
+	want := []struct {
+		counts int
+		cached bool
+		result string
+	}{
+		{2, false, `"data":[{"id":"2"},{"id":"3"}]`},
+		{2, false, `"data":[{"id":"1"},{"id":"2"}]`},
+		{-1, false, "获取分片失败（BX: "},
+		{-1, false, "解析查询条件失败"},
+		{1, true, `"data":[{"id":"3"}]`},
+	}
+	for i, result := range results {
+		if result.Index != i || result.QueryItem != queryItems[i] || result.Counts != want[i].counts || result.Cached != want[i].cached || !strings.Contains(result.Result, want[i].result) {
+			t.Errorf("第%d个查询: %+v，期望 %+v", i, result, want[i])
+		}
+	}
+	// 每个分片只获取一次，命中缓存的查询不获取分片
+	if loads["BA"] != 1 || loads["BB"] != 1 || loads["BX"] != 1 {
+		t.Errorf("获取分片次数 = %v", loads)
+	}
+	// 未命中的查询结果写入缓存
+	if _, counts, ok := GetCachedQueryResult("keyBA"); !ok || counts != 2 {
+		t.Errorf("查询结果未缓存")
+	}
+}
@@ -0,0 +1,598 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------队列（COHORT）-------------------
+// 队列是保存在服务端、属于一个组织的一组成员：索引查询匹配的交易ID（txId队列），或查询结果中某一列的值（rowKey队列，如患者ID）。
+// rowKey队列之间可以做并集、交集、差集（如 糖尿病患者 减去 已入组试验X的患者），查询项可以限定在队列内执行：
+// rowKey队列在每个条件组中加入 列 in 成员 的条件；txId队列只能限定到分片（读取队列中的交易上传的整个分片），
+// 差集、交集无法排除同一分片中的其他行，因此txId队列不能做集合运算。
+// 队列创建后不可修改；定义和成员的哈希锚定到链上，用于复现和校验。
+
+// 队列的成员类型
+const (
+	CohortKindTxId   = "txId"   // 成员为交易ID（索引查询的结果）
+	CohortKindRowKey = "rowKey" // 成员为查询结果中某一列的值
+)
+
+// 队列的来源（CohortDefinition.Source）
+const (
+	CohortSourceSearch = "search"     // 索引查询
+	CohortSourceQuery  = "query"      // 查询项
+	CohortOpUnion      = "union"      // 并集
+	CohortOpIntersect  = "intersect"  // 交集
+	CohortOpDifference = "difference" // 差集（第一个队列减去其余队列）
+)
+
+// 一个队列最多的成员数
+const maxCohortMembers = 100000
+
+// CohortOperand 集合运算的操作数
+type CohortOperand struct {
+	Name string `json:"name"` // 队列名称
+	Hash string `json:"hash"` // 运算时队列的哈希
+}
+
+// CohortDefinition 队列的定义：成员是如何得到的
+type CohortDefinition struct {
+	Source     string          `json:"source"`               // 来源：search/query/union/intersect/difference
+	DomainName string          `json:"domainName,omitempty"` // 查询的数据域（集合运算时为操作数共同的数据域）
+	Search     string          `json:"search,omitempty"`     // 索引查询请求（JSON，来源为search时）
+	QueryItem  string          `json:"queryItem,omitempty"`  // 查询项（来源为query时）
+	Operands   []CohortOperand `json:"operands,omitempty"`   // 操作数（集合运算时）
+}
+
+// Cohort 队列
+type Cohort struct {
+	Name       string           `json:"name"`               // 队列名称（组织内唯一）
+	OrgId      string           `json:"orgId"`              // 所属组织ID（只有该组织可以使用、删除）
+	Kind       string           `json:"kind"`               // 成员类型：txId/rowKey
+	KeyField   string           `json:"keyField,omitempty"` // rowKey队列的成员所在的列（查询结果中的列名）
+	Definition CohortDefinition `json:"definition"`         // 定义
+	Members    []string         `json:"members"`            // 成员（去重并排序；列出队列时不返回）
+	Counts     int              `json:"counts"`             // 成员数量
+	Hash       string           `json:"hash"`               // 定义和成员的哈希（sha256）
+	Anchored   bool             `json:"anchored"`           // 哈希是否已锚定到链上
+	CreatedBy  string           `json:"createdBy"`          // 创建队列的用户ID
+	CreatedAt  string           `json:"createdAt"`          // 创建时间（RFC3339）
+}
+
+// CohortStore 队列的存储，键为 组织ID__队列名称
+type CohortStore interface {
+	SaveCohort(key string, data []byte) error
+	LoadCohort(key string) ([]byte, error) // 不存在时返回nil
+	LoadCohorts() (map[string][]byte, error)
+	DeleteCohort(key string) error
+}
+
+// CohortPoseLookup 获取交易上传的分片（由索引服务实现），用于限定txId队列的查询
+type CohortPoseLookup func(txIDs []string) ([]string, error)
+
+// memoryCohortStore 内存中的队列存储（索引服务未初始化时使用，重启后丢失）
+type memoryCohortStore struct {
+	sync.RWMutex
+	cohorts map[string][]byte
+}
+
+// MemoryCohortStore 内存中的队列存储
+var MemoryCohortStore CohortStore = &memoryCohortStore{cohorts: make(map[string][]byte)}
+
+func (s *memoryCohortStore) SaveCohort(key string, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.cohorts[key] = data
+	return nil
+}
+
+func (s *memoryCohortStore) LoadCohort(key string) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.cohorts[key], nil
+}
+
+func (s *memoryCohortStore) LoadCohorts() (map[string][]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	result := make(map[string][]byte, len(s.cohorts))
+	for key, data := range s.cohorts {
+		result[key] = data
+	}
+	return result, nil
+}
+
+func (s *memoryCohortStore) DeleteCohort(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.cohorts, key)
+	return nil
+}
+
+// 队列的创建、删除和锚定状态的修改串行执行
+var cohortMu sync.Mutex
+
+// cohortKey 队列在存储中的键（组织ID和队列名称都不含连续两个下划线，键不会冲突）
+func cohortKey(orgId string, name string) string {
+	return orgId + "__" + name
+}
+
+// checkCohortOrgId 检查组织ID可以用于队列的键
+func checkCohortOrgId(orgId string) error {
+	if orgId == "" {
+		return errors.New("orgId 不能为空")
+	}
+	if strings.Contains(orgId, "__") {
+		return errors.New("orgId 不能包含连续两个下划线")
+	}
+	return nil
+}
+
+/**
+ * Ref 队列的引用（名称@哈希），记录在查询日志中
+ * @return string 引用
+ */
+func (c *Cohort) Ref() string {
+	return c.Name + "@" + c.Hash
+}
+
+/**
+ * AnchorDefinition 锚定到链上的定义：成员类型、成员所在的列和来源（JSON），与哈希一起可以复现队列
+ * @return string 定义（JSON字符串）
+ */
+func (c *Cohort) AnchorDefinition() string {
+	definition, _ := json.Marshal(struct {
+		Kind     string `json:"kind"`
+		KeyField string `json:"keyField,omitempty"`
+		CohortDefinition
+	}{c.Kind, c.KeyField, c.Definition})
+	return string(definition)
+}
+
+/**
+ * CohortHash 计算队列的哈希：名称、组织、成员类型、成员所在的列、定义和成员的sha256
+ * @param cohort 队列
+ * @return string 十六进制哈希
+ */
+func CohortHash(cohort *Cohort) string {
+	content, _ := json.Marshal(struct {
+		Name       string           `json:"name"`
+		OrgId      string           `json:"orgId"`
+		Kind       string           `json:"kind"`
+		KeyField   string           `json:"keyField"`
+		Definition CohortDefinition `json:"definition"`
+		Members    []string         `json:"members"`
+	}{cohort.Name, cohort.OrgId, cohort.Kind, cohort.KeyField, cohort.Definition, cohort.Members})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+/**
+ * loadCohort 从存储中读取队列
+ * @param store 队列存储
+ * @param orgId 组织ID
+ * @param name 队列名称
+ * @return *Cohort 队列，不存在时为nil
+ * @return error 错误信息
+ */
+func loadCohort(store CohortStore, orgId string, name string) (*Cohort, error) {
+	if err := checkCohortOrgId(orgId); err != nil {
+		return nil, err
+	}
+	data, err := store.LoadCohort(cohortKey(orgId, name))
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, nil
+	}
+	var cohort Cohort
+	if err := json.Unmarshal(data, &cohort); err != nil {
+		return nil, fmt.Errorf("队列 %s 解析失败: %s", name, err)
+	}
+	if cohort.OrgId != orgId || cohort.Name != name {
+		return nil, fmt.Errorf("队列 %s 不属于组织 %s", name, orgId)
+	}
+	return &cohort, nil
+}
+
+/**
+ * saveCohort 把队列写入存储
+ * @param store 队列存储
+ * @param cohort 队列
+ * @return error 错误信息
+ */
+func saveCohort(store CohortStore, cohort *Cohort) error {
+	data, err := json.Marshal(cohort)
+	if err != nil {
+		return err
+	}
+	return store.SaveCohort(cohortKey(cohort.OrgId, cohort.Name), data)
+}
+
+/**
+ * CreateCohort 创建队列：成员去重并排序后计算哈希
+ * @param store 队列存储
+ * @param name 队列名称
+ * @param orgId 所属组织ID
+ * @param uid 创建队列的用户ID
+ * @param kind 成员类型（txId/rowKey）
+ * @param keyField rowKey队列的成员所在的列
+ * @param members 成员
+ * @param definition 定义
+ * @return *Cohort 队列
+ * @return error 名称不合法、队列已存在或成员过多时返回错误
+ */
+func CreateCohort(store CohortStore, name string, orgId string, uid string, kind string, keyField string, members []string, definition CohortDefinition) (*Cohort, error) {
+	if !templateNameRe.MatchString(name) || strings.Contains(name, "__") {
+		return nil, errors.New("队列名称只能包含字母、数字、汉字、下划线、中划线和点（最长64个字符，不能包含连续两个下划线）")
+	}
+	if err := checkCohortOrgId(orgId); err != nil {
+		return nil, err
+	}
+	if uid == "" {
+		return nil, errors.New("uId 不能为空")
+	}
+	if kind != CohortKindTxId && kind != CohortKindRowKey {
+		return nil, fmt.Errorf("不支持的队列成员类型 %s", kind)
+	}
+	members = normalizeCohortMembers(members)
+	if len(members) > maxCohortMembers {
+		return nil, fmt.Errorf("队列成员数 %d 超过上限 %d", len(members), maxCohortMembers)
+	}
+
+	cohortMu.Lock()
+	defer cohortMu.Unlock()
+	existing, err := loadCohort(store, orgId, name)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("队列 %s 已存在", name)
+	}
+	cohort := &Cohort{
+		Name:       name,
+		OrgId:      orgId,
+		Kind:       kind,
+		KeyField:   keyField,
+		Definition: definition,
+		Members:    members,
+		Counts:     len(members),
+		CreatedBy:  uid,
+		CreatedAt:  time.Now().Format(time.RFC3339),
+	}
+	cohort.Hash = CohortHash(cohort)
+	if err := saveCohort(store, cohort); err != nil {
+		return nil, err
+	}
+	return cohort, nil
+}
+
+// normalizeCohortMembers 成员去重并排序（去掉空值）
+func normalizeCohortMembers(members []string) []string {
+	seen := make(map[string]bool, len(members))
+	result := make([]string, 0, len(members))
+	for _, member := range members {
+		if member == "" || seen[member] {
+			continue
+		}
+		seen[member] = true
+		result = append(result, member)
+	}
+	sort.Strings(result)
+	return result
+}
+
+/**
+ * GetCohort 获取组织的队列（含成员）
+ * @param store 队列存储
+ * @param orgId 组织ID
+ * @param name 队列名称
+ * @return *Cohort 队列
+ * @return error 队列不存在时返回错误
+ */
+func GetCohort(store CohortStore, orgId string, name string) (*Cohort, error) {
+	cohort, err := loadCohort(store, orgId, name)
+	if err != nil {
+		return nil, err
+	}
+	if cohort == nil {
+		return nil, fmt.Errorf("组织 %s 没有队列 %s", orgId, name)
+	}
+	return cohort, nil
+}
+
+/**
+ * ListCohorts 列出组织的所有队列（按名称排序，不含成员），解析失败的队列跳过
+ * @param store 队列存储
+ * @param orgId 组织ID
+ * @return []*Cohort 队列
+ * @return error 错误信息
+ */
+func ListCohorts(store CohortStore, orgId string) ([]*Cohort, error) {
+	stored, err := store.LoadCohorts()
+	if err != nil {
+		return nil, err
+	}
+	cohorts := make([]*Cohort, 0)
+	for _, data := range stored {
+		var cohort Cohort
+		if err := json.Unmarshal(data, &cohort); err != nil || cohort.OrgId != orgId {
+			continue
+		}
+		cohort.Members = nil
+		cohorts = append(cohorts, &cohort)
+	}
+	sort.Slice(cohorts, func(i, j int) bool { return cohorts[i].Name < cohorts[j].Name })
+	return cohorts, nil
+}
+
+/**
+ * DeleteCohort 删除组织的队列；已上链的哈希和查询日志不受影响，由其运算得到的队列也不受影响
+ * @param store 队列存储
+ * @param orgId 组织ID
+ * @param name 队列名称
+ * @return error 队列不存在时返回错误
+ */
+func DeleteCohort(store CohortStore, orgId string, name string) error {
+	cohortMu.Lock()
+	defer cohortMu.Unlock()
+	if _, err := GetCohort(store, orgId, name); err != nil {
+		return err
+	}
+	return store.DeleteCohort(cohortKey(orgId, name))
+}
+
+/**
+ * MarkCohortAnchored 记录队列的哈希已锚定到链上
+ * @param store 队列存储
+ * @param orgId 组织ID
+ * @param name 队列名称
+ * @return error 错误信息
+ */
+func MarkCohortAnchored(store CohortStore, orgId string, name string) error {
+	cohortMu.Lock()
+	defer cohortMu.Unlock()
+	cohort, err := GetCohort(store, orgId, name)
+	if err != nil {
+		return err
+	}
+	cohort.Anchored = true
+	return saveCohort(store, cohort)
+}
+
+/**
+ * CombineCohorts 对组织的队列做集合运算，结果保存为新队列
+ * @param store 队列存储
+ * @param op 运算：union/intersect/difference（差集为第一个队列减去其余队列）
+ * @param name 新队列的名称
+ * @param orgId 组织ID（操作数须属于该组织）
+ * @param uid 用户ID
+ * @param operandNames 操作数的名称（至少两个，须为同一数据域的rowKey队列）
+ * @return *Cohort 新队列
+ * @return error 错误信息
+ */
+func CombineCohorts(store CohortStore, op string, name string, orgId string, uid string, operandNames []string) (*Cohort, error) {
+	if op != CohortOpUnion && op != CohortOpIntersect && op != CohortOpDifference {
+		return nil, fmt.Errorf("不支持的集合运算 %s（union/intersect/difference）", op)
+	}
+	if len(operandNames) < 2 {
+		return nil, errors.New("集合运算至少需要两个队列")
+	}
+	operands := make([]*Cohort, 0, len(operandNames))
+	for _, operandName := range operandNames {
+		operand, err := GetCohort(store, orgId, strings.TrimSpace(operandName))
+		if err != nil {
+			return nil, err
+		}
+		if operand.Kind != CohortKindRowKey {
+			return nil, fmt.Errorf("队列 %s 的成员为交易ID，只能限定到分片，不能做集合运算", operand.Name)
+		}
+		if len(operands) > 0 && operand.Definition.DomainName != operands[0].Definition.DomainName {
+			return nil, fmt.Errorf("队列 %s 与 %s 属于不同的数据域，不能做集合运算", operand.Name, operands[0].Name)
+		}
+		operands = append(operands, operand)
+	}
+
+	definition := CohortDefinition{Source: op, DomainName: operands[0].Definition.DomainName}
+	keyField := operands[0].KeyField
+	members := make(map[string]bool, len(operands[0].Members))
+	for _, member := range operands[0].Members {
+		members[member] = true
+	}
+	for i, operand := range operands {
+		definition.Operands = append(definition.Operands, CohortOperand{Name: operand.Name, Hash: operand.Hash})
+		if operand.KeyField != keyField {
+			keyField = ""
+		}
+		if i == 0 {
+			continue
+		}
+		operandMembers := make(map[string]bool, len(operand.Members))
+		for _, member := range operand.Members {
+			operandMembers[member] = true
+		}
+		switch op {
+		case CohortOpUnion:
+			for member := range operandMembers {
+				members[member] = true
+			}
+		case CohortOpIntersect:
+			for member := range members {
+				if !operandMembers[member] {
+					delete(members, member)
+				}
+			}
+		case CohortOpDifference:
+			for member := range operandMembers {
+				delete(members, member)
+			}
+		}
+	}
+
+	result := make([]string, 0, len(members))
+	for member := range members {
+		result = append(result, member)
+	}
+	return CreateCohort(store, name, orgId, uid, operands[0].Kind, keyField, result, definition)
+}
+
+/**
+ * CohortRowKeys 从查询结果中取出某一列的值，作为rowKey队列的成员（空值跳过）
+ * @param queryResult 查询结果（JSON字符串）
+ * @param keyField 查询结果中的列名
+ * @return []string 列的值
+ * @return error 查询失败或结果中没有该列时返回错误
+ */
+func CohortRowKeys(queryResult string, keyField string) ([]string, error) {
+	if keyField == "" {
+		return nil, errors.New("keyField 不能为空")
+	}
+	var queryResultData QueryResult
+	if err := json.Unmarshal([]byte(queryResult), &queryResultData); err != nil {
+		return nil, errors.New("解析查询结果失败: " + err.Error())
+	}
+	if queryResultData.Counts == -1 {
+		return nil, errors.New("查询失败: " + queryResultData.Message)
+	}
+	keys := make([]string, 0, len(queryResultData.Data))
+	for _, row := range queryResultData.Data {
+		rowData, ok := row.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("查询结果不是行数据，不能保存为队列")
+		}
+		value, exists := rowData[keyField]
+		if !exists {
+			return nil, fmt.Errorf("查询结果中没有列 %s", keyField)
+		}
+		if value == nil {
+			continue
+		}
+		if text, ok := value.(string); ok {
+			keys = append(keys, text)
+			continue
+		}
+		keys = append(keys, fmt.Sprint(value))
+	}
+	return keys, nil
+}
+
+/**
+ * VerifyCohortAnchor 校验链上锚定的哈希与队列的定义和成员一致（防止服务端存储的队列被篡改）
+ * @param contractName 合约名
+ * @param chainServiceUrl 链服务地址
+ * @param cohort 队列
+ * @return error 读取链上哈希失败或哈希不一致时返回错误
+ */
+func VerifyCohortAnchor(contractName string, chainServiceUrl string, cohort *Cohort) error {
+	anchorJSON, err := GetCohortAnchor(contractName, chainServiceUrl, cohort.OrgId, cohort.Name, cohort.Hash)
+	if err != nil {
+		return errors.New("读取链上队列哈希失败: " + err.Error())
+	}
+	var anchor struct {
+		Hash       string `json:"hash"`
+		Definition string `json:"definition"`
+	}
+	if err := json.Unmarshal([]byte(anchorJSON), &anchor); err != nil {
+		return errors.New("链上队列哈希格式错误: " + err.Error())
+	}
+	if hash := CohortHash(cohort); anchor.Hash != hash || cohort.Hash != hash || anchor.Definition != cohort.AnchorDefinition() {
+		return fmt.Errorf("队列 %s 的内容与链上锚定的哈希不一致", cohort.Name)
+	}
+	return nil
+}
+
+/**
+ * RestrictQueryToCohort 把查询项限定在队列内
+ * @Description: rowKey队列在每个条件组中加入 数据集.field in 成员 的条件（没有条件时新建一个条件组）；
+ * txId队列把数据集中不是由队列中的交易上传的分片加入union.skipShards（不获取、不解密），只能用于索引查询得到的队列
+ * @param queryItem 查询项（JSON字符串）
+ * @param cohort 队列
+ * @param pos 限定的数据集（主CID），为空时为第一个数据集
+ * @param field rowKey队列匹配的列（数据集中的列名），为空时为队列的keyField
+ * @param lookup 获取交易上传的分片（txId队列使用）
+ * @return string 限定后的查询项
+ * @return error 错误信息
+ */
+func RestrictQueryToCohort(queryItem string, cohort *Cohort, pos string, field string, lookup CohortPoseLookup) (string, error) {
+	var queryItemData QueryItem
+	if err := json.Unmarshal([]byte(queryItem), &queryItemData); err != nil {
+		return "", errors.New("queryItem 格式错误: " + err.Error())
+	}
+	datasetIndex := -1
+	for i, filePoses := range queryItemData.FilePos {
+		if len(filePoses) > 0 && (filePoses[0] == pos || pos == "") {
+			datasetIndex = i
+			break
+		}
+	}
+	if datasetIndex == -1 {
+		return "", fmt.Errorf("查询项中没有数据集 %s", pos)
+	}
+	mainPos := queryItemData.FilePos[datasetIndex][0]
+
+	switch cohort.Kind {
+	case CohortKindRowKey:
+		if field == "" {
+			field = cohort.KeyField
+		}
+		if field == "" {
+			return "", errors.New("须指定队列成员匹配的列")
+		}
+		members, _ := json.Marshal(cohort.Members)
+		condition := QueryCondition{Field: field, Val: string(members), Pos: mainPos, Compare: "in", Type: "string"}
+		if len(queryItemData.QueryConditions) == 0 {
+			queryItemData.QueryConditions = [][]QueryCondition{{condition}}
+		} else {
+			for i := range queryItemData.QueryConditions {
+				queryItemData.QueryConditions[i] = append(queryItemData.QueryConditions[i], condition)
+			}
+		}
+	case CohortKindTxId:
+		// 按分片限定时同一分片中的其他行也会被读取，只有索引查询得到的队列（成员即整个上传）能按交易ID限定
+		if cohort.Definition.Source != CohortSourceSearch {
+			return "", fmt.Errorf("队列 %s 不是索引查询得到的交易ID队列，不能限定查询", cohort.Name)
+		}
+		if lookup == nil {
+			return "", errors.New("索引服务未初始化，不能按交易ID队列限定查询")
+		}
+		cohortPoses, err := lookup(cohort.Members)
+		if err != nil {
+			return "", errors.New("获取队列的分片失败: " + err.Error())
+		}
+		inCohort := make(map[string]bool, len(cohortPoses))
+		for _, cohortPos := range cohortPoses {
+			inCohort[cohortPos] = true
+		}
+		remaining := 0
+		for _, filePos := range queryItemData.FilePos[datasetIndex] {
+			if strIsInSlice(queryItemData.Union.SkipShards, filePos) {
+				continue
+			}
+			if inCohort[filePos] {
+				remaining++
+				continue
+			}
+			queryItemData.Union.SkipShards = append(queryItemData.Union.SkipShards, filePos)
+		}
+		if remaining == 0 {
+			return "", fmt.Errorf("数据集 %s 中没有队列 %s 的分片", mainPos, cohort.Name)
+		}
+	default:
+		return "", fmt.Errorf("不支持的队列成员类型 %s", cohort.Kind)
+	}
+
+	restricted, err := json.Marshal(queryItemData)
+	if err != nil {
+		return "", err
+	}
+	return string(restricted), nil
+}
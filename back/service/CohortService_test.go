@@ -0,0 +1,182 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestCohortStore 测试用的队列存储：同一数据域的rowKey队列a、b、c，其他数据域的队列d，以及txId队列t
+func newTestCohortStore(t *testing.T) CohortStore {
+	t.Helper()
+	store := &memoryCohortStore{cohorts: make(map[string][]byte)}
+	definition := CohortDefinition{Source: CohortSourceQuery, DomainName: "d1"}
+	cohorts := []struct {
+		name       string
+		kind       string
+		members    []string
+		definition CohortDefinition
+	}{
+		{"a", CohortKindRowKey, []string{"1", "2", "3", "4"}, definition},
+		{"b", CohortKindRowKey, []string{"3", "4", "5"}, definition},
+		{"c", CohortKindRowKey, []string{"4", "6"}, definition},
+		{"d", CohortKindRowKey, []string{"1"}, CohortDefinition{Source: CohortSourceQuery, DomainName: "d2"}},
+		{"t", CohortKindTxId, []string{"tx1"}, CohortDefinition{Source: CohortSourceSearch, DomainName: "d1"}},
+	}
+	for _, cohort := range cohorts {
+		if _, err := CreateCohort(store, cohort.name, "org1", "u1", cohort.kind, "id", cohort.members, cohort.definition); err != nil {
+			t.Fatalf("创建队列 %s 失败: %v", cohort.name, err)
+		}
+	}
+	return store
+}
+
+func TestCombineCohorts(t *testing.T) {
+	cases := []struct {
+		name     string
+		op       string
+		operands []string
+		want     []string
+		wantErr  string
+	}{
+		{"并集", CohortOpUnion, []string{"a", "b", "c"}, []string{"1", "2", "3", "4", "5", "6"}, ""},
+		{"交集", CohortOpIntersect, []string{"a", "b", "c"}, []string{"4"}, ""},
+		{"差集", CohortOpDifference, []string{"a", "b"}, []string{"1", "2"}, ""},
+		{"差集减去多个队列", CohortOpDifference, []string{"a", "b", "c"}, []string{"1", "2"}, ""},
+		{"重复的操作数", CohortOpIntersect, []string{"b", "c", "a", "b"}, []string{"4"}, ""},
+		{"不支持的运算", "xor", []string{"a", "b"}, nil, "不支持的集合运算"},
+		{"操作数不足", CohortOpUnion, []string{"a"}, nil, "至少需要两个队列"},
+		{"队列不存在", CohortOpUnion, []string{"a", "x"}, nil, "没有队列 x"},
+		{"不同数据域", CohortOpUnion, []string{"a", "d"}, nil, "不同的数据域"},
+		{"txId队列", CohortOpDifference, []string{"a", "t"}, nil, "不能做集合运算"},
+	}
+	for i, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newTestCohortStore(t)
+			cohort, err := CombineCohorts(store, tc.op, "r"+string(rune('a'+i)), "org1", "u1", tc.operands)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("err = %v，期望包含 %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CombineCohorts 失败: %v", err)
+			}
+			if !reflect.DeepEqual(cohort.Members, tc.want) || cohort.Counts != len(tc.want) {
+				t.Errorf("成员 = %v（%d个），期望 %v", cohort.Members, cohort.Counts, tc.want)
+			}
+			if cohort.Definition.Source != tc.op || cohort.Definition.DomainName != "d1" || len(cohort.Definition.Operands) != len(tc.operands) {
+				t.Errorf("定义 = %+v", cohort.Definition)
+			}
+			if cohort.Hash != CohortHash(cohort) {
+				t.Errorf("哈希与内容不一致")
+			}
+		})
+	}
+}
+
+func TestCreateCohortValidation(t *testing.T) {
+	definition := CohortDefinition{Source: CohortSourceQuery, DomainName: "d1"}
+	cases := []struct {
+		name    string
+		cohort  string
+		orgId   string
+		kind    string
+		wantErr string
+	}{
+		{"名称包含连续下划线", "a__b", "org1", CohortKindRowKey, "队列名称"},
+		{"名称为空", "", "org1", CohortKindRowKey, "队列名称"},
+		{"组织ID为空", "a", "", CohortKindRowKey, "orgId 不能为空"},
+		{"组织ID包含连续下划线", "a", "org__1", CohortKindRowKey, "orgId 不能包含连续两个下划线"},
+		{"成员类型不支持", "a", "org1", "other", "不支持的队列成员类型"},
+		{"已存在", "a", "org1", CohortKindRowKey, "已存在"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newTestCohortStore(t)
+			_, err := CreateCohort(store, tc.cohort, tc.orgId, "u1", tc.kind, "id", []string{"1"}, definition)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("err = %v，期望包含 %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCohortMembersNormalizedAndOwned(t *testing.T) {
+	store := newTestCohortStore(t)
+	cohort, err := CreateCohort(store, "n", "org1", "u1", CohortKindRowKey, "id", []string{"b", "", "a", "b"}, CohortDefinition{DomainName: "d1"})
+	if err != nil {
+		t.Fatalf("CreateCohort 失败: %v", err)
+	}
+	if !reflect.DeepEqual(cohort.Members, []string{"a", "b"}) {
+		t.Errorf("成员 = %v，期望去重、去空值并排序", cohort.Members)
+	}
+	// 其他组织看不到该队列
+	if _, err := GetCohort(store, "org2", "n"); err == nil {
+		t.Errorf("其他组织获取到了队列")
+	}
+	cohorts, err := ListCohorts(store, "org2")
+	if err != nil || len(cohorts) != 0 {
+		t.Errorf("其他组织列出队列 = %v, %v", cohorts, err)
+	}
+}
+
+func TestRestrictQueryToCohort(t *testing.T) {
+	store := newTestCohortStore(t)
+	queryItem := `{"queryConcatType":"single","filePos":[["S1","S2","S3"]],"queryConditions":[[{"field":"age","val":"30","pos":"S1","compare":"gt","type":"int"}],[{"field":"age","val":"10","pos":"S1","compare":"lt","type":"int"}]]}`
+
+	t.Run("rowKey队列在每个条件组中加入in条件", func(t *testing.T) {
+		cohort, _ := GetCohort(store, "org1", "b")
+		restricted, err := RestrictQueryToCohort(queryItem, cohort, "", "", nil)
+		if err != nil {
+			t.Fatalf("RestrictQueryToCohort 失败: %v", err)
+		}
+		var queryItemData QueryItem
+		json.Unmarshal([]byte(restricted), &queryItemData)
+		want := QueryCondition{Field: "id", Val: `["3","4","5"]`, Pos: "S1", Compare: "in", Type: "string"}
+		for i, group := range queryItemData.QueryConditions {
+			if len(group) != 2 || group[1] != want {
+				t.Errorf("条件组 %d = %+v", i, group)
+			}
+		}
+	})
+
+	t.Run("txId队列跳过不属于队列的分片", func(t *testing.T) {
+		cohort, _ := GetCohort(store, "org1", "t")
+		lookup := func(txIDs []string) ([]string, error) { return []string{"S2"}, nil }
+		restricted, err := RestrictQueryToCohort(queryItem, cohort, "S1", "", lookup)
+		if err != nil {
+			t.Fatalf("RestrictQueryToCohort 失败: %v", err)
+		}
+		var queryItemData QueryItem
+		json.Unmarshal([]byte(restricted), &queryItemData)
+		if !reflect.DeepEqual(queryItemData.Union.SkipShards, []string{"S1", "S3"}) {
+			t.Errorf("skipShards = %v，期望 [S1 S3]", queryItemData.Union.SkipShards)
+		}
+	})
+
+	errorCases := []struct {
+		name    string
+		cohort  *Cohort
+		pos     string
+		lookup  CohortPoseLookup
+		wantErr string
+	}{
+		{"数据集不存在", &Cohort{Name: "b", Kind: CohortKindRowKey, KeyField: "id"}, "X", nil, "没有数据集 X"},
+		{"rowKey队列没有匹配列", &Cohort{Name: "b", Kind: CohortKindRowKey}, "", nil, "须指定队列成员匹配的列"},
+		{"集合运算得到的txId队列", &Cohort{Name: "t", Kind: CohortKindTxId, Definition: CohortDefinition{Source: CohortOpDifference}}, "", nil, "不是索引查询得到的交易ID队列"},
+		{"索引服务未初始化", &Cohort{Name: "t", Kind: CohortKindTxId, Definition: CohortDefinition{Source: CohortSourceSearch}}, "", nil, "索引服务未初始化"},
+		{"没有队列的分片", &Cohort{Name: "t", Kind: CohortKindTxId, Definition: CohortDefinition{Source: CohortSourceSearch}}, "",
+			func(txIDs []string) ([]string, error) { return []string{"other"}, nil }, "没有队列 t 的分片"},
+	}
+	for _, tc := range errorCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := RestrictQueryToCohort(queryItem, tc.cohort, tc.pos, "", tc.lookup)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("err = %v，期望包含 %q", err, tc.wantErr)
+			}
+		})
+	}
+}
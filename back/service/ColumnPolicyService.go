@@ -0,0 +1,428 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ----------------列权限与脱敏（COLUMN POLICY）-------------------
+// 数据域策略中允许read的权限可以带列的允许/禁止列表和脱敏规则，合约按调用者的机构和角色合并为生效的列权限。
+// 查询时禁止的列不能被引用，也不会出现在结果中；脱敏的列返回前按规则脱敏，
+// 不能用于查询条件、连接条件、排序、分组、聚合（count除外）、计算列和列重命名，避免通过比较或派生值还原原始值。
+
+// 脱敏方式
+const (
+	MaskMethodHash    = "hash"    // 哈希（sha256，可加盐）
+	MaskMethodPartial = "partial" // 部分遮盖（保留前后若干字符，其余为*）
+	MaskMethodAgeBand = "ageBand" // 年龄分段（如 20-29）
+)
+
+// ColumnMask 列脱敏规则（与合约中的定义一致）
+type ColumnMask struct {
+	Column     string `json:"column"`               // 列名
+	Method     string `json:"method"`               // 脱敏方式：hash/partial/ageBand
+	KeepPrefix int    `json:"keepPrefix,omitempty"` // partial：保留的前缀字符数（前后都为0时保留1个前缀字符）
+	KeepSuffix int    `json:"keepSuffix,omitempty"` // partial：保留的后缀字符数
+	BandWidth  int    `json:"bandWidth,omitempty"`  // ageBand：每段的宽度，默认10
+	Salt       string `json:"salt,omitempty"`       // hash：盐
+}
+
+// ColumnPolicy 生效的列权限
+type ColumnPolicy struct {
+	AllowColumns []string         `json:"allowColumns"`        // 允许的列，为空时允许所有列
+	DenyColumns  []string         `json:"denyColumns"`         // 禁止的列（优先于允许的列）
+	Masks        []ColumnMask     `json:"masks"`               // 脱敏规则
+	Anonymity    *AnonymityPolicy `json:"anonymity,omitempty"` // 数据域的k-匿名策略
+}
+
+/**
+ * ParseColumnPolicy 解析合约返回的列权限，并校验脱敏规则
+ * @param policyJSON 列权限（JSON字符串）
+ * @return *ColumnPolicy 列权限，没有任何限制时为nil
+ * @return error 错误信息
+ */
+func ParseColumnPolicy(policyJSON string) (*ColumnPolicy, error) {
+	var policy ColumnPolicy
+	if err := json.Unmarshal([]byte(policyJSON), &policy); err != nil {
+		return nil, fmt.Errorf("列权限格式错误: %s", err)
+	}
+	for _, mask := range policy.Masks {
+		switch mask.Method {
+		case MaskMethodHash, MaskMethodPartial, MaskMethodAgeBand:
+		default:
+			return nil, fmt.Errorf("列 %s 的脱敏方式 %s 不支持（hash/partial/ageBand）", mask.Column, mask.Method)
+		}
+		if mask.KeepPrefix < 0 || mask.KeepSuffix < 0 || mask.BandWidth < 0 {
+			return nil, fmt.Errorf("列 %s 的脱敏参数不能为负数", mask.Column)
+		}
+	}
+	if err := policy.Anonymity.validate(); err != nil {
+		return nil, err
+	}
+	if policy.IsEmpty() {
+		return nil, nil
+	}
+	return &policy, nil
+}
+
+/**
+ * IsEmpty 列权限是否没有任何限制
+ * @return bool 是否没有限制
+ */
+func (p *ColumnPolicy) IsEmpty() bool {
+	return p == nil || (len(p.AllowColumns) == 0 && len(p.DenyColumns) == 0 && len(p.Masks) == 0 && p.Anonymity == nil)
+}
+
+/**
+ * Summary 列权限的摘要，记录在查询日志中（不含哈希的盐），如 deny:idCard;name:hash;age:ageBand(10)
+ * @return string 摘要，没有限制时为空
+ */
+func (p *ColumnPolicy) Summary() string {
+	if p.IsEmpty() {
+		return ""
+	}
+	parts := make([]string, 0, len(p.Masks)+2)
+	if len(p.AllowColumns) > 0 {
+		parts = append(parts, "allow:"+strings.Join(p.AllowColumns, ","))
+	}
+	if len(p.DenyColumns) > 0 {
+		parts = append(parts, "deny:"+strings.Join(p.DenyColumns, ","))
+	}
+	for _, mask := range p.Masks {
+		parts = append(parts, mask.describe())
+	}
+	return strings.Join(parts, ";")
+}
+
+/**
+ * Fingerprint 列权限的指纹（含哈希的盐），用于区分不同列权限下的缓存结果
+ * @return string 十六进制sha256，没有限制时为空
+ */
+func (p *ColumnPolicy) Fingerprint() string {
+	if p.IsEmpty() {
+		return ""
+	}
+	content, _ := json.Marshal(p)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+type columnPolicyKey struct{}
+
+/**
+ * WithColumnPolicy 把列权限附加到查询的context上，查询时按其过滤和脱敏结果列
+ * @param ctx 查询的context
+ * @param policy 列权限，为nil时不限制
+ * @return context.Context 新的context
+ */
+func WithColumnPolicy(ctx context.Context, policy *ColumnPolicy) context.Context {
+	if policy.IsEmpty() {
+		return ctx
+	}
+	return context.WithValue(ctx, columnPolicyKey{}, policy)
+}
+
+/**
+ * columnPolicyFromContext 获取context上的列权限
+ * @param ctx 查询的context
+ * @return *ColumnPolicy 列权限，没有时为nil
+ */
+func columnPolicyFromContext(ctx context.Context) *ColumnPolicy {
+	if ctx == nil {
+		return nil
+	}
+	policy, _ := ctx.Value(columnPolicyKey{}).(*ColumnPolicy)
+	return policy
+}
+
+// columnRules 一次查询中生效的列规则（列权限加上该查询的计算列），为nil时不限制
+type columnRules struct {
+	policy   *ColumnPolicy
+	computed map[string]bool // 计算列的列名：不受允许列表限制（引用的列已校验）
+}
+
+/**
+ * newColumnRules 校验查询项对列的引用是否符合列权限，返回结果列的规则
+ * @param queryItemData 查询项（列权限由GetQueryResultContext/StreamQuery设置）
+ * @return *columnRules 列规则，没有列权限时为nil
+ * @return error 引用了禁止的列或以不允许的方式使用脱敏列时返回错误
+ */
+func newColumnRules(queryItemData QueryItem) (*columnRules, error) {
+	if queryItemData.columnPolicy.IsEmpty() {
+		return nil, nil
+	}
+	rules := &columnRules{policy: queryItemData.columnPolicy, computed: make(map[string]bool)}
+	for _, computedColumn := range queryItemData.ComputedColumns {
+		rules.computed[computedColumn.Alias] = true
+	}
+
+	for _, conditions := range queryItemData.QueryConditions {
+		for _, condition := range conditions {
+			if err := rules.checkDerived(condition.Field, "查询条件"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, joint := range queryItemData.JointConditions {
+		for _, field := range []string{joint.Field1, joint.Field2} {
+			if err := rules.checkDerived(field, "连接条件"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, groupBy := range queryItemData.GroupBy {
+		if err := rules.checkDerived(groupBy.Field, "分组"); err != nil {
+			return nil, err
+		}
+	}
+	for _, aggregate := range queryItemData.Aggregates {
+		if aggregate.Field == "" || aggregate.Field == "*" {
+			continue
+		}
+		if strings.ToLower(aggregate.Func) == "count" {
+			if rules.hidden(aggregate.Field) {
+				return nil, fmt.Errorf("无权访问列 %s", aggregate.Field)
+			}
+			continue
+		}
+		if err := rules.checkDerived(aggregate.Field, "聚合"); err != nil {
+			return nil, err
+		}
+	}
+	for _, orderBy := range queryItemData.OrderBy {
+		// Pos为空时按聚合结果排序
+		if orderBy.Pos == "" {
+			continue
+		}
+		if err := rules.checkDerived(orderBy.Field, "排序"); err != nil {
+			return nil, err
+		}
+	}
+	if len(queryItemData.ComputedColumns) > 0 && len(queryItemData.FilePos) > 0 && len(queryItemData.FilePos[0]) > 0 {
+		plans, err := compileComputedColumns(queryItemData.ComputedColumns, queryItemData.FilePos[0][0], false)
+		if err != nil {
+			return nil, err
+		}
+		for _, plan := range plans {
+			for _, ref := range plan.refs {
+				if err := rules.checkDerived(headerField(ref), "计算列"); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	for _, mapping := range queryItemData.Union.ColumnMapping {
+		for from, to := range mapping {
+			for _, field := range []string{from, to} {
+				if err := rules.checkDerived(field, "列重命名"); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	// 明确要求返回禁止的列时报错（pos_*中的禁止列直接不返回）
+	for _, returnField := range queryItemData.ReturnField {
+		if field := headerField(returnField); field != "*" && rules.hidden(field) {
+			return nil, fmt.Errorf("无权访问列 %s", field)
+		}
+	}
+	return rules, nil
+}
+
+/**
+ * headerField 带前缀的列名（pos_field）中的列名
+ * @param key 带前缀的列名
+ * @return string 列名
+ */
+func headerField(key string) string {
+	return strings.Join(strings.Split(key, "_")[1:], "_")
+}
+
+/**
+ * hidden 列是否不可见（被禁止，或有允许列表而不在其中）
+ * @param field 列名
+ * @return bool 是否不可见
+ */
+func (r *columnRules) hidden(field string) bool {
+	if r == nil {
+		return false
+	}
+	if strIsInSlice(r.policy.DenyColumns, field) {
+		return true
+	}
+	return len(r.policy.AllowColumns) > 0 && !strIsInSlice(r.policy.AllowColumns, field) && !r.computed[field]
+}
+
+/**
+ * mask 列的脱敏规则
+ * @param field 列名
+ * @return *ColumnMask 脱敏规则，没有时为nil
+ */
+func (r *columnRules) mask(field string) *ColumnMask {
+	if r == nil {
+		return nil
+	}
+	for i := range r.policy.Masks {
+		if r.policy.Masks[i].Column == field {
+			return &r.policy.Masks[i]
+		}
+	}
+	return nil
+}
+
+/**
+ * checkDerived 检查列能否用于比较或产生派生值（查询条件、连接条件、排序、分组、聚合、计算列、列重命名）：不可见和脱敏的列都不能
+ * @param field 列名
+ * @param usage 用途（用于错误信息）
+ * @return error 错误信息
+ */
+func (r *columnRules) checkDerived(field string, usage string) error {
+	if r.hidden(field) {
+		return fmt.Errorf("无权访问列 %s", field)
+	}
+	if r.mask(field) != nil {
+		return fmt.Errorf("列 %s 已脱敏，不能用于%s", field, usage)
+	}
+	return nil
+}
+
+/**
+ * partialKeep 部分遮盖保留的前后缀字符数
+ * @return int 前缀字符数
+ * @return int 后缀字符数
+ */
+func (m *ColumnMask) partialKeep() (int, int) {
+	if m.KeepPrefix == 0 && m.KeepSuffix == 0 {
+		return 1, 0
+	}
+	return m.KeepPrefix, m.KeepSuffix
+}
+
+/**
+ * bandWidth 年龄分段的宽度
+ * @return int 宽度
+ */
+func (m *ColumnMask) bandWidth() int {
+	if m.BandWidth <= 0 {
+		return 10
+	}
+	return m.BandWidth
+}
+
+/**
+ * describe 脱敏规则的描述（不含哈希的盐），如 age:ageBand(10)、diseaseCode:partial(3,0)
+ * @return string 描述
+ */
+func (m *ColumnMask) describe() string {
+	switch m.Method {
+	case MaskMethodPartial:
+		prefix, suffix := m.partialKeep()
+		return fmt.Sprintf("%s:partial(%d,%d)", m.Column, prefix, suffix)
+	case MaskMethodAgeBand:
+		return fmt.Sprintf("%s:ageBand(%d)", m.Column, m.bandWidth())
+	}
+	return m.Column + ":" + m.Method
+}
+
+/**
+ * apply 对单元格的值脱敏（空值不处理）
+ * @param value 单元格的值
+ * @return string 脱敏后的值
+ */
+func (m *ColumnMask) apply(value string) string {
+	switch m.Method {
+	case MaskMethodHash:
+		sum := sha256.Sum256([]byte(m.Salt + value))
+		return hex.EncodeToString(sum[:])
+	case MaskMethodPartial:
+		runes := []rune(value)
+		prefix, suffix := m.partialKeep()
+		if len(runes) <= prefix+suffix {
+			return strings.Repeat("*", len(runes))
+		}
+		return string(runes[:prefix]) + strings.Repeat("*", len(runes)-prefix-suffix) + string(runes[len(runes)-suffix:])
+	case MaskMethodAgeBand:
+		age, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return "*"
+		}
+		width := m.bandWidth()
+		low := int(math.Floor(age/float64(width))) * width
+		return fmt.Sprintf("%d-%d", low, low+width-1)
+	}
+	return value
+}
+
+/**
+ * FetchColumnPolicy 从链上获取角色读取数据域时生效的列权限
+ * @param contractName 合约名
+ * @param chainServiceUrl 链服务地址
+ * @param domainName 数据域名称
+ * @param orgId 组织ID
+ * @param role 角色
+ * @return *ColumnPolicy 列权限，没有任何限制时为nil
+ * @return error 错误信息
+ */
+func FetchColumnPolicy(contractName string, chainServiceUrl string, domainName string, orgId string, role string) (*ColumnPolicy, error) {
+	policyJSON, err := GetColumnPolicy(contractName, chainServiceUrl, domainName, orgId, role)
+	if err != nil {
+		return nil, err
+	}
+	return ParseColumnPolicy(policyJSON)
+}
+
+/**
+ * ResolveQueryDomain 确定查询的分片所属的数据域（列权限、脱敏和k-匿名按该数据域生效）
+ * 分片的数据域从索引服务的上传记录获取：不带数据域上传的分片不受数据域管控；
+ * 请求提供了数据域时，属于其他数据域的分片被拒绝；未提供时使用分片所属的数据域，无法确定时拒绝查询
+ * @param domainName 请求中的数据域名称，可为空
+ * @param poses 查询的所有分片CID
+ * @param lookup 获取分片上传记录的函数，索引服务未初始化时为nil
+ * @return string 查询生效的数据域名称，所有分片都不受数据域管控时为空
+ * @return error 无法确定数据域、分片属于其他数据域或多个数据域时返回错误
+ */
+func ResolveQueryDomain(domainName string, poses []string, lookup PosRecordLookup) (string, error) {
+	domainName = strings.TrimSpace(domainName)
+	if lookup == nil {
+		if domainName == "" {
+			return "", errors.New("索引服务未初始化，无法确定分片所属的数据域，须提供 domainName")
+		}
+		return domainName, nil
+	}
+	records, err := lookup(poses)
+	if err != nil {
+		return "", errors.New("获取分片的上传记录失败: " + err.Error())
+	}
+	resolved := ""
+	for _, pos := range poses {
+		record, ok := records[pos]
+		if !ok {
+			if domainName == "" {
+				return "", fmt.Errorf("无法确定分片 %s 所属的数据域（索引中没有上传记录），须提供 domainName", pos)
+			}
+			continue
+		}
+		if record.DomainID == "" {
+			continue
+		}
+		posDomain := strings.TrimPrefix(record.DomainID, "DOMAIN_")
+		if domainName != "" && posDomain != domainName {
+			return "", fmt.Errorf("分片 %s 属于数据域 %s，不属于请求的数据域 %s", pos, posDomain, domainName)
+		}
+		if resolved != "" && posDomain != resolved {
+			return "", errors.New("查询涉及多个数据域的分片，须分别查询（或使用联邦查询）")
+		}
+		resolved = posDomain
+	}
+	if domainName != "" {
+		return domainName, nil
+	}
+	return resolved, nil
+}
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"chainqa_offchain_demo/indexer"
+	"chainqa_offchain_demo/setting"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestColumnMaskApply(t *testing.T) {
+	cases := []struct {
+		name  string
+		mask  ColumnMask
+		value string
+		want  string
+	}{
+		{"partial默认保留1个前缀字符", ColumnMask{Method: MaskMethodPartial}, "张三丰", "张**"},
+		{"partial保留前后缀", ColumnMask{Method: MaskMethodPartial, KeepPrefix: 3, KeepSuffix: 1}, "E11.901", "E11***1"},
+		{"partial值过短时全部遮盖", ColumnMask{Method: MaskMethodPartial, KeepPrefix: 2, KeepSuffix: 2}, "abc", "***"},
+		{"ageBand默认宽度10", ColumnMask{Method: MaskMethodAgeBand}, "37", "30-39"},
+		{"ageBand指定宽度", ColumnMask{Method: MaskMethodAgeBand, BandWidth: 5}, "37.5", "35-39"},
+		{"ageBand不是数字", ColumnMask{Method: MaskMethodAgeBand}, "unknown", "*"},
+		{"hash加盐", ColumnMask{Method: MaskMethodHash, Salt: "s"}, "1", "e8bc163c82eee18733288c7d4ac636db3a6deb013ef2d37b68322be20edc45cc"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.mask.apply(tc.value); got != tc.want {
+				t.Errorf("apply(%q) = %q，期望 %q", tc.value, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseColumnPolicy(t *testing.T) {
+	cases := []struct {
+		name        string
+		policy      string
+		wantNil     bool
+		wantErr     string
+		wantSummary string
+	}{
+		{"没有限制", `{}`, true, "", ""},
+		{"脱敏规则", `{"masks":[{"column":"age","method":"ageBand"},{"column":"code","method":"partial","keepPrefix":3}]}`, false, "", "age:ageBand(10);code:partial(3,0)"},
+		{"格式错误", `{`, false, "列权限格式错误", ""},
+		{"不支持的脱敏方式", `{"masks":[{"column":"a","method":"drop"}]}`, false, "脱敏方式 drop 不支持", ""},
+		{"脱敏参数为负数", `{"masks":[{"column":"a","method":"partial","keepPrefix":-1}]}`, false, "不能为负数", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := ParseColumnPolicy(tc.policy)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("err = %v，期望包含 %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseColumnPolicy 失败: %v", err)
+			}
+			if (policy == nil) != tc.wantNil {
+				t.Fatalf("policy = %+v", policy)
+			}
+			if policy.Summary() != tc.wantSummary {
+				t.Errorf("summary = %q，期望 %q", policy.Summary(), tc.wantSummary)
+			}
+		})
+	}
+}
+
+func TestResolveQueryDomain(t *testing.T) {
+	records := map[string]indexer.PosRecord{
+		"a1": {DomainID: "DOMAIN_d1"},
+		"a2": {DomainID: "DOMAIN_d1"},
+		"b1": {DomainID: "DOMAIN_d2"},
+		"u1": {},
+	}
+	lookup := func(poses []string) (map[string]indexer.PosRecord, error) {
+		result := make(map[string]indexer.PosRecord)
+		for _, pos := range poses {
+			if record, ok := records[pos]; ok {
+				result[pos] = record
+			}
+		}
+		return result, nil
+	}
+	failing := func(poses []string) (map[string]indexer.PosRecord, error) {
+		return nil, errors.New("redis不可用")
+	}
+	cases := []struct {
+		name       string
+		domainName string
+		poses      []string
+		lookup     PosRecordLookup
+		want       string
+		wantErr    string
+	}{
+		{"按分片确定数据域", "", []string{"a1", "a2"}, lookup, "d1", ""},
+		{"不受管控的分片", "", []string{"u1"}, lookup, "", ""},
+		{"受管控与不受管控的分片混合", "", []string{"u1", "a1"}, lookup, "d1", ""},
+		{"请求的数据域与分片一致", " d1 ", []string{"a1", "u1"}, lookup, "d1", ""},
+		{"请求的数据域下没有记录的分片", "d1", []string{"a1", "x"}, lookup, "d1", ""},
+		{"分片属于其他数据域", "d1", []string{"a1", "b1"}, lookup, "", "属于数据域 d2"},
+		{"多个数据域", "", []string{"a1", "b1"}, lookup, "", "多个数据域"},
+		{"没有上传记录", "", []string{"a1", "x"}, lookup, "", "无法确定分片 x 所属的数据域"},
+		{"索引服务未初始化", "", []string{"a1"}, nil, "", "索引服务未初始化"},
+		{"索引服务未初始化但提供了数据域", "d1", []string{"a1"}, nil, "d1", ""},
+		{"获取上传记录失败", "d1", []string{"a1"}, failing, "", "获取分片的上传记录失败"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			domainName, err := ResolveQueryDomain(tc.domainName, tc.poses, tc.lookup)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("err = %v，期望包含 %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil || domainName != tc.want {
+				t.Errorf("ResolveQueryDomain = %q, %v，期望 %q", domainName, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestColumnPolicyQuery(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	shards := map[string]string{
+		"CP": "id\tage\tname\tidCard\n1\t37\tann\t110\n2\t52\tbob\t120\n",
+		"CQ": "id\tcity\n1\tx\n",
+	}
+	policy := &ColumnPolicy{
+		DenyColumns: []string{"idCard"},
+		Masks:       []ColumnMask{{Column: "age", Method: MaskMethodAgeBand}, {Column: "name", Method: MaskMethodPartial}},
+	}
+	ctx := WithColumnPolicy(context.Background(), policy)
+	single := func(queryItemData QueryItem) QueryItem {
+		queryItemData.QueryConcatType = "single"
+		queryItemData.FilePos = [][]string{{"CP"}}
+		return queryItemData
+	}
+	cases := []struct {
+		name      string
+		queryItem QueryItem
+		want      string // 结果行，或期望包含的错误信息
+		wantOK    bool
+	}{
+		{"返回脱敏后的值，禁止的列不返回", single(QueryItem{ReturnField: []string{"CP_*"}}),
+			`[{"age":"30-39","id":"1","name":"a**"},{"age":"50-59","id":"2","name":"b**"}]`, true},
+		{"count可以使用脱敏列", single(QueryItem{Aggregates: []AggregateItem{{Func: "count", Pos: "CP", Field: "age", Type: "string"}}}), `"count(age)":"2"`, true},
+		{"明确返回禁止的列", single(QueryItem{ReturnField: []string{"CP_idCard"}}), "无权访问列 idCard", false},
+		{"禁止的列用于查询条件", single(QueryItem{ReturnField: []string{"CP_id"},
+			QueryConditions: [][]QueryCondition{{{Pos: "CP", Field: "idCard", Val: "110", Compare: "eq", Type: "string"}}}}), "无权访问列 idCard", false},
+		{"脱敏列按分段比较", single(QueryItem{ReturnField: []string{"CP_id"},
+			QueryConditions: [][]QueryCondition{{{Pos: "CP", Field: "age", Val: "37", Compare: "eq", Type: "int"}}}}), "列 age 已脱敏，不能用于查询条件", false},
+		{"脱敏列前缀匹配", single(QueryItem{ReturnField: []string{"CP_id"},
+			QueryConditions: [][]QueryCondition{{{Pos: "CP", Field: "name", Val: "an", Compare: "prefix", Type: "string"}}}}), "列 name 已脱敏，不能用于查询条件", false},
+		{"脱敏列排序", single(QueryItem{ReturnField: []string{"CP_id"}, OrderBy: []OrderByItem{{Pos: "CP", Field: "age", Type: "int"}}}), "列 age 已脱敏，不能用于排序", false},
+		{"脱敏列分组", single(QueryItem{GroupBy: []GroupByItem{{Pos: "CP", Field: "age", Type: "int"}}}), "列 age 已脱敏，不能用于分组", false},
+		{"脱敏列求和", single(QueryItem{Aggregates: []AggregateItem{{Func: "sum", Pos: "CP", Field: "age", Type: "int"}}}), "列 age 已脱敏，不能用于聚合", false},
+		{"脱敏列用于计算列", single(QueryItem{ReturnField: []string{"CP_x"}, ComputedColumns: []ComputedColumn{{Alias: "x", Expr: "age + 0"}}}), "列 age 已脱敏，不能用于计算列", false},
+		{"脱敏列用于列重命名", single(QueryItem{ReturnField: []string{"CP_id"}, Union: UnionOptions{ColumnMapping: map[string]map[string]string{"*": {"name": "n"}}}}), "列 name 已脱敏，不能用于列重命名", false},
+		{"脱敏列用于连接条件", QueryItem{QueryConcatType: "multi", FilePos: [][]string{{"CP"}, {"CQ"}}, ReturnField: []string{"CQ_city"},
+			JointConditions: []JointCondition{{Pos1: "CP", Field1: "name", Pos2: "CQ", Field2: "city", Compare: "eq", Type: "string", JointType: "INNER"}}}, "列 name 已脱敏，不能用于连接条件", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			queryItem, _ := json.Marshal(tc.queryItem)
+			queryResult, counts, err := GetQueryResultContext(ctx, string(queryItem), shards, QueryLimits{})
+			if err != nil || (counts != -1) != tc.wantOK {
+				t.Fatalf("查询结果 = %s, %v", queryResult, err)
+			}
+			if !tc.wantOK {
+				if !strings.Contains(queryResult, tc.want) {
+					t.Errorf("结果 = %s，期望包含 %s", queryResult, tc.want)
+				}
+				return
+			}
+			var queryResultData QueryResult
+			_ = json.Unmarshal([]byte(queryResult), &queryResultData)
+			rows, _ := json.Marshal(queryResultData.Data)
+			if !strings.Contains(string(rows), tc.want) {
+				t.Errorf("结果 = %s，期望 %s", rows, tc.want)
+			}
+		})
+	}
+}
+
+func TestColumnPolicyFingerprint(t *testing.T) {
+	var empty *ColumnPolicy
+	masked := &ColumnPolicy{Masks: []ColumnMask{{Column: "name", Method: MaskMethodHash, Salt: "s1"}}}
+	resalted := &ColumnPolicy{Masks: []ColumnMask{{Column: "name", Method: MaskMethodHash, Salt: "s2"}}}
+	denied := &ColumnPolicy{DenyColumns: []string{"name"}}
+	if empty.Fingerprint() != "" || (&ColumnPolicy{}).Fingerprint() != "" {
+		t.Errorf("没有限制的列权限的指纹应为空")
+	}
+	if masked.Fingerprint() != (&ColumnPolicy{Masks: []ColumnMask{{Column: "name", Method: MaskMethodHash, Salt: "s1"}}}).Fingerprint() {
+		t.Errorf("相同的列权限指纹不同")
+	}
+	// 盐不同时结果不同，指纹也不同（摘要中不含盐）
+	if masked.Fingerprint() == resalted.Fingerprint() || masked.Summary() != resalted.Summary() {
+		t.Errorf("盐不同: 指纹 %s / %s，摘要 %s / %s", masked.Fingerprint(), resalted.Fingerprint(), masked.Summary(), resalted.Summary())
+	}
+	if masked.Fingerprint() == denied.Fingerprint() {
+		t.Errorf("不同的列权限指纹相同")
+	}
+}
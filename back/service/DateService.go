@@ -0,0 +1,167 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // 编入时区数据库：运行镜像中没有zoneinfo时，time_zone等时区仍可加载
+
+	"chainqa_offchain_demo/setting"
+)
+
+// ----------------日期类型（DATE / DATETIME）-------------------
+
+// 内置的日期输入格式（Go layout），按顺序尝试
+var defaultDateLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	"2006/1/2 15:04:05",
+	"2006/1/2 15:04",
+	"2006-1-2",
+	"2006/1/2",
+	"2006.1.2",
+	"20060102",
+	"2006年1月2日",
+}
+
+// 输出格式：日期与日期时间统一按以下格式返回
+const (
+	dateOutputLayout     = "2006-01-02"
+	datetimeOutputLayout = "2006-01-02 15:04:05"
+)
+
+// DateOptions 日期解析选项（可在查询项中覆盖配置文件的默认值）
+type DateOptions struct {
+	Layouts  []string `json:"layouts"`  // 输入格式（Go layout），为空时使用配置文件或内置格式
+	TimeZone string   `json:"timeZone"` // 时区，如 Asia/Shanghai；为空时使用配置文件或本地时区
+}
+
+// DateParser 日期解析器：按给定格式和时区解析单元格
+type DateParser struct {
+	layouts  []string
+	location *time.Location
+}
+
+/**
+ * NewDateParser 创建日期解析器
+ * @param opts 查询项中的日期选项，未设置的部分依次回落到配置文件、内置默认值
+ * @return *DateParser 日期解析器
+ * @return error 错误信息（时区不存在等）
+ */
+func NewDateParser(opts DateOptions) (*DateParser, error) {
+	layouts := opts.Layouts
+	if len(layouts) == 0 {
+		layouts = setting.Conf.Query.DateLayouts
+	}
+	if len(layouts) == 0 {
+		layouts = defaultDateLayouts
+	}
+
+	timeZone := opts.TimeZone
+	if timeZone == "" {
+		timeZone = setting.Conf.Query.TimeZone
+	}
+	location := time.Local
+	if timeZone != "" {
+		loc, err := time.LoadLocation(timeZone)
+		if err != nil {
+			return nil, fmt.Errorf("时区 %s 不存在: %s", timeZone, err)
+		}
+		location = loc
+	}
+	return &DateParser{layouts: layouts, location: location}, nil
+}
+
+/**
+ * Parse 解析日期时间，不带时区的值按解析器时区理解，带时区的值转换到解析器时区
+ * @param value 单元格值或基准值
+ * @return time.Time 解析结果
+ * @return error 错误信息
+ */
+func (p *DateParser) Parse(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range p.layouts {
+		t, err := time.ParseInLocation(layout, value, p.location)
+		if err == nil {
+			return t.In(p.location), nil
+		}
+	}
+	// 兼容链上的秒级时间戳，如 1735693850
+	if len(value) == 10 {
+		if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return time.Unix(sec, 0).In(p.location), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%s 无法按日期格式 %v 解析", value, p.layouts)
+}
+
+/**
+ * ParseAs 按类型解析：date类型截断到当天0点，datetime类型保留时分秒
+ * @param value 单元格值或基准值
+ * @param cellType 类型（date/datetime）
+ * @return time.Time 解析结果
+ * @return error 错误信息
+ */
+func (p *DateParser) ParseAs(value string, cellType string) (time.Time, error) {
+	t, err := p.Parse(value)
+	if err != nil {
+		return t, err
+	}
+	if cellType == "date" {
+		year, month, day := t.Date()
+		t = time.Date(year, month, day, 0, 0, 0, 0, p.location)
+	}
+	return t, nil
+}
+
+/**
+ * Format 按类型输出统一格式的字符串
+ * @param t 时间
+ * @param cellType 类型（date/datetime）
+ * @return string 格式化结果
+ */
+func (p *DateParser) Format(t time.Time, cellType string) string {
+	if cellType == "date" {
+		return t.In(p.location).Format(dateOutputLayout)
+	}
+	return t.In(p.location).Format(datetimeOutputLayout)
+}
+
+/**
+ * Bucket 日期分桶，用于GROUP BY
+ * @param t 时间
+ * @param bucket 分桶粒度（day/week/month/quarter/year），为空时按天
+ * @return string 分桶键，如 2024-03、2024-Q1、2024-W09
+ * @return error 错误信息
+ */
+func (p *DateParser) Bucket(t time.Time, bucket string) (string, error) {
+	t = t.In(p.location)
+	switch bucket {
+	case "", "day":
+		return t.Format(dateOutputLayout), nil
+	case "week":
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week), nil
+	case "month":
+		return t.Format("2006-01"), nil
+	case "quarter":
+		return fmt.Sprintf("%d-Q%d", t.Year(), (int(t.Month())-1)/3+1), nil
+	case "year":
+		return t.Format("2006"), nil
+	default:
+		return "", errors.New("不支持的日期分桶粒度: " + bucket)
+	}
+}
+
+/**
+ * isDateType 判断类型是否为日期类型
+ * @param cellType 类型
+ * @return bool 是否为date/datetime
+ */
+func isDateType(cellType string) bool {
+	return cellType == "date" || cellType == "datetime"
+}
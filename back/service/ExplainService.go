@@ -0,0 +1,401 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ----------------查询计划（EXPLAIN）-------------------
+// 只使用分片的表头（已缓存的表结构或请求中提供的表头）校验查询项，不获取分片、不获取AES密钥、不上链日志。
+
+// ExplainShard 分片的表结构来源
+type ExplainShard struct {
+	Pos      string `json:"pos"`      // 分片位置（CID）
+	Known    bool   `json:"known"`    // 是否有表头（缓存或请求中提供）
+	RowCount int    `json:"rowCount"` // 行数，-1表示未知
+}
+
+// ExplainDataset 数据集
+type ExplainDataset struct {
+	Pos           string         `json:"pos"`           // 数据集主CID
+	Columns       []string       `json:"columns"`       // 列名
+	Shards        []ExplainShard `json:"shards"`        // 分片
+	EstimatedRows int            `json:"estimatedRows"` // 估计行数（各分片行数之和），-1表示未知
+}
+
+// ExplainJoinStep 联表步骤
+type ExplainJoinStep struct {
+	Pos1            string           `json:"pos1"`            // 数据集1
+	Pos2            string           `json:"pos2"`            // 数据集2
+	JointConditions []JointCondition `json:"jointConditions"` // 联表条件（多个为复合键）
+	PostJoinFilter  bool             `json:"postJoinFilter"`  // 是否为联表后的过滤条件（形成环的联表条件）
+	EstimatedRows   int              `json:"estimatedRows"`   // 本步之后的估计行数，-1表示未知
+}
+
+// ExplainResult 查询计划
+type ExplainResult struct {
+	Valid           bool              `json:"valid"`           // 查询项是否通过校验
+	QueryConcatType string            `json:"queryConcatType"` // 查询类型
+	Datasets        []ExplainDataset  `json:"datasets"`        // 数据集
+	JoinOrder       []ExplainJoinStep `json:"joinOrder"`       // 联表顺序（联表后的过滤条件在最后）
+	EstimatedRows   int               `json:"estimatedRows"`   // 参与过滤的估计行数（联表查询为联表后的行数），-1表示未知
+	Errors          []string          `json:"errors"`          // 错误信息
+}
+
+/**
+ * ExplainQuery 校验查询项并生成查询计划：校验查询条件、联表条件、返回列、分组聚合排序，给出联表顺序和估计行数
+ * @param queryItem 查询项（JSON字符串）
+ * @param schemas 请求中提供的表头：分片CID -> 列名，优先于缓存
+ * @return ExplainResult 查询计划（Errors为空时Valid为true）
+ */
+func ExplainQuery(queryItem string, schemas map[string][]string) ExplainResult {
+	result := ExplainResult{EstimatedRows: -1, Errors: make([]string, 0)}
+	addError := func(format string, args ...interface{}) {
+		result.Errors = append(result.Errors, fmt.Sprintf(format, args...))
+	}
+
+	var queryItemData QueryItem
+	if err := json.Unmarshal([]byte(queryItem), &queryItemData); err != nil {
+		addError("解析查询条件失败:%s", err)
+		return result
+	}
+	result.QueryConcatType = queryItemData.QueryConcatType
+	isMulti := queryItemData.QueryConcatType == "multi"
+	isUnion := queryItemData.QueryConcatType == "union"
+	if !isMulti && !isUnion && queryItemData.QueryConcatType != "single" {
+		addError("查询类型错误，不支持类型：%s", queryItemData.QueryConcatType)
+		return result
+	}
+	if len(queryItemData.FilePos) == 0 {
+		addError("filePos 不能为空")
+		return result
+	}
+	if queryItemData.QueryConcatType == "single" && len(queryItemData.FilePos) > 1 {
+		addError("单表查询只能有一个数据集，当前有%d个", len(queryItemData.FilePos))
+	}
+
+	dateParser, err := NewDateParser(queryItemData.DateOptions)
+	if err != nil {
+		addError("%s", err)
+		return result
+	}
+	if err := checkTypeWidening(queryItemData.Union.TypeWidening); err != nil {
+		addError("%s", err)
+	}
+
+	// 数据集表结构：各分片按列重命名映射改名后按列名合并，行数为各分片之和
+	tableMap := make(map[string]*Table)
+	rowCounts := make(map[string]int)
+	allKnown := true
+	for idx, filePosesSingleDataSet := range queryItemData.FilePos {
+		if len(filePosesSingleDataSet) == 0 {
+			addError("第%d个数据集没有分片", idx+1)
+			allKnown = false
+			continue
+		}
+		mainPos := filePosesSingleDataSet[0]
+		dataset := ExplainDataset{Pos: mainPos, EstimatedRows: 0}
+		var columns []string
+		seen := make(map[string]bool)
+		for _, filePos := range filePosesSingleDataSet {
+			shard := ExplainShard{Pos: filePos, RowCount: -1}
+			shardColumns, supplied := schemas[filePos]
+			if schema, ok := LookupSchema(filePos); ok {
+				shard.RowCount = schema.RowCount
+				if !supplied {
+					shardColumns = schema.Columns
+				}
+			}
+			shard.Known = supplied || shard.RowCount >= 0
+			dataset.Shards = append(dataset.Shards, shard)
+			if !shard.Known {
+				dataset.EstimatedRows = -1
+				addError("分片%s的表头未缓存（上传或查询过一次后会缓存，也可以在schemas中提供）", filePos)
+				continue
+			}
+			mapping := shardColumnMapping(queryItemData.Union, filePos)
+			for _, column := range shardColumns {
+				if to, ok := mapping[column]; ok && to != "" {
+					column = to
+				}
+				if !seen[column] {
+					seen[column] = true
+					columns = append(columns, column)
+				}
+			}
+			if shard.RowCount < 0 || dataset.EstimatedRows < 0 {
+				dataset.EstimatedRows = -1
+			} else {
+				dataset.EstimatedRows += shard.RowCount
+			}
+		}
+		if columns == nil {
+			allKnown = false
+			dataset.EstimatedRows = -1
+		} else {
+			dataset.Columns = columns
+			tableMap[mainPos] = newTable(mainPos, columns)
+		}
+		rowCounts[mainPos] = dataset.EstimatedRows
+		result.Datasets = append(result.Datasets, dataset)
+	}
+
+	// union查询：所有数据集按列名合并为第一个数据集的表
+	if isUnion && allKnown && len(result.Datasets) == len(queryItemData.FilePos) {
+		mainPos := result.Datasets[0].Pos
+		columns := make([]string, 0)
+		seen := make(map[string]bool)
+		estimatedRows := 0
+		for _, dataset := range result.Datasets {
+			for _, column := range dataset.Columns {
+				if !seen[column] {
+					seen[column] = true
+					columns = append(columns, column)
+				}
+			}
+			if dataset.EstimatedRows < 0 || estimatedRows < 0 {
+				estimatedRows = -1
+			} else {
+				estimatedRows += dataset.EstimatedRows
+			}
+		}
+		tableMap = map[string]*Table{mainPos: newTable(mainPos, columns)}
+		rowCounts[mainPos] = estimatedRows
+		rebaseUnionQuery(&queryItemData)
+	} else if isUnion {
+		// 有数据集的表头未知时不校验列
+		allKnown = false
+		tableMap = make(map[string]*Table)
+	}
+
+	// 计算列：编译表达式，校验引用的列，并把计算列加入所属数据集的表头（未知表头的数据集不校验）
+	if len(queryItemData.ComputedColumns) > 0 && len(result.Datasets) > 0 {
+		plans, err := compileComputedColumns(queryItemData.ComputedColumns, result.Datasets[0].Pos, isUnion)
+		if err != nil {
+			addError("%s", err)
+		}
+		for _, plan := range plans {
+			for _, ref := range plan.refs {
+				for pos, table := range tableMap {
+					if _, ok := table.HeaderMap[ref]; !ok && strings.HasPrefix(ref, pos+"_") {
+						addError("计算列%s中的列%s不存在", plan.Alias, strings.TrimPrefix(ref, pos+"_"))
+					}
+				}
+			}
+			if table, ok := tableMap[plan.Pos]; ok {
+				if _, exists := table.HeaderMap[plan.column]; exists {
+					addError("计算列%s与已有列重名", plan.Alias)
+					continue
+				}
+				table.HeaderMap[plan.column] = len(table.Columns)
+				table.Columns = append(table.Columns, plan.column)
+			}
+		}
+	}
+
+	// 参与查询的表头：单表为第一个数据集，联表为所有数据集
+	headerMap := make(map[string]int)
+	for _, dataset := range result.Datasets {
+		if table, ok := tableMap[dataset.Pos]; ok {
+			for key := range table.HeaderMap {
+				headerMap[key] = len(headerMap)
+			}
+		}
+		if !isMulti {
+			break
+		}
+	}
+	knownPos := func(pos string) bool {
+		if isMulti {
+			_, ok := tableMap[pos]
+			return ok
+		}
+		return len(result.Datasets) > 0 && pos == result.Datasets[0].Pos && tableMap[pos] != nil
+	}
+	isDatasetPos := func(pos string) bool {
+		for idx, dataset := range result.Datasets {
+			if dataset.Pos == pos && (isMulti || isUnion || idx == 0) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// 联表条件：拓扑排序得到联表顺序，并估计每步的行数
+	if isMulti {
+		for idx, jointCondition := range queryItemData.JointConditions {
+			if err := validateJointCondition(jointCondition, tableMap, isDatasetPos); err != nil {
+				addError("第%d个联表条件错误: %s", idx+1, err)
+			}
+		}
+		jointGroups, postJoinFilters, err := PlanJointGroups(queryItemData.JointConditions)
+		if err != nil {
+			addError("%s", err)
+		} else {
+			joined := make(map[string]bool)
+			for _, jointGroup := range jointGroups {
+				joined[jointGroup.Pos1], joined[jointGroup.Pos2] = true, true
+			}
+			for _, dataset := range result.Datasets {
+				if !joined[dataset.Pos] {
+					addError("数据集%s没有联表条件，存在未联表的数据集", dataset.Pos)
+				}
+			}
+			result.JoinOrder, result.EstimatedRows = estimateJoinOrder(jointGroups, postJoinFilters, rowCounts)
+		}
+	} else if len(result.Datasets) > 0 {
+		result.EstimatedRows = rowCounts[result.Datasets[0].Pos]
+	}
+
+	// 查询条件：逐个校验，未知表头的数据集只校验列以外的部分
+	for groupIdx, conditionGroup := range queryItemData.QueryConditions {
+		for condIdx, condition := range conditionGroup {
+			if !isDatasetPos(condition.Pos) {
+				addError("第%d组第%d个%s错误: 数据集 %s 不在查询的数据集中", groupIdx+1, condIdx+1, describeCondition(condition), condition.Pos)
+				continue
+			}
+			conditionHeaderMap := headerMap
+			if !knownPos(condition.Pos) {
+				conditionHeaderMap = map[string]int{condition.Pos + "_" + condition.Field: 0}
+			}
+			if err := validateQueryCondition(condition, conditionHeaderMap, dateParser); err != nil {
+				addError("第%d组第%d个%s错误: %s", groupIdx+1, condIdx+1, describeCondition(condition), err)
+			}
+		}
+	}
+
+	// 返回列（分组聚合查询忽略返回列）
+	if len(queryItemData.GroupBy) == 0 && len(queryItemData.Aggregates) == 0 {
+		for idx, returnField := range queryItemData.ReturnField {
+			parts := strings.SplitN(returnField, "_", 2)
+			if len(parts) != 2 || parts[1] == "" {
+				addError("第%d个返回列 %s 格式错误，应为 pos_field 或 pos_*", idx+1, returnField)
+				continue
+			}
+			if !isDatasetPos(parts[0]) {
+				addError("第%d个返回列 %s 的数据集不在查询的数据集中", idx+1, returnField)
+				continue
+			}
+			if parts[1] != "*" && knownPos(parts[0]) {
+				if _, ok := headerMap[returnField]; !ok {
+					addError("第%d个返回列 %s 不存在", idx+1, parts[1])
+				}
+			}
+		}
+	}
+
+	// 分组、聚合、排序（需要全部表头）
+	if allKnown {
+		if err := validateGroupAndOrder(queryItemData, headerMap, isMulti); err != nil {
+			addError("%s", err)
+		}
+	}
+
+	result.Valid = len(result.Errors) == 0
+	return result
+}
+
+/**
+ * validateJointCondition 校验联表条件（数据集、列、比较符、类型、联表类型）
+ * @param jointCondition 联表条件
+ * @param tableMap 已知表头的数据集（主CID -> 表头）
+ * @param isDatasetPos 判断是否为查询的数据集
+ * @return error 错误信息
+ */
+func validateJointCondition(jointCondition JointCondition, tableMap map[string]*Table, isDatasetPos func(pos string) bool) error {
+	for _, side := range [][2]string{{jointCondition.Pos1, jointCondition.Field1}, {jointCondition.Pos2, jointCondition.Field2}} {
+		if !isDatasetPos(side[0]) {
+			return fmt.Errorf("数据集%s不在查询的数据集中", side[0])
+		}
+		if table, ok := tableMap[side[0]]; ok {
+			if _, ok := table.HeaderMap[side[0]+"_"+side[1]]; !ok {
+				return fmt.Errorf("表%s中不存在联表字段%s", side[0], side[1])
+			}
+		}
+	}
+	if jointCondition.Pos1 == jointCondition.Pos2 {
+		return fmt.Errorf("联表条件两侧是同一个数据集%s", jointCondition.Pos1)
+	}
+	if err := checkJoinCompare(jointCondition.Compare); err != nil {
+		return err
+	}
+	switch jointCondition.Type {
+	case "string", "int", "float", "date", "datetime":
+	default:
+		return fmt.Errorf("联表条件类型错误，不支持类型：%s", jointCondition.Type)
+	}
+	if jointCondition.JointType != "INNER" {
+		return fmt.Errorf("不支持的联表类型:%s", jointCondition.JointType)
+	}
+	return nil
+}
+
+/**
+ * estimateJoinOrder 按联表顺序估计每步联表后的行数
+ * @param jointGroups 联表计划（按联表顺序）
+ * @param postJoinFilters 联表后的过滤条件
+ * @param rowCounts 各数据集的行数（-1表示未知）
+ * @return []ExplainJoinStep 联表步骤
+ * @return int 联表后的估计行数，-1表示未知
+ * @Description: 含等值条件的连接估计为两侧行数的较大值，只有不等条件的连接为两侧行数之积，其余为两侧行数之积的1/3；
+ * 联表后的过滤条件不改变估计行数
+ */
+func estimateJoinOrder(jointGroups []JointGroup, postJoinFilters []JointCondition, rowCounts map[string]int) ([]ExplainJoinStep, int) {
+	steps := make([]ExplainJoinStep, 0, len(jointGroups)+len(postJoinFilters))
+	current := -1
+	joined := make(map[string]bool)
+	for idx, jointGroup := range jointGroups {
+		var left, right int
+		switch {
+		case idx == 0:
+			left, right = rowCounts[jointGroup.Pos1], rowCounts[jointGroup.Pos2]
+		case joined[jointGroup.Pos1]:
+			left, right = current, rowCounts[jointGroup.Pos2]
+		default:
+			left, right = rowCounts[jointGroup.Pos1], current
+		}
+		joined[jointGroup.Pos1], joined[jointGroup.Pos2] = true, true
+		current = estimateJoinRows(jointGroup.JointConditions, left, right)
+		steps = append(steps, ExplainJoinStep{
+			Pos1:            jointGroup.Pos1,
+			Pos2:            jointGroup.Pos2,
+			JointConditions: jointGroup.JointConditions,
+			EstimatedRows:   current,
+		})
+	}
+	for _, jointCondition := range postJoinFilters {
+		steps = append(steps, ExplainJoinStep{
+			Pos1:            jointCondition.Pos1,
+			Pos2:            jointCondition.Pos2,
+			JointConditions: []JointCondition{jointCondition},
+			PostJoinFilter:  true,
+			EstimatedRows:   current,
+		})
+	}
+	return steps, current
+}
+
+// estimateJoinRows 估计两表联表后的行数
+func estimateJoinRows(jointConditions []JointCondition, left int, right int) int {
+	if left < 0 || right < 0 {
+		return -1
+	}
+	allNotEqual := true
+	for _, jointCondition := range jointConditions {
+		switch jointCondition.Compare {
+		case "eq":
+			if left > right {
+				return left
+			}
+			return right
+		case "ne":
+		default:
+			allNotEqual = false
+		}
+	}
+	if allNotEqual {
+		return left * right
+	}
+	return left * right / 3
+}
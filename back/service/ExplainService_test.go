@@ -0,0 +1,53 @@
+package service
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"chainqa_offchain_demo/setting"
+)
+
+func TestExplainQuery(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	RememberSchema("EA1", []string{"id", "age", "name"}, []string{"int", "int", "string"}, 3)
+	RememberSchema("EA2", []string{"id", "age", "name"}, []string{"int", "int", "string"}, 2)
+	schemas := map[string][]string{"EB1": {"pid", "cost"}}
+	cases := []struct {
+		name      string
+		queryItem QueryItem
+		wantRows  int
+		wantErr   string
+	}{
+		{"缓存的表结构", QueryItem{QueryConcatType: "single", FilePos: [][]string{{"EA1", "EA2"}}, ReturnField: []string{"EA1_id"},
+			QueryConditions: [][]QueryCondition{{{Pos: "EA1", Field: "age", Val: "30", Compare: "gt", Type: "int"}}}}, 5, ""},
+		{"请求中提供的表头", QueryItem{QueryConcatType: "single", FilePos: [][]string{{"EB1"}}, ReturnField: []string{"EB1_*"}}, -1, ""},
+		{"分片的表头未缓存", QueryItem{QueryConcatType: "single", FilePos: [][]string{{"EA1", "EX"}}, ReturnField: []string{"EA1_id"}}, -1, "分片EX的表头未缓存"},
+		{"查询条件的列不存在", QueryItem{QueryConcatType: "single", FilePos: [][]string{{"EA1"}}, ReturnField: []string{"EA1_id"},
+			QueryConditions: [][]QueryCondition{{{Pos: "EA1", Field: "cost", Val: "1", Compare: "eq", Type: "int"}}}}, -1, "第1组第1个"},
+		{"基准值类型错误", QueryItem{QueryConcatType: "single", FilePos: [][]string{{"EA1"}}, ReturnField: []string{"EA1_id"},
+			QueryConditions: [][]QueryCondition{{{Pos: "EA1", Field: "age", Val: "x", Compare: "gt", Type: "int"}}}}, -1, "第1组第1个"},
+		{"返回列不存在", QueryItem{QueryConcatType: "single", FilePos: [][]string{{"EA1"}}, ReturnField: []string{"EA1_cost"}}, -1, "第1个返回列 cost 不存在"},
+		{"返回列格式错误", QueryItem{QueryConcatType: "single", FilePos: [][]string{{"EA1"}}, ReturnField: []string{"id"}}, -1, "格式错误"},
+		{"单表查询有多个数据集", QueryItem{QueryConcatType: "single", FilePos: [][]string{{"EA1"}, {"EB1"}}, ReturnField: []string{"EA1_id"}}, -1, "单表查询只能有一个数据集"},
+		{"查询类型错误", QueryItem{QueryConcatType: "double", FilePos: [][]string{{"EA1"}}}, -1, "不支持类型：double"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			queryItem, _ := json.Marshal(tc.queryItem)
+			result := ExplainQuery(string(queryItem), schemas)
+			if tc.wantErr == "" {
+				if !result.Valid || len(result.Errors) > 0 {
+					t.Fatalf("校验失败: %v", result.Errors)
+				}
+				if result.EstimatedRows != tc.wantRows {
+					t.Errorf("estimatedRows = %d，期望 %d", result.EstimatedRows, tc.wantRows)
+				}
+				return
+			}
+			if result.Valid || !strings.Contains(strings.Join(result.Errors, "\n"), tc.wantErr) {
+				t.Errorf("errors = %v，期望包含 %q", result.Errors, tc.wantErr)
+			}
+		})
+	}
+}
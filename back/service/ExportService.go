@@ -0,0 +1,371 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// ----------------导出查询结果（EXPORT）-------------------
+
+// ExportFile 导出的文件（内容由Stream流式写出）
+type ExportFile struct {
+	Format      string // 导出格式（csv/xlsx/ndjson）
+	FileName    string // 文件名（含扩展名）
+	ContentType string // MIME类型
+	Counts      int    // 导出的行数
+	Sha256      string // 文件内容的SHA256（Stream写出后设置，记录在链上导出日志中）
+
+	write func(w io.Writer) error // 写出文件内容
+}
+
+// 支持的导出格式：扩展名和MIME类型
+var exportFormats = map[string][2]string{
+	"csv":    {"csv", "text/csv; charset=utf-8"},
+	"xlsx":   {"xlsx", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+	"ndjson": {"ndjson", "application/x-ndjson"},
+}
+
+// xlsx中结果工作表的名称
+const exportResultSheet = "查询结果"
+
+/**
+ * ExportQueryResult 将查询结果导出为文件（只确定列和文件信息，内容由Stream写出）
+ * @param queryItem 查询项（用于确定列顺序，联表查询的每个数据集另存为一个工作表）
+ * @param queryResult 查询结果（GetQueryResult的返回值）
+ * @param format 导出格式（csv/xlsx/ndjson）
+ * @param fileName 文件名（不含扩展名，为空时为 query_时间）
+ * @return ExportFile 导出的文件
+ * @return error 错误信息
+ */
+func ExportQueryResult(queryItem string, queryResult string, format string, fileName string) (ExportFile, error) {
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format == "" {
+		format = "csv"
+	}
+	formatInfo, ok := exportFormats[format]
+	if !ok {
+		return ExportFile{}, errors.New("不支持的导出格式 " + format + "（csv/xlsx/ndjson）")
+	}
+
+	var resultData QueryResult
+	if err := json.Unmarshal([]byte(queryResult), &resultData); err != nil {
+		return ExportFile{}, errors.New("查询失败: " + queryResult)
+	}
+	if resultData.Counts == -1 {
+		return ExportFile{}, errors.New("查询失败: " + resultData.Message)
+	}
+	var queryItemData QueryItem
+	_ = json.Unmarshal([]byte(queryItem), &queryItemData)
+
+	rows := make([]map[string]interface{}, 0, len(resultData.Data))
+	for _, row := range resultData.Data {
+		if rowData, ok := row.(map[string]interface{}); ok {
+			rows = append(rows, rowData)
+		}
+	}
+	columns := exportColumns(queryItemData, rows)
+
+	var write func(w io.Writer) error
+	switch format {
+	case "csv":
+		write = func(w io.Writer) error { return exportCSV(w, columns, rows) }
+	case "xlsx":
+		write = func(w io.Writer) error { return exportXLSX(w, queryItemData, columns, rows) }
+	case "ndjson":
+		write = func(w io.Writer) error { return exportNDJSON(w, rows) }
+	}
+
+	fileName = sanitizeFileName(fileName)
+	if fileName == "" {
+		fileName = "query_" + time.Now().Format("20060102150405")
+	}
+	return ExportFile{
+		Format:      format,
+		FileName:    fileName + "." + formatInfo[0],
+		ContentType: formatInfo[1],
+		Counts:      len(rows),
+		write:       write,
+	}, nil
+}
+
+/**
+ * Stream 将文件内容流式写出到w（不在内存中保留整个文件），写出成功后设置Sha256
+ * @param w 输出（如HTTP响应）
+ * @return error 错误信息
+ */
+func (f *ExportFile) Stream(w io.Writer) error {
+	hash := sha256.New()
+	if err := f.write(io.MultiWriter(w, hash)); err != nil {
+		return err
+	}
+	f.Sha256 = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
+
+/**
+ * exportColumns 确定导出的列顺序：按返回列、分组列、聚合函数的顺序，pos_*按表头顺序，其余列按名称排序
+ * @param queryItemData 查询项
+ * @param rows 结果行
+ * @return []string 列名
+ */
+func exportColumns(queryItemData QueryItem, rows []map[string]interface{}) []string {
+	isMulti := queryItemData.QueryConcatType == "multi"
+	present := make(map[string]bool)
+	for _, row := range rows {
+		for key := range row {
+			present[key] = true
+		}
+	}
+
+	columns := make([]string, 0, len(present))
+	added := make(map[string]bool)
+	add := func(key string) {
+		if present[key] && !added[key] {
+			added[key] = true
+			columns = append(columns, key)
+		}
+	}
+	for _, returnField := range queryItemData.ReturnField {
+		parts := strings.SplitN(returnField, "_", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if parts[1] != "*" {
+			add(outputKey(parts[0], parts[1], isMulti))
+			continue
+		}
+		// pos_*：按缓存的表头顺序，之后是计算列
+		for _, filePoses := range queryItemData.FilePos {
+			if len(filePoses) == 0 || filePoses[0] != parts[0] {
+				continue
+			}
+			for _, filePos := range filePoses {
+				if schema, ok := LookupSchema(filePos); ok {
+					for _, column := range schema.Columns {
+						add(outputKey(parts[0], column, isMulti))
+					}
+				}
+			}
+		}
+		for _, computedColumn := range queryItemData.ComputedColumns {
+			computedPos := computedColumn.Pos
+			if computedPos == "" && len(queryItemData.FilePos) > 0 && len(queryItemData.FilePos[0]) > 0 {
+				computedPos = queryItemData.FilePos[0][0]
+			}
+			if computedPos == parts[0] {
+				add(outputKey(parts[0], computedColumn.Alias, isMulti))
+			}
+		}
+	}
+	for _, groupBy := range queryItemData.GroupBy {
+		add(outputKey(groupBy.Pos, groupBy.Field, isMulti))
+	}
+	for _, aggregate := range queryItemData.Aggregates {
+		add(aggregateAlias(aggregate, isMulti))
+	}
+
+	rest := make([]string, 0)
+	for key := range present {
+		if !added[key] {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	return append(columns, rest...)
+}
+
+// exportCell 单元格的文本（空值为空字符串，来源列等数组、对象为JSON）
+func exportCell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}, map[string]interface{}:
+		valueJSON, _ := json.Marshal(v)
+		return string(valueJSON)
+	}
+	return fmt.Sprint(value)
+}
+
+// exportText 表格（CSV/XLSX）中单元格的文本：以 = + - @ 开头（或制表符、回车开头）的文本前加'，避免在Excel中作为公式执行；数值不处理
+func exportText(text string) string {
+	if text == "" || !strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+		return text
+	}
+	if _, err := strconv.ParseFloat(text, 64); err == nil {
+		return text
+	}
+	return "'" + text
+}
+
+// exportCSV 导出为CSV（带UTF-8 BOM，Excel打开中文不乱码）
+func exportCSV(w io.Writer, columns []string, rows []map[string]interface{}) error {
+	if _, err := io.WriteString(w, "\xEF\xBB\xBF"); err != nil {
+		return err
+	}
+	writer := csv.NewWriter(w)
+	record := make([]string, len(columns))
+	for i, column := range columns {
+		record[i] = exportText(column)
+	}
+	if err := writer.Write(record); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		for i, column := range columns {
+			record[i] = exportText(exportCell(row[column]))
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// exportNDJSON 导出为NDJSON（每行一个JSON对象）
+func exportNDJSON(w io.Writer, rows []map[string]interface{}) error {
+	for _, row := range rows {
+		line, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * exportXLSX 导出为XLSX：第一个工作表为完整结果；联表查询的每个数据集另存为一个工作表（以数据集CID命名，首列为结果行号）
+ * @param w 输出
+ * @param queryItemData 查询项
+ * @param columns 列名
+ * @param rows 结果行
+ * @return error 错误信息
+ */
+func exportXLSX(w io.Writer, queryItemData QueryItem, columns []string, rows []map[string]interface{}) error {
+	f := excelize.NewFile()
+	defer f.Close()
+	if err := f.SetSheetName("Sheet1", exportResultSheet); err != nil {
+		return err
+	}
+	if err := writeXLSXSheet(f, exportResultSheet, columns, columns, rows, false); err != nil {
+		return err
+	}
+
+	if queryItemData.QueryConcatType == "multi" {
+		usedNames := map[string]bool{exportResultSheet: true}
+		for _, filePoses := range queryItemData.FilePos {
+			if len(filePoses) == 0 {
+				continue
+			}
+			pos := filePoses[0]
+			datasetColumns, headers := make([]string, 0), make([]string, 0)
+			for _, column := range columns {
+				if strings.HasPrefix(column, pos+"_") {
+					datasetColumns = append(datasetColumns, column)
+					headers = append(headers, strings.TrimPrefix(column, pos+"_"))
+				}
+			}
+			if len(datasetColumns) == 0 {
+				continue
+			}
+			// 工作表名最长31个字符，截断后重名时加序号
+			base := []rune(pos)
+			if len(base) > 31 {
+				base = base[:31]
+			}
+			sheet := string(base)
+			for i := 2; usedNames[sheet]; i++ {
+				suffix := "_" + strconv.Itoa(i)
+				trimmed := base
+				if len(trimmed)+len(suffix) > 31 {
+					trimmed = trimmed[:31-len(suffix)]
+				}
+				sheet = string(trimmed) + suffix
+			}
+			usedNames[sheet] = true
+			if _, err := f.NewSheet(sheet); err != nil {
+				return err
+			}
+			if err := writeXLSXSheet(f, sheet, headers, datasetColumns, rows, true); err != nil {
+				return err
+			}
+		}
+	}
+	return f.Write(w)
+}
+
+/**
+ * writeXLSXSheet 写入一个工作表
+ * @param f 文件
+ * @param sheet 工作表名
+ * @param headers 表头
+ * @param columns 各表头对应的结果列名
+ * @param rows 结果行
+ * @param withRowNumber 是否在首列写入结果行号
+ * @return error 错误信息
+ */
+func writeXLSXSheet(f *excelize.File, sheet string, headers []string, columns []string, rows []map[string]interface{}, withRowNumber bool) error {
+	writer, err := f.NewStreamWriter(sheet)
+	if err != nil {
+		return err
+	}
+	offset := 0
+	if withRowNumber {
+		offset = 1
+	}
+	header := make([]interface{}, len(headers)+offset)
+	if withRowNumber {
+		header[0] = "行号"
+	}
+	for i, h := range headers {
+		header[i+offset] = exportText(h)
+	}
+	if err := writer.SetRow("A1", header); err != nil {
+		return err
+	}
+	for r, row := range rows {
+		record := make([]interface{}, len(columns)+offset)
+		if withRowNumber {
+			record[0] = r + 1
+		}
+		for i, column := range columns {
+			record[i+offset] = exportText(exportCell(row[column]))
+		}
+		cell, err := excelize.CoordinatesToCellName(1, r+2)
+		if err != nil {
+			return err
+		}
+		if err := writer.SetRow(cell, record); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// sanitizeFileName 去掉文件名中的路径分隔符、引号和控制字符
+func sanitizeFileName(fileName string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return -1
+		}
+		return r
+	}, fileName))
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// 测试用的查询项和查询结果：单元格包含可能被Excel作为公式执行的文本
+const (
+	testExportQueryItem  = `{"queryConcatType":"single","filePos":[["P"]],"returnField":["P_id","P_f"]}`
+	testExportResult     = `{"counts":5,"data":[{"id":"1","f":"=1+1"},{"id":"2","f":"+cmd"},{"id":"3","f":"-2.5"},{"id":"4","f":"@SUM(A1)"},{"id":"5","f":null}],"message":"查询成功"}`
+	testExportEscapedCSV = "\xEF\xBB\xBFid,f\n1,'=1+1\n2,'+cmd\n3,-2.5\n4,'@SUM(A1)\n5,\n"
+)
+
+// streamExport 导出并写出文件，检查Sha256与写出的内容一致
+func streamExport(t *testing.T, format string) (ExportFile, []byte) {
+	t.Helper()
+	file, err := ExportQueryResult(testExportQueryItem, testExportResult, format, "result")
+	if err != nil {
+		t.Fatalf("ExportQueryResult 失败: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := file.Stream(&buf); err != nil {
+		t.Fatalf("Stream 失败: %v", err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	if file.Sha256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("Sha256 = %s，与写出的内容不一致", file.Sha256)
+	}
+	if file.Counts != 5 || file.FileName != "result."+format {
+		t.Errorf("counts = %d, fileName = %s", file.Counts, file.FileName)
+	}
+	return file, buf.Bytes()
+}
+
+func TestExportCSV(t *testing.T) {
+	_, content := streamExport(t, "csv")
+	if string(content) != testExportEscapedCSV {
+		t.Errorf("CSV = %q，期望 %q", content, testExportEscapedCSV)
+	}
+}
+
+func TestExportNDJSON(t *testing.T) {
+	_, content := streamExport(t, "ndjson")
+	// NDJSON不是表格，原样导出
+	if !strings.Contains(string(content), `"f":"=1+1"`) || strings.Count(string(content), "\n") != 5 {
+		t.Errorf("NDJSON = %s", content)
+	}
+}
+
+func TestExportXLSX(t *testing.T) {
+	_, content := streamExport(t, "xlsx")
+	f, err := excelize.OpenReader(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("打开xlsx失败: %v", err)
+	}
+	defer f.Close()
+	rows, err := f.GetRows(exportResultSheet)
+	if err != nil {
+		t.Fatalf("读取工作表失败: %v", err)
+	}
+	got := make([]string, 0)
+	for _, row := range rows {
+		got = append(got, strings.Join(row, ","))
+	}
+	// 与CSV一致（GetRows省略行尾的空单元格）
+	want := strings.Split(strings.TrimPrefix(testExportEscapedCSV, "\xEF\xBB\xBF"), "\n")
+	want = append(want[:5], "5")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("xlsx = %q，期望 %q", got, want)
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	cases := []struct {
+		name        string
+		queryResult string
+		format      string
+		wantErr     string
+	}{
+		{"不支持的格式", testExportResult, "pdf", "不支持的导出格式 pdf"},
+		{"查询失败", `{"counts":-1,"data":[],"message":"列不存在"}`, "csv", "查询失败: 列不存在"},
+		{"查询结果不是JSON", "查询失败: 超时", "csv", "查询失败"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := ExportQueryResult(testExportQueryItem, tc.queryResult, tc.format, ""); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("err = %v，期望包含 %q", err, tc.wantErr)
+			}
+		})
+	}
+}
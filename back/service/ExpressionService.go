@@ -0,0 +1,455 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ----------------计算列（COMPUTED COLUMNS）-------------------
+// 计算列由表达式计算得到，在查询前加入表中，列名为 pos_alias，
+// 之后可以像普通列一样用于返回列、查询条件、联表条件、分组和排序。
+// 表达式支持 + - * / %、括号、数字和'字符串'字面量、NULL、列引用（列名 或 数据集.列名）以及内置函数调用，
+// 如 floor(age/10)*10、upper(name)、substr(diseaseCode,1,3)、datediff(outDate,inDate)。
+
+// ComputedColumn 计算列
+type ComputedColumn struct {
+	Alias string `json:"alias"` // 列名
+	Expr  string `json:"expr"`  // 表达式
+	Pos   string `json:"pos"`   // 所属数据集（列名前缀），为空时为第一个数据集的主CID；表达式中不带数据集的列也属于该数据集
+}
+
+// exprNode 表达式语法树节点
+type exprNode struct {
+	kind   string    // literal/column/call/neg/binary
+	value  exprValue // literal：字面量的值
+	pos    string    // column：列所属数据集（为空时为计算列所属数据集）
+	field  string    // column：列名
+	column string    // column：带前缀的列名（编译计算列时填写）
+	index  int       // column：列在表中的索引（计算时填写）
+	fn     string    // call：函数名（小写）
+	op     string    // binary：+ - * / %
+	args   []*exprNode
+	offset int // 在表达式中的位置（字符偏移）
+}
+
+// computedColumnPlan 编译后的计算列
+type computedColumnPlan struct {
+	ComputedColumn
+	column string    // 带前缀的列名 pos_alias
+	root   *exprNode // 表达式语法树
+	refs   []string  // 引用的列（带前缀，去重）
+}
+
+// ======================表达式解析======================
+// 与SQL方言共用词法分析和解析器，SQL中 SELECT 表达式 AS 别名 会编译为计算列
+
+// parseExpression 解析表达式：加减
+func (p *sqlParser) parseExpression() (*exprNode, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for p.isSymbol("+") || p.isSymbol("-") {
+		op := p.next()
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprNode{kind: "binary", op: op.text, args: []*exprNode{left, right}, offset: op.pos}
+	}
+	return left, nil
+}
+
+// parseTerm 解析乘除取余
+func (p *sqlParser) parseTerm() (*exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isSymbol("*") || p.isSymbol("/") || p.isSymbol("%") {
+		op := p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprNode{kind: "binary", op: op.text, args: []*exprNode{left, right}, offset: op.pos}
+	}
+	return left, nil
+}
+
+// parseUnary 解析负号
+func (p *sqlParser) parseUnary() (*exprNode, error) {
+	if p.isSymbol("-") {
+		op := p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNode{kind: "neg", args: []*exprNode{operand}, offset: op.pos}, nil
+	}
+	return p.parsePrimary()
+}
+
+// parsePrimary 解析字面量、括号、函数调用和列引用
+func (p *sqlParser) parsePrimary() (*exprNode, error) {
+	tok := p.peek()
+	switch {
+	case tok.kind == sqlNumber:
+		p.next()
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, p.errorAt(tok.pos, "无效的数字 %s", tok.text)
+		}
+		return &exprNode{kind: "literal", value: numValue(n), offset: tok.pos}, nil
+	case tok.kind == sqlString:
+		p.next()
+		return &exprNode{kind: "literal", value: strValue(tok.text), offset: tok.pos}, nil
+	case p.isKeyword("NULL"):
+		p.next()
+		return &exprNode{kind: "literal", value: exprValue{kind: exprNull}, offset: tok.pos}, nil
+	case p.isSymbol("("):
+		p.next()
+		node, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expectSymbol(")")
+	case tok.kind == sqlIdent && p.peekAt(1).kind == sqlSymbol && p.peekAt(1).text == "(":
+		return p.parseFunctionCall()
+	}
+	column, err := p.parseColumnRef()
+	if err != nil {
+		return nil, p.errorAt(tok.pos, "此处应为列名、字面量或函数")
+	}
+	if column.typeHint != "" {
+		return nil, p.errorAt(column.pos, "表达式中的列不支持类型标注")
+	}
+	return &exprNode{kind: "column", pos: column.alias, field: column.field, offset: column.pos}, nil
+}
+
+// parseFunctionCall 解析函数调用：函数名(参数, ...)
+func (p *sqlParser) parseFunctionCall() (*exprNode, error) {
+	name := p.next()
+	p.next() // (
+	fn, ok := scalarFunctions[strings.ToLower(name.text)]
+	if !ok {
+		return nil, p.errorAt(name.pos, "未知的函数 %s", name.text)
+	}
+	node := &exprNode{kind: "call", fn: strings.ToLower(name.text), offset: name.pos}
+	if !p.isSymbol(")") {
+		for {
+			arg, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			node.args = append(node.args, arg)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	if len(node.args) < fn.MinArgs || (fn.MaxArgs >= 0 && len(node.args) > fn.MaxArgs) {
+		switch {
+		case fn.MaxArgs < 0:
+			return nil, p.errorAt(name.pos, "函数 %s 至少需要%d个参数", name.text, fn.MinArgs)
+		case fn.MinArgs == fn.MaxArgs:
+			return nil, p.errorAt(name.pos, "函数 %s 需要%d个参数", name.text, fn.MinArgs)
+		}
+		return nil, p.errorAt(name.pos, "函数 %s 需要%d到%d个参数", name.text, fn.MinArgs, fn.MaxArgs)
+	}
+	return node, nil
+}
+
+/**
+ * compileExpression 解析表达式
+ * @param expr 表达式
+ * @return *exprNode 语法树
+ * @return error 错误信息（*SQLError，带位置）
+ */
+func compileExpression(expr string) (*exprNode, error) {
+	src := []rune(expr)
+	tokens, err := tokenizeSQL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &sqlParser{src: src, tokens: tokens}
+	node, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != sqlEOF {
+		return nil, p.errorAt(tok.pos, "无法识别的表达式内容")
+	}
+	return node, nil
+}
+
+// ======================表达式计算======================
+
+/**
+ * eval 计算一行的表达式值
+ * @param row 行
+ * @param dateParser 日期解析器
+ * @return exprValue 值
+ * @return error 错误信息
+ */
+func (n *exprNode) eval(row []string, dateParser *DateParser) (exprValue, error) {
+	switch n.kind {
+	case "literal":
+		return n.value, nil
+	case "column":
+		cell := row[n.index]
+		if cell == NullCell {
+			return exprValue{kind: exprNull}, nil
+		}
+		return strValue(cell), nil
+	case "neg":
+		v, err := n.args[0].eval(row, dateParser)
+		if err != nil || v.kind == exprNull {
+			return v, err
+		}
+		num, err := v.Number()
+		if err != nil {
+			return exprValue{}, err
+		}
+		return numValue(-num), nil
+	case "binary":
+		return n.evalBinary(row, dateParser)
+	case "call":
+		fn := scalarFunctions[n.fn]
+		args := make([]exprValue, len(n.args))
+		for i, arg := range n.args {
+			v, err := arg.eval(row, dateParser)
+			if err != nil {
+				return exprValue{}, err
+			}
+			if v.kind == exprNull && !fn.NullInput {
+				return v, nil
+			}
+			args[i] = v
+		}
+		v, err := fn.eval(args, dateParser)
+		if err != nil {
+			return exprValue{}, fmt.Errorf("%s: %s", n.fn, err)
+		}
+		return v, nil
+	}
+	return exprValue{}, errors.New("无法识别的表达式")
+}
+
+// evalBinary 计算四则运算和取余（任一操作数为空值或除数为0时结果为空值）
+func (n *exprNode) evalBinary(row []string, dateParser *DateParser) (exprValue, error) {
+	nums := make([]float64, 2)
+	for i, arg := range n.args {
+		v, err := arg.eval(row, dateParser)
+		if err != nil || v.kind == exprNull {
+			return v, err
+		}
+		nums[i], err = v.Number()
+		if err != nil {
+			return exprValue{}, err
+		}
+	}
+	switch n.op {
+	case "+":
+		return numValue(nums[0] + nums[1]), nil
+	case "-":
+		return numValue(nums[0] - nums[1]), nil
+	case "*":
+		return numValue(nums[0] * nums[1]), nil
+	}
+	if n.op == "/" {
+		if nums[1] == 0 {
+			return exprValue{kind: exprNull}, nil
+		}
+		return numValue(nums[0] / nums[1]), nil
+	}
+	if int64(nums[1]) == 0 {
+		return exprValue{kind: exprNull}, nil
+	}
+	return numValue(float64(int64(nums[0]) % int64(nums[1]))), nil
+}
+
+// walk 遍历语法树
+func (n *exprNode) walk(visit func(node *exprNode)) {
+	visit(n)
+	for _, arg := range n.args {
+		arg.walk(visit)
+	}
+}
+
+// resultType 表达式结果的类型（float/string/date），无法确定时为空
+func (n *exprNode) resultType() string {
+	switch n.kind {
+	case "literal":
+		switch n.value.kind {
+		case exprNum:
+			return "float"
+		case exprStr:
+			return "string"
+		}
+	case "neg", "binary":
+		return "float"
+	case "call":
+		return scalarFunctions[n.fn].ResultType
+	}
+	return ""
+}
+
+// String 输出表达式文本（列引用带数据集，可再次解析）
+func (n *exprNode) String() string {
+	switch n.kind {
+	case "literal":
+		switch n.value.kind {
+		case exprNum:
+			return strconv.FormatFloat(n.value.num, 'f', -1, 64)
+		case exprStr:
+			return "'" + strings.ReplaceAll(n.value.str, "'", "''") + "'"
+		}
+		return "NULL"
+	case "column":
+		if n.pos == "" {
+			return `"` + n.field + `"`
+		}
+		return `"` + n.pos + `"."` + n.field + `"`
+	case "neg":
+		return "(-" + n.args[0].String() + ")"
+	case "binary":
+		return "(" + n.args[0].String() + " " + n.op + " " + n.args[1].String() + ")"
+	}
+	args := make([]string, len(n.args))
+	for i, arg := range n.args {
+		args[i] = arg.String()
+	}
+	return n.fn + "(" + strings.Join(args, ", ") + ")"
+}
+
+// ======================计算列======================
+
+/**
+ * compileComputedColumns 编译计算列
+ * @param computedColumns 计算列
+ * @param defaultPos 未指定所属数据集时使用的数据集主CID
+ * @param merged 为true时所有数据集已合并为defaultPos（union查询），计算列和列引用都改为defaultPos
+ * @return []*computedColumnPlan 编译后的计算列
+ * @return error 错误信息
+ */
+func compileComputedColumns(computedColumns []ComputedColumn, defaultPos string, merged bool) ([]*computedColumnPlan, error) {
+	plans := make([]*computedColumnPlan, 0, len(computedColumns))
+	columns := make(map[string]bool)
+	for _, computedColumn := range computedColumns {
+		if strings.TrimSpace(computedColumn.Alias) == "" {
+			return nil, errors.New("计算列缺少列名（alias）")
+		}
+		pos := computedColumn.Pos
+		if pos == "" || merged {
+			pos = defaultPos
+		}
+		root, err := compileExpression(computedColumn.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("计算列%s的表达式有误: %s", computedColumn.Alias, err)
+		}
+		plan := &computedColumnPlan{ComputedColumn: computedColumn, column: pos + "_" + computedColumn.Alias, root: root}
+		if columns[plan.column] {
+			return nil, fmt.Errorf("计算列%s重复定义", computedColumn.Alias)
+		}
+		columns[plan.column] = true
+		plan.ComputedColumn.Pos = pos
+
+		refs := make(map[string]bool)
+		root.walk(func(node *exprNode) {
+			if node.kind != "column" {
+				return
+			}
+			refPos := node.pos
+			if refPos == "" || merged {
+				refPos = pos
+			}
+			node.column = refPos + "_" + node.field
+			if !refs[node.column] {
+				refs[node.column] = true
+				plan.refs = append(plan.refs, node.column)
+			}
+		})
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+/**
+ * applyComputedColumns 按定义顺序在表中加入计算列（后面的计算列可以引用前面的）
+ * @param table 表
+ * @param plans 编译后的计算列
+ * @param applied 各计算列是否已加入（会被更新）
+ * @param final 为false时跳过引用的列不在表中的计算列（留到联表之后），为true时视为错误
+ * @param dateParser 日期解析器
+ * @return error 错误信息
+ */
+func applyComputedColumns(table *Table, plans []*computedColumnPlan, applied []bool, final bool, dateParser *DateParser) error {
+	for i, plan := range plans {
+		if applied[i] {
+			continue
+		}
+		missing := ""
+		for _, ref := range plan.refs {
+			if _, ok := table.HeaderMap[ref]; !ok {
+				missing = ref
+				break
+			}
+		}
+		if missing != "" {
+			if final {
+				return fmt.Errorf("计算列%s中的列%s不存在", plan.Alias, strings.TrimPrefix(missing, plan.Pos+"_"))
+			}
+			continue
+		}
+		if _, ok := table.HeaderMap[plan.column]; ok {
+			return fmt.Errorf("计算列%s与已有列重名", plan.Alias)
+		}
+		plan.root.walk(func(node *exprNode) {
+			if node.kind == "column" {
+				node.index = table.HeaderMap[node.column]
+			}
+		})
+		values := make([]string, len(table.Rows))
+		for r, row := range table.Rows {
+			v, err := plan.root.eval(row, dateParser)
+			if err != nil {
+				return fmt.Errorf("计算列%s第%d行: %s", plan.Alias, r+1, err)
+			}
+			values[r] = v.String(dateParser)
+		}
+		table.HeaderMap[plan.column] = len(table.Columns)
+		table.Columns = append(table.Columns, plan.column)
+		for r, row := range table.Rows {
+			// 行可能与其他表共用底层数组，复制后再追加
+			table.Rows[r] = append(row[:len(row):len(row)], values[r])
+		}
+		applied[i] = true
+	}
+	return nil
+}
+
+/**
+ * addComputedColumns 编译并在表中加入全部计算列（单表和union查询使用）
+ * @param table 表
+ * @param computedColumns 计算列
+ * @param mainPos 数据集主CID
+ * @param merged 是否为合并后的union表
+ * @param dateParser 日期解析器
+ * @return error 错误信息
+ */
+func addComputedColumns(table *Table, computedColumns []ComputedColumn, mainPos string, merged bool, dateParser *DateParser) error {
+	if len(computedColumns) == 0 {
+		return nil
+	}
+	plans, err := compileComputedColumns(computedColumns, mainPos, merged)
+	if err != nil {
+		return err
+	}
+	return applyComputedColumns(table, plans, make([]bool, len(plans)), true, dateParser)
+}
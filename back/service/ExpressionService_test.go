@@ -0,0 +1,84 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"chainqa_offchain_demo/setting"
+)
+
+// exprQuery 执行带计算列的查询，返回结果行（JSON字符串）或查询失败的信息
+func exprQuery(t *testing.T, queryItemData QueryItem) (string, bool) {
+	t.Helper()
+	content, err := EncodeTable([]string{"id", "age", "name", "inDate", "outDate"}, [][]string{
+		{"1", "37", "ann", "2024-01-01", "2024-01-11"},
+		{"2", "52", "bob", "2024-02-01", "2024-02-03"},
+		{"3", "58", NullCell, "2024-03-01", "2024-03-31"},
+	})
+	if err != nil {
+		t.Fatalf("EncodeTable 失败: %v", err)
+	}
+	queryItemData.QueryConcatType = "single"
+	queryItemData.FilePos = [][]string{{"E"}}
+	queryItem, _ := json.Marshal(queryItemData)
+	queryResult, counts := GetQueryResult(string(queryItem), map[string]string{"E": content})
+	if counts == -1 {
+		return queryResult, false
+	}
+	var queryResultData QueryResult
+	if err := json.Unmarshal([]byte(queryResult), &queryResultData); err != nil {
+		t.Fatalf("解析查询结果失败: %s", queryResult)
+	}
+	rows, _ := json.Marshal(queryResultData.Data)
+	return string(rows), true
+}
+
+func TestComputedColumns(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	RegisterScalarFunction("initial", 1, 1, func(args []string) (string, error) {
+		if args[0] == "" {
+			return "", errors.New("空字符串没有首字母")
+		}
+		return args[0][:1], nil
+	})
+	band := ComputedColumn{Alias: "band", Expr: "floor(age/10)*10"}
+	stay := ComputedColumn{Alias: "stay", Expr: "datediff(outDate, inDate)"}
+	cases := []struct {
+		name      string
+		queryItem QueryItem
+		want      string // 结果行，或期望包含的错误信息
+		wantOK    bool
+	}{
+		{"数值、字符串、日期函数", QueryItem{ReturnField: []string{"E_id", "E_band", "E_up", "E_stay", "E_label"},
+			ComputedColumns: []ComputedColumn{band, stay, {Alias: "up", Expr: "upper(name)"}, {Alias: "label", Expr: "concat(coalesce(name, '-'), '/', E.id)"}}},
+			`[{"band":"30","id":"1","label":"ann/1","stay":"10","up":"ANN"},{"band":"50","id":"2","label":"bob/2","stay":"2","up":"BOB"},{"band":"50","id":"3","label":"-/3","stay":"30","up":null}]`, true},
+		{"计算列用于查询条件和排序", QueryItem{ReturnField: []string{"E_id"}, ComputedColumns: []ComputedColumn{band, stay},
+			QueryConditions: [][]QueryCondition{{{Pos: "E", Field: "band", Val: "50", Compare: "eq", Type: "int"}}},
+			OrderBy:         []OrderByItem{{Pos: "E", Field: "stay", Type: "int", Desc: true}}},
+			`[{"id":"3"},{"id":"2"}]`, true},
+		{"计算列引用计算列", QueryItem{ReturnField: []string{"E_id", "E_half"}, ComputedColumns: []ComputedColumn{band, {Alias: "half", Expr: "band / 2"}},
+			QueryConditions: [][]QueryCondition{{{Pos: "E", Field: "id", Val: "1", Compare: "eq", Type: "int"}}}},
+			`[{"half":"15","id":"1"}]`, true},
+		{"注册的函数", QueryItem{ReturnField: []string{"E_i"}, ComputedColumns: []ComputedColumn{{Alias: "i", Expr: "INITIAL(name)"}},
+			QueryConditions: [][]QueryCondition{{{Pos: "E", Field: "id", Val: "2", Compare: "le", Type: "int"}}}},
+			`[{"i":"a"},{"i":"b"}]`, true},
+		{"未知的函数", QueryItem{ReturnField: []string{"E_id"}, ComputedColumns: []ComputedColumn{{Alias: "x", Expr: "nosuch(age)"}}}, "未知的函数 nosuch", false},
+		{"表达式不完整", QueryItem{ReturnField: []string{"E_id"}, ComputedColumns: []ComputedColumn{{Alias: "x", Expr: "age +"}}}, "第1行第6列", false},
+		{"引用的列不存在", QueryItem{ReturnField: []string{"E_id"}, ComputedColumns: []ComputedColumn{{Alias: "x", Expr: "cost + 1"}}}, "计算列x中的列cost不存在", false},
+		{"与已有列重名", QueryItem{ReturnField: []string{"E_id"}, ComputedColumns: []ComputedColumn{{Alias: "age", Expr: "1"}}}, "计算列age与已有列重名", false},
+		{"值无法转换为数字", QueryItem{ReturnField: []string{"E_id"}, ComputedColumns: []ComputedColumn{{Alias: "x", Expr: "name * 2"}}}, "无法转换为数字", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := exprQuery(t, tc.queryItem)
+			if ok != tc.wantOK {
+				t.Fatalf("查询结果 = %s", got)
+			}
+			if ok && got != tc.want || !ok && !strings.Contains(got, tc.want) {
+				t.Errorf("结果 = %s，期望 %s", got, tc.want)
+			}
+		})
+	}
+}
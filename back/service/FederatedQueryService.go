@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// ----------------跨数据域联邦查询（FEDERATED QUERY）-------------------
+// 一次请求查询多个数据域（如多中心研究中不同机构的数据域）：各数据域按调用者在其中的列权限、k-匿名策略分别执行，
+// 结果合并为一个结果集，每行附带来源数据域列；无权访问或查询失败的数据域在domains中说明，其余数据域照常返回（部分结果）。
+
+// FederatedDomainColumn 结果行中的来源数据域列
+const FederatedDomainColumn = "_domain"
+
+// 数据域在联邦查询中的状态
+const (
+	FederatedStatusOK     = "ok"     // 查询成功
+	FederatedStatusEmpty  = "empty"  // 索引中没有匹配的记录
+	FederatedStatusDenied = "denied" // 无权访问
+	FederatedStatusError  = "error"  // 检查权限、查询索引或执行查询失败
+)
+
+// FederatedDomainQuery 联邦查询中单个数据域的查询
+type FederatedDomainQuery struct {
+	DomainName string        // 数据域名称
+	QueryItem  string        // 查询项，为空时不执行（状态和说明见Status、Message）
+	Policy     *ColumnPolicy // 调用者在该数据域中生效的列权限
+	CacheKey   string        // 结果缓存键，为空时不使用缓存
+	Pruner     ShardPruner   // 分片裁剪函数，为nil时不裁剪
+	Status     string        // 不执行时的状态：empty/denied/error
+	Message    string        // 不执行时的说明
+}
+
+// FederatedDomainResult 联邦查询中单个数据域的结果
+type FederatedDomainResult struct {
+	DomainName string `json:"domainName"` // 数据域名称
+	Status     string `json:"status"`     // ok/empty/denied/error
+	Counts     int    `json:"counts"`     // 该数据域返回的行数，未执行或失败时为-1
+	Message    string `json:"message"`    // 该数据域的查询信息（含列权限、k-匿名的说明）或失败原因
+	Cached     bool   `json:"cached"`     // 是否命中结果缓存
+	Code       int    `json:"code"`       // 查询因超时、取消或超出资源限制而中止时的错误码，其余为0
+
+	QueryItem string `json:"-"` // 执行的查询项（上链查询日志用），未执行时为空
+	Result    string `json:"-"` // 该数据域的查询结果（上链查询日志用）
+}
+
+// FederatedQueryResult 联邦查询的结果
+type FederatedQueryResult struct {
+	Counts  int                     `json:"counts"`  // 合并后的结果数量
+	Data    []interface{}           `json:"data"`    // 合并后的结果行，每行带来源数据域列（_domain）
+	Message string                  `json:"message"` // 查询信息
+	Partial bool                    `json:"partial"` // 有数据域无权访问或查询失败时为true
+	Domains []FederatedDomainResult `json:"domains"` // 各数据域的结果（与请求中的顺序一致）
+}
+
+/**
+ * RunFederatedQuery 并发执行各数据域的查询（各自的列权限附加在context上），合并结果并标注来源数据域
+ * @param ctx 整个联邦查询的context（超时、取消）
+ * @param queries 各数据域的查询
+ * @param limits 资源限制（每个数据域分别计算）
+ * @param loader 分片获取函数
+ * @return FederatedQueryResult 合并后的结果
+ * @return error 整个联邦查询超时或被取消时为*QueryAbortError
+ */
+func RunFederatedQuery(ctx context.Context, queries []FederatedDomainQuery, limits QueryLimits, loader ShardLoader) (FederatedQueryResult, error) {
+	domains := make([]FederatedDomainResult, len(queries))
+	var wg sync.WaitGroup
+	for i, query := range queries {
+		domains[i] = FederatedDomainResult{DomainName: query.DomainName, Status: query.Status, Counts: -1, Message: query.Message}
+		if query.QueryItem == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, query FederatedDomainQuery) {
+			defer wg.Done()
+			batchResult := RunBatchQuery(WithColumnPolicy(ctx, query.Policy), []string{query.QueryItem}, []string{query.CacheKey}, limits, query.Pruner, loader)[0]
+			domains[i].QueryItem, domains[i].Result = query.QueryItem, batchResult.Result
+			domains[i].Cached, domains[i].Code = batchResult.Cached, batchResult.Code
+			var queryResultData QueryResult
+			if err := json.Unmarshal([]byte(batchResult.Result), &queryResultData); err != nil {
+				// 部分错误（如查询条件错误）以字符串返回
+				domains[i].Status, domains[i].Message = FederatedStatusError, batchResult.Result
+				return
+			}
+			domains[i].Message = queryResultData.Message
+			if batchResult.Counts == -1 {
+				domains[i].Status = FederatedStatusError
+				return
+			}
+			domains[i].Status, domains[i].Counts = FederatedStatusOK, batchResult.Counts
+		}(i, query)
+	}
+	wg.Wait()
+
+	// 按请求中的顺序合并各数据域的结果行
+	result := FederatedQueryResult{Domains: domains}
+	failedCount := 0
+	for _, domain := range domains {
+		switch domain.Status {
+		case FederatedStatusOK:
+			var queryResultData QueryResult
+			_ = json.Unmarshal([]byte(domain.Result), &queryResultData)
+			for _, row := range queryResultData.Data {
+				if rowData, ok := row.(map[string]interface{}); ok {
+					rowData[FederatedDomainColumn] = domain.DomainName
+				}
+				result.Data = append(result.Data, row)
+			}
+		case FederatedStatusEmpty:
+		default:
+			failedCount++
+		}
+	}
+	result.Counts = len(result.Data)
+	result.Partial = failedCount > 0
+	if result.Partial {
+		result.Message = fmt.Sprintf("联邦查询完成，%d个数据域无权访问或查询失败，结果只包含其余数据域", failedCount)
+	} else {
+		result.Message = "联邦查询成功"
+	}
+	return result, contextAbortError(ctx)
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"chainqa_offchain_demo/setting"
+)
+
+func TestRunFederatedQuery(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	shards := map[string]string{
+		"FA": "id\tage\n1\t37\n2\t52\n",
+		"FB": "id\tage\n3\t41\n",
+	}
+	loader := func(ctx context.Context, filePos string) (string, error) {
+		content, ok := shards[filePos]
+		if !ok {
+			return "", errors.New("分片不存在")
+		}
+		return content, nil
+	}
+	queryItem := func(filePos string, val string) string {
+		queryItemJSON, _ := json.Marshal(QueryItem{QueryConcatType: "single", FilePos: [][]string{{filePos}}, ReturnField: []string{filePos + "_*"},
+			QueryConditions: [][]QueryCondition{{{Pos: filePos, Field: "id", Val: val, Compare: "ge", Type: "int"}}}})
+		return string(queryItemJSON)
+	}
+	ageBand := &ColumnPolicy{Masks: []ColumnMask{{Column: "age", Method: MaskMethodAgeBand}}}
+	queries := []FederatedDomainQuery{
+		{DomainName: "d1", QueryItem: queryItem("FA", "2")},
+		{DomainName: "d2", QueryItem: queryItem("FB", "0"), Policy: ageBand},
+		{DomainName: "d3", Status: FederatedStatusDenied, Message: "无权访问数据域 d3"},
+		{DomainName: "d4", Status: FederatedStatusEmpty, Message: "索引中没有匹配的记录"},
+		{DomainName: "d5", QueryItem: queryItem("FX", "0")},
+	}
+
+	result, err := RunFederatedQuery(context.Background(), queries, QueryLimits{}, loader)
+	if err != nil {
+		t.Fatalf("联邦查询失败: %v", err)
+	}
+	// 各数据域按各自的列权限执行，结果按请求中的顺序合并，每行带来源数据域
+	rows, _ := json.Marshal(result.Data)
+	if want := `[{"_domain":"d1","age":"52","id":"2"},{"_domain":"d2","age":"40-49","id":"3"}]`; string(rows) != want {
+		t.Errorf("结果行 = %s，期望 %s", rows, want)
+	}
+	if result.Counts != 2 || !result.Partial || !strings.Contains(result.Message, "2个数据域无权访问或查询失败") {
+		t.Errorf("结果 = %d, %v, %s", result.Counts, result.Partial, result.Message)
+	}
+	wantDomains := []struct {
+		status  string
+		counts  int
+		message string
+	}{
+		{FederatedStatusOK, 1, "查询成功"},
+		{FederatedStatusOK, 1, "查询成功"},
+		{FederatedStatusDenied, -1, "无权访问数据域 d3"},
+		{FederatedStatusEmpty, -1, "索引中没有匹配的记录"},
+		{FederatedStatusError, -1, "获取分片失败"},
+	}
+	for i, domain := range result.Domains {
+		if domain.DomainName != queries[i].DomainName || domain.Status != wantDomains[i].status || domain.Counts != wantDomains[i].counts ||
+			!strings.Contains(domain.Message, wantDomains[i].message) {
+			t.Errorf("第%d个数据域: %+v，期望 %+v", i, domain, wantDomains[i])
+		}
+		if (domain.QueryItem != "") != (queries[i].QueryItem != "") {
+			t.Errorf("第%d个数据域的查询项 = %s", i, domain.QueryItem)
+		}
+	}
+
+	// 没有失败的数据域时不是部分结果
+	result, err = RunFederatedQuery(context.Background(), queries[:2], QueryLimits{}, loader)
+	if err != nil || result.Partial || result.Counts != 2 || result.Message != "联邦查询成功" {
+		t.Errorf("结果 = %+v, %v", result, err)
+	}
+
+	// 整个联邦查询被取消
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = RunFederatedQuery(ctx, queries[:2], QueryLimits{}, loader)
+	var abortErr *QueryAbortError
+	if !errors.As(err, &abortErr) {
+		t.Errorf("取消的联邦查询返回 %v", err)
+	}
+}
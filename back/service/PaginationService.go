@@ -0,0 +1,386 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"chainqa_offchain_demo/indexer"
+	"chainqa_offchain_demo/setting"
+)
+
+// ----------------分页查询（PAGINATION）-------------------
+// 行查询（queryData/sql/queryByFields/模板）和索引查询（searchIndex）的结果较多时可以分页返回：
+// 第一次请求时指定pageSize，返回第一页和下一页的游标（nextCursor），之后用游标请求下一页，直到nextCursor为空。
+// 游标是不透明的签名字符串（载荷 + HMAC-SHA256），包含分页查询ID、偏移量、每页大小、用户ID和过期时间，客户端无法伪造或修改。
+// 行查询在服务端保存完整的结果行（已按列权限、k-匿名处理），翻页不再获取和解密分片；
+// 索引查询只保存查询条件，每页重新执行索引查询并截取（索引中的交易按区块高度排列，顺序是确定的）。
+// 每一页的访问都上链一条查询日志，记录相同的分页查询ID和本页的偏移量。
+
+// 分页查询的类型
+const (
+	PagedQueryKindRows  = "rows"  // 行查询：返回结果行
+	PagedQueryKindIndex = "index" // 索引查询：返回交易ID及其所在的文件位置
+)
+
+// 分页查询的默认配置
+const (
+	defaultMaxPageSize     = 1000
+	defaultPageTTL         = 600 // 秒
+	defaultMaxPagedQueries = 64
+)
+
+// ErrPagedQueryExpired 分页查询已过期或被淘汰，须重新查询
+var ErrPagedQueryExpired = errors.New("分页查询已过期，请重新查询")
+
+// PageIndex 分页索引查询使用的索引服务（由索引服务实现）
+type PageIndex interface {
+	ExecuteQueryPage(req indexer.SearchRequest, offset int, limit int) (*indexer.SearchResult, error)
+	GetPosesByTxIDs(txIDs []string) ([]string, error)
+}
+
+// PagedQuery 服务端保存的分页查询
+type PagedQuery struct {
+	ID         string          // 分页查询ID（上链日志中每一页相同）
+	Uid        string          // 发起查询的用户ID，只有该用户可以翻页
+	Kind       string          // rows/index
+	QueryItem  string          // 上链查询日志的查询项
+	LogOptions QueryLogOptions // 每一页上链查询日志的附加信息（操作类型、列权限、k-匿名等）
+
+	rows      []interface{}         // rows：完整的结果行
+	message   string                // rows：查询信息
+	search    indexer.SearchRequest // index：索引查询条件
+	pageSize  int                   // 每页大小
+	expiresAt time.Time             // 过期时间
+}
+
+// QueryPage 分页查询的一页
+type QueryPage struct {
+	PagedQueryId string        `json:"pagedQueryId"`         // 分页查询ID
+	Offset       int           `json:"offset"`               // 本页的偏移量
+	PageSize     int           `json:"pageSize"`             // 每页大小
+	Counts       int           `json:"counts"`               // 本页的数量
+	Total        int           `json:"total"`                // 总数，索引查询不统计总数时为-1
+	Data         []interface{} `json:"data,omitempty"`       // rows：本页的结果行
+	TxIDs        []string      `json:"txIds,omitempty"`      // index：本页的交易ID
+	FilePoses    []string      `json:"filePoses,omitempty"`  // index：本页交易所在的文件位置（去重）
+	Message      string        `json:"message"`              // 查询信息
+	NextCursor   string        `json:"nextCursor,omitempty"` // 下一页的游标，没有下一页时为空
+	ExpiresAt    int64         `json:"expiresAt"`            // 分页查询的过期时间（Unix秒），过期后须重新查询
+}
+
+// pageCursor 游标的载荷
+type pageCursor struct {
+	ID     string `json:"id"` // 分页查询ID
+	Offset int    `json:"o"`  // 偏移量
+	Size   int    `json:"n"`  // 每页大小
+	Uid    string `json:"u"`  // 用户ID
+	Exp    int64  `json:"e"`  // 过期时间（Unix秒）
+}
+
+var (
+	pagedQueries     = make(map[string]*PagedQuery)
+	pagedQueriesLock sync.Mutex
+
+	cursorSecret     []byte
+	cursorSecretOnce sync.Once
+)
+
+/**
+ * ValidatePageSize 校验每页大小
+ * @param pageSize 每页大小（0表示不分页）
+ * @return error 错误信息
+ */
+func ValidatePageSize(pageSize int) error {
+	if pageSize < 0 {
+		return errors.New("pageSize 不能为负数")
+	}
+	if maxPageSize := positiveOr(setting.Conf.Query.MaxPageSize, defaultMaxPageSize); pageSize > maxPageSize {
+		return fmt.Errorf("pageSize 不能超过 %d", maxPageSize)
+	}
+	return nil
+}
+
+/**
+ * StartRowsPagedQuery 保存行查询的结果并返回第一页
+ * @param uid 用户ID
+ * @param queryItem 查询项（上链查询日志用）
+ * @param queryResult 查询结果（JSON字符串）
+ * @param pageSize 每页行数
+ * @param logOptions 每一页上链查询日志的附加信息
+ * @return *QueryPage 第一页
+ * @return *PagedQuery 分页查询（PagedQueryId已写入其LogOptions）
+ * @return error 错误信息
+ */
+func StartRowsPagedQuery(uid string, queryItem string, queryResult string, pageSize int, logOptions QueryLogOptions) (*QueryPage, *PagedQuery, error) {
+	var queryResultData QueryResult
+	if err := json.Unmarshal([]byte(queryResult), &queryResultData); err != nil {
+		return nil, nil, errors.New("解析查询结果失败: " + err.Error())
+	}
+	query := &PagedQuery{
+		Uid:        uid,
+		Kind:       PagedQueryKindRows,
+		QueryItem:  queryItem,
+		LogOptions: logOptions,
+		rows:       queryResultData.Data,
+		message:    queryResultData.Message,
+		pageSize:   pageSize,
+	}
+	return startPagedQuery(query, nil)
+}
+
+/**
+ * StartIndexPagedQuery 保存索引查询的条件并返回第一页
+ * @param uid 用户ID
+ * @param queryItem 上链查询日志的查询项（索引查询条件）
+ * @param req 索引查询条件
+ * @param pageSize 每页交易ID数
+ * @param logOptions 每一页上链查询日志的附加信息
+ * @param index 索引服务
+ * @return *QueryPage 第一页
+ * @return *PagedQuery 分页查询（PagedQueryId已写入其LogOptions）
+ * @return error 错误信息
+ */
+func StartIndexPagedQuery(uid string, queryItem string, req indexer.SearchRequest, pageSize int, logOptions QueryLogOptions, index PageIndex) (*QueryPage, *PagedQuery, error) {
+	query := &PagedQuery{
+		Uid:        uid,
+		Kind:       PagedQueryKindIndex,
+		QueryItem:  queryItem,
+		LogOptions: logOptions,
+		search:     req,
+		pageSize:   pageSize,
+	}
+	return startPagedQuery(query, index)
+}
+
+/**
+ * startPagedQuery 生成分页查询ID、保存分页查询并返回第一页
+ * @param query 分页查询
+ * @param index 索引服务（索引查询时使用）
+ * @return *QueryPage 第一页
+ * @return *PagedQuery 分页查询
+ * @return error 错误信息
+ */
+func startPagedQuery(query *PagedQuery, index PageIndex) (*QueryPage, *PagedQuery, error) {
+	if query.pageSize <= 0 {
+		return nil, nil, errors.New("pageSize 须为正数")
+	}
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, nil, errors.New("生成分页查询ID失败: " + err.Error())
+	}
+	query.ID = hex.EncodeToString(idBytes)
+	query.LogOptions.PagedQueryId = query.ID
+	query.expiresAt = time.Now().Add(pageTTL())
+
+	page, err := query.page(0, query.expiresAt, index)
+	if err != nil {
+		return nil, nil, err
+	}
+	// 只有一页时不保存
+	if page.NextCursor != "" {
+		storePagedQuery(query)
+	}
+	return page, query, nil
+}
+
+/**
+ * NextQueryPage 校验游标并返回对应的一页（延长分页查询的有效期）
+ * @param cursor 游标
+ * @param uid 用户ID（须与发起查询的用户一致）
+ * @param index 索引服务（索引查询时使用）
+ * @return *QueryPage 本页
+ * @return *PagedQuery 分页查询（上链查询日志用）
+ * @return error 游标无效时返回错误；分页查询过期或被淘汰时为ErrPagedQueryExpired
+ */
+func NextQueryPage(cursor string, uid string, index PageIndex) (*QueryPage, *PagedQuery, error) {
+	payload, err := parseCursor(cursor)
+	if err != nil {
+		return nil, nil, err
+	}
+	if payload.Uid != uid {
+		return nil, nil, errors.New("游标不属于该用户")
+	}
+	if time.Now().Unix() > payload.Exp {
+		return nil, nil, ErrPagedQueryExpired
+	}
+
+	pagedQueriesLock.Lock()
+	query, ok := pagedQueries[payload.ID]
+	if ok && time.Now().After(query.expiresAt) {
+		delete(pagedQueries, payload.ID)
+		ok = false
+	}
+	var expiresAt time.Time
+	if ok {
+		query.expiresAt = time.Now().Add(pageTTL())
+		expiresAt = query.expiresAt
+	}
+	pagedQueriesLock.Unlock()
+	if !ok {
+		return nil, nil, ErrPagedQueryExpired
+	}
+	if query.Uid != uid || query.pageSize != payload.Size {
+		return nil, nil, errors.New("游标与分页查询不一致")
+	}
+
+	// 最后一页之后仍保留到过期，客户端可以重试
+	page, err := query.page(payload.Offset, expiresAt, index)
+	if err != nil {
+		return nil, nil, err
+	}
+	return page, query, nil
+}
+
+/**
+ * page 取出从offset开始的一页，并生成下一页的游标
+ * @param offset 偏移量
+ * @param expiresAt 分页查询的过期时间（写入游标）
+ * @param index 索引服务（索引查询时使用）
+ * @return *QueryPage 本页
+ * @return error 错误信息
+ */
+func (q *PagedQuery) page(offset int, expiresAt time.Time, index PageIndex) (*QueryPage, error) {
+	page := &QueryPage{PagedQueryId: q.ID, Offset: offset, PageSize: q.pageSize, ExpiresAt: expiresAt.Unix()}
+	hasMore := false
+	switch q.Kind {
+	case PagedQueryKindRows:
+		page.Total, page.Message = len(q.rows), q.message
+		if offset < len(q.rows) {
+			page.Data = q.rows[offset:min(offset+q.pageSize, len(q.rows))]
+		}
+		page.Counts = len(page.Data)
+		hasMore = offset+q.pageSize < len(q.rows)
+	case PagedQueryKindIndex:
+		if index == nil {
+			return nil, errors.New("索引服务未初始化")
+		}
+		// 每页重新执行索引查询，新上链的记录排在后面，不影响已返回的页
+		result, err := index.ExecuteQueryPage(q.search, offset, q.pageSize)
+		if err != nil {
+			return nil, errors.New("查询失败: " + err.Error())
+		}
+		page.FilePoses, err = index.GetPosesByTxIDs(result.TxIDs)
+		if err != nil {
+			return nil, errors.New("获取pos信息失败: " + err.Error())
+		}
+		page.TxIDs, page.Counts, page.Total = result.TxIDs, len(result.TxIDs), -1
+		hasMore = result.HasMore
+		page.Message = "索引查询成功"
+	default:
+		return nil, fmt.Errorf("不支持的分页查询类型 %s", q.Kind)
+	}
+	if hasMore {
+		cursor, err := signCursor(pageCursor{ID: q.ID, Offset: offset + q.pageSize, Size: q.pageSize, Uid: q.Uid, Exp: page.ExpiresAt})
+		if err != nil {
+			return nil, err
+		}
+		page.NextCursor = cursor
+	}
+	return page, nil
+}
+
+/**
+ * storePagedQuery 保存分页查询：先清理过期的，超过个数上限时淘汰最早过期的
+ * @param query 分页查询
+ */
+func storePagedQuery(query *PagedQuery) {
+	pagedQueriesLock.Lock()
+	defer pagedQueriesLock.Unlock()
+	now := time.Now()
+	for id, stored := range pagedQueries {
+		if now.After(stored.expiresAt) {
+			delete(pagedQueries, id)
+		}
+	}
+	maxPagedQueries := positiveOr(setting.Conf.Query.MaxPagedQueries, defaultMaxPagedQueries)
+	for len(pagedQueries) >= maxPagedQueries {
+		oldestID := ""
+		for id, stored := range pagedQueries {
+			if oldestID == "" || stored.expiresAt.Before(pagedQueries[oldestID].expiresAt) {
+				oldestID = id
+			}
+		}
+		delete(pagedQueries, oldestID)
+	}
+	pagedQueries[query.ID] = query
+}
+
+// pageTTL 分页查询的有效期
+func pageTTL() time.Duration {
+	return time.Duration(positiveOr(setting.Conf.Query.PageTTL, defaultPageTTL)) * time.Second
+}
+
+/**
+ * pageCursorSecret 游标的签名密钥：使用配置的密钥，未配置时第一次使用时随机生成
+ * @return []byte 密钥
+ */
+func pageCursorSecret() []byte {
+	cursorSecretOnce.Do(func() {
+		if secret := setting.Conf.Query.CursorSecret; secret != "" {
+			cursorSecret = []byte(secret)
+			return
+		}
+		cursorSecret = make([]byte, 32)
+		if _, err := rand.Read(cursorSecret); err != nil {
+			panic("生成游标签名密钥失败: " + err.Error())
+		}
+	})
+	return cursorSecret
+}
+
+/**
+ * signCursor 生成签名的游标：base64url(载荷).base64url(HMAC-SHA256(载荷))
+ * @param payload 游标的载荷
+ * @return string 游标
+ * @return error 错误信息
+ */
+func signCursor(payload pageCursor) (string, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return "", errors.New("生成游标失败: " + err.Error())
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payloadBytes)
+	mac := hmac.New(sha256.New, pageCursorSecret())
+	mac.Write([]byte(encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+/**
+ * parseCursor 校验游标的签名并解析载荷
+ * @param cursor 游标
+ * @return pageCursor 游标的载荷
+ * @return error 游标格式错误或签名不正确
+ */
+func parseCursor(cursor string) (pageCursor, error) {
+	var payload pageCursor
+	encoded, signature, ok := strings.Cut(strings.TrimSpace(cursor), ".")
+	if !ok {
+		return payload, errors.New("游标格式错误")
+	}
+	signatureBytes, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return payload, errors.New("游标格式错误")
+	}
+	mac := hmac.New(sha256.New, pageCursorSecret())
+	mac.Write([]byte(encoded))
+	if !hmac.Equal(signatureBytes, mac.Sum(nil)) {
+		return payload, errors.New("游标签名不正确")
+	}
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return payload, errors.New("游标格式错误")
+	}
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil || payload.ID == "" || payload.Offset < 0 || payload.Size <= 0 {
+		return payload, errors.New("游标格式错误")
+	}
+	return payload, nil
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestPagedQuery 保存5行的行查询，每页2行
+func startTestPagedQuery(t *testing.T, uid string) *QueryPage {
+	t.Helper()
+	queryResult, _ := json.Marshal(QueryResult{Counts: 5, Data: []interface{}{"r0", "r1", "r2", "r3", "r4"}, Message: "查询成功"})
+	page, _, err := StartRowsPagedQuery(uid, "{}", string(queryResult), 2, QueryLogOptions{})
+	if err != nil {
+		t.Fatalf("StartRowsPagedQuery 失败: %v", err)
+	}
+	return page
+}
+
+func TestRowsPagedQueryWalk(t *testing.T) {
+	page := startTestPagedQuery(t, "u1")
+	got := make([]interface{}, 0)
+	offsets := make([]int, 0)
+	for {
+		got = append(got, page.Data...)
+		offsets = append(offsets, page.Offset)
+		if page.Total != 5 {
+			t.Fatalf("total = %d，期望 5", page.Total)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		var err error
+		page, _, err = NextQueryPage(page.NextCursor, "u1", nil)
+		if err != nil {
+			t.Fatalf("NextQueryPage 失败: %v", err)
+		}
+	}
+	if strings.Join(toStrings(got), ",") != "r0,r1,r2,r3,r4" {
+		t.Errorf("翻页得到的行 = %v", got)
+	}
+	if len(offsets) != 3 || offsets[2] != 4 {
+		t.Errorf("偏移量 = %v，期望 [0 2 4]", offsets)
+	}
+}
+
+func TestNextQueryPageRejectsInvalidCursor(t *testing.T) {
+	page := startTestPagedQuery(t, "u1")
+	encoded, signature, _ := strings.Cut(page.NextCursor, ".")
+	payloadBytes, _ := base64.RawURLEncoding.DecodeString(encoded)
+	var payload pageCursor
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+		t.Fatalf("游标载荷解析失败: %v", err)
+	}
+
+	// 修改偏移量但沿用原签名
+	tampered := payload
+	tampered.Offset = 0
+	tamperedBytes, _ := json.Marshal(tampered)
+	tamperedCursor := base64.RawURLEncoding.EncodeToString(tamperedBytes) + "." + signature
+
+	// 正确签名但每页大小与分页查询不一致
+	resized := payload
+	resized.Size = 3
+	resizedCursor, _ := signCursor(resized)
+
+	// 正确签名但已过期
+	expired := payload
+	expired.Exp = time.Now().Add(-time.Minute).Unix()
+	expiredCursor, _ := signCursor(expired)
+
+	// 正确签名但分页查询不存在
+	unknown := payload
+	unknown.ID = "unknown"
+	unknownCursor, _ := signCursor(unknown)
+
+	cases := []struct {
+		name    string
+		cursor  string
+		uid     string
+		wantErr string
+		expired bool
+	}{
+		{"格式错误", "abc", "u1", "游标格式错误", false},
+		{"签名不是base64", encoded + ".!!", "u1", "游标格式错误", false},
+		{"篡改载荷", tamperedCursor, "u1", "游标签名不正确", false},
+		{"其他用户", page.NextCursor, "u2", "游标不属于该用户", false},
+		{"每页大小不一致", resizedCursor, "u1", "游标与分页查询不一致", false},
+		{"游标过期", expiredCursor, "u1", "", true},
+		{"分页查询不存在", unknownCursor, "u1", "", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := NextQueryPage(tc.cursor, tc.uid, nil)
+			if tc.expired {
+				if !errors.Is(err, ErrPagedQueryExpired) {
+					t.Fatalf("err = %v，期望 ErrPagedQueryExpired", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tc.wantErr {
+				t.Fatalf("err = %v，期望 %q", err, tc.wantErr)
+			}
+		})
+	}
+
+	// 被拒绝的游标不影响原游标
+	if _, _, err := NextQueryPage(page.NextCursor, "u1", nil); err != nil {
+		t.Fatalf("原游标翻页失败: %v", err)
+	}
+}
+
+func TestValidatePageSize(t *testing.T) {
+	cases := []struct {
+		pageSize int
+		wantErr  bool
+	}{
+		{-1, true},
+		{0, false},
+		{1, false},
+		{defaultMaxPageSize, false},
+		{defaultMaxPageSize + 1, true},
+	}
+	for _, tc := range cases {
+		if err := ValidatePageSize(tc.pageSize); (err != nil) != tc.wantErr {
+			t.Errorf("ValidatePageSize(%d) = %v，期望出错 %v", tc.pageSize, err, tc.wantErr)
+		}
+	}
+}
+
+// toStrings 测试辅助：把结果行转为字符串
+func toStrings(values []interface{}) []string {
+	result := make([]string, len(values))
+	for i, value := range values {
+		result[i], _ = value.(string)
+	}
+	return result
+}
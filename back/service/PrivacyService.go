@@ -0,0 +1,267 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"chainqa_offchain_demo/setting"
+)
+
+// ----------------差分隐私聚合查询（DIFFERENTIAL PRIVACY）-------------------
+// 查询项带privacy时为差分隐私查询：只返回count/sum/avg的加噪结果（可按列分组，即分面计数），不返回原始行。
+// 每次查询使用的隐私预算（epsilon）按聚合函数平均分配；各分组互不相交，分组不额外使用预算。
+// 每个组织在数据域中的累计预算记录在链上，查询成功后、返回结果前在链上扣减，超过预算时不返回结果（失败的查询不消耗预算）。
+
+// 噪声机制
+const (
+	PrivacyMechanismLaplace  = "laplace"  // 拉普拉斯机制（纯epsilon差分隐私）
+	PrivacyMechanismGaussian = "gaussian" // 高斯机制（(epsilon, delta)差分隐私）
+)
+
+// PrivacyOptions 差分隐私查询选项
+type PrivacyOptions struct {
+	Mechanism string                `json:"mechanism"` // 噪声机制：laplace（默认）/gaussian
+	Epsilon   float64               `json:"epsilon"`   // 本次查询使用的隐私预算
+	Delta     float64               `json:"delta"`     // gaussian：delta，须在(0,1)之间
+	Bounds    map[string][2]float64 `json:"bounds"`    // sum/avg的列的取值范围：列名 -> [下界, 上界]，超出的值截断到范围内
+}
+
+// privacyPlan 校验后的差分隐私查询计划
+type privacyPlan struct {
+	options    PrivacyOptions
+	releaseEps float64 // 每次发布（count、sum各一次，avg为sum和count两次）使用的epsilon
+	releaseDel float64 // 每次发布使用的delta
+	minCount   int     // 分组的最小加噪计数
+	countIndex int     // 分组时用于过滤小分组的count聚合的下标
+
+	droppedGroups int // 加噪后计数过小而不返回的分组数（由groupAndAggregate设置）
+}
+
+/**
+ * newPrivacyPlan 校验差分隐私查询：只允许count/sum/avg，sum/avg须设置取值范围，分组时须包含count
+ * @param queryItemData 查询项
+ * @return *privacyPlan 查询计划，不是差分隐私查询时为nil
+ * @return error 错误信息
+ */
+func newPrivacyPlan(queryItemData QueryItem) (*privacyPlan, error) {
+	options := queryItemData.Privacy
+	if options == nil {
+		return nil, nil
+	}
+	if err := ValidatePrivacyOptions(options); err != nil {
+		return nil, err
+	}
+	if len(queryItemData.Aggregates) == 0 {
+		return nil, errors.New("差分隐私查询只能返回聚合结果（count/sum/avg）")
+	}
+
+	plan := &privacyPlan{options: *options, minCount: setting.Conf.Query.DPMinGroupCount, countIndex: -1}
+	releases := 0
+	for i, aggregate := range queryItemData.Aggregates {
+		switch aggregate.Func {
+		case "count":
+			releases++
+			if plan.countIndex < 0 {
+				plan.countIndex = i
+			}
+		case "sum", "avg":
+			bounds, ok := options.Bounds[aggregate.Field]
+			if !ok {
+				return nil, fmt.Errorf("差分隐私查询中 %s(%s) 须在 bounds 中设置取值范围", aggregate.Func, aggregate.Field)
+			}
+			if !(bounds[0] < bounds[1]) {
+				return nil, fmt.Errorf("列 %s 的取值范围下界须小于上界", aggregate.Field)
+			}
+			releases++
+			if aggregate.Func == "avg" {
+				releases++
+			}
+		default:
+			return nil, fmt.Errorf("差分隐私查询不支持聚合函数 %s（只支持count/sum/avg）", aggregate.Func)
+		}
+	}
+	if len(queryItemData.GroupBy) > 0 && plan.countIndex < 0 {
+		return nil, errors.New("差分隐私分组查询须包含count，用于去掉小分组")
+	}
+	plan.releaseEps = options.Epsilon / float64(releases)
+	plan.releaseDel = options.Delta / float64(releases)
+	return plan, nil
+}
+
+/**
+ * ValidatePrivacyOptions 校验差分隐私选项（噪声机制、epsilon、delta），使用预算前调用
+ * @param options 差分隐私选项
+ * @return error 错误信息
+ */
+func ValidatePrivacyOptions(options *PrivacyOptions) error {
+	if options.Mechanism == "" {
+		options.Mechanism = PrivacyMechanismLaplace
+	}
+	switch options.Mechanism {
+	case PrivacyMechanismLaplace:
+	case PrivacyMechanismGaussian:
+		if !(options.Delta > 0 && options.Delta < 1) {
+			return errors.New("高斯机制的 delta 须在 (0,1) 之间")
+		}
+	default:
+		return fmt.Errorf("不支持的噪声机制 %s（laplace/gaussian）", options.Mechanism)
+	}
+	if !(options.Epsilon > 0) || math.IsInf(options.Epsilon, 0) {
+		return errors.New("epsilon 须为正数")
+	}
+	if maxEpsilon := setting.Conf.Query.DPMaxEpsilon; maxEpsilon > 0 && options.Epsilon > maxEpsilon {
+		return fmt.Errorf("epsilon 不能超过 %g", maxEpsilon)
+	}
+	return nil
+}
+
+/**
+ * PrivacyQuery 判断查询项是否为差分隐私查询，是时校验查询（使用隐私预算前调用）
+ * @param queryItem 查询项（JSON字符串）
+ * @return string 差分隐私选项的摘要（记录在查询日志中），不是差分隐私查询（或查询项格式错误）时为空
+ * @return float64 本次查询使用的隐私预算
+ * @return error 差分隐私查询不合法时返回错误
+ */
+func PrivacyQuery(queryItem string) (string, float64, error) {
+	var queryItemData QueryItem
+	if err := json.Unmarshal([]byte(queryItem), &queryItemData); err != nil || queryItemData.Privacy == nil {
+		return "", 0, nil
+	}
+	plan, err := newPrivacyPlan(queryItemData)
+	if err != nil {
+		return "", 0, err
+	}
+	return plan.summary(), plan.options.Epsilon, nil
+}
+
+/**
+ * accumulate 累计一个非空单元格：sum/avg的值截断到取值范围内
+ * @param state 聚合状态
+ * @param aggregate 聚合函数
+ * @param cellValue 单元格值
+ * @return error 错误信息
+ */
+func (p *privacyPlan) accumulate(state *aggregateState, aggregate AggregateItem, cellValue string) error {
+	if aggregate.Func != "count" {
+		v, err := strconv.ParseFloat(cellValue, 64)
+		if err != nil {
+			return fmt.Errorf("数据 %v 无法转换为数字", cellValue)
+		}
+		bounds := p.options.Bounds[aggregate.Field]
+		state.sumFloat += math.Min(math.Max(v, bounds[0]), bounds[1])
+	}
+	state.count++
+	return nil
+}
+
+/**
+ * release 输出加噪后的聚合结果：count为非负整数，sum截断到可能的范围内，avg为加噪的和除以加噪的计数
+ * @param state 聚合状态
+ * @param aggregate 聚合函数
+ * @return string 聚合结果
+ * @return float64 加噪后的计数（count时有效，用于过滤小分组）
+ */
+func (p *privacyPlan) release(state aggregateState, aggregate AggregateItem) (string, float64) {
+	noisyCount := float64(state.count) + p.noise(1)
+	switch aggregate.Func {
+	case "count":
+		count := math.Max(0, math.Round(noisyCount))
+		return strconv.FormatFloat(count, 'f', -1, 64), count
+	case "sum":
+		bounds := p.options.Bounds[aggregate.Field]
+		noisySum := state.sumFloat + p.noise(math.Max(math.Abs(bounds[0]), math.Abs(bounds[1])))
+		if aggregate.Type == "int" {
+			noisySum = math.Round(noisySum)
+		}
+		return strconv.FormatFloat(noisySum, 'f', -1, 64), 0
+	case "avg":
+		bounds := p.options.Bounds[aggregate.Field]
+		noisySum := state.sumFloat + p.noise(math.Max(math.Abs(bounds[0]), math.Abs(bounds[1])))
+		if noisyCount < 1 {
+			return NullCell, 0
+		}
+		avg := math.Min(math.Max(noisySum/noisyCount, bounds[0]), bounds[1])
+		return strconv.FormatFloat(avg, 'f', -1, 64), 0
+	}
+	return NullCell, 0
+}
+
+/**
+ * noise 按噪声机制生成一次发布的噪声
+ * @param sensitivity 敏感度（增删一行时结果的最大变化）
+ * @return float64 噪声
+ */
+func (p *privacyPlan) noise(sensitivity float64) float64 {
+	if p.options.Mechanism == PrivacyMechanismGaussian {
+		sigma := sensitivity * math.Sqrt(2*math.Log(1.25/p.releaseDel)) / p.releaseEps
+		return sigma * gaussianSample()
+	}
+	return laplaceSample(sensitivity / p.releaseEps)
+}
+
+/**
+ * summary 差分隐私选项的摘要，如 laplace(epsilon=0.5)
+ * @return string 摘要
+ */
+func (p *privacyPlan) summary() string {
+	if p.options.Mechanism == PrivacyMechanismGaussian {
+		return fmt.Sprintf("%s(epsilon=%g, delta=%g)", p.options.Mechanism, p.options.Epsilon, p.options.Delta)
+	}
+	return fmt.Sprintf("%s(epsilon=%g)", p.options.Mechanism, p.options.Epsilon)
+}
+
+/**
+ * uniformSample 生成(0,1)之间的均匀分布随机数（使用crypto/rand，噪声不可预测）
+ * @return float64 随机数
+ */
+func uniformSample() float64 {
+	var buf [8]byte
+	for {
+		if _, err := rand.Read(buf[:]); err != nil {
+			panic("生成随机数失败: " + err.Error())
+		}
+		u := float64(binary.BigEndian.Uint64(buf[:])>>11) / (1 << 53)
+		if u > 0 {
+			return u
+		}
+	}
+}
+
+/**
+ * laplaceSample 生成拉普拉斯分布的随机数
+ * @param scale 尺度参数b
+ * @return float64 随机数
+ */
+func laplaceSample(scale float64) float64 {
+	u := uniformSample() - 0.5
+	if u < 0 {
+		return scale * math.Log(1+2*u)
+	}
+	return -scale * math.Log(1-2*u)
+}
+
+/**
+ * gaussianSample 生成标准正态分布的随机数（Box-Muller）
+ * @return float64 随机数
+ */
+func gaussianSample() float64 {
+	return math.Sqrt(-2*math.Log(uniformSample())) * math.Cos(2*math.Pi*uniformSample())
+}
+
+/**
+ * note 差分隐私查询结果的说明，附加在查询结果的message中
+ * @return string 说明
+ */
+func (p *privacyPlan) note() string {
+	parts := []string{"差分隐私：" + p.summary()}
+	if p.droppedGroups > 0 {
+		parts = append(parts, fmt.Sprintf("%d个分组加噪后计数过小，未返回", p.droppedGroups))
+	}
+	return "（" + strings.Join(parts, "，") + "）"
+}
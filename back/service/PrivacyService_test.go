@@ -0,0 +1,175 @@
+package service
+
+import (
+	"chainqa_offchain_demo/setting"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNewPrivacyPlanBudgetSplit(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	bounds := map[string][2]float64{"age": {0, 100}}
+	cases := []struct {
+		name        string
+		aggregates  []AggregateItem
+		groupBy     []GroupByItem
+		options     PrivacyOptions
+		wantEps     float64
+		wantDel     float64
+		wantSummary string
+	}{
+		{"单个count使用全部预算", []AggregateItem{{Func: "count"}}, nil,
+			PrivacyOptions{Epsilon: 1}, 1, 0, "laplace(epsilon=1)"},
+		{"count和sum平分", []AggregateItem{{Func: "count"}, {Func: "sum", Field: "age"}}, nil,
+			PrivacyOptions{Epsilon: 1, Bounds: bounds}, 0.5, 0, "laplace(epsilon=1)"},
+		{"avg按两次发布计算", []AggregateItem{{Func: "count"}, {Func: "avg", Field: "age"}}, []GroupByItem{{Field: "gender"}},
+			PrivacyOptions{Epsilon: 0.9, Bounds: bounds}, 0.3, 0, "laplace(epsilon=0.9)"},
+		{"高斯机制同时平分delta", []AggregateItem{{Func: "count"}, {Func: "sum", Field: "age"}}, nil,
+			PrivacyOptions{Mechanism: PrivacyMechanismGaussian, Epsilon: 2, Delta: 1e-5, Bounds: bounds}, 1, 5e-6, "gaussian(epsilon=2, delta=1e-05)"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			options := tc.options
+			plan, err := newPrivacyPlan(QueryItem{Aggregates: tc.aggregates, GroupBy: tc.groupBy, Privacy: &options})
+			if err != nil {
+				t.Fatalf("newPrivacyPlan 失败: %v", err)
+			}
+			if math.Abs(plan.releaseEps-tc.wantEps) > 1e-12 || math.Abs(plan.releaseDel-tc.wantDel) > 1e-18 {
+				t.Errorf("每次发布 epsilon = %g, delta = %g，期望 %g, %g", plan.releaseEps, plan.releaseDel, tc.wantEps, tc.wantDel)
+			}
+			if plan.summary() != tc.wantSummary {
+				t.Errorf("summary = %s，期望 %s", plan.summary(), tc.wantSummary)
+			}
+		})
+	}
+}
+
+func TestNewPrivacyPlanErrors(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	cases := []struct {
+		name       string
+		aggregates []AggregateItem
+		groupBy    []GroupByItem
+		options    PrivacyOptions
+		maxEpsilon float64
+		wantErr    string
+	}{
+		{"epsilon为0", []AggregateItem{{Func: "count"}}, nil, PrivacyOptions{}, 0, "epsilon 须为正数"},
+		{"epsilon超过上限", []AggregateItem{{Func: "count"}}, nil, PrivacyOptions{Epsilon: 2}, 1, "epsilon 不能超过 1"},
+		{"不支持的噪声机制", []AggregateItem{{Func: "count"}}, nil, PrivacyOptions{Mechanism: "other", Epsilon: 1}, 0, "不支持的噪声机制"},
+		{"高斯机制缺少delta", []AggregateItem{{Func: "count"}}, nil, PrivacyOptions{Mechanism: PrivacyMechanismGaussian, Epsilon: 1}, 0, "delta"},
+		{"没有聚合", nil, nil, PrivacyOptions{Epsilon: 1}, 0, "只能返回聚合结果"},
+		{"不支持的聚合", []AggregateItem{{Func: "max", Field: "age"}}, nil, PrivacyOptions{Epsilon: 1}, 0, "不支持聚合函数 max"},
+		{"sum缺少取值范围", []AggregateItem{{Func: "sum", Field: "age"}}, nil, PrivacyOptions{Epsilon: 1}, 0, "须在 bounds 中设置取值范围"},
+		{"取值范围颠倒", []AggregateItem{{Func: "avg", Field: "age"}}, nil,
+			PrivacyOptions{Epsilon: 1, Bounds: map[string][2]float64{"age": {10, 0}}}, 0, "下界须小于上界"},
+		{"分组缺少count", []AggregateItem{{Func: "sum", Field: "age"}}, []GroupByItem{{Field: "gender"}},
+			PrivacyOptions{Epsilon: 1, Bounds: map[string][2]float64{"age": {0, 100}}}, 0, "须包含count"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			setting.Conf.Query.DPMaxEpsilon = tc.maxEpsilon
+			defer func() { setting.Conf.Query.DPMaxEpsilon = 0 }()
+			options := tc.options
+			_, err := newPrivacyPlan(QueryItem{Aggregates: tc.aggregates, GroupBy: tc.groupBy, Privacy: &options})
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("err = %v，期望包含 %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestPrivacyQuery(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	cases := []struct {
+		name        string
+		queryItem   string
+		wantSummary string
+		wantEpsilon float64
+		wantErr     bool
+	}{
+		{"不是差分隐私查询", `{"filePos":[["P"]]}`, "", 0, false},
+		{"格式错误的查询项", `{`, "", 0, false},
+		{"差分隐私查询", `{"aggregates":[{"func":"count"}],"privacy":{"epsilon":0.5}}`, "laplace(epsilon=0.5)", 0.5, false},
+		{"不合法的差分隐私查询", `{"privacy":{"epsilon":0.5}}`, "", 0, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			summary, epsilon, err := PrivacyQuery(tc.queryItem)
+			if (err != nil) != tc.wantErr || summary != tc.wantSummary || epsilon != tc.wantEpsilon {
+				t.Errorf("PrivacyQuery = %q, %g, %v", summary, epsilon, err)
+			}
+		})
+	}
+}
+
+func TestPrivacyNoiseDistribution(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	const samples = 20000
+	cases := []struct {
+		name    string
+		options PrivacyOptions
+		wantAbs float64 // 噪声绝对值的期望
+	}{
+		// 拉普拉斯分布 E|X| = b = 敏感度/epsilon
+		{"laplace", PrivacyOptions{Epsilon: 0.5}, 2},
+		// 正态分布 E|X| = sigma*sqrt(2/pi)
+		{"gaussian", PrivacyOptions{Mechanism: PrivacyMechanismGaussian, Epsilon: 1, Delta: 1e-5},
+			math.Sqrt(2*math.Log(1.25/1e-5)) * math.Sqrt(2/math.Pi)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			options := tc.options
+			plan, err := newPrivacyPlan(QueryItem{Aggregates: []AggregateItem{{Func: "count"}}, Privacy: &options})
+			if err != nil {
+				t.Fatalf("newPrivacyPlan 失败: %v", err)
+			}
+			sum, sumAbs := 0.0, 0.0
+			for i := 0; i < samples; i++ {
+				noise := plan.noise(1)
+				sum += noise
+				sumAbs += math.Abs(noise)
+			}
+			if mean := sum / samples; math.Abs(mean) > 0.1*tc.wantAbs {
+				t.Errorf("噪声均值 = %g，期望接近0", mean)
+			}
+			if meanAbs := sumAbs / samples; math.Abs(meanAbs-tc.wantAbs) > 0.1*tc.wantAbs {
+				t.Errorf("噪声绝对值均值 = %g，期望接近 %g", meanAbs, tc.wantAbs)
+			}
+		})
+	}
+}
+
+func TestPrivacyReleaseBounds(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	options := PrivacyOptions{Epsilon: 0.1, Bounds: map[string][2]float64{"age": {0, 100}}}
+	plan, err := newPrivacyPlan(QueryItem{Aggregates: []AggregateItem{{Func: "count"}, {Func: "avg", Field: "age"}}, Privacy: &options})
+	if err != nil {
+		t.Fatalf("newPrivacyPlan 失败: %v", err)
+	}
+	// 超出取值范围的值截断后累计
+	var state aggregateState
+	for _, value := range []string{"-50", "50", "500"} {
+		if err := plan.accumulate(&state, AggregateItem{Func: "avg", Field: "age"}, value); err != nil {
+			t.Fatalf("accumulate 失败: %v", err)
+		}
+	}
+	if state.sumFloat != 150 || state.count != 3 {
+		t.Errorf("sum = %g, count = %d，期望 150, 3", state.sumFloat, state.count)
+	}
+	for i := 0; i < 200; i++ {
+		count, _ := plan.release(aggregateState{count: 1}, AggregateItem{Func: "count"})
+		if value, err := strconv.ParseFloat(count, 64); err != nil || value < 0 || value != math.Round(value) {
+			t.Fatalf("加噪计数 = %s，期望非负整数", count)
+		}
+		avg, _ := plan.release(state, AggregateItem{Func: "avg", Field: "age"})
+		if avg == NullCell {
+			continue
+		}
+		if value, err := strconv.ParseFloat(avg, 64); err != nil || value < 0 || value > 100 {
+			t.Fatalf("加噪平均值 = %s，期望在取值范围内", avg)
+		}
+	}
+}
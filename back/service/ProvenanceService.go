@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"chainqa_offchain_demo/indexer"
+)
+
+// ----------------结果行来源（PROVENANCE）-------------------
+// 查询项带withProvenance时，每个结果行附带来源列（_provenance）：行所在的数据集、分片CID、分片下标、分片中的行号，
+// 以及上传该分片的数字信封交易（上传者、上传时间、区块高度、交易ID，来自索引服务），用于把结果追溯到上传的原始文件。
+// 解析分片时每个数据集加入一个内部来源列（单元格为 数据集下标:分片下标:行号），随过滤、排序、合并、联表保留，投影时展开；
+// 联表查询的结果行有多个来源（每个数据集一个，外连接中未匹配的一侧没有来源）。只能用于返回原始行的查询。
+
+// ProvenanceColumn 来源列：结果行中的来源（数组），也是表中内部来源列的列名（不带pos前缀）
+const ProvenanceColumn = "_provenance"
+
+// RowProvenance 结果行的一个来源
+type RowProvenance struct {
+	Dataset     string `json:"dataset"`     // 数据集主CID
+	Cid         string `json:"cid"`         // 分片CID
+	ShardIndex  int    `json:"shardIndex"`  // 分片在数据集中的下标（从0开始）
+	RowNumber   int    `json:"rowNumber"`   // 分片中的行号（从1开始，不含表头）
+	Uploader    string `json:"uploader"`    // 上传者用户ID（索引中没有上传记录时为空，下同）
+	UploadedAt  string `json:"uploadedAt"`  // 上传时间（Unix秒）
+	BlockHeight uint64 `json:"blockHeight"` // 数字信封交易所在的区块高度
+	TxID        string `json:"txId"`        // 数字信封交易ID
+}
+
+// PosRecordLookup 按分片CID获取上传分片的数字信封交易（由索引服务实现），没有记录的分片不在结果中
+type PosRecordLookup func(poses []string) (map[string]indexer.PosRecord, error)
+
+type posRecordLookupKey struct{}
+
+/**
+ * WithPosRecordLookup 在context上附加分片上传记录的获取函数（withProvenance的查询使用）
+ * @param ctx 查询的context
+ * @param lookup 获取函数，为nil时来源中的上传信息为空
+ * @return context.Context 附加后的context
+ */
+func WithPosRecordLookup(ctx context.Context, lookup PosRecordLookup) context.Context {
+	if lookup == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, posRecordLookupKey{}, lookup)
+}
+
+// provenancePlan 一次查询中来源列的展开
+type provenancePlan struct {
+	filePos [][]string                   // 查询项中的数据集和分片
+	records map[string]indexer.PosRecord // 分片CID -> 上传记录
+}
+
+/**
+ * newProvenancePlan 为withProvenance的查询获取所有分片的上传记录
+ * @param ctx 查询的context（带获取函数）
+ * @param queryItemData 查询项
+ * @return *provenancePlan 来源列的展开，查询项没有withProvenance时为nil
+ * @return error 分组聚合、差分隐私查询，或获取上传记录失败时返回错误
+ */
+func newProvenancePlan(ctx context.Context, queryItemData QueryItem) (*provenancePlan, error) {
+	if !queryItemData.WithProvenance {
+		return nil, nil
+	}
+	if len(queryItemData.GroupBy) > 0 || len(queryItemData.Aggregates) > 0 || queryItemData.Privacy != nil {
+		return nil, errors.New("withProvenance 只能用于返回原始行的查询（不支持分组聚合和差分隐私）")
+	}
+	plan := &provenancePlan{filePos: queryItemData.FilePos, records: make(map[string]indexer.PosRecord)}
+	lookup, _ := ctx.Value(posRecordLookupKey{}).(PosRecordLookup)
+	if lookup == nil {
+		return plan, nil
+	}
+	poses := make([]string, 0)
+	for _, filePoses := range queryItemData.FilePos {
+		poses = append(poses, filePoses...)
+	}
+	records, err := lookup(poses)
+	if err != nil {
+		return nil, errors.New("获取分片的上传记录失败: " + err.Error())
+	}
+	plan.records = records
+	return plan, nil
+}
+
+/**
+ * addProvenanceColumn 在解析后的分片中加入内部来源列，单元格为 数据集下标:分片下标:行号
+ * @param table 分片的表（列名带mainPos前缀）
+ * @param mainPos 列名前缀
+ * @param datasetIndex 数据集在查询项filePos中的下标
+ * @param shardIndex 分片在数据集中的下标
+ * @return error 分片中已有同名列时返回错误
+ */
+func addProvenanceColumn(table *Table, mainPos string, datasetIndex int, shardIndex int) error {
+	column := mainPos + "_" + ProvenanceColumn
+	if _, exists := table.HeaderMap[column]; exists {
+		return fmt.Errorf("列名 %s 为保留列名，不能与withProvenance同时使用", ProvenanceColumn)
+	}
+	index := len(table.Columns)
+	table.HeaderMap[column] = index
+	table.Columns = append(table.Columns, column)
+	prefix := strconv.Itoa(datasetIndex) + ":" + strconv.Itoa(shardIndex) + ":"
+	for i := range table.Rows {
+		// 旧格式的行可能多于表头的列，来源放在表头之后的第一列
+		table.Rows[i] = append(table.Rows[i][:index:index], prefix+strconv.Itoa(i+1))
+	}
+	return nil
+}
+
+/**
+ * rowProvenance 展开结果行的来源列
+ * @param cells 行数据
+ * @param indexes 表中内部来源列的列索引
+ * @return []RowProvenance 来源（联表时每个数据集一个，按数据集在查询项中的顺序）
+ */
+func (p *provenancePlan) rowProvenance(cells []string, indexes []int) []RowProvenance {
+	byDataset := make([]*RowProvenance, len(p.filePos))
+	for _, index := range indexes {
+		parts := strings.Split(cells[index], ":")
+		if isNullCell(cells[index]) || len(parts) != 3 {
+			// 外连接中未匹配的一侧
+			continue
+		}
+		datasetIndex, _ := strconv.Atoi(parts[0])
+		shardIndex, _ := strconv.Atoi(parts[1])
+		rowNumber, _ := strconv.Atoi(parts[2])
+		if datasetIndex >= len(p.filePos) || shardIndex >= len(p.filePos[datasetIndex]) {
+			continue
+		}
+		source := RowProvenance{
+			Dataset:    p.filePos[datasetIndex][0],
+			Cid:        p.filePos[datasetIndex][shardIndex],
+			ShardIndex: shardIndex,
+			RowNumber:  rowNumber,
+		}
+		if record, ok := p.records[source.Cid]; ok {
+			source.Uploader, source.UploadedAt = record.Uid, record.TimeStamp
+			source.BlockHeight, source.TxID = record.BlockHeight, record.TxID
+		}
+		byDataset[datasetIndex] = &source
+	}
+	sources := make([]RowProvenance, 0, len(indexes))
+	for _, source := range byDataset {
+		if source != nil {
+			sources = append(sources, *source)
+		}
+	}
+	return sources
+}
+
+// provenanceDataset 解析第datasetIndex个数据集时传给AggregateSliceINDataSet的来源参数，不需要来源时为-1
+func (q QueryItem) provenanceDataset(datasetIndex int) int {
+	if !q.WithProvenance {
+		return -1
+	}
+	return datasetIndex
+}
+
+// isProvenanceColumn 是否为内部来源列（列名带pos前缀）
+func isProvenanceColumn(key string) bool {
+	return headerField(key) == ProvenanceColumn
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"chainqa_offchain_demo/indexer"
+	"chainqa_offchain_demo/setting"
+)
+
+func TestQueryWithProvenance(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	shards := map[string]string{
+		"PV1": "id\tage\n1\t30\n2\t45\n",
+		"PV2": "id\tage\n3\t50\n4\t20\n",
+		"PW1": "id\tcity\n2\tx\n3\ty\n",
+	}
+	lookup := func(poses []string) (map[string]indexer.PosRecord, error) {
+		return map[string]indexer.PosRecord{"PV2": {TxID: "tx2", BlockHeight: 7, Uid: "u1", TimeStamp: "1735693850"}}, nil
+	}
+	ctx := WithPosRecordLookup(context.Background(), lookup)
+	single := QueryItem{QueryConcatType: "single", FilePos: [][]string{{"PV1", "PV2"}}, ReturnField: []string{"PV1_id"}, WithProvenance: true,
+		QueryConditions: [][]QueryCondition{{{Pos: "PV1", Field: "age", Val: "40", Compare: "ge", Type: "int"}}},
+		OrderBy:         []OrderByItem{{Pos: "PV1", Field: "age", Type: "int", Desc: true}}}
+	joint := QueryItem{QueryConcatType: "multi", FilePos: [][]string{{"PV1", "PV2"}, {"PW1"}}, ReturnField: []string{"PV1_id", "PW1_city"}, WithProvenance: true,
+		JointConditions: []JointCondition{{Pos1: "PV1", Field1: "id", Pos2: "PW1", Field2: "id", Compare: "eq", Type: "int", JointType: "INNER"}}}
+
+	cases := []struct {
+		name      string
+		queryItem QueryItem
+		want      string
+	}{
+		{"单表：过滤、排序后保留来源，带上传记录", single,
+			`[{"_provenance":[{"dataset":"PV1","cid":"PV2","shardIndex":1,"rowNumber":1,"uploader":"u1","uploadedAt":"1735693850","blockHeight":7,"txId":"tx2"}],"id":"3"},` +
+				`{"_provenance":[{"dataset":"PV1","cid":"PV1","shardIndex":0,"rowNumber":2,"uploader":"","uploadedAt":"","blockHeight":0,"txId":""}],"id":"2"}]`},
+		{"联表：每个数据集一个来源", joint,
+			`[{"PV1_id":"2","PW1_city":"x","_provenance":[{"dataset":"PV1","cid":"PV1","shardIndex":0,"rowNumber":2,"uploader":"","uploadedAt":"","blockHeight":0,"txId":""},` +
+				`{"dataset":"PW1","cid":"PW1","shardIndex":0,"rowNumber":1,"uploader":"","uploadedAt":"","blockHeight":0,"txId":""}]},` +
+				`{"PV1_id":"3","PW1_city":"y","_provenance":[{"dataset":"PV1","cid":"PV2","shardIndex":1,"rowNumber":1,"uploader":"u1","uploadedAt":"1735693850","blockHeight":7,"txId":"tx2"},` +
+				`{"dataset":"PW1","cid":"PW1","shardIndex":0,"rowNumber":2,"uploader":"","uploadedAt":"","blockHeight":0,"txId":""}]}]`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			queryItem, _ := json.Marshal(tc.queryItem)
+			queryResult, counts, err := GetQueryResultContext(ctx, string(queryItem), shards, QueryLimits{})
+			if err != nil || counts == -1 {
+				t.Fatalf("查询失败: %s, %v", queryResult, err)
+			}
+			var queryResultData QueryResult
+			_ = json.Unmarshal([]byte(queryResult), &queryResultData)
+			// 结果行经过JSON往返，按键名排序后比较
+			var wantData interface{}
+			_ = json.Unmarshal([]byte(tc.want), &wantData)
+			rows, _ := json.Marshal(queryResultData.Data)
+			wantRows, _ := json.Marshal(wantData)
+			if string(rows) != string(wantRows) {
+				t.Errorf("结果 = %s，期望 %s", rows, wantRows)
+			}
+		})
+	}
+
+	// 流式查询的来源与普通查询一致
+	streamItem := single
+	streamItem.OrderBy = nil
+	queryItem, _ := json.Marshal(streamItem)
+	buffered, _, _ := GetQueryResultContext(ctx, string(queryItem), shards, QueryLimits{})
+	streamed := make([]interface{}, 0)
+	loader := func(ctx context.Context, filePos string) (string, error) { return shards[filePos], nil }
+	if queryResult, counts, err := StreamQuery(ctx, string(queryItem), QueryLimits{}, loader, func(row interface{}) error {
+		streamed = append(streamed, row)
+		return nil
+	}); err != nil || counts == -1 {
+		t.Fatalf("流式查询失败: %s, %v", queryResult, err)
+	}
+	var bufferedData QueryResult
+	_ = json.Unmarshal([]byte(buffered), &bufferedData)
+	bufferedRows, _ := json.Marshal(bufferedData.Data)
+	streamedRows, _ := json.Marshal(streamed)
+	if string(streamedRows) != string(bufferedRows) {
+		t.Errorf("流式结果 = %s，期望 %s", streamedRows, bufferedRows)
+	}
+
+	errCases := []struct {
+		name      string
+		ctx       context.Context
+		queryItem QueryItem
+		shards    map[string]string
+		want      string
+	}{
+		{"分组聚合", ctx, QueryItem{QueryConcatType: "single", FilePos: [][]string{{"PV1"}}, WithProvenance: true,
+			GroupBy: []GroupByItem{{Pos: "PV1", Field: "age", Type: "int"}}}, shards, "withProvenance 只能用于返回原始行的查询"},
+		{"保留列名", ctx, QueryItem{QueryConcatType: "single", FilePos: [][]string{{"PX"}}, ReturnField: []string{"PX_*"}, WithProvenance: true},
+			map[string]string{"PX": "id\t_provenance\n1\ta\n"}, "列名 _provenance 为保留列名"},
+		{"获取上传记录失败", WithPosRecordLookup(context.Background(), func(poses []string) (map[string]indexer.PosRecord, error) {
+			return nil, errors.New("索引服务不可用")
+		}), single, shards, "获取分片的上传记录失败: 索引服务不可用"},
+	}
+	for _, tc := range errCases {
+		t.Run(tc.name, func(t *testing.T) {
+			queryItem, _ := json.Marshal(tc.queryItem)
+			queryResult, counts, _ := GetQueryResultContext(tc.ctx, string(queryItem), tc.shards, QueryLimits{})
+			if counts != -1 || !strings.Contains(queryResult, tc.want) {
+				t.Errorf("结果 = %s，期望包含 %s", queryResult, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,382 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"chainqa_offchain_demo/indexer"
+)
+
+// ----------------谓词下推（PREDICATE PUSHDOWN）-------------------
+// 上传时每个分片的元数据（姓名、年龄、性别、医院、科室、疾病代码）已在索引服务中建立索引。
+// 单表查询的条件落在这些字段上时，先通过索引找出可能满足条件的分片，
+// 数据域内已索引、但不可能满足条件的分片记入 union.skipShards，不获取、不解密。
+// 未索引的分片无法判断，照常读取。
+
+// 谓词下推的限制
+const (
+	pushdownMaxAge      = 200 // 只有下界的年龄条件，上界取该值
+	pushdownMaxRequests = 16  // 一个查询最多展开的索引查询数（in条件按取值展开），超过时不下推
+)
+
+// 可下推的字符串字段：列名 -> 索引字段
+var pushdownStringFields = map[string]string{
+	"name":        "name",
+	"gender":      "gender",
+	"hospital":    "hospital",
+	"department":  "department",
+	"diseaseCode": "diseaseCode",
+}
+
+// ShardPruner 跳过不可能满足条件的分片：返回加入union.skipShards后的查询项和跳过的分片
+type ShardPruner func(queryItem string) (string, []string)
+
+// ShardIndex 分片索引（由索引服务实现）
+type ShardIndex interface {
+	ExecuteQuery(req indexer.SearchRequest) (*indexer.SearchResult, error)
+	GetPosesByTxIDs(txIDs []string) ([]string, error)
+	IndexedPoses(domainID string, poses []string) (map[string]bool, error)
+}
+
+/**
+ * PushdownShards 将查询条件下推到索引服务，跳过不可能满足条件的分片
+ * @param queryItem 查询项（JSON字符串）
+ * @param domainID 数据域ID（DOMAIN_ + 数据域名称）
+ * @param index 分片索引
+ * @return string 查询项（有跳过的分片时为加入union.skipShards后的查询项，否则原样返回）
+ * @return []string 本次跳过的分片
+ * @return error 错误信息（索引服务出错等，调用方可忽略并照常查询）
+ */
+func PushdownShards(queryItem string, domainID string, index ShardIndex) (string, []string, error) {
+	var queryItemData QueryItem
+	if err := json.Unmarshal([]byte(queryItem), &queryItemData); err != nil {
+		return queryItem, nil, err
+	}
+	// 只下推单表查询：联表时跳过分片会改变外连接的结果
+	if queryItemData.QueryConcatType != "single" || len(queryItemData.FilePos) == 0 || len(queryItemData.FilePos[0]) == 0 {
+		return queryItem, nil, nil
+	}
+	mainPos := queryItemData.FilePos[0][0]
+	requests, ok := pushdownRequests(queryItemData, mainPos, domainID)
+	if !ok {
+		return queryItem, nil, nil
+	}
+
+	indexed, err := index.IndexedPoses(domainID, queryItemData.FilePos[0])
+	if err != nil || len(indexed) == 0 {
+		return queryItem, nil, err
+	}
+	candidates := make(map[string]bool)
+	for _, req := range requests {
+		searchResult, err := index.ExecuteQuery(req)
+		if err != nil {
+			return queryItem, nil, err
+		}
+		poses, err := index.GetPosesByTxIDs(searchResult.TxIDs)
+		if err != nil {
+			return queryItem, nil, err
+		}
+		for _, pos := range poses {
+			candidates[pos] = true
+		}
+	}
+
+	skipped := skipShards(&queryItemData, mainPos, func(filePos string) bool {
+		return indexed[filePos] && !candidates[filePos]
+	})
+	if len(skipped) == 0 {
+		return queryItem, nil, nil
+	}
+	prunedQueryItem, err := json.Marshal(queryItemData)
+	if err != nil {
+		return queryItem, nil, err
+	}
+	return string(prunedQueryItem), skipped, nil
+}
+
+/**
+ * pushdownRequests 将查询条件转为索引查询：条件组之间为OR，每个条件组展开为若干个索引查询
+ * @param queryItemData 查询项
+ * @param mainPos 数据集主CID
+ * @param domainID 数据域ID
+ * @return []indexer.SearchRequest 索引查询（满足任一查询的分片才可能有结果）
+ * @return bool 能否下推（没有条件、某个条件组不含索引字段、展开过多时不能下推）
+ */
+func pushdownRequests(queryItemData QueryItem, mainPos string, domainID string) ([]indexer.SearchRequest, bool) {
+	if len(queryItemData.QueryConditions) == 0 {
+		return nil, false
+	}
+	// 与索引字段同名的计算列不是上传时的元数据
+	computed := make(map[string]bool)
+	for _, computedColumn := range queryItemData.ComputedColumns {
+		computed[computedColumn.Alias] = true
+	}
+	requests := make([]indexer.SearchRequest, 0)
+	for _, conditionGroup := range queryItemData.QueryConditions {
+		groupRequests, ok := groupPushdownRequests(conditionGroup, mainPos, domainID, computed)
+		if !ok {
+			return nil, false
+		}
+		requests = append(requests, groupRequests...)
+		if len(requests) > pushdownMaxRequests {
+			return nil, false
+		}
+	}
+	return requests, true
+}
+
+/**
+ * groupPushdownRequests 将一个条件组（AND）转为索引查询：年龄条件合并为一个区间，字符串字段的eq/in按取值展开
+ * @param conditionGroup 条件组
+ * @param mainPos 数据集主CID
+ * @param domainID 数据域ID
+ * @param computed 计算列的别名
+ * @return []indexer.SearchRequest 索引查询（为空表示该条件组不可能满足）
+ * @return bool 条件组中是否有可下推的条件
+ */
+func groupPushdownRequests(conditionGroup []QueryCondition, mainPos string, domainID string, computed map[string]bool) ([]indexer.SearchRequest, bool) {
+	ageStart, ageEnd := 0, pushdownMaxAge
+	hasAge := false
+	stringValues := make(map[string][]string) // 索引字段 -> 可能的取值
+	for _, condition := range conditionGroup {
+		if (condition.Pos != "" && condition.Pos != mainPos) || computed[condition.Field] {
+			continue
+		}
+		if condition.Field == "age" {
+			start, end, ok := ageConditionRange(condition)
+			if !ok {
+				continue
+			}
+			hasAge = true
+			ageStart, ageEnd = max(ageStart, start), min(ageEnd, end)
+			continue
+		}
+		indexField, ok := pushdownStringFields[condition.Field]
+		if !ok || (condition.Type != "" && condition.Type != "string") {
+			continue
+		}
+		var values []string
+		switch condition.Compare {
+		case "eq":
+			values = []string{condition.Val}
+		case "in":
+			list, err := parseCondValList(condition.Val)
+			if err != nil {
+				continue
+			}
+			values = list
+		default:
+			continue
+		}
+		// 同一字段的多个条件取交集
+		if previous, ok := stringValues[indexField]; ok {
+			values = intersectStrings(previous, values)
+		}
+		stringValues[indexField] = values
+	}
+	if !hasAge && len(stringValues) == 0 {
+		return nil, false
+	}
+	if hasAge && ageStart > ageEnd {
+		return []indexer.SearchRequest{}, true
+	}
+
+	base := indexer.SearchRequest{DomainID: domainID}
+	if hasAge {
+		base.AgeStart, base.AgeEnd = ageStart, ageEnd
+	}
+	requests := []indexer.SearchRequest{base}
+	for _, indexField := range []string{"name", "gender", "hospital", "department", "diseaseCode"} {
+		values, ok := stringValues[indexField]
+		if !ok {
+			continue
+		}
+		expanded := make([]indexer.SearchRequest, 0, len(requests)*len(values))
+		for _, req := range requests {
+			for _, value := range values {
+				next := req
+				setSearchField(&next, indexField, value)
+				expanded = append(expanded, next)
+			}
+		}
+		requests = expanded
+		if len(requests) > pushdownMaxRequests {
+			return nil, false
+		}
+	}
+	return requests, true
+}
+
+/**
+ * ageConditionRange 年龄条件对应的整数区间（上传时的年龄为整数）
+ * @param condition 年龄条件（int/float类型的eq/gt/ge/lt/le/between）
+ * @return int 下界
+ * @return int 上界
+ * @return bool 能否转为区间
+ */
+func ageConditionRange(condition QueryCondition) (int, int, bool) {
+	if condition.Type != "int" && condition.Type != "float" {
+		return 0, 0, false
+	}
+	if condition.Compare == "between" {
+		bounds, err := parseCondValBetween(condition.Val)
+		if err != nil {
+			return 0, 0, false
+		}
+		low, err1 := strconv.ParseFloat(strings.TrimSpace(bounds[0]), 64)
+		high, err2 := strconv.ParseFloat(strings.TrimSpace(bounds[1]), 64)
+		if err1 != nil || err2 != nil {
+			return 0, 0, false
+		}
+		return int(math.Ceil(low)), int(math.Floor(high)), true
+	}
+	val, err := strconv.ParseFloat(strings.TrimSpace(condition.Val), 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	switch condition.Compare {
+	case "eq":
+		return int(math.Ceil(val)), int(math.Floor(val)), true
+	case "ge":
+		return int(math.Ceil(val)), pushdownMaxAge, true
+	case "gt":
+		return int(math.Floor(val)) + 1, pushdownMaxAge, true
+	case "le":
+		return 0, int(math.Floor(val)), true
+	case "lt":
+		return 0, int(math.Ceil(val)) - 1, true
+	}
+	return 0, 0, false
+}
+
+/**
+ * skipShards 将主数据集中可以跳过的分片加入union.skipShards
+ * @param queryItemData 查询项（会被修改）
+ * @param mainPos 数据集主CID
+ * @param canSkip 分片能否跳过
+ * @return []string 本次跳过的分片
+ * @Description: 所有分片都被跳过、且没有主分片的表头时，保留主分片用于确定列
+ */
+func skipShards(queryItemData *QueryItem, mainPos string, canSkip func(filePos string) bool) []string {
+	skipped := make([]string, 0)
+	remaining := 0
+	for _, filePos := range queryItemData.FilePos[0] {
+		if strIsInSlice(queryItemData.Union.SkipShards, filePos) || strIsInSlice(skipped, filePos) {
+			continue
+		}
+		if canSkip(filePos) {
+			skipped = append(skipped, filePos)
+		} else {
+			remaining++
+		}
+	}
+	if remaining == 0 && len(skipped) > 0 {
+		if _, ok := LookupSchema(mainPos); !ok {
+			skipped = removeString(skipped, mainPos)
+		}
+	}
+	queryItemData.Union.SkipShards = append(queryItemData.Union.SkipShards, skipped...)
+	return skipped
+}
+
+// setSearchField 设置索引查询的等值字段
+func setSearchField(req *indexer.SearchRequest, indexField string, value string) {
+	switch indexField {
+	case "name":
+		req.Name = value
+	case "gender":
+		req.Gender = value
+	case "hospital":
+		req.Hospital = value
+	case "department":
+		req.Department = value
+	case "diseaseCode":
+		req.DiseaseCode = value
+	}
+}
+
+// intersectStrings 两个字符串切片的交集（保持a中的顺序）
+func intersectStrings(a []string, b []string) []string {
+	result := make([]string, 0)
+	for _, v := range a {
+		if strIsInSlice(b, v) && !strIsInSlice(result, v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// removeString 删除切片中的某个字符串
+func removeString(slice []string, str string) []string {
+	result := make([]string, 0, len(slice))
+	for _, v := range slice {
+		if v != str {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+/**
+ * ShardsToLoad 查询需要获取的分片（去掉union.skipShards中的分片）
+ * @param queryItemData 查询项
+ * @return []string 分片CID数组
+ */
+func ShardsToLoad(queryItemData QueryItem) []string {
+	filePoses := make([]string, 0)
+	for _, filePosesSingleDataSet := range queryItemData.FilePos {
+		for _, filePos := range filePosesSingleDataSet {
+			if !strIsInSlice(queryItemData.Union.SkipShards, filePos) {
+				filePoses = append(filePoses, filePos)
+			}
+		}
+	}
+	return filePoses
+}
+
+/**
+ * skippedDataSetTable 数据集的所有分片都被跳过时，按主分片缓存的表头（经列重命名）构造空表
+ * @param mainPos 数据集主CID
+ * @param unionOptions 合并选项
+ * @return *Table 空表
+ * @return error 主分片的表头未缓存
+ */
+func skippedDataSetTable(mainPos string, unionOptions UnionOptions) (*Table, error) {
+	schema, ok := LookupSchema(mainPos)
+	if !ok {
+		return nil, fmt.Errorf("数据集%s的所有分片都已跳过，且没有缓存的表头", mainPos)
+	}
+	table := newTable(mainPos, schema.Columns)
+	if err := renameTableColumns(table, mainPos, shardColumnMapping(unionOptions, mainPos), mainPos); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// skippedShardsNote 结果信息中跳过分片的说明
+func skippedShardsNote(skipShards []string) string {
+	if len(skipShards) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("（跳过%d个分片: %s）", len(skipShards), strings.Join(skipShards, ", "))
+}
+
+// withSkippedShardsMessage 在查询结果的信息中加入跳过的分片
+func withSkippedShardsMessage(queryResult string, skipShards []string) string {
+	if len(skipShards) == 0 {
+		return queryResult
+	}
+	var queryResultData QueryResult
+	if err := json.Unmarshal([]byte(queryResult), &queryResultData); err != nil {
+		return queryResult
+	}
+	queryResultData.Message += skippedShardsNote(skipShards)
+	returnData, err := json.Marshal(queryResultData)
+	if err != nil {
+		return queryResult
+	}
+	return string(returnData)
+}
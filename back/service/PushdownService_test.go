@@ -0,0 +1,149 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"chainqa_offchain_demo/indexer"
+)
+
+// testShardMeta 分片上传时建立索引的元数据
+type testShardMeta struct {
+	age    int
+	gender string
+}
+
+// testShardIndex 测试用的分片索引：PD3未建立索引
+type testShardIndex struct {
+	shards  map[string][]testShardMeta
+	queries int
+	fail    bool
+}
+
+func (idx *testShardIndex) ExecuteQuery(req indexer.SearchRequest) (*indexer.SearchResult, error) {
+	idx.queries++
+	if idx.fail {
+		return nil, errors.New("索引服务不可用")
+	}
+	result := &indexer.SearchResult{TxIDs: make([]string, 0)}
+	for pos, metas := range idx.shards {
+		for _, meta := range metas {
+			if meta.age >= req.AgeStart && (req.AgeEnd == 0 || meta.age <= req.AgeEnd) && (req.Gender == "" || req.Gender == meta.gender) {
+				result.TxIDs = append(result.TxIDs, "tx_"+pos)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+func (idx *testShardIndex) GetPosesByTxIDs(txIDs []string) ([]string, error) {
+	poses := make([]string, 0, len(txIDs))
+	for _, txID := range txIDs {
+		poses = append(poses, strings.TrimPrefix(txID, "tx_"))
+	}
+	return poses, nil
+}
+
+func (idx *testShardIndex) IndexedPoses(domainID string, poses []string) (map[string]bool, error) {
+	indexed := make(map[string]bool)
+	for _, pos := range poses {
+		if _, ok := idx.shards[pos]; ok && domainID == "DOMAIN_d1" {
+			indexed[pos] = true
+		}
+	}
+	return indexed, nil
+}
+
+func TestPushdownShards(t *testing.T) {
+	// 表结构缓存是全局的，去掉其他查询记录的分片（主分片的表结构未缓存时才保留主分片）
+	schemaCache.Lock()
+	for _, pos := range []string{"PD1", "PD2", "PD3"} {
+		delete(schemaCache.schemas, pos)
+	}
+	schemaCache.Unlock()
+	index := &testShardIndex{shards: map[string][]testShardMeta{
+		"PD1": {{age: 30, gender: "F"}, {age: 40, gender: "F"}},
+		"PD2": {{age: 60, gender: "M"}},
+	}}
+	single := func(conditions ...[]QueryCondition) QueryItem {
+		return QueryItem{QueryConcatType: "single", FilePos: [][]string{{"PD1", "PD2", "PD3"}}, ReturnField: []string{"PD1_id"}, QueryConditions: conditions}
+	}
+	age := func(compare string, val string) QueryCondition {
+		return QueryCondition{Pos: "PD1", Field: "age", Val: val, Compare: compare, Type: "int"}
+	}
+	gender := QueryCondition{Pos: "PD1", Field: "gender", Val: `["M","X"]`, Compare: "in", Type: "string"}
+	computedAge := single([]QueryCondition{age("gt", "50")})
+	computedAge.ComputedColumns = []ComputedColumn{{Alias: "age", Expr: "1"}}
+	indexedOnly := single([]QueryCondition{age("gt", "70")})
+	indexedOnly.FilePos = [][]string{{"PD1", "PD2"}}
+	cases := []struct {
+		name      string
+		queryItem QueryItem
+		domainID  string
+		want      []string // 跳过的分片
+	}{
+		{"年龄区间", single([]QueryCondition{age("between", `["25","45"]`)}), "DOMAIN_d1", []string{"PD2"}},
+		{"in条件按取值展开", single([]QueryCondition{gender}), "DOMAIN_d1", []string{"PD1"}},
+		{"条件组之间为OR", single([]QueryCondition{age("lt", "20")}, []QueryCondition{age("ge", "35")}), "DOMAIN_d1", nil},
+		{"条件组内为AND", single([]QueryCondition{age("le", "40"), gender}), "DOMAIN_d1", []string{"PD1", "PD2"}},
+		{"矛盾的年龄条件跳过所有已索引的分片", single([]QueryCondition{age("gt", "50"), age("lt", "40")}), "DOMAIN_d1", []string{"PD1", "PD2"}},
+		{"所有分片都被跳过时保留主分片确定列", indexedOnly, "DOMAIN_d1", []string{"PD2"}},
+		{"某个条件组没有索引字段时不下推", single([]QueryCondition{age("gt", "50")}, []QueryCondition{{Pos: "PD1", Field: "cost", Val: "1", Compare: "eq", Type: "int"}}), "DOMAIN_d1", nil},
+		{"非等值的字符串条件不下推", single([]QueryCondition{{Pos: "PD1", Field: "gender", Val: "M", Compare: "ne", Type: "string"}}), "DOMAIN_d1", nil},
+		{"与索引字段同名的计算列不下推", computedAge, "DOMAIN_d1", nil},
+		{"其他数据域的分片未索引", single([]QueryCondition{age("gt", "50")}), "DOMAIN_d2", nil},
+		{"联表查询不下推", QueryItem{QueryConcatType: "multi", FilePos: [][]string{{"PD1"}, {"PD2"}}, QueryConditions: [][]QueryCondition{{age("gt", "50")}}}, "DOMAIN_d1", nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			queryItem, _ := json.Marshal(tc.queryItem)
+			prunedQueryItem, skipped, err := PushdownShards(string(queryItem), tc.domainID, index)
+			if err != nil {
+				t.Fatalf("PushdownShards 失败: %v", err)
+			}
+			if len(skipped) != len(tc.want) || len(tc.want) > 0 && !reflect.DeepEqual(skipped, tc.want) {
+				t.Fatalf("skipped = %v，期望 %v", skipped, tc.want)
+			}
+			if len(skipped) == 0 {
+				if prunedQueryItem != string(queryItem) {
+					t.Errorf("没有跳过的分片时查询项应原样返回: %s", prunedQueryItem)
+				}
+				return
+			}
+			var queryItemData QueryItem
+			_ = json.Unmarshal([]byte(prunedQueryItem), &queryItemData)
+			if !reflect.DeepEqual(queryItemData.Union.SkipShards, tc.want) || !reflect.DeepEqual(ShardsToLoad(queryItemData), removeStrings(tc.queryItem.FilePos[0], tc.want)) {
+				t.Errorf("skipShards = %v, 获取的分片 = %v", queryItemData.Union.SkipShards, ShardsToLoad(queryItemData))
+			}
+		})
+	}
+
+	// 索引服务出错时返回原查询项
+	index.fail = true
+	queryItem, _ := json.Marshal(single([]QueryCondition{age("gt", "50")}))
+	if prunedQueryItem, skipped, err := PushdownShards(string(queryItem), "DOMAIN_d1", index); err == nil || len(skipped) > 0 || prunedQueryItem != string(queryItem) {
+		t.Errorf("索引服务出错: skipped = %v, err = %v", skipped, err)
+	}
+}
+
+// removeStrings 去掉切片中的若干字符串
+func removeStrings(slice []string, strs []string) []string {
+	for _, str := range strs {
+		slice = removeString(slice, str)
+	}
+	return slice
+}
+
+func TestSkippedShardsQuery(t *testing.T) {
+	// 跳过的分片不参与查询，结果信息中说明跳过的分片
+	queryItem, _ := json.Marshal(QueryItem{QueryConcatType: "single", FilePos: [][]string{{"PD1", "PD2"}}, ReturnField: []string{"PD1_id"},
+		Union: UnionOptions{SkipShards: []string{"PD2"}}})
+	queryResult, counts := GetQueryResult(string(queryItem), map[string]string{"PD1": "id\tage\n1\t30\n"})
+	if counts != 1 || !strings.Contains(queryResult, "跳过1个分片: PD2") {
+		t.Errorf("查询结果 = %s", queryResult)
+	}
+}
@@ -0,0 +1,572 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ----------------分组、聚合与排序（GROUP BY / AGGREGATE / ORDER BY）-------------------
+
+// GroupByItem 分组列
+type GroupByItem struct {
+	Pos    string `json:"pos"`    // 位置（数据集主CID）
+	Field  string `json:"field"`  // 字段名（列名）
+	Type   string `json:"type"`   // 类型（string/int/float/date/datetime）
+	Bucket string `json:"bucket"` // 日期分桶粒度（day/week/month/quarter/year），仅date/datetime有效
+}
+
+// AggregateItem 聚合函数
+type AggregateItem struct {
+	Func  string `json:"func"`  // 聚合函数（count/sum/avg/min/max）
+	Pos   string `json:"pos"`   // 位置（数据集主CID）
+	Field string `json:"field"` // 字段名，count时可为*或空，表示统计行数
+	Type  string `json:"type"`  // 类型（sum/avg只支持int/float）
+	Alias string `json:"alias"` // 结果列名，为空时为 func(field)
+}
+
+// OrderByItem 排序列
+type OrderByItem struct {
+	Pos   string `json:"pos"`   // 位置；按聚合结果排序时为空，Field填聚合结果列名
+	Field string `json:"field"` // 字段名（列名）
+	Type  string `json:"type"`  // 类型（string/int/float/date/datetime）
+	Desc  bool   `json:"desc"`  // 是否降序，空值始终排在最后
+}
+
+// aggregateState 单个分组内单个聚合函数的累计状态
+type aggregateState struct {
+	count    int     // 非空值数量（count(*)时为行数）
+	sumInt   int64   // int类型的和
+	sumFloat float64 // float类型的和
+	min      string  // 最小值（原始单元格）
+	max      string  // 最大值（原始单元格）
+}
+
+/**
+ * outputKey 生成结果中的列名：单表查询去掉pos前缀，联表查询保留pos前缀
+ * @param pos 位置
+ * @param field 字段名
+ * @param isMulti 是否联表查询
+ * @return string 结果列名
+ */
+func outputKey(pos string, field string, isMulti bool) string {
+	if isMulti {
+		return pos + "_" + field
+	}
+	return field
+}
+
+/**
+ * aggregateAlias 聚合结果列名
+ * @param aggregate 聚合函数
+ * @param isMulti 是否联表查询
+ * @return string 结果列名
+ */
+func aggregateAlias(aggregate AggregateItem, isMulti bool) string {
+	if aggregate.Alias != "" {
+		return aggregate.Alias
+	}
+	if aggregate.Field == "" || aggregate.Field == "*" {
+		return aggregate.Func + "(*)"
+	}
+	return aggregate.Func + "(" + outputKey(aggregate.Pos, aggregate.Field, isMulti) + ")"
+}
+
+/**
+ * isCountAll 是否为 count(*)
+ * @param aggregate 聚合函数
+ * @return bool 是否统计行数
+ */
+func isCountAll(aggregate AggregateItem) bool {
+	return aggregate.Func == "count" && (aggregate.Field == "" || aggregate.Field == "*")
+}
+
+/**
+ * compareCellValues 按类型比较两个单元格的大小（不处理空值，调用方需先判断）
+ * @param a 值a
+ * @param b 值b
+ * @param cellType 类型
+ * @param dateParser 日期解析器
+ * @return int a<b为-1，a==b为0，a>b为1
+ * @return error 错误信息
+ */
+func compareCellValues(a string, b string, cellType string, dateParser *DateParser) (int, error) {
+	switch cellType {
+	case "int":
+		aInt, err := strconv.ParseInt(a, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("数据 %v 无法转换为整数", a)
+		}
+		bInt, err := strconv.ParseInt(b, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("数据 %v 无法转换为整数", b)
+		}
+		switch {
+		case aInt < bInt:
+			return -1, nil
+		case aInt > bInt:
+			return 1, nil
+		}
+		return 0, nil
+	case "float":
+		aFloat, err := strconv.ParseFloat(a, 64)
+		if err != nil {
+			return 0, fmt.Errorf("数据 %v 无法转换为浮点数", a)
+		}
+		bFloat, err := strconv.ParseFloat(b, 64)
+		if err != nil {
+			return 0, fmt.Errorf("数据 %v 无法转换为浮点数", b)
+		}
+		switch {
+		case aFloat < bFloat:
+			return -1, nil
+		case aFloat > bFloat:
+			return 1, nil
+		}
+		return 0, nil
+	case "date", "datetime":
+		aTime, err := dateParser.ParseAs(a, cellType)
+		if err != nil {
+			return 0, fmt.Errorf("数据 %s", err)
+		}
+		bTime, err := dateParser.ParseAs(b, cellType)
+		if err != nil {
+			return 0, fmt.Errorf("数据 %s", err)
+		}
+		return aTime.Compare(bTime), nil
+	case "string":
+		return strings.Compare(a, b), nil
+	default:
+		return 0, errors.New("不支持的类型: " + cellType)
+	}
+}
+
+/**
+ * compareForOrder 排序比较：空值始终排在最后，非空值按升/降序
+ * @param a 值a
+ * @param b 值b
+ * @param orderBy 排序列
+ * @param dateParser 日期解析器
+ * @return int 比较结果（<0 表示a排在前面）
+ * @return error 错误信息
+ */
+func compareForOrder(a string, b string, orderBy OrderByItem, dateParser *DateParser) (int, error) {
+	aNull, bNull := isNullCell(a), isNullCell(b)
+	switch {
+	case aNull && bNull:
+		return 0, nil
+	case aNull:
+		return 1, nil
+	case bNull:
+		return -1, nil
+	}
+	cmp, err := compareCellValues(a, b, orderBy.Type, dateParser)
+	if err != nil {
+		return 0, err
+	}
+	if orderBy.Desc {
+		cmp = -cmp
+	}
+	return cmp, nil
+}
+
+/**
+ * validateGroupAndOrder 校验分组、聚合、排序的列与类型
+ * @param queryItemData 查询项
+ * @param tableHeaderMap 表头map
+ * @param isMulti 是否联表查询
+ * @return error 错误信息
+ */
+func validateGroupAndOrder(queryItemData QueryItem, tableHeaderMap map[string]int, isMulti bool) error {
+	checkType := func(cellType string) bool {
+		return cellType == "string" || cellType == "int" || cellType == "float" || isDateType(cellType)
+	}
+	for idx, groupBy := range queryItemData.GroupBy {
+		if _, ok := tableHeaderMap[groupBy.Pos+"_"+groupBy.Field]; !ok {
+			return fmt.Errorf("第%d个分组列 %s 不存在", idx+1, groupBy.Field)
+		}
+		if !checkType(groupBy.Type) {
+			return fmt.Errorf("第%d个分组列 %s 的类型 %s 不支持", idx+1, groupBy.Field, groupBy.Type)
+		}
+		if groupBy.Bucket != "" && !isDateType(groupBy.Type) {
+			return fmt.Errorf("第%d个分组列 %s 只有date/datetime类型才能按粒度分桶", idx+1, groupBy.Field)
+		}
+	}
+
+	outputColumns := make(map[string]bool) // 分组聚合查询中可用于排序的结果列
+	for _, groupBy := range queryItemData.GroupBy {
+		outputColumns[outputKey(groupBy.Pos, groupBy.Field, isMulti)] = true
+	}
+	for idx, aggregate := range queryItemData.Aggregates {
+		switch aggregate.Func {
+		case "count", "min", "max":
+		case "sum", "avg":
+			if aggregate.Type != "int" && aggregate.Type != "float" {
+				return fmt.Errorf("第%d个聚合函数 %s 只支持int/float类型", idx+1, aggregate.Func)
+			}
+		default:
+			return fmt.Errorf("第%d个聚合函数 %s 不支持", idx+1, aggregate.Func)
+		}
+		if !isCountAll(aggregate) {
+			if _, ok := tableHeaderMap[aggregate.Pos+"_"+aggregate.Field]; !ok {
+				return fmt.Errorf("第%d个聚合函数的列 %s 不存在", idx+1, aggregate.Field)
+			}
+			if !checkType(aggregate.Type) {
+				return fmt.Errorf("第%d个聚合函数的列 %s 的类型 %s 不支持", idx+1, aggregate.Field, aggregate.Type)
+			}
+		}
+		outputColumns[aggregateAlias(aggregate, isMulti)] = true
+	}
+
+	isGrouped := len(queryItemData.GroupBy) > 0 || len(queryItemData.Aggregates) > 0
+	for idx, orderBy := range queryItemData.OrderBy {
+		if !checkType(orderBy.Type) {
+			return fmt.Errorf("第%d个排序列 %s 的类型 %s 不支持", idx+1, orderBy.Field, orderBy.Type)
+		}
+		if isGrouped {
+			column := orderBy.Field
+			if orderBy.Pos != "" {
+				column = outputKey(orderBy.Pos, orderBy.Field, isMulti)
+			}
+			if !outputColumns[column] {
+				return fmt.Errorf("第%d个排序列 %s 不是分组列或聚合结果列", idx+1, column)
+			}
+		} else if _, ok := tableHeaderMap[orderBy.Pos+"_"+orderBy.Field]; !ok {
+			return fmt.Errorf("第%d个排序列 %s 不存在", idx+1, orderBy.Field)
+		}
+	}
+	return nil
+}
+
+/**
+ * sortRawRows 对满足条件的原始行排序（未分组时），排序列按类型整列解析一次
+ * @param table 表
+ * @param rowIdxs 满足条件的行索引（原地排序）
+ * @param orderBys 排序列
+ * @param dateParser 日期解析器
+ * @return error 错误信息
+ */
+func sortRawRows(table *Table, rowIdxs []int, orderBys []OrderByItem, dateParser *DateParser) error {
+	if len(orderBys) == 0 {
+		return nil
+	}
+	indexes := make([]int, len(orderBys))
+	columns := make([]*typedColumn, len(orderBys))
+	for i, orderBy := range orderBys {
+		indexes[i] = table.HeaderMap[orderBy.Pos+"_"+orderBy.Field]
+		if orderBy.Type != "string" {
+			columns[i] = table.typedColumn(indexes[i], orderBy.Type, dateParser)
+		}
+	}
+	var sortErr error
+	sort.SliceStable(rowIdxs, func(i, j int) bool {
+		for k, orderBy := range orderBys {
+			cmp, err := compareTypedForOrder(table, indexes[k], columns[k], rowIdxs[i], rowIdxs[j], orderBy)
+			if err != nil {
+				if sortErr == nil {
+					sortErr = fmt.Errorf("排序列 %s 错误: %s", orderBy.Field, err)
+				}
+				return false
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+	return sortErr
+}
+
+/**
+ * compareTypedForOrder 使用已解析的列进行排序比较：空值始终排在最后，非空值按升/降序
+ * @param table 表
+ * @param index 列索引
+ * @param column 已解析的列（string类型为nil）
+ * @param a 行a的索引
+ * @param b 行b的索引
+ * @param orderBy 排序列
+ * @return int 比较结果（<0 表示a排在前面）
+ * @return error 错误信息
+ */
+func compareTypedForOrder(table *Table, index int, column *typedColumn, a int, b int, orderBy OrderByItem) (int, error) {
+	aCell, bCell := table.Rows[a][index], table.Rows[b][index]
+	aNull, bNull := isNullCell(aCell), isNullCell(bCell)
+	switch {
+	case aNull && bNull:
+		return 0, nil
+	case aNull:
+		return 1, nil
+	case bNull:
+		return -1, nil
+	}
+	cmp := 0
+	switch orderBy.Type {
+	case "string":
+		cmp = strings.Compare(aCell, bCell)
+	case "int", "float", "date", "datetime":
+		if column.errs[a] != nil {
+			return 0, column.errs[a]
+		}
+		if column.errs[b] != nil {
+			return 0, column.errs[b]
+		}
+		switch orderBy.Type {
+		case "int":
+			if column.ints[a] < column.ints[b] {
+				cmp = -1
+			} else if column.ints[a] > column.ints[b] {
+				cmp = 1
+			}
+		case "float":
+			cmp = threeWay(column.floats[a], column.floats[b])
+		default:
+			cmp = column.times[a].Compare(column.times[b])
+		}
+	default:
+		return 0, errors.New("不支持的类型: " + orderBy.Type)
+	}
+	if orderBy.Desc {
+		cmp = -cmp
+	}
+	return cmp, nil
+}
+
+/**
+ * sortResultRows 对分组聚合后的结果行排序
+ * @param rows 结果行
+ * @param orderBys 排序列（Pos为空时Field为聚合结果列名）
+ * @param isMulti 是否联表查询
+ * @param dateParser 日期解析器
+ * @return error 错误信息
+ */
+func sortResultRows(rows []map[string]string, orderBys []OrderByItem, isMulti bool, dateParser *DateParser) error {
+	if len(orderBys) == 0 {
+		return nil
+	}
+	columns := make([]string, len(orderBys))
+	for i, orderBy := range orderBys {
+		columns[i] = orderBy.Field
+		if orderBy.Pos != "" {
+			columns[i] = outputKey(orderBy.Pos, orderBy.Field, isMulti)
+		}
+	}
+	var sortErr error
+	sort.SliceStable(rows, func(i, j int) bool {
+		for k, orderBy := range orderBys {
+			cmp, err := compareForOrder(rows[i][columns[k]], rows[j][columns[k]], orderBy, dateParser)
+			if err != nil {
+				if sortErr == nil {
+					sortErr = fmt.Errorf("排序列 %s 错误: %s", columns[k], err)
+				}
+				return false
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+	return sortErr
+}
+
+/**
+ * groupAndAggregate 对满足条件的行分组并计算聚合函数
+ * @param queryItemData 查询项（使用其中的GroupBy和Aggregates）
+ * @param rows 满足条件的行
+ * @param tableHeaderMap 表头map
+ * @param isMulti 是否联表查询
+ * @param dateParser 日期解析器
+ * @param privacy 差分隐私查询计划：不为nil时输出加噪的结果，并去掉加噪后计数过小的分组
+ * @param anonymity k-匿名处理计划：不为nil时按策略去掉少于k行的分组
+ * @return []map[string]string 结果行：分组列 + 聚合结果列
+ * @return error 错误信息
+ */
+func groupAndAggregate(queryItemData QueryItem, rows [][]string, tableHeaderMap map[string]int, isMulti bool, dateParser *DateParser, privacy *privacyPlan, anonymity *anonymityPlan) ([]map[string]string, error) {
+	groupBys := queryItemData.GroupBy
+	aggregates := queryItemData.Aggregates
+
+	groupKeyValues := make(map[string][]string)      // 分组键 -> 分组列的值
+	groupStates := make(map[string][]aggregateState) // 分组键 -> 聚合状态
+	groupOrder := make([]string, 0)                  // 分组出现的顺序，保证结果稳定
+	groupRows := make(map[string]int)                // 分组键 -> 分组的行数（k-匿名）
+
+	// 没有GROUP BY时，整张表为一组（即使没有满足条件的行，也返回一行聚合结果）
+	if len(groupBys) == 0 {
+		groupKeyValues["[]"] = []string{}
+		groupStates["[]"] = make([]aggregateState, len(aggregates))
+		groupOrder = append(groupOrder, "[]")
+	}
+
+	for _, row := range rows {
+		keyValues := make([]string, len(groupBys))
+		for i, groupBy := range groupBys {
+			cellValue := row[tableHeaderMap[groupBy.Pos+"_"+groupBy.Field]]
+			if isDateType(groupBy.Type) && !isNullCell(cellValue) {
+				t, err := dateParser.ParseAs(cellValue, groupBy.Type)
+				if err != nil {
+					return nil, fmt.Errorf("分组列 %s 错误: %s", groupBy.Field, err)
+				}
+				if groupBy.Bucket != "" {
+					cellValue, err = dateParser.Bucket(t, groupBy.Bucket)
+					if err != nil {
+						return nil, err
+					}
+				} else {
+					cellValue = dateParser.Format(t, groupBy.Type)
+				}
+			}
+			keyValues[i] = cellValue
+		}
+		// 以JSON数组作为分组键，避免单元格中的分隔符或空值造成分组冲突
+		groupKeyBytes, _ := json.Marshal(keyValues)
+		groupKey := string(groupKeyBytes)
+		if _, ok := groupStates[groupKey]; !ok {
+			groupKeyValues[groupKey] = keyValues
+			groupStates[groupKey] = make([]aggregateState, len(aggregates))
+			groupOrder = append(groupOrder, groupKey)
+		}
+
+		groupRows[groupKey]++
+		states := groupStates[groupKey]
+		for i, aggregate := range aggregates {
+			if isCountAll(aggregate) {
+				states[i].count++
+				continue
+			}
+			cellValue := row[tableHeaderMap[aggregate.Pos+"_"+aggregate.Field]]
+			if isNullCell(cellValue) {
+				continue
+			}
+			if privacy != nil {
+				if err := privacy.accumulate(&states[i], aggregate, cellValue); err != nil {
+					return nil, fmt.Errorf("聚合函数 %s 错误: %s", aggregateAlias(aggregate, isMulti), err)
+				}
+				continue
+			}
+			if err := accumulate(&states[i], aggregate, cellValue, dateParser); err != nil {
+				return nil, fmt.Errorf("聚合函数 %s 错误: %s", aggregateAlias(aggregate, isMulti), err)
+			}
+		}
+	}
+
+	resultRows := make([]map[string]string, 0, len(groupOrder))
+	for _, groupKey := range groupOrder {
+		// 分组列或查询条件涉及准标识符时，少于k行的分组不返回
+		if anonymity.suppressGroup(groupRows[groupKey]) {
+			continue
+		}
+		resultRow := make(map[string]string)
+		for i, groupBy := range groupBys {
+			resultRow[outputKey(groupBy.Pos, groupBy.Field, isMulti)] = groupKeyValues[groupKey][i]
+		}
+		dropped := false
+		for i, aggregate := range aggregates {
+			if privacy == nil {
+				resultRow[aggregateAlias(aggregate, isMulti)] = aggregateResult(groupStates[groupKey][i], aggregate, dateParser)
+				continue
+			}
+			value, noisyCount := privacy.release(groupStates[groupKey][i], aggregate)
+			resultRow[aggregateAlias(aggregate, isMulti)] = value
+			// 分组本身也可能泄露信息：加噪后计数过小的分组不返回
+			if len(groupBys) > 0 && i == privacy.countIndex && (noisyCount <= 0 || noisyCount < float64(privacy.minCount)) {
+				dropped = true
+			}
+		}
+		if dropped {
+			privacy.droppedGroups++
+			continue
+		}
+		resultRows = append(resultRows, resultRow)
+	}
+	return resultRows, nil
+}
+
+/**
+ * accumulate 将一个非空单元格累计到聚合状态中
+ * @param state 聚合状态
+ * @param aggregate 聚合函数
+ * @param cellValue 单元格值
+ * @param dateParser 日期解析器
+ * @return error 错误信息
+ */
+func accumulate(state *aggregateState, aggregate AggregateItem, cellValue string, dateParser *DateParser) error {
+	switch aggregate.Func {
+	case "sum", "avg":
+		if aggregate.Type == "int" {
+			v, err := strconv.ParseInt(cellValue, 10, 64)
+			if err != nil {
+				return fmt.Errorf("数据 %v 无法转换为整数", cellValue)
+			}
+			state.sumInt += v
+			state.sumFloat += float64(v)
+		} else {
+			v, err := strconv.ParseFloat(cellValue, 64)
+			if err != nil {
+				return fmt.Errorf("数据 %v 无法转换为浮点数", cellValue)
+			}
+			state.sumFloat += v
+		}
+	case "min", "max":
+		if state.count == 0 {
+			state.min, state.max = cellValue, cellValue
+			break
+		}
+		cmp, err := compareCellValues(cellValue, state.min, aggregate.Type, dateParser)
+		if err != nil {
+			return err
+		}
+		if cmp < 0 {
+			state.min = cellValue
+		}
+		cmp, err = compareCellValues(cellValue, state.max, aggregate.Type, dateParser)
+		if err != nil {
+			return err
+		}
+		if cmp > 0 {
+			state.max = cellValue
+		}
+	}
+	state.count++
+	return nil
+}
+
+/**
+ * aggregateResult 输出聚合结果（字符串）；没有非空值时sum/avg/min/max返回空值（NullCell）
+ * @param state 聚合状态
+ * @param aggregate 聚合函数
+ * @param dateParser 日期解析器
+ * @return string 聚合结果
+ */
+func aggregateResult(state aggregateState, aggregate AggregateItem, dateParser *DateParser) string {
+	if aggregate.Func == "count" {
+		return strconv.Itoa(state.count)
+	}
+	if state.count == 0 {
+		return NullCell
+	}
+	switch aggregate.Func {
+	case "sum":
+		if aggregate.Type == "int" {
+			return strconv.FormatInt(state.sumInt, 10)
+		}
+		return strconv.FormatFloat(state.sumFloat, 'f', -1, 64)
+	case "avg":
+		return strconv.FormatFloat(state.sumFloat/float64(state.count), 'f', -1, 64)
+	case "min", "max":
+		value := state.min
+		if aggregate.Func == "max" {
+			value = state.max
+		}
+		// 日期统一输出格式，避免不同分片的格式不一致
+		if isDateType(aggregate.Type) {
+			if t, err := dateParser.ParseAs(value, aggregate.Type); err == nil {
+				return dateParser.Format(t, aggregate.Type)
+			}
+		}
+		return value
+	}
+	return ""
+}
@@ -0,0 +1,270 @@
+package service
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chainqa_offchain_demo/setting"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ----------------查询结果缓存（QUERY CACHE）-------------------
+// CID按内容寻址，同一查询项在相同分片上的结果是确定的。
+// 缓存键为规范化后的查询项（及影响结果的日期配置）的SHA256，缓存值为查询结果，存储在内存（LRU）或Redis中。
+// 缓存只省去获取分片、获取AES密钥和解密查询，权限检查和上链查询日志由调用方照常进行。
+
+// 缓存的默认配置
+const (
+	defaultQueryCacheTTL           = 600             // 秒
+	defaultQueryCacheMaxEntries    = 256             // 内存缓存最多条数
+	defaultQueryCacheMaxBytes      = 64 << 20        // 内存缓存最多字节数
+	defaultQueryCacheMaxEntryBytes = 4 << 20         // 单条结果最多字节数，超过时不缓存
+	queryCacheRedisPrefix          = "query_cache:"  // Redis键前缀
+	queryCacheRedisTimeout         = 2 * time.Second // Redis操作超时
+)
+
+// cachedQueryResult 缓存的查询结果
+type cachedQueryResult struct {
+	Result   string `json:"result"`   // 查询结果（GetQueryResult的返回值）
+	Counts   int    `json:"counts"`   // 结果数量
+	CachedAt int64  `json:"cachedAt"` // 缓存时间（Unix秒）
+}
+
+// queryCacheStore 缓存存储
+type queryCacheStore interface {
+	get(key string) (cachedQueryResult, bool)
+	set(key string, value cachedQueryResult)
+}
+
+var queryCache queryCacheStore // 为nil时不缓存
+
+/**
+ * InitQueryCache 按配置初始化查询结果缓存
+ * @param redisClient Redis客户端（backend为redis时使用，可为nil）
+ * @return error 错误信息（backend为redis但没有Redis客户端等）
+ */
+func InitQueryCache(redisClient *redis.Client) error {
+	conf := setting.Conf.QueryCache
+	if !conf.Enabled {
+		queryCache = nil
+		return nil
+	}
+	ttl := time.Duration(positiveOr(conf.TTL, defaultQueryCacheTTL)) * time.Second
+	maxEntryBytes := positiveOr(conf.MaxEntryBytes, defaultQueryCacheMaxEntryBytes)
+	switch strings.ToLower(conf.Backend) {
+	case "", "memory":
+		queryCache = &memoryQueryCache{
+			ttl:           ttl,
+			maxEntries:    positiveOr(conf.MaxEntries, defaultQueryCacheMaxEntries),
+			maxBytes:      positiveOr(conf.MaxBytes, defaultQueryCacheMaxBytes),
+			maxEntryBytes: maxEntryBytes,
+			entries:       make(map[string]*list.Element),
+			order:         list.New(),
+		}
+	case "redis":
+		if redisClient == nil {
+			return fmt.Errorf("查询缓存使用Redis，但Redis客户端未初始化")
+		}
+		queryCache = &redisQueryCache{client: redisClient, ttl: ttl, maxEntryBytes: maxEntryBytes}
+	default:
+		return fmt.Errorf("不支持的查询缓存类型 %s（memory/redis）", conf.Backend)
+	}
+	return nil
+}
+
+// positiveOr 配置值不大于0时使用默认值
+func positiveOr(value int, defaultValue int) int {
+	if value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+/**
+ * QueryCacheEnabled 是否启用了查询结果缓存
+ * @return bool 是否启用
+ */
+func QueryCacheEnabled() bool {
+	return queryCache != nil
+}
+
+/**
+ * QueryCacheKey 计算查询项的缓存键：规范化查询项（去掉空白和未知字段，AND组内的条件和OR组排序）后取SHA256，
+ * 并带上影响结果的日期配置和分片裁剪使用的数据域
+ * @param queryItem 查询项
+ * @param pruneDomain 未命中时按索引下推裁剪分片使用的数据域（不同数据域下推得到的结果不同），不裁剪时为空
+ * @return string 缓存键
+ * @return error 查询项格式错误
+ */
+func QueryCacheKey(queryItem string, pruneDomain string) (string, error) {
+	var queryItemData QueryItem
+	if err := json.Unmarshal([]byte(queryItem), &queryItemData); err != nil {
+		return "", err
+	}
+	// 条件的顺序不影响结果
+	groupKeys := make([]string, len(queryItemData.QueryConditions))
+	for i, conditionGroup := range queryItemData.QueryConditions {
+		conditionKeys := make([]string, len(conditionGroup))
+		for j, condition := range conditionGroup {
+			conditionKey, _ := json.Marshal(condition)
+			conditionKeys[j] = string(conditionKey)
+		}
+		sort.Strings(conditionKeys)
+		groupKeys[i] = "[" + strings.Join(conditionKeys, ",") + "]"
+	}
+	sort.Strings(groupKeys)
+	queryItemData.QueryConditions = nil
+
+	canonical, err := json.Marshal(queryItemData)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	hash.Write(canonical)
+	hash.Write([]byte("|" + strings.Join(groupKeys, "|")))
+	hash.Write([]byte("|" + strings.Join(setting.Conf.Query.DateLayouts, "|") + "|" + setting.Conf.Query.TimeZone))
+	hash.Write([]byte("|domain:" + strings.TrimSpace(pruneDomain)))
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/**
+ * GetCachedQueryResult 获取缓存的查询结果
+ * @param key 缓存键
+ * @return string 查询结果
+ * @return int 结果数量
+ * @return bool 是否命中
+ */
+func GetCachedQueryResult(key string) (string, int, bool) {
+	if queryCache == nil || key == "" {
+		return "", 0, false
+	}
+	value, ok := queryCache.get(key)
+	if !ok {
+		return "", 0, false
+	}
+	return value.Result, value.Counts, true
+}
+
+/**
+ * CacheQueryResult 缓存查询结果（查询失败的结果不缓存）
+ * @param key 缓存键
+ * @param queryResult 查询结果
+ * @param counts 结果数量
+ */
+func CacheQueryResult(key string, queryResult string, counts int) {
+	if queryCache == nil || key == "" || counts == -1 {
+		return
+	}
+	queryCache.set(key, cachedQueryResult{Result: queryResult, Counts: counts, CachedAt: time.Now().Unix()})
+}
+
+// ======================内存缓存（LRU）======================
+
+type memoryQueryCacheEntry struct {
+	key       string
+	value     cachedQueryResult
+	expiresAt time.Time
+}
+
+type memoryQueryCache struct {
+	mu            sync.Mutex
+	ttl           time.Duration
+	maxEntries    int
+	maxBytes      int
+	maxEntryBytes int
+	bytes         int                      // 当前缓存的结果字节数
+	entries       map[string]*list.Element // 缓存键 -> LRU链表节点
+	order         *list.List               // 最近使用的在前
+}
+
+func (m *memoryQueryCache) get(key string) (cachedQueryResult, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	element, ok := m.entries[key]
+	if !ok {
+		return cachedQueryResult{}, false
+	}
+	entry := element.Value.(*memoryQueryCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		m.remove(element)
+		return cachedQueryResult{}, false
+	}
+	m.order.MoveToFront(element)
+	return entry.value, true
+}
+
+func (m *memoryQueryCache) set(key string, value cachedQueryResult) {
+	if len(value.Result) > m.maxEntryBytes {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if element, ok := m.entries[key]; ok {
+		m.remove(element)
+	}
+	entry := &memoryQueryCacheEntry{key: key, value: value, expiresAt: time.Now().Add(m.ttl)}
+	m.entries[key] = m.order.PushFront(entry)
+	m.bytes += len(value.Result)
+	// 超过条数或字节数上限时淘汰最久未使用的
+	for m.order.Len() > m.maxEntries || m.bytes > m.maxBytes {
+		m.remove(m.order.Back())
+	}
+}
+
+// remove 删除节点（调用方持有锁）
+func (m *memoryQueryCache) remove(element *list.Element) {
+	entry := element.Value.(*memoryQueryCacheEntry)
+	m.order.Remove(element)
+	delete(m.entries, entry.key)
+	m.bytes -= len(entry.value.Result)
+}
+
+// ======================Redis缓存======================
+// 过期由Redis的TTL处理；Redis出错时视为未命中，不影响查询
+
+type redisQueryCache struct {
+	client        *redis.Client
+	ttl           time.Duration
+	maxEntryBytes int
+}
+
+func (r *redisQueryCache) get(key string) (cachedQueryResult, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryCacheRedisTimeout)
+	defer cancel()
+	data, err := r.client.Get(ctx, queryCacheRedisPrefix+key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			fmt.Println("读取查询缓存失败", err)
+		}
+		return cachedQueryResult{}, false
+	}
+	var value cachedQueryResult
+	if err := json.Unmarshal(data, &value); err != nil {
+		return cachedQueryResult{}, false
+	}
+	return value, true
+}
+
+func (r *redisQueryCache) set(key string, value cachedQueryResult) {
+	if len(value.Result) > r.maxEntryBytes {
+		return
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), queryCacheRedisTimeout)
+	defer cancel()
+	if err := r.client.Set(ctx, queryCacheRedisPrefix+key, data, r.ttl).Err(); err != nil {
+		fmt.Println("写入查询缓存失败", err)
+	}
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"container/list"
+	"strings"
+	"testing"
+	"time"
+
+	"chainqa_offchain_demo/setting"
+)
+
+func TestQueryCacheKey(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	base := `{"queryConcatType":"single","filePos":[["P"]],"returnField":["P_id"],"queryConditions":[[{"pos":"P","field":"age","val":"30","compare":"gt","type":"int"},{"pos":"P","field":"name","val":"a","compare":"eq","type":"string"}],[{"pos":"P","field":"id","val":"1","compare":"eq","type":"int"}]]}`
+	baseKey, err := QueryCacheKey(base, "")
+	if err != nil {
+		t.Fatalf("QueryCacheKey 失败: %v", err)
+	}
+	cases := []struct {
+		name        string
+		queryItem   string
+		pruneDomain string
+		same        bool
+	}{
+		{"空白和未知字段", strings.ReplaceAll(base, `"returnField"`, ` "unknown": 1, "returnField" `), " ", true},
+		{"AND组内条件的顺序", `{"queryConcatType":"single","filePos":[["P"]],"returnField":["P_id"],"queryConditions":[[{"pos":"P","field":"name","val":"a","compare":"eq","type":"string"},{"pos":"P","field":"age","val":"30","compare":"gt","type":"int"}],[{"pos":"P","field":"id","val":"1","compare":"eq","type":"int"}]]}`, "", true},
+		{"OR组的顺序", `{"queryConcatType":"single","filePos":[["P"]],"returnField":["P_id"],"queryConditions":[[{"pos":"P","field":"id","val":"1","compare":"eq","type":"int"}],[{"pos":"P","field":"age","val":"30","compare":"gt","type":"int"},{"pos":"P","field":"name","val":"a","compare":"eq","type":"string"}]]}`, "", true},
+		{"基准值不同", strings.Replace(base, `"val":"30"`, `"val":"31"`, 1), "", false},
+		{"返回列不同", strings.Replace(base, `["P_id"]`, `["P_*"]`, 1), "", false},
+		{"分片不同", strings.Replace(base, `[["P"]]`, `[["P","Q"]]`, 1), "", false},
+		{"裁剪分片的数据域不同", base, "d1", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := QueryCacheKey(tc.queryItem, tc.pruneDomain)
+			if err != nil {
+				t.Fatalf("QueryCacheKey 失败: %v", err)
+			}
+			if (key == baseKey) != tc.same {
+				t.Errorf("缓存键相同 = %v，期望 %v", key == baseKey, tc.same)
+			}
+		})
+	}
+
+	// 数据域的缓存键互不相同
+	key1, _ := QueryCacheKey(base, "d1")
+	key2, _ := QueryCacheKey(base, "d2")
+	if key1 == key2 {
+		t.Errorf("不同数据域的缓存键相同")
+	}
+	// 日期配置影响结果
+	setting.Conf.Query.TimeZone = "Asia/Shanghai"
+	if key, _ := QueryCacheKey(base, ""); key == baseKey {
+		t.Errorf("时区不同时缓存键相同")
+	}
+	if _, err := QueryCacheKey("{", ""); err == nil {
+		t.Errorf("查询项格式错误时应返回错误")
+	}
+}
+
+func TestMemoryQueryCache(t *testing.T) {
+	newCache := func(ttl time.Duration) *memoryQueryCache {
+		return &memoryQueryCache{ttl: ttl, maxEntries: 2, maxBytes: 10, maxEntryBytes: 6, entries: make(map[string]*list.Element), order: list.New()}
+	}
+	defer func() { queryCache = nil }()
+
+	cache := newCache(time.Minute)
+	queryCache = cache
+	CacheQueryResult("a", "aaa", 1)
+	CacheQueryResult("b", "bbb", 1)
+	CacheQueryResult("failed", "x", -1)   // 查询失败的结果不缓存
+	CacheQueryResult("big", "1234567", 1) // 超过单条上限不缓存
+	if _, _, ok := GetCachedQueryResult("a"); !ok {
+		t.Fatalf("a 未命中")
+	}
+	CacheQueryResult("c", "ccc", 1) // 超过条数上限，淘汰最久未使用的b
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "failed": false, "big": false, "": false} {
+		if _, _, ok := GetCachedQueryResult(key); ok != want {
+			t.Errorf("%q 命中 = %v，期望 %v", key, ok, want)
+		}
+	}
+	CacheQueryResult("d", "dddddd", 1) // 超过字节数上限，淘汰到不超过为止
+	if cache.bytes > cache.maxBytes || cache.order.Len() != len(cache.entries) {
+		t.Errorf("bytes = %d，entries = %d，order = %d", cache.bytes, len(cache.entries), cache.order.Len())
+	}
+
+	queryCache = newCache(-time.Second)
+	CacheQueryResult("e", "eee", 1)
+	if _, _, ok := GetCachedQueryResult("e"); ok {
+		t.Errorf("过期的结果不应命中")
+	}
+}
@@ -0,0 +1,243 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"chainqa_offchain_demo/setting"
+)
+
+// ----------------查询超时、取消与资源限制（QUERY LIMITS）-------------------
+// 每个查询带有一个context（请求断开、超时、取消接口都会结束它）和一组资源限制，
+// 获取分片、获取密钥、过滤、联表时检查，超出时以QueryAbortError结束查询。
+
+// 查询中止的错误码（与响应中的code一致）
+const (
+	QueryCodeTimeout             = 40801 // 超过最长执行时间
+	QueryCodeCanceled            = 49901 // 查询被取消（取消接口或客户端断开）
+	QueryCodeRowsScannedExceeded = 41301 // 扫描行数超过限制
+	QueryCodeJoinedRowsExceeded  = 41302 // 联表结果行数超过限制
+	QueryCodeResultBytesExceeded = 41303 // 查询结果字节数超过限制
+)
+
+// 每处理多少行检查一次查询是否已结束
+const guardCheckInterval = 4096
+
+// QueryAbortError 查询因超时、取消或超出资源限制而中止
+type QueryAbortError struct {
+	Code    int    `json:"code"`    // 错误码
+	Message string `json:"message"` // 错误信息
+}
+
+func (e *QueryAbortError) Error() string {
+	return e.Message
+}
+
+/**
+ * QueryAbortCode 查询中止的错误码
+ * @param err 错误信息
+ * @return int 不是查询中止错误时返回0
+ */
+func QueryAbortCode(err error) int {
+	var abortErr *QueryAbortError
+	if errors.As(err, &abortErr) {
+		return abortErr.Code
+	}
+	return 0
+}
+
+var (
+	errQueryCanceled = &QueryAbortError{Code: QueryCodeCanceled, Message: "查询已取消"}
+	errQueryTimeout  = &QueryAbortError{Code: QueryCodeTimeout, Message: "查询超时"}
+)
+
+// QueryLimits 查询的资源限制，为0的项不限制
+type QueryLimits struct {
+	Timeout        time.Duration // 最长执行时间
+	MaxRowsScanned int           // 最多扫描的行数
+	MaxJoinedRows  int           // 联表结果最多行数
+	MaxResultBytes int           // 查询结果最多字节数
+}
+
+/**
+ * ConfiguredQueryLimits 配置文件中的查询资源限制（配置文件 query.timeout_seconds 等）
+ * @return QueryLimits 资源限制
+ */
+func ConfiguredQueryLimits() QueryLimits {
+	return QueryLimits{
+		Timeout:        time.Duration(setting.Conf.Query.TimeoutSeconds) * time.Second,
+		MaxRowsScanned: setting.Conf.Query.MaxRowsScanned,
+		MaxJoinedRows:  setting.Conf.Query.MaxJoinedRows,
+		MaxResultBytes: setting.Conf.Query.MaxResultBytes,
+	}
+}
+
+// QueryGuard 查询执行期间的context和资源计数，为nil时不检查
+type QueryGuard struct {
+	ctx         context.Context
+	limits      QueryLimits
+	rowsScanned int64
+}
+
+/**
+ * NewQueryGuard 创建查询守卫（超时已包含在ctx中，这里只检查行数和字节数）
+ * @param ctx 查询的context
+ * @param limits 资源限制
+ * @return *QueryGuard 查询守卫
+ */
+func NewQueryGuard(ctx context.Context, limits QueryLimits) *QueryGuard {
+	return &QueryGuard{ctx: ctx, limits: limits}
+}
+
+/**
+ * contextAbortError 把context结束的原因转为查询中止错误
+ * @param ctx context
+ * @return error 未结束时为nil
+ */
+func contextAbortError(ctx context.Context) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	var abortErr *QueryAbortError
+	if cause := context.Cause(ctx); errors.As(cause, &abortErr) {
+		return abortErr
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errQueryTimeout
+	}
+	return errQueryCanceled
+}
+
+/**
+ * Err 查询是否已结束（超时或取消）
+ * @return error 已结束时为QueryAbortError
+ */
+func (g *QueryGuard) Err() error {
+	if g == nil || g.ctx == nil {
+		return nil
+	}
+	return contextAbortError(g.ctx)
+}
+
+/**
+ * scanRows 累加扫描的行数，超过限制时返回错误
+ * @param n 本次扫描的行数
+ * @return error 错误信息
+ */
+func (g *QueryGuard) scanRows(n int) error {
+	if g == nil {
+		return nil
+	}
+	scanned := atomic.AddInt64(&g.rowsScanned, int64(n))
+	if g.limits.MaxRowsScanned > 0 && scanned > int64(g.limits.MaxRowsScanned) {
+		return &QueryAbortError{Code: QueryCodeRowsScannedExceeded, Message: fmt.Sprintf("扫描行数超过限制（%d行）", g.limits.MaxRowsScanned)}
+	}
+	return nil
+}
+
+/**
+ * checkJoinedRows 检查联表结果行数是否超过限制
+ * @param n 联表结果行数
+ * @return error 错误信息
+ */
+func (g *QueryGuard) checkJoinedRows(n int) error {
+	if g == nil || g.limits.MaxJoinedRows <= 0 || n <= g.limits.MaxJoinedRows {
+		return nil
+	}
+	return &QueryAbortError{Code: QueryCodeJoinedRowsExceeded, Message: fmt.Sprintf("联表结果行数超过限制（%d行）", g.limits.MaxJoinedRows)}
+}
+
+/**
+ * checkResultBytes 检查查询结果字节数是否超过限制
+ * @param n 查询结果字节数
+ * @return error 错误信息
+ */
+func (g *QueryGuard) checkResultBytes(n int) error {
+	if g == nil || g.limits.MaxResultBytes <= 0 || n <= g.limits.MaxResultBytes {
+		return nil
+	}
+	return &QueryAbortError{Code: QueryCodeResultBytesExceeded, Message: fmt.Sprintf("查询结果超过限制（%d字节）", g.limits.MaxResultBytes)}
+}
+
+// ----------------执行中的查询（取消接口）-------------------
+
+// runningQuery 执行中的查询
+type runningQuery struct {
+	uid    string                  // 发起查询的用户ID
+	cancel context.CancelCauseFunc // 取消查询
+}
+
+var (
+	runningQueriesMu sync.Mutex
+	runningQueries   = make(map[string]*runningQuery)
+)
+
+/**
+ * StartQuery 登记一个执行中的查询：创建带超时的context，可通过CancelQuery按查询执行ID取消
+ * @param parent 父context（通常为请求的context，客户端断开时查询也结束）
+ * @param queryID 查询执行ID，为空时生成
+ * @param uid 发起查询的用户ID（只有该用户能取消）
+ * @param timeout 最长执行时间，为0时不限制
+ * @return context.Context 查询的context
+ * @return string 查询执行ID
+ * @return func() 查询结束时调用，释放登记
+ * @return error 查询执行ID已在执行中时返回错误
+ */
+func StartQuery(parent context.Context, queryID string, uid string, timeout time.Duration) (context.Context, string, func(), error) {
+	if queryID == "" {
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, "", nil, errors.New("生成查询执行ID失败:" + err.Error())
+		}
+		queryID = hex.EncodeToString(buf)
+	}
+
+	timeoutCtx, cancelTimeout := parent, context.CancelFunc(func() {})
+	if timeout > 0 {
+		timeoutCtx, cancelTimeout = context.WithTimeoutCause(parent, timeout, errQueryTimeout)
+	}
+	ctx, cancel := context.WithCancelCause(timeoutCtx)
+
+	runningQueriesMu.Lock()
+	defer runningQueriesMu.Unlock()
+	if _, ok := runningQueries[queryID]; ok {
+		cancel(errQueryCanceled)
+		cancelTimeout()
+		return nil, "", nil, errors.New("查询执行ID " + queryID + " 正在执行中")
+	}
+	runningQueries[queryID] = &runningQuery{uid: uid, cancel: cancel}
+	release := func() {
+		cancel(errQueryCanceled)
+		cancelTimeout()
+		runningQueriesMu.Lock()
+		delete(runningQueries, queryID)
+		runningQueriesMu.Unlock()
+	}
+	return ctx, queryID, release, nil
+}
+
+/**
+ * CancelQuery 取消执行中的查询
+ * @param queryID 查询执行ID
+ * @param uid 用户ID，须与发起查询的用户一致
+ * @return error 查询不存在（已结束）或无权取消时返回错误
+ */
+func CancelQuery(queryID string, uid string) error {
+	runningQueriesMu.Lock()
+	defer runningQueriesMu.Unlock()
+	query, ok := runningQueries[queryID]
+	if !ok {
+		return errors.New("查询 " + queryID + " 不存在或已结束")
+	}
+	if query.uid != uid {
+		return errors.New("只能取消自己发起的查询")
+	}
+	query.cancel(errQueryCanceled)
+	return nil
+}
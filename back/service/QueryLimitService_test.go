@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"chainqa_offchain_demo/setting"
+)
+
+// 测试用的数据集
+var testLimitShards = map[string]string{
+	"LA": "id\tk\n1\tx\n2\tx\n3\ty\n",
+	"LB": "k\tv\nx\t1\nx\t2\n",
+}
+
+func TestQueryLimits(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	single, _ := json.Marshal(QueryItem{QueryConcatType: "single", FilePos: [][]string{{"LA"}}, ReturnField: []string{"LA_*"}})
+	multi, _ := json.Marshal(QueryItem{QueryConcatType: "multi", FilePos: [][]string{{"LA"}, {"LB"}}, ReturnField: []string{"LA_id", "LB_v"},
+		JointConditions: []JointCondition{{Pos1: "LA", Field1: "k", Pos2: "LB", Field2: "k", Compare: "eq", Type: "string", JointType: "INNER"}}})
+	cases := []struct {
+		name      string
+		queryItem []byte
+		limits    QueryLimits
+		wantCode  int // 0表示不中止
+	}{
+		{"不限制", single, QueryLimits{}, 0},
+		{"扫描行数在限制内", single, QueryLimits{MaxRowsScanned: 3}, 0},
+		{"扫描行数超过限制", single, QueryLimits{MaxRowsScanned: 2}, QueryCodeRowsScannedExceeded},
+		{"联表结果行数在限制内", multi, QueryLimits{MaxJoinedRows: 4}, 0},
+		{"联表结果行数超过限制", multi, QueryLimits{MaxJoinedRows: 3}, QueryCodeJoinedRowsExceeded},
+		{"查询结果超过限制", single, QueryLimits{MaxResultBytes: 20}, QueryCodeResultBytesExceeded},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			queryResult, counts, err := GetQueryResultContext(context.Background(), string(tc.queryItem), testLimitShards, tc.limits)
+			if code := QueryAbortCode(err); code != tc.wantCode {
+				t.Fatalf("错误码 = %d，期望 %d（%s）", code, tc.wantCode, queryResult)
+			}
+			if (counts == -1) != (tc.wantCode != 0) {
+				t.Errorf("counts = %d（%s）", counts, queryResult)
+			}
+		})
+	}
+}
+
+func TestStartAndCancelQuery(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	ctx, runId, release, err := StartQuery(context.Background(), "run-1", "u1", 0)
+	if err != nil || runId != "run-1" {
+		t.Fatalf("StartQuery = %s, %v", runId, err)
+	}
+	if _, _, _, err := StartQuery(context.Background(), "run-1", "u1", 0); err == nil {
+		t.Errorf("执行中的查询执行ID不能重复")
+	}
+	if err := CancelQuery("run-1", "u2"); err == nil {
+		t.Errorf("不能取消其他用户的查询")
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("查询不应已结束")
+	}
+	if err := CancelQuery("run-1", "u1"); err != nil {
+		t.Fatalf("CancelQuery 失败: %v", err)
+	}
+	queryItem, _ := json.Marshal(QueryItem{QueryConcatType: "single", FilePos: [][]string{{"LA"}}, ReturnField: []string{"LA_id"}})
+	if _, counts, err := GetQueryResultContext(ctx, string(queryItem), testLimitShards, QueryLimits{}); counts != -1 || QueryAbortCode(err) != QueryCodeCanceled {
+		t.Errorf("取消后查询 = %d, %v，期望错误码 %d", counts, err, QueryCodeCanceled)
+	}
+	// 获取分片时取消
+	loader := func(ctx context.Context, filePos string) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	if _, counts, err := StreamQuery(ctx, string(queryItem), QueryLimits{}, loader, func(row interface{}) error { return nil }); counts != -1 || QueryAbortCode(err) != QueryCodeCanceled {
+		t.Errorf("取消后流式查询 = %d, %v", counts, err)
+	}
+	release()
+	if err := CancelQuery("run-1", "u1"); err == nil {
+		t.Errorf("已结束的查询不能取消")
+	}
+
+	// 超时
+	ctx, runId, release, err = StartQuery(context.Background(), "", "u1", time.Millisecond)
+	if err != nil || runId == "" {
+		t.Fatalf("StartQuery = %s, %v", runId, err)
+	}
+	defer release()
+	<-ctx.Done()
+	if _, counts, err := GetQueryResultContext(ctx, string(queryItem), testLimitShards, QueryLimits{}); counts != -1 || QueryAbortCode(err) != QueryCodeTimeout {
+		t.Errorf("超时后查询 = %d, %v，期望错误码 %d", counts, err, QueryCodeTimeout)
+	}
+	if _, err := LoadShards(ctx, []string{"LA"}, loader); QueryAbortCode(err) != QueryCodeTimeout {
+		t.Errorf("超时后获取分片 = %v", err)
+	}
+}
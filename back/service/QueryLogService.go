@@ -0,0 +1,112 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// QueryLogEntry 链上的查询日志（与合约中的QueryLog结构一致）
+type QueryLogEntry struct {
+	QueryId     string // 查询ID
+	Uid         string // 用户ID
+	Timestamp   string // 时间戳（Unix秒）
+	QueryItem   string // 查询项
+	QueryStatus int    // 查询状态（结果数量，-1表示失败）
+	QueryResult string // 查询结果
+	Action      string // 操作类型（query/export/metadata/search/cohort，旧日志为空）
+
+	TemplateName    string // 执行的查询模板名称（不是通过模板执行时为空）
+	TemplateVersion int    // 执行的查询模板版本
+	ColumnMasks     string // 查询时生效的列权限（禁止的列和脱敏规则）
+	Privacy         string // 差分隐私查询的噪声机制和隐私预算
+	Anonymity       string // 触发的k-匿名策略及隐藏、泛化的情况
+	PagedQueryId    string // 分页查询ID（同一分页查询每一页的日志相同）
+	PageOffset      int    // 分页查询中本页的偏移量
+	Cohort          string // 构建的队列，或查询限定的队列（名称@哈希）
+}
+
+// QueryLogOptions 上链查询日志时的附加信息，均为选填
+type QueryLogOptions struct {
+	Action          string // 操作类型（query/export/metadata/search/cohort，为空时合约记为query）
+	TemplateName    string // 执行的查询模板名称
+	TemplateVersion int    // 执行的查询模板版本
+	ColumnMasks     string // 查询时生效的列权限摘要（ColumnPolicy.Summary）
+	Privacy         string // 差分隐私查询的摘要（噪声机制和epsilon）
+	Anonymity       string // 触发的k-匿名策略的摘要（AnonymityReport.Summary）
+	PagedQueryId    string // 分页查询ID（每一页的日志相同）
+	PageOffset      int    // 分页查询中本页的偏移量
+	Cohort          string // 构建的队列，或查询限定的队列（Cohort.Ref）
+}
+
+/**
+ * applyTo 把附加信息写入合约调用参数（为空的不写入）
+ * @param args 合约调用参数
+ */
+func (options QueryLogOptions) applyTo(args map[string]interface{}) {
+	if options.Action != "" {
+		args["action"] = options.Action
+	}
+	if options.TemplateName != "" {
+		args["templateName"] = options.TemplateName
+		args["templateVersion"] = strconv.Itoa(options.TemplateVersion)
+	}
+	if options.ColumnMasks != "" {
+		args["columnMasks"] = options.ColumnMasks
+	}
+	if options.Privacy != "" {
+		args["privacy"] = options.Privacy
+	}
+	if options.Anonymity != "" {
+		args["anonymity"] = options.Anonymity
+	}
+	if options.PagedQueryId != "" {
+		args["pagedQueryId"] = options.PagedQueryId
+		args["pageOffset"] = strconv.Itoa(options.PageOffset)
+	}
+	if options.Cohort != "" {
+		args["cohort"] = options.Cohort
+	}
+}
+
+/**
+ * WithAnonymity 从查询结果中取出触发的k-匿名策略，记录在查询日志中
+ * @param queryResult 查询结果（JSON字符串）
+ * @return QueryLogOptions 附加了k-匿名摘要的选项
+ */
+func (options QueryLogOptions) WithAnonymity(queryResult string) QueryLogOptions {
+	options.Anonymity = AnonymitySummary(queryResult)
+	return options
+}
+
+/**
+ * FindQueryLog 在用户的链上查询日志中按查询ID查找
+ * @param contractName 合约名称
+ * @param chainServiceUrl 区块链服务地址
+ * @param uId 用户ID（只能查找自己的查询日志）
+ * @param queryId 查询ID
+ * @return QueryLogEntry 查询日志
+ * @return error 错误信息
+ */
+func FindQueryLog(contractName string, chainServiceUrl string, uId string, queryId string) (QueryLogEntry, error) {
+	if uId == "" || queryId == "" {
+		return QueryLogEntry{}, errors.New("uId 和 queryId 不能为空")
+	}
+	result, err := GetAllQueryLogByUid(contractName, chainServiceUrl, uId)
+	if err != nil {
+		return QueryLogEntry{}, err
+	}
+	var logs struct {
+		Count         int
+		QueryLogArray []QueryLogEntry
+	}
+	if err := json.Unmarshal([]byte(result), &logs); err != nil {
+		return QueryLogEntry{}, errors.New("解析查询日志失败: " + err.Error())
+	}
+	for _, entry := range logs.QueryLogArray {
+		if entry.QueryId == queryId {
+			return entry, nil
+		}
+	}
+	return QueryLogEntry{}, errors.New("未找到查询日志 " + queryId)
+}
@@ -0,0 +1,599 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 行数不少于该值时分块并发匹配
+const parallelFilterMinRows = 10000
+
+// ----------------编译后的查询计划（COMPILED QUERY PLAN）-------------------
+// 查询前将查询条件编译一次：列索引预先解析、基准值预先转换为对应类型、正则预先编译；
+// 表中参与比较的列按类型整列解析一次并缓存（列式），逐行匹配时只做数值/时间比较。
+
+// typedColumn 按类型解析后的一列（只解析非空单元格）
+type typedColumn struct {
+	ints   []int64     // int类型的值
+	floats []float64   // float类型的值
+	times  []time.Time // date/datetime类型的值
+	errs   []error     // 单元格解析错误（匹配到该单元格时才返回，与逐行解析的行为一致）
+}
+
+// compiledCondition 编译后的单个查询条件
+type compiledCondition struct {
+	condition QueryCondition // 原始条件（用于错误信息）
+	colIndex  int            // 列索引
+	column    *typedColumn   // 按类型解析后的列（string类型为nil）
+
+	strVal   string               // string：基准值
+	lowerVal string               // string：小写的基准值（icontain）
+	re       *regexp.Regexp       // string：预编译的正则
+	strSet   map[string]struct{}  // string：in/notin的集合
+	strLow   string               // string：between下界
+	strHigh  string               // string：between上界
+	intVal   int64                // int：基准值/between下界
+	intHigh  int64                // int：between上界
+	intSet   map[int64]struct{}   // int：in/notin的集合
+	fltVal   float64              // float：基准值/between下界
+	fltHigh  float64              // float：between上界
+	fltSet   map[float64]struct{} // float：in/notin的集合
+	timeVal  time.Time            // date：基准值/between下界
+	timeHigh time.Time            // date：between上界
+	timeSet  []time.Time          // date：in/notin的列表
+}
+
+// queryPlan 编译后的查询计划：组间为OR关系，组内为AND关系
+type queryPlan struct {
+	table  *Table
+	groups [][]compiledCondition
+}
+
+/**
+ * typedColumn 获取按类型解析后的列，同一张表的同一列同一类型只解析一次
+ * @param index 列索引
+ * @param cellType 类型（int/float/date/datetime）
+ * @param dateParser 日期解析器
+ * @return *typedColumn 解析后的列
+ */
+func (t *Table) typedColumn(index int, cellType string, dateParser *DateParser) *typedColumn {
+	key := strconv.Itoa(index) + "_" + cellType
+	if column, ok := t.typedColumns[key]; ok {
+		return column
+	}
+	column := &typedColumn{errs: make([]error, len(t.Rows))}
+	switch cellType {
+	case "int":
+		column.ints = make([]int64, len(t.Rows))
+	case "float":
+		column.floats = make([]float64, len(t.Rows))
+	case "date", "datetime":
+		column.times = make([]time.Time, len(t.Rows))
+	}
+	for rowIdx, row := range t.Rows {
+		cellValue := row[index]
+		if isNullCell(cellValue) {
+			continue
+		}
+		switch cellType {
+		case "int":
+			v, err := strconv.ParseInt(cellValue, 10, 64)
+			if err != nil {
+				column.errs[rowIdx] = fmt.Errorf("数据 %v 无法转换为整数: %s，该列可能非数字列，建议使用string比较。请修改查询条件的type", cellValue, err)
+			}
+			column.ints[rowIdx] = v
+		case "float":
+			v, err := strconv.ParseFloat(cellValue, 64)
+			if err != nil {
+				column.errs[rowIdx] = fmt.Errorf("数据 %v 无法转换为浮点数: %s，该列可能非数字列，建议使用string比较。请修改查询条件的type", cellValue, err)
+			}
+			column.floats[rowIdx] = v
+		case "date", "datetime":
+			v, err := dateParser.ParseAs(cellValue, cellType)
+			if err != nil {
+				column.errs[rowIdx] = fmt.Errorf("数据 %s，该列可能非日期列，请修改查询条件的type", err)
+			}
+			column.times[rowIdx] = v
+		}
+	}
+	if t.typedColumns == nil {
+		t.typedColumns = make(map[string]*typedColumn)
+	}
+	t.typedColumns[key] = column
+	return column
+}
+
+/**
+ * compileQueryPlan 编译查询条件（调用前需先通过validateQueryConditions校验）
+ * @param table 表
+ * @param queryConditions 查询条件数组
+ * @param dateParser 日期解析器
+ * @return *queryPlan 查询计划
+ * @return error 错误信息
+ */
+func compileQueryPlan(table *Table, queryConditions [][]QueryCondition, dateParser *DateParser) (*queryPlan, error) {
+	plan := &queryPlan{table: table, groups: make([][]compiledCondition, 0, len(queryConditions))}
+	for groupIdx, conditionGroup := range queryConditions {
+		group := make([]compiledCondition, 0, len(conditionGroup))
+		for _, condition := range conditionGroup {
+			compiled, err := compileCondition(table, condition, dateParser)
+			if err != nil {
+				return nil, fmt.Errorf("第%d组%s错误: %s", groupIdx+1, describeCondition(condition), err)
+			}
+			group = append(group, compiled)
+		}
+		plan.groups = append(plan.groups, group)
+	}
+	return plan, nil
+}
+
+/**
+ * compileCondition 编译单个查询条件：解析列索引、转换基准值、编译正则
+ * @param table 表
+ * @param condition 查询条件
+ * @param dateParser 日期解析器
+ * @return compiledCondition 编译后的条件
+ * @return error 错误信息
+ */
+func compileCondition(table *Table, condition QueryCondition, dateParser *DateParser) (compiledCondition, error) {
+	compiled := compiledCondition{condition: condition}
+	colIndex, ok := table.HeaderMap[condition.Pos+"_"+condition.Field]
+	if !ok {
+		return compiled, fmt.Errorf("查询条件中 %s 列不存在", condition.Field)
+	}
+	compiled.colIndex = colIndex
+	if condition.Compare == "isnull" || condition.Compare == "notnull" {
+		return compiled, nil
+	}
+
+	// 基准值列表（in/notin为列表，between为[下界,上界]，其余为单个值）
+	var vals []string
+	switch condition.Compare {
+	case "in", "notin":
+		list, err := parseCondValList(condition.Val)
+		if err != nil {
+			return compiled, err
+		}
+		vals = list
+	case "between":
+		bounds, err := parseCondValBetween(condition.Val)
+		if err != nil {
+			return compiled, err
+		}
+		vals = bounds
+	default:
+		vals = []string{condition.Val}
+	}
+
+	switch condition.Type {
+	case "string":
+		compiled.strVal = condition.Val
+		compiled.lowerVal = strings.ToLower(condition.Val)
+		switch condition.Compare {
+		case "regexp":
+			re, err := regexp.Compile(condition.Val)
+			if err != nil {
+				return compiled, fmt.Errorf("查询条件传入的正则表达式错误: %s", condition.Val)
+			}
+			compiled.re = re
+		case "in", "notin":
+			compiled.strSet = make(map[string]struct{}, len(vals))
+			for _, val := range vals {
+				compiled.strSet[val] = struct{}{}
+			}
+		case "between":
+			compiled.strLow, compiled.strHigh = vals[0], vals[1]
+		}
+	case "int":
+		ints := make([]int64, len(vals))
+		for i, val := range vals {
+			v, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return compiled, fmt.Errorf("查询条件中基准值 %v 无法转换为整数: %s 。请修改查询条件的type", val, err)
+			}
+			ints[i] = v
+		}
+		compiled.intVal = ints[0]
+		if condition.Compare == "between" {
+			compiled.intHigh = ints[1]
+		}
+		compiled.intSet = make(map[int64]struct{}, len(ints))
+		for _, v := range ints {
+			compiled.intSet[v] = struct{}{}
+		}
+		compiled.column = table.typedColumn(colIndex, "int", dateParser)
+	case "float":
+		floats := make([]float64, len(vals))
+		for i, val := range vals {
+			v, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return compiled, fmt.Errorf("查询条件中基准值 %v 无法转换为浮点数: %s，请修改查询条件的type", val, err)
+			}
+			floats[i] = v
+		}
+		compiled.fltVal = floats[0]
+		if condition.Compare == "between" {
+			compiled.fltHigh = floats[1]
+		}
+		compiled.fltSet = make(map[float64]struct{}, len(floats))
+		for _, v := range floats {
+			compiled.fltSet[v] = struct{}{}
+		}
+		compiled.column = table.typedColumn(colIndex, "float", dateParser)
+	case "date", "datetime":
+		times := make([]time.Time, len(vals))
+		for i, val := range vals {
+			v, err := dateParser.ParseAs(val, condition.Type)
+			if err != nil {
+				return compiled, fmt.Errorf("查询条件中基准值 %s", err)
+			}
+			times[i] = v
+		}
+		compiled.timeVal = times[0]
+		if condition.Compare == "between" {
+			compiled.timeHigh = times[1]
+		}
+		compiled.timeSet = times
+		compiled.column = table.typedColumn(colIndex, condition.Type, dateParser)
+	default:
+		return compiled, fmt.Errorf("查询条件中暂时不支持 %s 列的类型: %s", condition.Field, condition.Type)
+	}
+	return compiled, nil
+}
+
+/**
+ * filterRows 校验并编译查询条件，返回满足条件的行索引（按行序）。行数较多时分块并发匹配
+ * @param table 表
+ * @param queryConditions 查询条件数组
+ * @param dateParser 日期解析器
+ * @param limit 大于0时只需要前limit个满足条件的行，各分块满足后提前结束
+ * @param guard 查询守卫（扫描行数限制、超时、取消），为nil时不检查
+ * @return []int 满足条件的行索引
+ * @return error 错误信息，会指明出错的条件
+ */
+func filterRows(table *Table, queryConditions [][]QueryCondition, dateParser *DateParser, limit int, guard *QueryGuard) ([]int, error) {
+	if err := guard.scanRows(len(table.Rows)); err != nil {
+		return nil, err
+	}
+	if err := guard.Err(); err != nil {
+		return nil, err
+	}
+	// 先校验查询条件，避免逐行扫描到一半才发现条件错误
+	if err := validateQueryConditions(queryConditions, table.HeaderMap, dateParser); err != nil {
+		return nil, err
+	}
+	// 编译查询条件：列索引、基准值、正则只解析一次，参与比较的列整列按类型解析一次
+	plan, err := compileQueryPlan(table, queryConditions, dateParser)
+	if err != nil {
+		return nil, err
+	}
+
+	workers := runtime.GOMAXPROCS(0)
+	if len(table.Rows) < parallelFilterMinRows {
+		workers = 1
+	}
+	chunkSize := (len(table.Rows) + workers - 1) / workers
+	chunkRows := make([][]int, workers) // 各分块满足条件的行
+	chunkErrs := make([]error, workers) // 各分块遇到的第一个错误（之前满足条件的行仍然有效）
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		start := w * chunkSize
+		end := min(start+chunkSize, len(table.Rows))
+		if start >= end {
+			break
+		}
+		wg.Add(1)
+		go func(w int, start int, end int) {
+			defer wg.Done()
+			matched := make([]int, 0)
+			for rowIdx := start; rowIdx < end; rowIdx++ {
+				// 每匹配一定行数检查一次查询是否已超时或取消
+				if (rowIdx-start)%guardCheckInterval == guardCheckInterval-1 {
+					if err := guard.Err(); err != nil {
+						chunkErrs[w] = err
+						break
+					}
+				}
+				flag, err := plan.matches(rowIdx)
+				if err != nil {
+					chunkErrs[w] = err
+					break
+				}
+				if flag {
+					matched = append(matched, rowIdx)
+					if limit > 0 && len(matched) >= limit {
+						break
+					}
+				}
+			}
+			chunkRows[w] = matched
+		}(w, start, end)
+	}
+	wg.Wait()
+
+	// 按分块顺序合并，与逐行顺序匹配的结果一致
+	matchedRowIdxs := make([]int, 0)
+	for w := 0; w < workers; w++ {
+		matchedRowIdxs = append(matchedRowIdxs, chunkRows[w]...)
+		if limit > 0 && len(matchedRowIdxs) >= limit {
+			return matchedRowIdxs[:limit], nil
+		}
+		if chunkErrs[w] != nil {
+			return nil, chunkErrs[w]
+		}
+	}
+	return matchedRowIdxs, nil
+}
+
+/**
+ * matches 判断第rowIdx行是否满足查询计划（任一组满足即可）
+ * @param rowIdx 行索引
+ * @return bool 是否满足
+ * @return error 错误信息，会指明出错的组和条件
+ */
+func (plan *queryPlan) matches(rowIdx int) (bool, error) {
+	// 如果没有查询条件，那么默认为全查询
+	if len(plan.groups) == 0 {
+		return true, nil
+	}
+	row := plan.table.Rows[rowIdx]
+	for groupIdx, group := range plan.groups {
+		groupFlag := true
+		for i := range group {
+			flag, err := group[i].match(row, rowIdx)
+			if err != nil {
+				return false, fmt.Errorf("第%d组%s错误: %s", groupIdx+1, describeCondition(group[i].condition), err)
+			}
+			if !flag {
+				groupFlag = false
+				break
+			}
+		}
+		// 满足条件即可返回，不同数组的条件为OR关系，同组条件为AND关系
+		if groupFlag {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+/**
+ * match 判断单元格是否满足编译后的条件
+ * @param row 行数据
+ * @param rowIdx 行索引（用于读取已解析的列）
+ * @return bool 比较结果
+ * @return error 错误信息
+ */
+func (c *compiledCondition) match(row []string, rowIdx int) (bool, error) {
+	cellValue := row[c.colIndex]
+	compare := c.condition.Compare
+	switch compare {
+	case "isnull":
+		return isNullCell(cellValue), nil
+	case "notnull":
+		return !isNullCell(cellValue), nil
+	}
+
+	if c.condition.Type == "string" {
+		return c.matchString(cellValue)
+	}
+
+	// 空值与任何数字/日期比较都不成立
+	if isNullCell(cellValue) {
+		return false, nil
+	}
+	if err := c.column.errs[rowIdx]; err != nil {
+		return false, err
+	}
+	switch c.condition.Type {
+	case "int":
+		v := c.column.ints[rowIdx]
+		switch compare {
+		case "in":
+			_, ok := c.intSet[v]
+			return ok, nil
+		case "notin":
+			_, ok := c.intSet[v]
+			return !ok, nil
+		case "between":
+			return v >= c.intVal && v <= c.intHigh, nil
+		}
+		return compareResult(threeWayInt(v, c.intVal), compare, "int")
+	case "float":
+		v := c.column.floats[rowIdx]
+		switch compare {
+		case "in":
+			_, ok := c.fltSet[v]
+			return ok, nil
+		case "notin":
+			_, ok := c.fltSet[v]
+			return !ok, nil
+		case "between":
+			return v >= c.fltVal && v <= c.fltHigh, nil
+		}
+		return compareResult(threeWay(v, c.fltVal), compare, "float")
+	default:
+		v := c.column.times[rowIdx]
+		switch compare {
+		case "in", "notin":
+			found := false
+			for _, t := range c.timeSet {
+				if v.Equal(t) {
+					found = true
+					break
+				}
+			}
+			return found == (compare == "in"), nil
+		case "between":
+			return !v.Before(c.timeVal) && !v.After(c.timeHigh), nil
+		}
+		return compareResult(v.Compare(c.timeVal), compare, c.condition.Type)
+	}
+}
+
+/**
+ * matchString 字符串条件匹配（正则已预编译）
+ * @param cellValue 单元格值
+ * @return bool 比较结果
+ * @return error 错误信息
+ */
+func (c *compiledCondition) matchString(cellValue string) (bool, error) {
+	// 空值与任何字符串比较都不成立
+	if cellValue == NullCell {
+		return false, nil
+	}
+	switch c.condition.Compare {
+	case "eq":
+		return cellValue == c.strVal, nil
+	case "ne":
+		return cellValue != c.strVal, nil
+	case "ieq":
+		return strings.EqualFold(cellValue, c.strVal), nil
+	case "lt", "gt", "le", "ge":
+		return compareResult(strings.Compare(cellValue, c.strVal), c.condition.Compare, "string")
+	case "regexp":
+		return c.re.MatchString(cellValue), nil
+	case "contain":
+		return strings.Contains(cellValue, c.strVal), nil
+	case "notcontain":
+		return !strings.Contains(cellValue, c.strVal), nil
+	case "icontain":
+		return strings.Contains(strings.ToLower(cellValue), c.lowerVal), nil
+	case "suffix":
+		return strings.HasSuffix(cellValue, c.strVal), nil
+	case "prefix":
+		return strings.HasPrefix(cellValue, c.strVal), nil
+	case "in":
+		_, ok := c.strSet[cellValue]
+		return ok, nil
+	case "notin":
+		_, ok := c.strSet[cellValue]
+		return !ok, nil
+	case "between":
+		return cellValue >= c.strLow && cellValue <= c.strHigh, nil
+	default:
+		return false, fmt.Errorf("查询条件传入的运算比较符 %s 暂不被string类型支持", c.condition.Compare)
+	}
+}
+
+/**
+ * threeWay 三路比较两个数
+ * @param a 单元格值
+ * @param b 基准值
+ * @return int a<b为-1，a==b为0，a>b为1
+ */
+func threeWay(a float64, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+/**
+ * threeWayInt 三路比较两个整数
+ * @param a 单元格值
+ * @param b 基准值
+ * @return int a<b为-1，a==b为0，a>b为1
+ */
+func threeWayInt(a int64, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+/**
+ * compareCells 按类型比较两个单元格（联表条件），与查询条件共用compareResult
+ * @param left 表1的单元格值
+ * @param right 表2的单元格值
+ * @param compare 比较符（eq/ne/lt/gt/le/ge，由checkJoinCompare校验）
+ * @param cellType 类型（string/int/float/date/datetime）
+ * @param dateParser 日期解析器（两侧的日期格式可以不同，统一解析后再比较）
+ * @return bool 比较结果，任一侧为空值时不成立
+ * @return error 错误信息
+ */
+func compareCells(left string, right string, compare string, cellType string, dateParser *DateParser) (bool, error) {
+	if left == NullCell || right == NullCell {
+		return false, nil
+	}
+	if cellType != "string" && (isNullCell(left) || isNullCell(right)) {
+		return false, nil
+	}
+	var cmp int
+	switch cellType {
+	case "string":
+		cmp = strings.Compare(left, right)
+	case "int":
+		values := [2]int64{}
+		for i, cellValue := range []string{left, right} {
+			v, err := strconv.ParseInt(cellValue, 10, 64)
+			if err != nil {
+				return false, fmt.Errorf("数据 %v 无法转换为整数: %s，该列可能非数字列，建议使用string比较。请修改联表条件的type", cellValue, err)
+			}
+			values[i] = v
+		}
+		cmp = threeWayInt(values[0], values[1])
+	case "float":
+		values := [2]float64{}
+		for i, cellValue := range []string{left, right} {
+			v, err := strconv.ParseFloat(cellValue, 64)
+			if err != nil {
+				return false, fmt.Errorf("数据 %v 无法转换为浮点数: %s，该列可能非数字列，建议使用string比较。请修改联表条件的type", cellValue, err)
+			}
+			values[i] = v
+		}
+		cmp = threeWay(values[0], values[1])
+	case "date", "datetime":
+		values := [2]time.Time{}
+		for i, cellValue := range []string{left, right} {
+			v, err := dateParser.ParseAs(cellValue, cellType)
+			if err != nil {
+				return false, fmt.Errorf("数据 %s，该列可能非日期列，请修改联表条件的type", err)
+			}
+			values[i] = v
+		}
+		cmp = values[0].Compare(values[1])
+	default:
+		return false, errors.New("联表条件类型错误，不支持类型：" + cellType)
+	}
+	return compareResult(cmp, compare, cellType)
+}
+
+/**
+ * compareResult 根据三路比较结果和比较符得出比较结果
+ * @param cmp 三路比较结果（-1/0/1）
+ * @param compare 比较符（gt/lt/ge/le/eq/ne）
+ * @param cellType 类型（用于错误信息）
+ * @return bool 比较结果
+ * @return error 错误信息
+ */
+func compareResult(cmp int, compare string, cellType string) (bool, error) {
+	switch compare {
+	case "gt":
+		return cmp > 0, nil
+	case "lt":
+		return cmp < 0, nil
+	case "ge":
+		return cmp >= 0, nil
+	case "le":
+		return cmp <= 0, nil
+	case "eq":
+		return cmp == 0, nil
+	case "ne":
+		return cmp != 0, nil
+	default:
+		return false, fmt.Errorf("查询条件传入的运算比较符 %s 暂不被%s类型支持", compare, cellType)
+	}
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"chainqa_offchain_demo/setting"
+)
+
+// testPlanTable 测试用的表：一列为各类型的单元格（含空值与空字符串）
+func testPlanTable(values []string) *Table {
+	table := newTable("P", []string{"v"})
+	for _, value := range values {
+		table.Rows = append(table.Rows, []string{value})
+	}
+	return table
+}
+
+func TestFilterRowsMatchesCompareCells(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	dateParser, _ := NewDateParser(DateOptions{})
+	cases := []struct {
+		cellType string
+		values   []string
+		val      string
+	}{
+		{"int", []string{"-3", "0", "7", "12", NullCell}, "7"},
+		{"float", []string{"1.5", "-0.25", "2", "1e2", NullCell}, "1.5"},
+		{"date", []string{"2024-01-01", "2024/2/1", "20240301", NullCell}, "2024-02-01"},
+		{"datetime", []string{"2024-01-01 08:00:00", "2024-01-01 08:00", "2024-01-02 00:00:00", NullCell}, "2024-01-01 08:00:00"},
+		{"string", []string{"a", "b", "B", "", NullCell}, "b"},
+	}
+	for _, tc := range cases {
+		for _, compare := range []string{"eq", "ne", "lt", "le", "gt", "ge"} {
+			t.Run(tc.cellType+" "+compare, func(t *testing.T) {
+				table := testPlanTable(tc.values)
+				condition := QueryCondition{Pos: "P", Field: "v", Val: tc.val, Compare: compare, Type: tc.cellType}
+				got, err := filterRows(table, [][]QueryCondition{{condition}}, dateParser, 0, nil)
+				if err != nil {
+					t.Fatalf("filterRows 失败: %v", err)
+				}
+				// 编译后的查询计划与联表条件共用的比较函数逐行比较的结果一致
+				want := make([]int, 0)
+				for rowIdx, row := range table.Rows {
+					flag, err := compareCells(row[0], tc.val, compare, tc.cellType, dateParser)
+					if err != nil {
+						t.Fatalf("compareCells 失败: %v", err)
+					}
+					if flag {
+						want = append(want, rowIdx)
+					}
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("filterRows = %v，逐行比较 = %v", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestFilterRowsParallel(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	values := make([]string, parallelFilterMinRows*3)
+	for i := range values {
+		values[i] = strconv.Itoa(i % 10)
+	}
+	table := testPlanTable(values)
+	conditions := [][]QueryCondition{{{Pos: "P", Field: "v", Val: `["3","5"]`, Compare: "in", Type: "int"}}, {{Pos: "P", Field: "v", Val: "9", Compare: "eq", Type: "string"}}}
+	got, err := filterRows(table, conditions, nil, 0, nil)
+	if err != nil {
+		t.Fatalf("filterRows 失败: %v", err)
+	}
+	if len(got) != len(values)*3/10 {
+		t.Fatalf("结果行数 = %d，期望 %d", len(got), len(values)*3/10)
+	}
+	for i, rowIdx := range got {
+		if v := values[rowIdx]; v != "3" && v != "5" && v != "9" || i > 0 && got[i-1] >= rowIdx {
+			t.Fatalf("第%d个结果行 %d 不满足条件或顺序错误", i, rowIdx)
+		}
+	}
+	// LIMIT跨分块时按行顺序截断
+	limited, err := filterRows(table, conditions, nil, parallelFilterMinRows/2, nil)
+	if err != nil || !reflect.DeepEqual(limited, got[:parallelFilterMinRows/2]) {
+		t.Errorf("LIMIT结果与前%d行不一致: %v", parallelFilterMinRows/2, err)
+	}
+}
+
+func TestFilterRowsErrors(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	table := testPlanTable([]string{"1", "x"})
+	cases := []struct {
+		name      string
+		condition QueryCondition
+		wantErr   string
+	}{
+		{"列不存在", QueryCondition{Pos: "P", Field: "w", Val: "1", Compare: "eq", Type: "int"}, "w"},
+		{"单元格不是整数", QueryCondition{Pos: "P", Field: "v", Val: "1", Compare: "gt", Type: "int"}, "x"},
+		{"正则错误", QueryCondition{Pos: "P", Field: "v", Val: "(", Compare: "regexp", Type: "string"}, "("},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := filterRows(table, [][]QueryCondition{{tc.condition}}, nil, 0, nil)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("err = %v，期望包含 %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckJoinCompare(t *testing.T) {
+	for _, compare := range []string{"eq", "ne", "lt", "le", "gt", "ge"} {
+		if err := checkJoinCompare(compare); err != nil {
+			t.Errorf("checkJoinCompare(%s) = %v", compare, err)
+		}
+	}
+	for _, compare := range []string{"in", "notin", "between", "regexp", ""} {
+		if err := checkJoinCompare(compare); err == nil || !strings.Contains(err.Error(), "只支持 eq/ne/lt/gt/le/ge") {
+			t.Errorf("checkJoinCompare(%s) = %v，期望不支持", compare, err)
+		}
+	}
+}
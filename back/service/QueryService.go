@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
 
@@ -17,30 +18,43 @@ import (
 // 查询条件结构
 // 查询项（一次查询传入的数据）
 type QueryItem struct {
-	QueryConcatType string             `json:"queryConcatType"` // 查询条件组合类型（AND/OR）
-	QueryConditions [][]QueryCondition `json:"queryConditions"` // 查询条件
-	FilePos         [][]string         `json:"filePos"`         // 文件在IPFS中的位置(教师文件)
-	ReturnField     []string           `json:"returnField"`     // 返回的列名
-	JointConditions []JointCondition   `json:"jointConditions"` // 联表查询条件
+	QueryConcatType string             `json:"queryConcatType"`          // 查询条件组合类型（AND/OR）
+	QueryConditions [][]QueryCondition `json:"queryConditions"`          // 查询条件
+	FilePos         [][]string         `json:"filePos"`                  // 文件在IPFS中的位置(教师文件)
+	ReturnField     []string           `json:"returnField"`              // 返回的列名
+	JointConditions []JointCondition   `json:"jointConditions"`          // 联表查询条件
+	GroupBy         []GroupByItem      `json:"groupBy"`                  // 分组列（可选）
+	Aggregates      []AggregateItem    `json:"aggregates"`               // 聚合函数（可选，COUNT/SUM/AVG/MIN/MAX）
+	OrderBy         []OrderByItem      `json:"orderBy"`                  // 排序列（可选）
+	DateOptions     DateOptions        `json:"dateOptions"`              // 日期解析选项（可选，覆盖配置文件）
+	Limit           int                `json:"limit"`                    // 最多返回的行数（可选，0表示不限制）
+	Union           UnionOptions       `json:"union"`                    // 分片合并选项（可选，列重命名映射、类型拓宽策略）
+	ComputedColumns []ComputedColumn   `json:"computedColumns"`          // 计算列（可选，表达式列，按 pos_alias 引用）
+	Privacy         *PrivacyOptions    `json:"privacy,omitempty"`        // 差分隐私选项（可选，设置时只返回加噪的count/sum/avg）
+	WithProvenance  bool               `json:"withProvenance,omitempty"` // 每个结果行附带来源（可选，见ProvenanceService）
+
+	guard        *QueryGuard     // 查询守卫（超时、取消、资源限制），由GetQueryResultContext设置，不参与JSON
+	columnPolicy *ColumnPolicy   // 调用者的列权限（禁止的列、脱敏规则），由GetQueryResultContext设置，不参与JSON
+	provenance   *provenancePlan // 来源列的展开（withProvenance时），由GetQueryResultContext设置，不参与JSON
 }
 
 // QueryCondition 定义细化查询条件结构
 type QueryCondition struct {
 	Field   string `json:"field"`   // 字段名（列名）
-	Val     string `json:"val"`     // 基准值
+	Val     string `json:"val"`     // 基准值（in/notin为JSON数组，between为[下界,上界]的JSON数组）
 	Pos     string `json:"pos"`     // 位置（多联表的时候来标记）
-	Compare string `json:"compare"` // 比较符
-	Type    string `json:"type"`    // 类型（string/int/float）
+	Compare string `json:"compare"` // 比较符（eq/ne/lt/gt/le/ge/in/notin/between/isnull/notnull，string类型另有regexp/contain/notcontain/icontain/ieq/prefix/suffix）
+	Type    string `json:"type"`    // 类型（string/int/float/date/datetime）
 }
 
 // JointCondition 定义联表查询条件结构
 type JointCondition struct {
-	Pos1      string `json:"pos1"`    // 位置1
-	Field1    string `json:"field1"`  // 字段1
-	Pos2      string `json:"pos2"`    // 位置2
-	Field2    string `json:"field2"`  // 字段2
-	Compare   string `json:"compare"` // 比较符
-	Type      string `json:"type"`
+	Pos1      string `json:"pos1"`      // 位置1
+	Field1    string `json:"field1"`    // 字段1
+	Pos2      string `json:"pos2"`      // 位置2
+	Field2    string `json:"field2"`    // 字段2
+	Compare   string `json:"compare"`   // 比较符
+	Type      string `json:"type"`      // 类型（string/int/float/date/datetime）
 	JointType string `json:"jointType"` // 联表类型（INNER/OUTER）
 }
 
@@ -50,261 +64,176 @@ type QueryResult struct {
 	Counts int `json:"counts"` // 若为-1，则表示查询错误；若为0，则表示查询无结果；若为其他值，则表示查询结果数量
 
 	// 返回的data，即查询结果。
-	// 采用JSON格式，key为列名，value为该列的值，均以字符串标识。
+	// 采用JSON格式，key为列名，value为该列的值，均以字符串标识（空值为null）。
 	Data []interface{} `json:"data"` // 当Counts为0或-1时，为空；当Counts为其他值时，非空
 
 	// 返回的信息，string格式
 	Message string `json:"message"` // 主要是：错误信息。当Counts为-1时，非空
 
+	// 触发k-匿名时的说明（未触发时不返回）
+	Anonymity *AnonymityReport `json:"anonymity,omitempty"`
 }
 
 /**
- * @Description: 解析表头
- * @author: jjq
- * @param tableStr 表字符串(从IPFS读入，为教师上传的文件的内容)
- * @return map[string]int 表头字段名和索引的映射关系
- * @usage: tableHeaderMap["id"]=0。
+ * isNullCell 判断单元格是否为空值（新格式中的null，以及旧格式中的空字符串或null，不区分大小写）
+ * @param cellValue 单元格值
+ * @return bool 是否为空值
  */
-func parseTableHeader(fix_prefix_pos, tableStr string) map[string]int {
-	// 读取文件，按行读取，第一行是表头
-	lines := strings.Split(tableStr, "\n")
-	// 获取表头，按空格拆分
-	headers := strings.Fields(lines[0])
-	// tableHeaderMap 用于存储表头字段名和索引序号（第x列，从0开始）的映射关系
-	tableHeaderMap := make(map[string]int)
-	for i, header := range headers {
-		tableHeaderMap[fix_prefix_pos+"_"+header] = i
-		// 列名为header ，索引为i
-	}
-
-	return tableHeaderMap
-	// usage: tableHeaderMap["id"]=0。
+func isNullCell(cellValue string) bool {
+	return cellValue == NullCell || cellValue == "" || strings.EqualFold(cellValue, "null")
 }
 
 /**
- * @description: 比较两个map是否相等，即比较两个map的键值对是否完全相同（包括键和值）
- * @param a map[string]int 第一个map
- * @param b map[string]int 第二个map
- * @return bool 如果两个map相等，则返回true，否则返回false
+ * parseCondValList 解析in/notin/between的基准值列表，基准值为JSON数组，如 ["A01","B02"] 或 [18,30]
+ * @param condVal 查询条件基准值
+ * @return []string 列表元素（统一转为字符串）
+ * @return error 错误信息
  */
-func compareMaps(a, b map[string]int) bool {
-	// 如果两个 map 的长度不同，它们肯定不相等
-	if len(a) != len(b) {
-		return false
-	}
-
-	// 遍历 map a，检查每个键值对是否在 map b 中
-	for key, value := range a {
-		if bValue, exists := b[key]; !exists || bValue != value {
-			return false
+func parseCondValList(condVal string) ([]string, error) {
+	var rawVals []json.RawMessage
+	if err := json.Unmarshal([]byte(condVal), &rawVals); err != nil {
+		return nil, fmt.Errorf("基准值 %s 不是合法的JSON数组: %s", condVal, err)
+	}
+	vals := make([]string, 0, len(rawVals))
+	for _, rawVal := range rawVals {
+		var strVal string
+		if err := json.Unmarshal(rawVal, &strVal); err == nil {
+			vals = append(vals, strVal)
+			continue
 		}
+		// 数字等非字符串元素，直接取其字面值
+		vals = append(vals, strings.TrimSpace(string(rawVal)))
 	}
-
-	// 所有键值对都相等，两个 map 相等
-	return true
+	return vals, nil
 }
 
 /**
- * matchesConditions 检查行是否匹配查询条件数组
- * @author: jjq
- * @param {string} row 行字符串，即一行数据，将按空格拆分
- * @param tableHeaderMap 表头字段名和索引的映射关系
- * @param conditions 查询条件数组（数组内条件按AND逻辑关联）
- * @return bool 本行是否满足查询条件组匹配要求
+ * parseCondValBetween 解析between的基准值，必须为两个元素的JSON数组 [下界, 上界]（闭区间）
+ * @param condVal 查询条件基准值
+ * @return []string 下界和上界
+ * @return error 错误信息
  */
-func matchesConditions(row string, tableHeaderMap map[string]int, conditions []QueryCondition) (bool, error) {
-
-	// 遍历每个conditions。该condition为同一组conditionGroup的，其为AND关系，必须同时满足。
-	// 将row按空格拆分
-	cells := strings.Fields(row)
-	if len(cells) == 0 {
-		return false, nil
+func parseCondValBetween(condVal string) ([]string, error) {
+	bounds, err := parseCondValList(condVal)
+	if err != nil {
+		return nil, err
 	}
-	for _, condition := range conditions {
-		// 检查字段是否存在
-		_, ok := tableHeaderMap[condition.Pos+"_"+condition.Field]
-		if !ok {
-			errorMsg := fmt.Sprintf("查询条件中 %s 列不存在", condition.Field)
-			return false, errors.New(errorMsg)
-		}
-
-		// 获取条件基准值
-		condVal := condition.Val
-
-		// 如果condition.Field为age，且condVal为0，则继续
-		if condition.Field == "age" && condVal == "0" {
-			continue
-		}
-		// 如果condition.Field为name、gender、hospital、department、diseaseCode，且condVal为空，则继续
-		if (condition.Field == "name" || condition.Field == "gender" || condition.Field == "hospital" || condition.Field == "department" || condition.Field == "diseaseCode") && condVal == "" {
-			continue
-		}
-
-		// 获取单元格值：根据表头获取到比较列的索引（从0开始），然后根据索引获取到单元格值
-
-		cellValue := cells[tableHeaderMap[condition.Pos+"_"+condition.Field]]
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("between的基准值必须为两个元素的JSON数组，实际为 %s", condVal)
+	}
+	return bounds, nil
+}
 
-		// 获取类型
-		cellType := condition.Type
-		// 获取比较符
-		compare := condition.Compare
+/**
+ * describeCondition 生成查询条件的描述，用于错误信息中指明出错的条件
+ * @param condition 查询条件
+ * @return string 条件描述，如 条件(age int between [18,30])
+ */
+func describeCondition(condition QueryCondition) string {
+	return fmt.Sprintf("条件(%s %s %s %s)", condition.Field, condition.Type, condition.Compare, condition.Val)
+}
 
-		// 根据cellType调用对应的函数（cellType可以为int，float，string）
-		switch cellType {
-		case "int":
-			flag, err := compareInt(cellValue, condVal, compare)
-			if err != nil {
-				return false, err
-			} else if !flag && err == nil {
-				return false, nil
-			} else {
-				// 继续
-			}
-		case "float":
-			flag, err := compareFloat(cellValue, condVal, compare)
-			if err != nil {
-				return false, err
-			} else if !flag && err == nil {
-				return false, nil
-			} else {
-				// 继续
-			}
-		case "string":
-			flag, err := compareString(cellValue, condVal, compare)
-			if err != nil {
-				return false, err
-			} else if !flag && err == nil {
-				return false, nil
-			} else {
-				// 继续
+/**
+ * validateQueryConditions 在逐行匹配之前校验所有查询条件（列是否存在、类型与比较符是否匹配、基准值是否合法）
+ * @param queryConditions 查询条件数组
+ * @param tableHeaderMap 表头map
+ * @param dateParser 日期解析器
+ * @return error 错误信息，会指明出错的条件
+ */
+func validateQueryConditions(queryConditions [][]QueryCondition, tableHeaderMap map[string]int, dateParser *DateParser) error {
+	for groupIdx, conditionGroup := range queryConditions {
+		for condIdx, condition := range conditionGroup {
+			if err := validateQueryCondition(condition, tableHeaderMap, dateParser); err != nil {
+				return fmt.Errorf("第%d组第%d个%s错误: %s", groupIdx+1, condIdx+1, describeCondition(condition), err)
 			}
-		default:
-			errorMsg := fmt.Sprintf("查询条件中暂时不支持 %s 列的类型: %s", condition.Field, condition.Type)
-			return false, errors.New(errorMsg)
 		}
-
 	}
-	// 所有条件都通过，才为true！
-	return true, nil
-}
-
-func compareString(cellValue string, condVal string, compare string) (bool, error) {
-	switch compare {
-	case "eq":
-		return cellValue == condVal, nil
-	case "ne":
-		return cellValue != condVal, nil
-	case "lt":
-		return strings.Compare(cellValue, condVal) < 0, nil
-	case "gt":
-		return strings.Compare(cellValue, condVal) > 0, nil
-	case "le":
-		return strings.Compare(cellValue, condVal) <= 0, nil
-	case "ge":
-		return strings.Compare(cellValue, condVal) >= 0, nil
-	case "regexp":
-		re, err := regexp.Compile(condVal)
-		if err != nil {
-			errorMsg := fmt.Sprintf("查询条件传入的正则表达式错误: %s", condVal)
-			return false, errors.New(errorMsg)
-		}
-		return re.MatchString(cellValue), nil
-	case "contain":
-		return strings.Contains(cellValue, condVal), nil
-	case "suffix":
-		// cellValue是否以condVal结尾
-		return strings.HasSuffix(cellValue, condVal), nil
-	case "prefix":
-		return strings.HasPrefix(cellValue, condVal), nil
-	default:
-		errorMsg := fmt.Sprintf("查询条件传入的运算比较符 %s 暂不被string类型支持", compare)
-		return false, errors.New(errorMsg)
-	}
-
+	return nil
 }
 
 /**
- * 比较浮点数
- * @author: jjq
- * @param cellValue 单元格值
- * @param condVal 查询条件基准值
- * @param compare 比较符
- * @return bool 比较结果
+ * validateQueryCondition 校验单个查询条件
+ * @param condition 查询条件
+ * @param tableHeaderMap 表头map
+ * @param dateParser 日期解析器
  * @return error 错误信息
  */
-func compareFloat(cellValue string, condVal string, compare string) (bool, error) {
-	// 将cellValue转换为float64类型
-	cellValueFloat, err := strconv.ParseFloat(cellValue, 64)
-	if err != nil {
-		errorMsg := fmt.Sprintf("数据 %v 无法转换为浮点数: %s，该列可能非数字列，建议使用string比较。请修改查询条件的type", cellValue, err)
-		return false, errors.New(errorMsg)
+func validateQueryCondition(condition QueryCondition, tableHeaderMap map[string]int, dateParser *DateParser) error {
+	if _, ok := tableHeaderMap[condition.Pos+"_"+condition.Field]; !ok {
+		return fmt.Errorf("列 %s 不存在", condition.Field)
+	}
+	// 比较符是否被该类型支持
+	switch condition.Compare {
+	case "eq", "ne", "lt", "gt", "le", "ge", "in", "notin", "between", "isnull", "notnull":
+	case "regexp", "contain", "notcontain", "icontain", "ieq", "suffix", "prefix":
+		if condition.Type != "string" {
+			return fmt.Errorf("运算比较符 %s 仅支持string类型", condition.Compare)
+		}
+	default:
+		return fmt.Errorf("不支持的运算比较符 %s", condition.Compare)
 	}
-	condValFloat, err := strconv.ParseFloat(condVal, 64)
-	if err != nil {
-		errorMsg := fmt.Sprintf("查询条件中基准值 %v 无法转换为浮点数: %s，请修改查询条件的type", condVal, err)
-		return false, errors.New(errorMsg)
+	// 类型是否支持
+	switch condition.Type {
+	case "int", "float", "string", "date", "datetime":
+	default:
+		return fmt.Errorf("暂不支持的类型 %s", condition.Type)
 	}
-	// return compareNum[float64](cellValueFloat, condValFloat, compare)
-	switch compare {
-	case "gt":
-		return cellValueFloat > condValFloat, nil
-	case "lt":
-		return cellValueFloat < condValFloat, nil
-	case "ge":
-		return cellValueFloat >= condValFloat, nil
-	case "le":
-		return cellValueFloat <= condValFloat, nil
-	case "eq":
-		return cellValueFloat == condValFloat, nil
-	case "ne":
-		return cellValueFloat != condValFloat, nil
-
+	switch condition.Compare {
+	case "isnull", "notnull":
+		return nil
+	case "in", "notin":
+		vals, err := parseCondValList(condition.Val)
+		if err != nil {
+			return err
+		}
+		for _, val := range vals {
+			if err := checkCondValType(val, condition.Type, dateParser); err != nil {
+				return err
+			}
+		}
+	case "between":
+		bounds, err := parseCondValBetween(condition.Val)
+		if err != nil {
+			return err
+		}
+		for _, bound := range bounds {
+			if err := checkCondValType(bound, condition.Type, dateParser); err != nil {
+				return err
+			}
+		}
+	case "regexp":
+		if _, err := regexp.Compile(condition.Val); err != nil {
+			return fmt.Errorf("正则表达式错误: %s", condition.Val)
+		}
 	default:
-		errorMsg := fmt.Sprintf("查询条件传入的运算比较符 %s 暂不被float类型支持", compare)
-		return false, errors.New(errorMsg)
+		return checkCondValType(condition.Val, condition.Type, dateParser)
 	}
+	return nil
 }
 
 /**
- * 比较整数
- * @author: jjq
- * @param cellValue 单元格值
- * @param condVal 查询条件基准值
- * @param compare 比较符
- * @return bool 比较结果
+ * checkCondValType 检查基准值能否转换为指定类型
+ * @param val 基准值
+ * @param cellType 类型
+ * @param dateParser 日期解析器
  * @return error 错误信息
  */
-func compareInt(cellValue string, condVal string, compare string) (bool, error) {
-	// 将cellValue转换为float64类型
-	cellValueInt, err := strconv.ParseInt(cellValue, 10, 64)
-	if err != nil {
-		errorMsg := fmt.Sprintf("数据 %v 无法转换为整数: %s，该列可能非数字列，建议使用string比较。请修改查询条件的type", cellValue, err)
-		return false, errors.New(errorMsg)
-	}
-	condValInt, err := strconv.ParseInt(condVal, 10, 64)
-	if err != nil {
-		errorMsg := fmt.Sprintf("查询条件中基准值 %v 无法转换为整数: %s 。请修改查询条件的type", condVal, err)
-		return false, errors.New(errorMsg)
-	}
-	// return compareNum[int64](cellValueInt, condValInt, compare)
-	switch compare {
-	case "gt":
-		return cellValueInt > condValInt, nil
-	case "lt":
-		return cellValueInt < condValInt, nil
-	case "ge":
-		return cellValueInt >= condValInt, nil
-	case "le":
-		return cellValueInt <= condValInt, nil
-	case "eq":
-		return cellValueInt == condValInt, nil
-	case "ne":
-		return cellValueInt != condValInt, nil
-
-	default:
-		errorMsg := fmt.Sprintf("查询条件传入的运算比较符 %s 暂不被int类型支持", compare)
-		return false, errors.New(errorMsg)
+func checkCondValType(val string, cellType string, dateParser *DateParser) error {
+	switch cellType {
+	case "int":
+		if _, err := strconv.ParseInt(val, 10, 64); err != nil {
+			return fmt.Errorf("基准值 %v 无法转换为整数", val)
+		}
+	case "float":
+		if _, err := strconv.ParseFloat(val, 64); err != nil {
+			return fmt.Errorf("基准值 %v 无法转换为浮点数", val)
+		}
+	case "date", "datetime":
+		if _, err := dateParser.ParseAs(val, cellType); err != nil {
+			return fmt.Errorf("基准值 %s", err)
+		}
 	}
+	return nil
 }
 
 /**
@@ -341,35 +270,45 @@ func compareNum[T constraints.Ordered](cellValue T, condVal T, compare string) (
 */
 
 /**
- * AggregateSliceINDataSet 聚合同一个数据集多个分片（多个分片文件）的数据，返回表头和表数据字符串
- * @param filePosesSingleDataSet 文件位置（CID）数组，该数组内的文件位置为同一个数据集的多个分片（格式应该一样）
- * @param filePosAndDataMap 文件位置和文件内容的map（原始文件内容字符串）
- * @return map[string]int 表头map
- * @return string 表数据字符串
+ * AggregateSliceINDataSet 聚合同一个数据集多个分片（多个分片文件）的数据，返回合并后的表
+ * @param filePosesSingleDataSet 文件位置（CID）数组，该数组内的文件位置为同一个数据集的多个分片
+ * @param filePosAndDataMap 文件位置和文件内容的map（原始文件内容字符串，新格式与旧的空格分隔格式均可）
+ * @param unionOptions 合并选项（列重命名映射）
+ * @param provenanceDataset 大于等于0时为各分片加入内部来源列（withProvenance），值为数据集在查询项filePos中的下标
+ * @return *Table 合并后的表，列名以第一个分片的CID为前缀
  * @return error 错误信息
+ * @Description: 各分片按列重命名映射改名后按列名合并，分片中缺少的列为空值
  */
-func AggregateSliceINDataSet(filePosesSingleDataSet []string, filePosAndDataMap map[string]string) (map[string]int, string, error) {
-	tableHeaderMap := make(map[string]int)
-	tableStr := ""
-	for idx, filePos := range filePosesSingleDataSet {
-		if idx == 0 {
-			tableHeaderMap = parseTableHeader(filePos, filePosAndDataMap[filePos])
-			tableStr += filePosAndDataMap[filePos]
-			tableStr += "\n"
-		} else {
-			// 先比较是否表头一致
-			if !compareMaps(tableHeaderMap, parseTableHeader(filePosesSingleDataSet[0], filePosAndDataMap[filePos])) {
-				return nil, "", errors.New(filePos + "与" + filePosesSingleDataSet[0] + "表头不一致")
-			}
-			// 删掉表头
-			tableStr += filePosAndDataMap[filePos][strings.Index(filePosAndDataMap[filePos], "\n")+1:]
-			// 如果不是最后一个数据集，那么加上换行符
-			if idx != len(filePosesSingleDataSet)-1 {
-				tableStr += "\n"
+func AggregateSliceINDataSet(filePosesSingleDataSet []string, filePosAndDataMap map[string]string, unionOptions UnionOptions, provenanceDataset int) (*Table, error) {
+	if len(filePosesSingleDataSet) == 0 {
+		return nil, errors.New("数据集没有分片")
+	}
+	shards := make([]*Table, 0, len(filePosesSingleDataSet))
+	for shardIndex, filePos := range filePosesSingleDataSet {
+		if strIsInSlice(unionOptions.SkipShards, filePos) {
+			continue
+		}
+		// 所有分片都以第0个分片的CID作为列名前缀
+		shard, err := DecodeTable(filePosesSingleDataSet[0], filePosAndDataMap[filePos])
+		if err != nil {
+			return nil, fmt.Errorf("%s 解析失败: %s", filePos, err)
+		}
+		rememberTableSchema(filePos, filePosesSingleDataSet[0], shard)
+		if err := renameTableColumns(shard, filePosesSingleDataSet[0], shardColumnMapping(unionOptions, filePos), filePos); err != nil {
+			return nil, err
+		}
+		if provenanceDataset >= 0 {
+			if err := addProvenanceColumn(shard, filePosesSingleDataSet[0], provenanceDataset, shardIndex); err != nil {
+				return nil, err
 			}
 		}
+		shards = append(shards, shard)
+	}
+	if len(shards) == 0 {
+		// 所有分片都被跳过：按主分片缓存的表头返回空表
+		return skippedDataSetTable(filePosesSingleDataSet[0], unionOptions)
 	}
-	return tableHeaderMap, tableStr, nil
+	return unionTables(shards), nil
 }
 
 // =====================联表操作=====================
@@ -381,243 +320,321 @@ func AggregateSliceINDataSet(filePosesSingleDataSet []string, filePosAndDataMap
  * @param line2Arr 表2的行数据数组
  * @param field1Index 表1的字段索引
  * @param field2Index 表2的字段索引
+ * @param dateParser 日期解析器（date/datetime类型使用）
  * @return bool 比较结果
  * @return error 错误信息
  */
-func checkRowPairJoinConditionSatisfied(jointCondition JointCondition, line1Arr []string, line2Arr []string, field1Index int, field2Index int) (bool, error) {
-	// 比较两个值是否相等
-	switch jointCondition.Type {
-	case "string":
-		return compareInt(line1Arr[field1Index], line2Arr[field2Index], jointCondition.Compare)
-	case "int":
-		return compareInt(line1Arr[field1Index], line2Arr[field2Index], jointCondition.Compare)
-	case "float":
-		return compareFloat(line1Arr[field1Index], line2Arr[field2Index], jointCondition.Compare)
-	default:
-		return false, errors.New("联表条件类型错误，不支持类型：" + jointCondition.Type)
-	}
+func checkRowPairJoinConditionSatisfied(jointCondition JointCondition, line1Arr []string, line2Arr []string, field1Index int, field2Index int, dateParser *DateParser) (bool, error) {
+	// 空值不与任何值连接；两侧的日期格式可以不同（如 2024/3/5 与 2024-03-05），统一解析后再比较
+	return compareCells(line1Arr[field1Index], line2Arr[field2Index], jointCondition.Compare, jointCondition.Type, dateParser)
 }
 
 /**
- * JointTwoTableInner 联表操作，返回表头和表数据字符串（INNER连接）
- * @param jointCondition 联表条件
- * @param tableHeaderMap1 表1表头map
- * @param tableHeaderMap2 表2表头map
- * @param tableStr1 表1数据字符串
- * @param tableStr2 表2数据字符串
- * @return string 表数据字符串
- * @return map[string]int 表头map
+ * JointTwoTableInner 联表操作，返回联表后的表（INNER连接）
+ * @param jointConditions 同一对数据集之间的联表条件（多个条件组成复合键，需同时满足），Pos1均在表1中，Pos2均在表2中
+ * @param table1 表1
+ * @param table2 表2
+ * @param dateParser 日期解析器
+ * @param guard 查询守卫（为nil时不检查超时和联表行数）
+ * @return *Table 联表后的表（列为表1的列加表2的列）
  * @return error 错误信息
  */
-func JointTwoTableInner(jointCondition JointCondition, tableHeaderMap1 map[string]int, tableHeaderMap2 map[string]int, tableStr1 string, tableStr2 string) (string, map[string]int, error) {
-	tableStrReturn := ""
-	tableHeaderMapReturn := make(map[string]int)
-	// 解析表1和表2
-	field1Index, ok1 := tableHeaderMap1[jointCondition.Pos1+"_"+jointCondition.Field1]
-	if !ok1 {
-		return "", nil, errors.New("表" + jointCondition.Pos1 + "中不存在联表字段" + jointCondition.Field1)
-	}
-	field2Index, ok2 := tableHeaderMap2[jointCondition.Pos2+"_"+jointCondition.Field2]
-	if !ok2 {
-		return "", nil, errors.New("表" + jointCondition.Pos2 + "中不存在联表字段" + jointCondition.Field2)
-	}
-
-	// 逐个比较
-	lines1 := strings.Split(tableStr1, "\n") // 表1的行
-	lines2 := strings.Split(tableStr2, "\n") // 表2的行
-	// 先把表头line合并
-	tableStrReturn = lines1[0] + " " + lines2[0] + "\n"
-	// 每行按空格拆分
-	for idx1, line1 := range lines1 {
-		if idx1 == 0 || line1 == "" {
-			continue
+func JointTwoTableInner(jointConditions []JointCondition, table1 *Table, table2 *Table, dateParser *DateParser, guard *QueryGuard) (*Table, error) {
+	if len(jointConditions) == 0 {
+		return nil, errors.New("联表条件不能为空")
+	}
+	if table1 == nil {
+		return nil, errors.New("联表条件中的数据集" + jointConditions[0].Pos1 + "不在查询的数据集中")
+	}
+	if table2 == nil {
+		return nil, errors.New("联表条件中的数据集" + jointConditions[0].Pos2 + "不在查询的数据集中")
+	}
+	// 解析表1和表2中每个联表条件的字段索引
+	field1Indexes := make([]int, len(jointConditions))
+	field2Indexes := make([]int, len(jointConditions))
+	for i, jointCondition := range jointConditions {
+		field1Index, ok1 := table1.HeaderMap[jointCondition.Pos1+"_"+jointCondition.Field1]
+		if !ok1 {
+			return nil, errors.New("表" + jointCondition.Pos1 + "中不存在联表字段" + jointCondition.Field1)
 		}
-		line1Arr := strings.Split(line1, " ")
-		for idx2, line2 := range lines2 {
-			if idx2 == 0 || line2 == "" {
-				continue
-			}
-			line2Arr := strings.Split(line2, " ")
-			// 比较两个值是否相等
-			flag, err := checkRowPairJoinConditionSatisfied(jointCondition, line1Arr, line2Arr, field1Index, field2Index)
-			if err != nil {
-				return "联表条件比较错误：" + err.Error(), nil, errors.New("联表条件比较错误：" + err.Error())
-			} else if flag {
-				// 如果满足联表条件，那么加入到tableStrReturn中
-				tableStrReturnNewLine := line1 + " " + line2
-				// 删除每行首位空格
-				tableStrReturnNewLine = strings.Trim(tableStrReturnNewLine, " ")
-				tableStrReturn += tableStrReturnNewLine + "\n"
-			}
-
+		field2Index, ok2 := table2.HeaderMap[jointCondition.Pos2+"_"+jointCondition.Field2]
+		if !ok2 {
+			return nil, errors.New("表" + jointCondition.Pos2 + "中不存在联表字段" + jointCondition.Field2)
 		}
-	}
-
-	// 删除最后一个\n
-	if tableStrReturn[len(tableStrReturn)-1] == '\n' {
-		tableStrReturn = tableStrReturn[:len(tableStrReturn)-1]
+		field1Indexes[i], field2Indexes[i] = field1Index, field2Index
 	}
 
 	// 整合表头
-	// 对于每一个tableHeaderMap2的value，加上len(tableHeaderMap1)，然后加入到tableHeaderMapReturn中.作为新的表头Header
-	for key, value := range tableHeaderMap2 {
-		tableHeaderMapReturn[key] = value + len(tableHeaderMap1)
-	}
-	for key, value := range tableHeaderMap1 {
-		tableHeaderMapReturn[key] = value
+	// 对于表2的每一列，索引加上表1的列数，然后加入到新的表头中
+	tableReturn := &Table{
+		Columns:   append(append(make([]string, 0, len(table1.Columns)+len(table2.Columns)), table1.Columns...), table2.Columns...),
+		HeaderMap: make(map[string]int),
+		Rows:      make([][]string, 0),
+	}
+	for key, value := range table2.HeaderMap {
+		tableReturn.HeaderMap[key] = value + len(table1.Columns)
+	}
+	for key, value := range table1.HeaderMap {
+		tableReturn.HeaderMap[key] = value
+	}
+
+	// 逐个比较，所有联表条件都满足才连接
+	compared := 0
+	for _, row1 := range table1.Rows {
+		// 每比较一定行数检查一次查询是否已超时或取消
+		compared += len(table2.Rows)
+		if compared >= guardCheckInterval {
+			compared = 0
+			if err := guard.Err(); err != nil {
+				return nil, err
+			}
+		}
+		for _, row2 := range table2.Rows {
+			flag := true
+			for i, jointCondition := range jointConditions {
+				satisfied, err := checkRowPairJoinConditionSatisfied(jointCondition, row1, row2, field1Indexes[i], field2Indexes[i], dateParser)
+				if err != nil {
+					return nil, errors.New("联表条件比较错误：" + err.Error())
+				}
+				if !satisfied {
+					flag = false
+					break
+				}
+			}
+			if flag {
+				// 如果满足联表条件，那么两行拼接后加入到新表中
+				newRow := make([]string, 0, len(row1)+len(row2))
+				newRow = append(append(newRow, row1...), row2...)
+				tableReturn.Rows = append(tableReturn.Rows, newRow)
+				if err := guard.checkJoinedRows(len(tableReturn.Rows)); err != nil {
+					return nil, err
+				}
+			}
+		}
 	}
 
-	return tableStrReturn, tableHeaderMapReturn, nil
+	return tableReturn, nil
 
 }
 
 /**
- * JointTwoTable 两表联表操作，返回表头和表数据字符串
- * @param jointCondition 联表条件
- * @param tableHeaderMap1 表1表头map
- * @param tableHeaderMap2 表2表头map
- * @param tableStr1 表1数据字符串
- * @param tableStr2 表2数据字符串
- * @return string 表数据字符串
- * @return map[string]int 表头map
+ * JointTwoTable 两表联表操作，返回联表后的表
+ * @param jointConditions 同一对数据集之间的联表条件（复合键）
+ * @param table1 表1
+ * @param table2 表2
+ * @param dateParser 日期解析器
+ * @param guard 查询守卫
+ * @return *Table 联表后的表
  * @return error 错误信息
  */
-func JointTwoTable(jointCondition JointCondition, tableHeaderMap1 map[string]int, tableHeaderMap2 map[string]int, tableStr1 string, tableStr2 string) (string, map[string]int, error) {
+func JointTwoTable(jointConditions []JointCondition, table1 *Table, table2 *Table, dateParser *DateParser, guard *QueryGuard) (*Table, error) {
+	for _, jointCondition := range jointConditions {
+		if jointCondition.JointType != "INNER" {
+			return nil, errors.New("不支持的联表类型:" + jointCondition.JointType)
+		}
+	}
+	// 内连接
+	return JointTwoTableInner(jointConditions, table1, table2, dateParser, guard)
+}
 
-	switch jointCondition.JointType {
-	case "INNER":
-		// 内连接
-		return JointTwoTableInner(jointCondition, tableHeaderMap1, tableHeaderMap2, tableStr1, tableStr2)
-	default:
-		return "不支持的联表类型", nil, errors.New("不支持的联表类型:" + jointCondition.JointType)
+/**
+ * filterJoinedTable 对联表后的表应用联表条件（形成环的联表条件在联表后作为过滤条件）
+ * @param table 联表后的表
+ * @param jointConditions 过滤用的联表条件（两侧的列都在表中）
+ * @param dateParser 日期解析器
+ * @param guard 查询守卫
+ * @return *Table 过滤后的表
+ * @return error 错误信息
+ */
+func filterJoinedTable(table *Table, jointConditions []JointCondition, dateParser *DateParser, guard *QueryGuard) (*Table, error) {
+	if len(jointConditions) == 0 {
+		return table, nil
+	}
+	field1Indexes := make([]int, len(jointConditions))
+	field2Indexes := make([]int, len(jointConditions))
+	for i, jointCondition := range jointConditions {
+		field1Index, ok1 := table.HeaderMap[jointCondition.Pos1+"_"+jointCondition.Field1]
+		if !ok1 {
+			return nil, errors.New("表" + jointCondition.Pos1 + "中不存在联表字段" + jointCondition.Field1)
+		}
+		field2Index, ok2 := table.HeaderMap[jointCondition.Pos2+"_"+jointCondition.Field2]
+		if !ok2 {
+			return nil, errors.New("表" + jointCondition.Pos2 + "中不存在联表字段" + jointCondition.Field2)
+		}
+		field1Indexes[i], field2Indexes[i] = field1Index, field2Index
+	}
+	rows := make([][]string, 0, len(table.Rows))
+	for rowIdx, row := range table.Rows {
+		if rowIdx%guardCheckInterval == 0 {
+			if err := guard.Err(); err != nil {
+				return nil, err
+			}
+		}
+		flag := true
+		for i, jointCondition := range jointConditions {
+			satisfied, err := checkRowPairJoinConditionSatisfied(jointCondition, row, row, field1Indexes[i], field2Indexes[i], dateParser)
+			if err != nil {
+				return nil, errors.New("联表条件比较错误：" + err.Error())
+			}
+			if !satisfied {
+				flag = false
+				break
+			}
+		}
+		if flag {
+			rows = append(rows, row)
+		}
 	}
+	table.Rows = rows
+	return table, nil
 }
 
-func JointTables(jointConditions []JointCondition, tableHeaderMap_map map[string]map[string]int, tableStrMap map[string]string) (string, map[string]int, error) {
-	tableHeaderMap := make(map[string]int) // 联表后的表头
-	tableStr := ""                         // 最终的表头和表数据字符串
-	posHasJoint := make([]string, 0)       // 已联表的数据集
+/**
+ * JointTables 按联表计划依次联表：同一对数据集之间的多个联表条件组成复合键一起联表，形成环的联表条件在联表后作为过滤条件
+ * @param jointConditions 联表条件数组
+ * @param tableMap 数据集主CID到表的映射（所有数据集都需要被联表条件连接）
+ * @param dateParser 日期解析器
+ * @param guard 查询守卫（超时、取消、联表行数限制），为nil时不检查
+ * @return *Table 联表后的表
+ * @return error 错误信息
+ */
+func JointTables(jointConditions []JointCondition, tableMap map[string]*Table, dateParser *DateParser, guard *QueryGuard) (*Table, error) {
+	jointGroups, postJoinFilters, err := PlanJointGroups(jointConditions)
+	if err != nil {
+		return nil, err
+	}
 
-	for idx, jointCondition := range jointConditions {
+	var table *Table                 // 联表后的表
+	posHasJoint := make([]string, 0) // 已联表的数据集
+	for idx, jointGroup := range jointGroups {
 		if idx == 0 {
 			// 对第一个进行联表
-			newTableStr, newTableHeader, err := JointTwoTable(jointCondition, tableHeaderMap_map[jointCondition.Pos1], tableHeaderMap_map[jointCondition.Pos2], tableStrMap[jointCondition.Pos1], tableStrMap[jointCondition.Pos2]) // 联表
+			newTable, err := JointTwoTable(jointGroup.JointConditions, tableMap[jointGroup.Pos1], tableMap[jointGroup.Pos2], dateParser, guard) // 联表
 			if err != nil {
-				return "", nil, err
+				return nil, err
 			}
-			posHasJoint = append(posHasJoint, jointCondition.Pos1, jointCondition.Pos2)
-			tableStr = newTableStr
-			tableHeaderMap = newTableHeader
+			posHasJoint = append(posHasJoint, jointGroup.Pos1, jointGroup.Pos2)
+			table = newTable
+		} else if strIsInSlice(posHasJoint, jointGroup.Pos1) {
+			// 表1已联表，连接表2
+			newTable, err := JointTwoTable(jointGroup.JointConditions, table, tableMap[jointGroup.Pos2], dateParser, guard) // 联表
+			if err != nil {
+				return nil, err
+			}
+			posHasJoint = append(posHasJoint, jointGroup.Pos2)
+			table = newTable
 		} else {
-			// 对后续的进行联表
-			// 判断是否已经联表
-			if strIsInSlice(posHasJoint, jointCondition.Pos1) && strIsInSlice(posHasJoint, jointCondition.Pos2) {
-				continue
-			} else if strIsInSlice(posHasJoint, jointCondition.Pos1) && !strIsInSlice(posHasJoint, jointCondition.Pos2) {
-				newTableStr, newTableHeader, err := JointTwoTable(jointCondition, tableHeaderMap, tableHeaderMap_map[jointCondition.Pos2], tableStr, tableStrMap[jointCondition.Pos2]) // 联表
-				if err != nil {
-					return "", nil, err
-				}
-				posHasJoint = append(posHasJoint, jointCondition.Pos2)
-				tableStr = newTableStr
-				tableHeaderMap = newTableHeader
-			} else if !strIsInSlice(posHasJoint, jointCondition.Pos1) && strIsInSlice(posHasJoint, jointCondition.Pos2) {
-				newTableStr, newTableHeader, err := JointTwoTable(jointCondition, tableHeaderMap_map[jointCondition.Pos1], tableHeaderMap, tableStrMap[jointCondition.Pos1], tableStr) // 联表
-				if err != nil {
-					return "", nil, err
-				}
-				posHasJoint = append(posHasJoint, jointCondition.Pos1)
-				tableStr = newTableStr
-				tableHeaderMap = newTableHeader
-			} else {
-				return "", nil, errors.New("联表条件中存在未联表的数据集")
+			// 表2已联表，连接表1
+			newTable, err := JointTwoTable(jointGroup.JointConditions, tableMap[jointGroup.Pos1], table, dateParser, guard) // 联表
+			if err != nil {
+				return nil, err
 			}
-
+			posHasJoint = append(posHasJoint, jointGroup.Pos1)
+			table = newTable
 		}
 	}
-	if len(posHasJoint) != len(jointConditions)+1 {
-		return "", nil, errors.New("联表条件中存在未联表的数据集")
+	for pos := range tableMap {
+		if !strIsInSlice(posHasJoint, pos) {
+			return nil, errors.New("数据集" + pos + "没有联表条件，存在未联表的数据集")
+		}
 	}
-	return tableStr, tableHeaderMap, nil
+	return filterJoinedTable(table, postJoinFilters, dateParser, guard)
+}
+
+// JointGroup 同一对数据集之间的联表条件（多个条件组成复合键）
+type JointGroup struct {
+	Pos1            string           `json:"pos1"`            // 数据集1
+	Pos2            string           `json:"pos2"`            // 数据集2
+	JointConditions []JointCondition `json:"jointConditions"` // 联表条件（Pos1、Pos2与本组一致）
 }
 
+// 联表条件两侧交换时比较符的变化（a < b 即 b > a）
+var swappedJoinCompare = map[string]string{"eq": "eq", "ne": "ne", "lt": "gt", "gt": "lt", "le": "ge", "ge": "le"}
+
 /**
- * TopologicalSortOfEdges 对联表条件进行拓扑排序，返回排序后的联表条件数组（注：拓扑排序后，位于数组后面的联表条件中要么pos1已经被连接，要么pos2已经被连接）
- * @param edges 联表条件数组
- * @return []JointCondition 排序后的联表条件数组
+ * checkJoinCompare 校验联表条件的运算比较符：只支持比较两侧单元格的 eq/ne/lt/gt/le/ge
+ * （in/notin/between 等的基准值为列表或字面量，不能与另一张表的单元格比较）
+ * @param compare 运算比较符
  * @return error 错误信息
  */
-func TopologicalSortOfEdges(edges []JointCondition) ([]JointCondition, error) {
-
-	adjList := make(map[string][]string)
-	inDegree := make(map[string]int)
-	allPos := make(map[string]bool)
-
-	// Initialize graph
-	for _, edge := range edges {
-		for _, pos := range []string{edge.Pos1, edge.Pos2} {
-			if _, exists := allPos[pos]; !exists {
-				adjList[pos] = []string{}
-				allPos[pos] = true
-				inDegree[pos] = 0
-			}
-		}
+func checkJoinCompare(compare string) error {
+	if _, ok := swappedJoinCompare[compare]; !ok {
+		return fmt.Errorf("联表条件不支持运算比较符 %s（只支持 eq/ne/lt/gt/le/ge）", compare)
 	}
+	return nil
+}
 
-	// Build graph
-	for _, edge := range edges {
-		adjList[edge.Pos1] = append(adjList[edge.Pos1], edge.Pos2)
-		adjList[edge.Pos2] = append(adjList[edge.Pos2], edge.Pos1)
-		inDegree[edge.Pos1]++
-		inDegree[edge.Pos2]++
+/**
+ * PlanJointGroups 生成联表计划：将同一对数据集之间的联表条件合并为复合键，并排序使每组联表时有一侧已经被连接
+ * @param jointConditions 联表条件数组
+ * @return []JointGroup 按联表顺序排列的联表条件组（生成树）
+ * @return []JointCondition 形成环的联表条件，在联表后作为过滤条件
+ * @return error 错误信息（数据集之间不连通等）
+ */
+func PlanJointGroups(jointConditions []JointCondition) ([]JointGroup, []JointCondition, error) {
+	if len(jointConditions) == 0 {
+		return nil, nil, errors.New("联表查询至少需要一个联表条件")
 	}
 
-	// Initialize queue with nodes having 0 in-degree
-	var queue []string
-	for pos, degree := range inDegree {
-		if degree == 1 { // Adjusted for undirected graph
-			queue = append(queue, pos)
+	// 按数据集对分组，方向与该对数据集第一次出现时一致
+	groups := make([]JointGroup, 0)
+	groupIndex := make(map[string]int)
+	for _, jointCondition := range jointConditions {
+		if jointCondition.Pos1 == jointCondition.Pos2 {
+			return nil, nil, errors.New("联表条件两侧是同一个数据集" + jointCondition.Pos1)
 		}
-	}
-
-	// Process nodes in the queue
-	var sortedEdges []JointCondition
-	visited := make(map[string]bool)
-	for len(queue) > 0 {
-		pos := queue[0]
-		queue = queue[1:]
-
-		// Find the edge that should be added to the sorted list
-		for _, edge := range edges {
-			if (edge.Pos1 == pos || edge.Pos2 == pos) && !visited[edge.Pos1+edge.Pos2] && !visited[edge.Pos2+edge.Pos1] {
-				sortedEdges = append(sortedEdges, edge)
-				visited[edge.Pos1+edge.Pos2] = true
-				visited[edge.Pos2+edge.Pos1] = true
-				break
+		if err := checkJoinCompare(jointCondition.Compare); err != nil {
+			return nil, nil, err
+		}
+		if idx, ok := groupIndex[jointCondition.Pos2+"\x00"+jointCondition.Pos1]; ok {
+			// 方向相反：交换两侧
+			swapped := jointCondition
+			swapped.Pos1, swapped.Field1, swapped.Pos2, swapped.Field2 = jointCondition.Pos2, jointCondition.Field2, jointCondition.Pos1, jointCondition.Field1
+			if compare, ok := swappedJoinCompare[jointCondition.Compare]; ok {
+				swapped.Compare = compare
 			}
+			groups[idx].JointConditions = append(groups[idx].JointConditions, swapped)
+			continue
 		}
-
-		// Decrease in-degree of adjacent nodes
-		for _, adj := range adjList[pos] {
-			inDegree[adj]--
-			if inDegree[adj] == 1 { // Adjusted for undirected graph
-				queue = append(queue, adj)
+		key := jointCondition.Pos1 + "\x00" + jointCondition.Pos2
+		if idx, ok := groupIndex[key]; ok {
+			groups[idx].JointConditions = append(groups[idx].JointConditions, jointCondition)
+			continue
+		}
+		groupIndex[key] = len(groups)
+		groups = append(groups, JointGroup{Pos1: jointCondition.Pos1, Pos2: jointCondition.Pos2, JointConditions: []JointCondition{jointCondition}})
+	}
+
+	// 从第一组开始，每次选取一侧已联表的组；两侧都已联表的组形成环，作为联表后的过滤条件
+	sortedGroups := []JointGroup{groups[0]}
+	postJoinFilters := make([]JointCondition, 0)
+	joined := map[string]bool{groups[0].Pos1: true, groups[0].Pos2: true}
+	used := make([]bool, len(groups))
+	used[0] = true
+	for remaining := len(groups) - 1; remaining > 0; {
+		progressed := false
+		for idx, group := range groups {
+			if used[idx] {
+				continue
 			}
+			switch {
+			case joined[group.Pos1] && joined[group.Pos2]:
+				postJoinFilters = append(postJoinFilters, group.JointConditions...)
+			case joined[group.Pos1] || joined[group.Pos2]:
+				sortedGroups = append(sortedGroups, group)
+				joined[group.Pos1], joined[group.Pos2] = true, true
+			default:
+				continue
+			}
+			used[idx] = true
+			remaining--
+			progressed = true
+		}
+		if !progressed {
+			return nil, nil, errors.New("联表条件中存在未联表的数据集")
 		}
 	}
-
-	// Check for cycles in the graph
-	if len(sortedEdges) != len(edges) {
-
-		return nil, fmt.Errorf("联表条件中存在环，无法进行拓扑排序")
-	}
-
-	// Reverse the sortedEdges to get the final order
-	for i, j := 0, len(sortedEdges)-1; i < j; i, j = i+1, j-1 {
-		sortedEdges[i], sortedEdges[j] = sortedEdges[j], sortedEdges[i]
-	}
-
-	return sortedEdges, nil
+	return sortedGroups, postJoinFilters, nil
 }
 
 // =====================辅助函数=====================
@@ -639,95 +656,165 @@ func strIsInSlice(slice []string, str string) bool {
 
 /**
  * QueryModule 查询模块，返回查询结果（JSON字符串）和查询结果数量
- * @param queryConditions 查询条件数组
- * @param returnField 返回的列名
- * @param tableStr 表数据字符串
- * @param tableHeaderMap 表头map
+ * @param queryItemData 查询项（使用其中的查询条件、返回列、分组、聚合、排序）
+ * @param table 表（单表或联表后的表）
  * @param isMulti 是否联表查询
+ * @param dateParser 日期解析器
  * @return string 查询结果（JSON字符串）
  * @return int 查询结果数量
  * @return error 错误信息
+ * @Description: 有GroupBy或Aggregates时，返回分组列和聚合结果列（忽略ReturnField）；否则按ReturnField返回原始行
  */
-func QueryModule(queryConditions [][]QueryCondition, returnField []string, tableStr string, tableHeaderMap map[string]int, isMulti bool) (string, int, error) {
+func QueryModule(queryItemData QueryItem, table *Table, isMulti bool, dateParser *DateParser) (string, int, error) {
 	queryResultData := QueryResult{} // 初始化返回结果
+	tableHeaderMap := table.HeaderMap
 
-	needReturnAllSlices := make([]string, 0) // 需要全部返回的分片数据(含*)
-	for _, returnFieldSingle := range returnField {
-		if strings.Join(strings.Split(returnFieldSingle, "_")[1:], "_") == "*" {
-			// 如果有*，那么返回该数据集所有字段，则将此pos加入到needReturnAllSlices中
-			needReturnAllSlices = append(needReturnAllSlices, strings.Split(returnFieldSingle, "_")[0]) // 返回所有字段的数据集
-		}
+	if err := validateGroupAndOrder(queryItemData, tableHeaderMap, isMulti); err != nil {
+		return errorQueryResult(err.Error()), -1, err
+	}
+	columns, err := newColumnRules(queryItemData)
+	if err != nil {
+		return errorQueryResult(err.Error()), -1, err
 	}
+	privacy, err := newPrivacyPlan(queryItemData)
+	if err != nil {
+		return errorQueryResult(err.Error()), -1, err
+	}
+	anonymity := newAnonymityPlan(queryItemData)
 
-	// 逐行判断是否满足查询条件
-	lines := strings.Split(tableStr, "\n")
-	countLinesSatisfy := 0 // countLinesSatisfy: 满足条件的行数，计数
+	// 逐行判断是否满足查询条件（分块并发）
+	// 没有排序和分组时，满足LIMIT即可提前结束（k-匿名需要全部满足条件的行来划分等价类）
+	earlyLimit := 0
+	if len(queryItemData.GroupBy) == 0 && len(queryItemData.Aggregates) == 0 && len(queryItemData.OrderBy) == 0 && anonymity == nil {
+		earlyLimit = queryItemData.Limit
+	}
+	matchedRowIdxs, err := filterRows(table, queryItemData.QueryConditions, dateParser, earlyLimit, queryItemData.guard)
+	if err != nil {
+		return errorQueryResult(err.Error()), -1, err
+	}
 
 	queryResultData.Data = nil
-	for _, line := range lines[1:] {
-		yesForConditionFlag := false // 本行是否满足查询条件
-
-		// 逐个conditionGroup判断
-		// 只要满足其中一个conditionGroup条件，就认为本行满足查询条件【数组之间为OR关系】
-		// 如果没有查询条件，那么默认为全查询
-		if queryConditions == nil || len(queryConditions) == 0 {
-			yesForConditionFlag = true
-		} else {
-			for _, conditionGroup := range queryConditions {
-				condFlag, err := matchesConditions(line, tableHeaderMap, conditionGroup)
-				if err != nil {
-					// fmt.Println("matchesConditions error: ", err)
-					return errorQueryResult(err.Error()), -1, err
-				}
-				// 满足条件即可返回，不同数组的条件为OR关系，同组条件为AND关系
-				if condFlag {
-					yesForConditionFlag = true
-					break
-				}
-			}
+	if len(queryItemData.GroupBy) > 0 || len(queryItemData.Aggregates) > 0 {
+		// 分组聚合
+		matchedRows := make([][]string, len(matchedRowIdxs))
+		for i, rowIdx := range matchedRowIdxs {
+			matchedRows[i] = table.Rows[rowIdx]
 		}
-
-		if yesForConditionFlag == true && len(line) > 0 {
-			// 将一行的数据变为JSON格式，key为tableHeaderMap的key，value为行数据
-			rowData := make(map[string]string)
-
-			for key, index := range tableHeaderMap {
-
-				// 遍历每个列，判断只返回returnField中的字段。如果为*（在needReturnAllSlices数组中），那么该数据集的所有列恒为真，也需要返回该字段
-				if strIsInSlice(returnField, key) || (len(returnField) > 0 && strIsInSlice(needReturnAllSlices, strings.Split(key, "_")[0])) {
-					KeyWithoutPos := strings.Join(strings.Split(key, "_")[1:], "_")
-					// line只需要读取前len(line)-1个字符，因为最后一个是换行。读取时去掉前缀
-					// 去掉了反而会吞掉最后一个字符，不知道为什么。所以不去掉。
-					if isMulti {
-						// 联表查询需要考虑到前缀问题
-						// // * 同一个列名需要代表相同的值！无论是否联表。否则会造成覆盖
-
-						// rowData[KeyWithoutPos] = strings.Split(line[:len(line)], " ")[index]
-
-						// 有前缀
-						rowData[key] = strings.Split(line[:len(line)], " ")[index]
-					} else {
-						rowData[KeyWithoutPos] = strings.Split(line[:len(line)], " ")[index]
-					}
-				}
+		resultRows, err := groupAndAggregate(queryItemData, matchedRows, tableHeaderMap, isMulti, dateParser, privacy, anonymity)
+		if err != nil {
+			return errorQueryResult(err.Error()), -1, err
+		}
+		if err := sortResultRows(resultRows, queryItemData.OrderBy, isMulti, dateParser); err != nil {
+			return errorQueryResult(err.Error()), -1, err
+		}
+		for _, resultRow := range resultRows {
+			// 空值输出为null
+			rowData := make(map[string]interface{})
+			for key, value := range resultRow {
+				rowData[key] = cellOutput(value)
 			}
-
-			queryResultData.Data = append(queryResultData.Data, rowData) // 添加到数组中
-			countLinesSatisfy++
-
+			queryResultData.Data = append(queryResultData.Data, rowData)
 		}
+	} else {
+		if err := sortRawRows(table, matchedRowIdxs, queryItemData.OrderBy, dateParser); err != nil {
+			return errorQueryResult(err.Error()), -1, err
+		}
+		if anonymity != nil {
+			matchedRowIdxs = anonymity.suppressRows(table, matchedRowIdxs)
+		}
+		queryResultData.Data = projectRows(table, matchedRowIdxs, queryItemData.ReturnField, isMulti, columns, queryItemData.provenance)
+	}
 
+	// LIMIT：只返回前Limit行
+	if queryItemData.Limit > 0 && len(queryResultData.Data) > queryItemData.Limit {
+		queryResultData.Data = queryResultData.Data[:queryItemData.Limit]
 	}
-	queryResultData.Counts = countLinesSatisfy
+
+	queryResultData.Counts = len(queryResultData.Data)
 	if isMulti {
 		queryResultData.Message = "联表查询成功"
 	} else {
 		queryResultData.Message = "查询成功"
 	}
+	if privacy != nil {
+		queryResultData.Message += privacy.note()
+	}
+	if anonymity.fired() {
+		queryResultData.Message += anonymity.note()
+		queryResultData.Anonymity = &anonymity.report
+	}
 	returnData, _ := json.Marshal(queryResultData)
 	return string(returnData), queryResultData.Counts, nil
 }
 
+/**
+ * projectRows 按返回列投影行数据，将每行变为JSON格式，key为列名，value为行数据（空值为null）
+ * @param table 表
+ * @param rowIdxs 需要返回的行索引
+ * @param returnField 返回的列名（pos_field，pos_*表示该数据集的所有列）
+ * @param isMulti 是否联表查询（联表查询的列名保留pos前缀）
+ * @param columns 列规则：不可见的列不返回，脱敏的列返回脱敏后的值；为nil时不限制
+ * @param provenance 来源列的展开，为nil时不返回来源
+ * @return []interface{} 结果行
+ */
+func projectRows(table *Table, rowIdxs []int, returnField []string, isMulti bool, columns *columnRules, provenance *provenancePlan) []interface{} {
+	needReturnAllSlices := make([]string, 0) // 需要全部返回的分片数据(含*)
+	for _, returnFieldSingle := range returnField {
+		if strings.Join(strings.Split(returnFieldSingle, "_")[1:], "_") == "*" {
+			// 如果有*，那么返回该数据集所有字段，则将此pos加入到needReturnAllSlices中
+			needReturnAllSlices = append(needReturnAllSlices, strings.Split(returnFieldSingle, "_")[0]) // 返回所有字段的数据集
+		}
+	}
+
+	// 预先确定需要返回的列（结果列名和列索引），避免逐行遍历表头
+	projectedKeys := make([]string, 0)
+	projectedIndexes := make([]int, 0)
+	projectedMasks := make([]*ColumnMask, 0)
+	provenanceIndexes := make([]int, 0)
+	for key, index := range table.HeaderMap {
+		if isProvenanceColumn(key) {
+			provenanceIndexes = append(provenanceIndexes, index)
+			continue
+		}
+		if columns.hidden(headerField(key)) {
+			continue
+		}
+		// 遍历每个列，判断只返回returnField中的字段。如果为*（在needReturnAllSlices数组中），那么该数据集的所有列恒为真，也需要返回该字段
+		if strIsInSlice(returnField, key) || (len(returnField) > 0 && strIsInSlice(needReturnAllSlices, strings.Split(key, "_")[0])) {
+			if isMulti {
+				// 联表查询需要考虑到前缀问题
+				// // * 同一个列名需要代表相同的值！无论是否联表。否则会造成覆盖
+
+				// 有前缀
+				projectedKeys = append(projectedKeys, key)
+			} else {
+				projectedKeys = append(projectedKeys, strings.Join(strings.Split(key, "_")[1:], "_"))
+			}
+			projectedIndexes = append(projectedIndexes, index)
+			projectedMasks = append(projectedMasks, columns.mask(headerField(key)))
+		}
+	}
+
+	var data []interface{}
+	for _, rowIdx := range rowIdxs {
+		cells := table.Rows[rowIdx]
+		rowData := make(map[string]interface{}, len(projectedKeys))
+		for i, key := range projectedKeys {
+			cell := cells[projectedIndexes[i]]
+			if projectedMasks[i] != nil && !isNullCell(cell) {
+				rowData[key] = projectedMasks[i].apply(cell)
+				continue
+			}
+			rowData[key] = cellOutput(cell)
+		}
+		if provenance != nil {
+			rowData[ProvenanceColumn] = provenance.rowProvenance(cells, provenanceIndexes)
+		}
+		data = append(data, rowData) // 添加到数组中
+	}
+	return data
+}
+
 /**
  * 返回查询失败的结果
  * @author: jjq
@@ -754,9 +841,6 @@ func ReturnQuerySingle(queryItemData QueryItem, filePosAndDataMap map[string]str
 	// queryResultData := QueryResult{} // 初始化返回结果
 
 	filePos2DimArr := queryItemData.FilePos // 文件位置（CID）:此为二维数组，每个元素为同一个数据集
-	returnField := queryItemData.ReturnField
-	queryConditions := queryItemData.QueryConditions
-
 	// 将FilePos转为一维数组，元素为每个子元素的第一个元素
 	filePosArr := make([]string, 0)
 	for _, filePos := range filePos2DimArr {
@@ -764,15 +848,28 @@ func ReturnQuerySingle(queryItemData QueryItem, filePosAndDataMap map[string]str
 	}
 	// 把filePosAndDataMap中的数据读取出来，拼接在一起。
 
-	tableHeaderMap, tableStr, err := AggregateSliceINDataSet(filePos2DimArr[0], filePosAndDataMap) // 聚合同一个数据集多个分片（多个分片文件）的数据，返回表头和表数据字符串
+	table, err := AggregateSliceINDataSet(filePos2DimArr[0], filePosAndDataMap, queryItemData.Union, queryItemData.provenanceDataset(0)) // 聚合同一个数据集多个分片（多个分片文件）的数据，返回合并后的表
 	if err != nil {
 		return errorQueryResult(err.Error()), -1, err
 	}
 
 	// fmt.Println("表头索引", tableHeaderMap) // 结果——map[id:0 name:1 score:2]
 
+	dateParser, err := NewDateParser(queryItemData.DateOptions)
+	if err != nil {
+		return errorQueryResult(err.Error()), -1, err
+	}
+	// 加入计算列
+	if err := addComputedColumns(table, queryItemData.ComputedColumns, filePos2DimArr[0][0], false, dateParser); err != nil {
+		return errorQueryResult(err.Error()), -1, err
+	}
+	// 分片之间类型不一致时放宽查询中的类型
+	if err := widenQueryTypes(&queryItemData, table, dateParser); err != nil {
+		return errorQueryResult(err.Error()), -1, err
+	}
+
 	// -----------------查询部分-----------------
-	return QueryModule(queryConditions, returnField, tableStr, tableHeaderMap, false)
+	return QueryModule(queryItemData, table, false, dateParser)
 }
 
 // =====================联表查询=====================
@@ -780,80 +877,106 @@ func ReturnQuerySingle(queryItemData QueryItem, filePosAndDataMap map[string]str
 func ReturnQueryMulti(queryItemData QueryItem, filePosAndDataMap map[string]string) (string, int, error) {
 
 	filePos2DimArr := queryItemData.FilePos // 文件位置（CID）:此为二维数组，每个元素为同一个数据集
-	returnField := queryItemData.ReturnField
-	queryConditions := queryItemData.QueryConditions
-	jointConditions := queryItemData.JointConditions // 联表条件
 
-	if len(filePos2DimArr) != len(jointConditions)+1 {
-		return "联表条件数量与数据集数量不匹配（联表条件=数据集数量-1）", -1, errors.New("联表条件数量与数据集数量不匹配")
+	tableMap := make(map[string]*Table)
+	filePosArr := make([]string, 0)
+
+	dateParser, err := NewDateParser(queryItemData.DateOptions)
+	if err != nil {
+		return errorQueryResult(err.Error()), -1, err
 	}
-	// 拓扑排序联表条件
-	jointConditions, err := TopologicalSortOfEdges(jointConditions)
+	// 计算列：只引用一个数据集的先在该数据集中计算（可用作联表条件），其余的联表后计算
+	computedPlans, err := compileComputedColumns(queryItemData.ComputedColumns, filePos2DimArr[0][0], false)
 	if err != nil {
-		return err.Error(), -1, err
+		return errorQueryResult(err.Error()), -1, err
 	}
-
-	tableStrMap := make(map[string]string)
-	tableHeaderMap_map := make(map[string]map[string]int)
-	filePosArr := make([]string, 0)
+	computedApplied := make([]bool, len(computedPlans))
 
 	// 合并数据集，并返回合并后的数据集
-	for _, filePosesSingleDataSet := range filePos2DimArr {
+	for datasetIndex, filePosesSingleDataSet := range filePos2DimArr {
 		// 逐个解析每个数据集，filePosesSingleDataSet代表一个数据集（多个分片）的数组
-		tableStr := ""
-		// 解析表头字符串
-		tableHeaderMap, tableStr, err := AggregateSliceINDataSet(filePosesSingleDataSet, filePosAndDataMap) // 聚合同一个数据集多个分片（多个分片文件）的数据，返回表头和表数据字符串
+		table, err := AggregateSliceINDataSet(filePosesSingleDataSet, filePosAndDataMap, queryItemData.Union, queryItemData.provenanceDataset(datasetIndex)) // 聚合同一个数据集多个分片（多个分片文件）的数据，返回合并后的表
 		if err != nil {
 			return errorQueryResult(err.Error()), -1, err
 		}
+		if err := applyComputedColumns(table, computedPlans, computedApplied, false, dateParser); err != nil {
+			return errorQueryResult(err.Error()), -1, err
+		}
+		// 分片之间类型不一致时放宽查询中的类型
+		if err := widenQueryTypes(&queryItemData, table, dateParser); err != nil {
+			return errorQueryResult(err.Error()), -1, err
+		}
 
 		// 赋值，以第0个数据集的主索引
-		tableStrMap[filePosesSingleDataSet[0]] = tableStr
-		tableHeaderMap_map[filePosesSingleDataSet[0]] = tableHeaderMap
+		tableMap[filePosesSingleDataSet[0]] = table
 		filePosArr = append(filePosArr, filePosesSingleDataSet[0])
 
 	}
-	tableStr, tableHeaderMap, err := JointTables(jointConditions, tableHeaderMap_map, tableStrMap)
+	table, err := JointTables(queryItemData.JointConditions, tableMap, dateParser, queryItemData.guard)
 	if err != nil {
 		return errorQueryResult(err.Error()), -1, err
 	}
-
-	// fmt.Println("tableStr:", tableStr)
-	// fmt.Println("tableHeaderMap:", tableHeaderMap)
+	if err := applyComputedColumns(table, computedPlans, computedApplied, true, dateParser); err != nil {
+		return errorQueryResult(err.Error()), -1, err
+	}
 
 	// -----------------查询部分-----------------
-	return QueryModule(queryConditions, returnField, tableStr, tableHeaderMap, true)
+	return QueryModule(queryItemData, table, true, dateParser)
 
 }
 
 func GetQueryResult(queryItem string, filePosAndDataMap map[string]string) (string, int) {
+	queryResult, resultCounts, _ := GetQueryResultContext(context.Background(), queryItem, filePosAndDataMap, QueryLimits{})
+	return queryResult, resultCounts
+}
+
+/**
+ * GetQueryResultContext 执行查询，过滤、联表期间检查ctx是否结束以及资源限制
+ * @param ctx 查询的context（超时、取消）
+ * @param queryItem 查询项（JSON字符串）
+ * @param filePosAndDataMap 文件位置和明文的map
+ * @param limits 资源限制
+ * @return string 查询结果
+ * @return int 查询结果数量，-1表示错误
+ * @return error 查询因超时、取消或超出资源限制而中止时为*QueryAbortError，其余错误在查询结果中返回
+ */
+func GetQueryResultContext(ctx context.Context, queryItem string, filePosAndDataMap map[string]string, limits QueryLimits) (string, int, error) {
 
 	// 解析查询条件，将queryItem转为JSON
 	var queryItemData QueryItem
 	err := json.Unmarshal([]byte(queryItem), &queryItemData)
 	if err != nil {
 		// fmt.Println("解析查询条件失败:", err)
-		return errorQueryResult("解析查询条件失败:" + err.Error()), -1
+		return errorQueryResult("解析查询条件失败:" + err.Error()), -1, nil
+	}
+	queryItemData.guard = NewQueryGuard(ctx, limits)
+	queryItemData.columnPolicy = columnPolicyFromContext(ctx)
+	queryItemData.provenance, err = newProvenancePlan(ctx, queryItemData)
+	if err != nil {
+		return errorQueryResult(err.Error()), -1, nil
 	}
 
+	var returnStr string
+	var resultCounts int
 	if queryItemData.QueryConcatType == "single" {
-		returnStr, resultCounts, err := ReturnQuerySingle(queryItemData, filePosAndDataMap)
-		if err != nil {
-			return "查询失败: " + err.Error(), -1
-		} else {
-			return returnStr, resultCounts
-		}
+		returnStr, resultCounts, err = ReturnQuerySingle(queryItemData, filePosAndDataMap)
 	} else if queryItemData.QueryConcatType == "multi" {
-		returnStr, resultCounts, err := ReturnQueryMulti(queryItemData, filePosAndDataMap)
+		returnStr, resultCounts, err = ReturnQueryMulti(queryItemData, filePosAndDataMap)
 		// return "联表查询暂未开放", -1
-
-		if err != nil {
-			return "查询失败: " + err.Error(), -1
-		} else {
-			return returnStr, resultCounts
-		}
+	} else if queryItemData.QueryConcatType == "union" {
+		returnStr, resultCounts, err = ReturnQueryUnion(queryItemData, filePosAndDataMap)
 	} else {
-		return "查询条件中的QueryConcatType字段错误", -1
+		return "查询条件中的QueryConcatType字段错误", -1, nil
 	}
-
+	if err == nil {
+		err = queryItemData.guard.checkResultBytes(len(returnStr))
+	}
+	if err != nil {
+		var abortErr *QueryAbortError
+		if errors.As(err, &abortErr) {
+			return "查询失败: " + err.Error(), -1, abortErr
+		}
+		return "查询失败: " + err.Error(), -1, nil
+	}
+	return withSkippedShardsMessage(returnStr, queryItemData.Union.SkipShards), resultCounts, nil
 }
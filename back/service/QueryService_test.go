@@ -0,0 +1,193 @@
+package service
+
+import (
+	"chainqa_offchain_demo/setting"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testQueryShards 测试用的数据集：P为旧格式的分片，Q为新格式的分片（含空值）
+func testQueryShards(t *testing.T) map[string]string {
+	t.Helper()
+	setting.Conf = new(setting.AppConfig)
+	content, err := EncodeTable([]string{"id", "age", "name", "date", "cost"}, [][]string{{"4", NullCell, NullCell, NullCell, NullCell}})
+	if err != nil {
+		t.Fatalf("EncodeTable 失败: %v", err)
+	}
+	return map[string]string{
+		"P": "id\tage\tname\tdate\tcost\n1\t10\ta\t2024-01-01\t1.5\n2\t20\tb\t2024-02-01\t2.5\n3\t30\tc\t2024-03-01\t10\n",
+		"Q": content,
+	}
+}
+
+// queryIds 执行单条件查询，返回结果行的id
+func queryIds(t *testing.T, shards map[string]string, condition QueryCondition) []string {
+	t.Helper()
+	condition.Pos = "P"
+	queryItem, _ := json.Marshal(QueryItem{
+		QueryConcatType: "single",
+		FilePos:         [][]string{{"P", "Q"}},
+		ReturnField:     []string{"P_id"},
+		QueryConditions: [][]QueryCondition{{condition}},
+	})
+	queryResult, counts := GetQueryResult(string(queryItem), shards)
+	var queryResultData QueryResult
+	if err := json.Unmarshal([]byte(queryResult), &queryResultData); err != nil || counts == -1 {
+		t.Fatalf("查询失败: %s", queryResult)
+	}
+	ids := make([]string, 0)
+	for _, row := range queryResultData.Data {
+		ids = append(ids, row.(map[string]interface{})["id"].(string))
+	}
+	return ids
+}
+
+func TestQueryOperators(t *testing.T) {
+	shards := testQueryShards(t)
+	cases := []struct {
+		name      string
+		condition QueryCondition
+		want      []string
+	}{
+		{"int between", QueryCondition{Field: "age", Val: `["15","30"]`, Compare: "between", Type: "int"}, []string{"2", "3"}},
+		{"int in", QueryCondition{Field: "age", Val: `["10","30"]`, Compare: "in", Type: "int"}, []string{"1", "3"}},
+		{"int notin 不含空值", QueryCondition{Field: "age", Val: `["10"]`, Compare: "notin", Type: "int"}, []string{"2", "3"}},
+		{"float lt", QueryCondition{Field: "cost", Val: "2.5", Compare: "lt", Type: "float"}, []string{"1"}},
+		{"float between", QueryCondition{Field: "cost", Val: `["2","10"]`, Compare: "between", Type: "float"}, []string{"2", "3"}},
+		{"string in", QueryCondition{Field: "name", Val: `["a","c","x"]`, Compare: "in", Type: "string"}, []string{"1", "3"}},
+		{"string between", QueryCondition{Field: "name", Val: `["b","z"]`, Compare: "between", Type: "string"}, []string{"2", "3"}},
+		{"string isnull", QueryCondition{Field: "name", Compare: "isnull", Type: "string"}, []string{"4"}},
+		{"int isnull", QueryCondition{Field: "age", Compare: "isnull", Type: "int"}, []string{"4"}},
+		{"date notnull", QueryCondition{Field: "date", Compare: "notnull", Type: "date"}, []string{"1", "2", "3"}},
+		{"date in", QueryCondition{Field: "date", Val: `["2024-02-01","2024-03-01"]`, Compare: "in", Type: "date"}, []string{"2", "3"}},
+		{"date between", QueryCondition{Field: "date", Val: `["2024-01-15","2024-02-15"]`, Compare: "between", Type: "date"}, []string{"2"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := queryIds(t, shards, tc.condition); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("结果 = %v，期望 %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestQueryOperatorErrors(t *testing.T) {
+	shards := testQueryShards(t)
+	cases := []struct {
+		name      string
+		condition QueryCondition
+	}{
+		{"between 不是数组", QueryCondition{Field: "age", Val: "10", Compare: "between", Type: "int"}},
+		{"between 只有一个值", QueryCondition{Field: "age", Val: `["10"]`, Compare: "between", Type: "int"}},
+		{"in 不是数组", QueryCondition{Field: "age", Val: "10", Compare: "in", Type: "int"}},
+		{"不支持的比较符", QueryCondition{Field: "age", Val: "10", Compare: "like", Type: "int"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			condition := tc.condition
+			condition.Pos = "P"
+			queryItem, _ := json.Marshal(QueryItem{
+				QueryConcatType: "single",
+				FilePos:         [][]string{{"P"}},
+				QueryConditions: [][]QueryCondition{{condition}},
+			})
+			if queryResult, counts := GetQueryResult(string(queryItem), shards); counts != -1 {
+				t.Errorf("counts = %d，期望 -1（%s）", counts, queryResult)
+			}
+		})
+	}
+}
+
+// 测试用的联表数据集：A与B按(id, k)复合键联表，B与C联表，C与A形成环
+var testJoinShards = map[string]string{
+	"A": "id\tk\tx\n1\tp\t10\n1\tq\t20\n2\tp\t30\n",
+	"B": "aid\tk\tcid\n1\tp\tc1\n1\tq\tc2\n2\tq\tc1\n",
+	"C": "id\tx\nc1\t10\nc2\t99\n",
+}
+
+func TestJointQuery(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	idKey := JointCondition{Pos1: "A", Field1: "id", Pos2: "B", Field2: "aid", Compare: "eq", Type: "int", JointType: "INNER"}
+	kKey := JointCondition{Pos1: "B", Field1: "k", Pos2: "A", Field2: "k", Compare: "eq", Type: "string", JointType: "INNER"}
+	toC := JointCondition{Pos1: "B", Field1: "cid", Pos2: "C", Field2: "id", Compare: "eq", Type: "string", JointType: "INNER"}
+	cycle := JointCondition{Pos1: "C", Field1: "x", Pos2: "A", Field2: "x", Compare: "le", Type: "int", JointType: "INNER"}
+	cases := []struct {
+		name            string
+		jointConditions []JointCondition
+		want            []string // 结果行的 A_id/A_k/C_id
+	}{
+		{"单键联表", []JointCondition{idKey, toC}, []string{"1/p/c1", "1/p/c2", "1/q/c1", "1/q/c2", "2/p/c1"}},
+		{"复合键联表（反向的条件交换两侧）", []JointCondition{idKey, kKey, toC}, []string{"1/p/c1", "1/q/c2"}},
+		{"形成环的联表条件作为联表后的过滤条件", []JointCondition{idKey, kKey, toC, cycle}, []string{"1/p/c1"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			queryItem, _ := json.Marshal(QueryItem{
+				QueryConcatType: "multi",
+				FilePos:         [][]string{{"A"}, {"B"}, {"C"}},
+				ReturnField:     []string{"A_id", "A_k", "C_id"},
+				JointConditions: tc.jointConditions,
+			})
+			queryResult, counts := GetQueryResult(string(queryItem), testJoinShards)
+			var queryResultData QueryResult
+			if err := json.Unmarshal([]byte(queryResult), &queryResultData); err != nil || counts == -1 {
+				t.Fatalf("查询失败: %s", queryResult)
+			}
+			got := make([]string, 0)
+			for _, row := range queryResultData.Data {
+				data := row.(map[string]interface{})
+				got = append(got, fmt.Sprintf("%v/%v/%v", data["A_id"], data["A_k"], data["C_id"]))
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("结果 = %v，期望 %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPlanJointGroups(t *testing.T) {
+	ab := JointCondition{Pos1: "A", Field1: "id", Pos2: "B", Field2: "aid", Compare: "lt"}
+	ba := JointCondition{Pos1: "B", Field1: "k", Pos2: "A", Field2: "k", Compare: "lt"}
+	bc := JointCondition{Pos1: "B", Field1: "cid", Pos2: "C", Field2: "id", Compare: "eq"}
+	ca := JointCondition{Pos1: "C", Field1: "x", Pos2: "A", Field2: "x", Compare: "eq"}
+	de := JointCondition{Pos1: "D", Field1: "id", Pos2: "E", Field2: "id", Compare: "eq"}
+
+	groups, postJoinFilters, err := PlanJointGroups([]JointCondition{bc, ca, ab, ba})
+	if err != nil {
+		t.Fatalf("PlanJointGroups 失败: %v", err)
+	}
+	swapped := JointCondition{Pos1: "A", Field1: "k", Pos2: "B", Field2: "k", Compare: "gt"}
+	wantGroups := []JointGroup{
+		{Pos1: "B", Pos2: "C", JointConditions: []JointCondition{bc}},
+		{Pos1: "C", Pos2: "A", JointConditions: []JointCondition{ca}},
+	}
+	if !reflect.DeepEqual(groups, wantGroups) {
+		t.Errorf("groups = %+v，期望 %+v", groups, wantGroups)
+	}
+	if want := []JointCondition{ab, swapped}; !reflect.DeepEqual(postJoinFilters, want) {
+		t.Errorf("postJoinFilters = %+v，期望 %+v", postJoinFilters, want)
+	}
+
+	errCases := []struct {
+		name            string
+		jointConditions []JointCondition
+		wantErr         string
+	}{
+		{"没有联表条件", nil, "至少需要一个联表条件"},
+		{"两侧是同一个数据集", []JointCondition{{Pos1: "A", Pos2: "A", Compare: "eq"}}, "同一个数据集"},
+		{"数据集不连通", []JointCondition{ab, de}, "未联表的数据集"},
+		{"不支持的比较符", []JointCondition{{Pos1: "A", Pos2: "B", Compare: "in"}}, "不支持运算比较符 in"},
+	}
+	for _, tc := range errCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, _, err := PlanJointGroups(tc.jointConditions); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("err = %v，期望包含 %q", err, tc.wantErr)
+			}
+		})
+	}
+}
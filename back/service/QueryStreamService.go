@@ -0,0 +1,451 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"chainqa_offchain_demo/setting"
+)
+
+// ----------------分片并发查询与流式返回（SHARD PARALLEL / STREAMING）-------------------
+
+// 默认并发处理的分片数
+const defaultShardParallelism = 4
+
+// errShardSkipped 提前结束时跳过的分片（不会被读取）
+var errShardSkipped = errors.New("分片已跳过")
+
+// ShardLoader 获取一个分片（CID）并解密，返回明文；ctx结束时应尽快返回
+type ShardLoader func(ctx context.Context, filePos string) (string, error)
+
+// RowEmitter 流式查询时逐行输出结果，返回错误（如客户端断开）时停止查询
+type RowEmitter func(row interface{}) error
+
+// shardResult 单个分片的过滤结果
+type shardResult struct {
+	index   int // 分片在filePos中的顺序（按该顺序输出）
+	filePos string
+	table   *Table
+	rowIdxs []int
+	missing []string // 查询中引用而该分片中没有的列
+	err     error
+}
+
+/**
+ * shardParallelism 并发处理的分片数（配置文件 query.shard_parallelism）
+ * @return int 并发数
+ */
+func shardParallelism() int {
+	if setting.Conf.Query.ShardParallelism > 0 {
+		return setting.Conf.Query.ShardParallelism
+	}
+	return defaultShardParallelism
+}
+
+/**
+ * loadShard 获取单个分片，ctx已结束时不获取；获取失败且ctx已结束时返回查询中止错误
+ * @param ctx 查询的context
+ * @param filePos 文件位置（CID）
+ * @param loader 分片获取函数
+ * @return string 明文
+ * @return error 错误信息
+ */
+func loadShard(ctx context.Context, filePos string, loader ShardLoader) (string, error) {
+	if err := contextAbortError(ctx); err != nil {
+		return "", err
+	}
+	data, err := loader(ctx, filePos)
+	if err != nil {
+		if abortErr := contextAbortError(ctx); abortErr != nil {
+			return "", abortErr
+		}
+		return "", err
+	}
+	return data, nil
+}
+
+/**
+ * LoadShards 并发获取并解密多个分片，任一分片失败则返回该错误
+ * @param ctx 查询的context，结束时不再获取剩余分片
+ * @param filePoses 文件位置（CID）数组，重复的只获取一次
+ * @param loader 分片获取函数
+ * @return map[string]string 文件位置和明文的map
+ * @return error 错误信息，超时或取消时为*QueryAbortError
+ */
+func LoadShards(ctx context.Context, filePoses []string, loader ShardLoader) (map[string]string, error) {
+	filePosAndDataMap := make(map[string]string)
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, shardParallelism())
+	started := make(map[string]bool)
+	for _, filePos := range filePoses {
+		if started[filePos] {
+			continue
+		}
+		started[filePos] = true
+		wg.Add(1)
+		go func(filePos string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			// 已有分片失败时，不再获取剩余分片
+			mu.Lock()
+			failed := firstErr != nil
+			mu.Unlock()
+			if failed {
+				return
+			}
+			data, err := loadShard(ctx, filePos, loader)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			filePosAndDataMap[filePos] = data
+		}(filePos)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return filePosAndDataMap, nil
+}
+
+/**
+ * isShardStreamable 判断查询能否逐分片流式返回：单表、无分组聚合、无排序，且逐分片处理与合并分片后的结果一致。
+ * 多个分片按列名合并时，pos_*返回合并后的全部列（需要所有分片的表头），类型拓宽按合并后的整列判断（需要所有分片的数据），
+ * 因此返回pos_*、或查询条件声明了非string类型且允许类型拓宽时，不逐分片返回
+ * @param queryItemData 查询项
+ * @return bool 是否可以逐分片返回
+ */
+func isShardStreamable(queryItemData QueryItem) bool {
+	if queryItemData.QueryConcatType != "single" || len(queryItemData.FilePos) == 0 ||
+		len(queryItemData.GroupBy) > 0 || len(queryItemData.Aggregates) > 0 || len(queryItemData.OrderBy) > 0 {
+		return false
+	}
+	if len(streamShards(queryItemData)) <= 1 {
+		return true
+	}
+	for _, returnField := range queryItemData.ReturnField {
+		if headerField(returnField) == "*" {
+			return false
+		}
+	}
+	if queryItemData.Union.TypeWidening != "none" {
+		for _, conditionGroup := range queryItemData.QueryConditions {
+			for _, condition := range conditionGroup {
+				if condition.Type != "" && condition.Type != "string" {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+/**
+ * streamShards 逐分片流式查询时需要获取的分片（按filePos顺序，跳过的分片不获取）
+ * @param queryItemData 查询项
+ * @return []string 分片位置（CID）
+ */
+func streamShards(queryItemData QueryItem) []string {
+	filePoses := make([]string, 0, len(queryItemData.FilePos[0]))
+	for _, filePos := range queryItemData.FilePos[0] {
+		if !strIsInSlice(queryItemData.Union.SkipShards, filePos) {
+			filePoses = append(filePoses, filePos)
+		}
+	}
+	return filePoses
+}
+
+/**
+ * StreamQuery 流式查询：分片并发获取、解密、过滤，满足条件的行通过emit逐行输出
+ * @param ctx 查询的context（超时、取消）
+ * @param queryItem 查询项（JSON字符串）
+ * @param limits 资源限制
+ * @param loader 分片获取函数
+ * @param emit 逐行输出函数
+ * @return string 完整的查询结果（JSON字符串，与GetQueryResult格式一致，用于上链日志）
+ * @return int 查询结果数量，-1表示错误
+ * @return error 查询因超时、取消或超出资源限制而中止时为*QueryAbortError
+ * @Description: 单表且无分组、聚合、排序时（见isShardStreamable），各分片并发过滤，按filePos的顺序逐个分片输出，满足LIMIT后不再等待剩余分片；
+ * 其余查询需要全部分片，并发获取后一次计算，再逐行输出。两种方式输出的行与GetQueryResult的结果一致。
+ */
+func StreamQuery(ctx context.Context, queryItem string, limits QueryLimits, loader ShardLoader, emit RowEmitter) (string, int, error) {
+	var queryItemData QueryItem
+	if err := json.Unmarshal([]byte(queryItem), &queryItemData); err != nil {
+		return errorQueryResult("解析查询条件失败:" + err.Error()), -1, nil
+	}
+
+	// k-匿名需要全部结果行才能划分等价类，不能逐个分片输出
+	if policy := columnPolicyFromContext(ctx); isShardStreamable(queryItemData) && (policy == nil || policy.Anonymity == nil) {
+		queryItemData.guard = NewQueryGuard(ctx, limits)
+		queryItemData.columnPolicy = policy
+		provenance, err := newProvenancePlan(ctx, queryItemData)
+		if err != nil {
+			return errorQueryResult(err.Error()), -1, nil
+		}
+		queryItemData.provenance = provenance
+		return streamQuerySingle(ctx, queryItemData, loader, emit)
+	}
+
+	// 需要全部分片的查询（或启用了k-匿名）：并发获取后整体计算
+	filePosAndDataMap, err := LoadShards(ctx, ShardsToLoad(queryItemData), loader)
+	if err != nil {
+		return abortableQueryResult(err)
+	}
+	queryResult, code, err := GetQueryResultContext(ctx, queryItem, filePosAndDataMap, limits)
+	if code == -1 {
+		return queryResult, code, err
+	}
+	var queryResultData QueryResult
+	if err := json.Unmarshal([]byte(queryResult), &queryResultData); err != nil {
+		return errorQueryResult(err.Error()), -1, nil
+	}
+	for _, row := range queryResultData.Data {
+		if err := emit(row); err != nil {
+			return errorQueryResult("输出查询结果失败: " + err.Error()), -1, nil
+		}
+	}
+	return queryResult, code, nil
+}
+
+/**
+ * abortableQueryResult 把错误转为查询结果，查询中止的错误同时返回
+ * @param err 错误信息
+ * @return string 查询结果
+ * @return int -1
+ * @return error 查询中止时为*QueryAbortError，否则为nil
+ */
+func abortableQueryResult(err error) (string, int, error) {
+	var abortErr *QueryAbortError
+	if errors.As(err, &abortErr) {
+		return errorQueryResult(err.Error()), -1, abortErr
+	}
+	return errorQueryResult(err.Error()), -1, nil
+}
+
+/**
+ * streamQuerySingle 单表逐分片流式查询
+ * @param ctx 查询的context
+ * @param queryItemData 查询项（带查询守卫）
+ * @param loader 分片获取函数
+ * @param emit 逐行输出函数
+ * @return string 完整的查询结果（JSON字符串）
+ * @return int 查询结果数量，-1表示错误
+ * @return error 查询中止时为*QueryAbortError
+ */
+func streamQuerySingle(ctx context.Context, queryItemData QueryItem, loader ShardLoader, emit RowEmitter) (string, int, error) {
+	if len(queryItemData.FilePos[0]) == 0 {
+		return errorQueryResult("filePos 不能为空"), -1, nil
+	}
+	mainPos := queryItemData.FilePos[0][0]
+	// 跳过的分片不获取
+	filePosesSingleDataSet := streamShards(queryItemData)
+	dateParser, err := NewDateParser(queryItemData.DateOptions)
+	if err != nil {
+		return errorQueryResult(err.Error()), -1, nil
+	}
+	columns, err := newColumnRules(queryItemData)
+	if err != nil {
+		return errorQueryResult(err.Error()), -1, nil
+	}
+	limit := queryItemData.Limit
+
+	// 各分片并发获取、解密、过滤；results有足够缓冲，提前结束后剩余的分片不会阻塞
+	results := make(chan shardResult, len(filePosesSingleDataSet))
+	done := make(chan struct{})
+	sem := make(chan struct{}, shardParallelism())
+	for index, filePos := range filePosesSingleDataSet {
+		go func(index int, filePos string) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			select {
+			case <-done:
+				// 已满足LIMIT或已出错，跳过尚未开始的分片
+				results <- shardResult{index: index, filePos: filePos, err: errShardSkipped}
+				return
+			default:
+			}
+			result := filterShard(ctx, filePos, mainPos, queryItemData, loader, dateParser, limit, len(filePosesSingleDataSet))
+			result.index = index
+			results <- result
+		}(index, filePos)
+	}
+	defer close(done)
+
+	queryResultData := QueryResult{}
+	missingCounts := make(map[string]int) // 各列缺少该列的分片数
+	resultBytes := 0                      // 已输出结果的字节数
+	finished := true
+	// 先完成的分片暂存，按filePos的顺序输出（与合并分片后的行序一致，LIMIT返回的行确定）
+	pending := make(map[int]shardResult)
+	next := 0
+	for next < len(filePosesSingleDataSet) && finished {
+		select {
+		case result := <-results:
+			pending[result.index] = result
+		case <-ctx.Done():
+			return abortableQueryResult(contextAbortError(ctx))
+		}
+		for finished {
+			result, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			if result.err != nil {
+				return abortableQueryResult(result.err)
+			}
+			for _, field := range result.missing {
+				missingCounts[field]++
+			}
+
+			rowIdxs := result.rowIdxs
+			if limit > 0 && len(queryResultData.Data)+len(rowIdxs) > limit {
+				rowIdxs = rowIdxs[:limit-len(queryResultData.Data)]
+			}
+			for _, row := range projectRows(result.table, rowIdxs, queryItemData.ReturnField, false, columns, queryItemData.provenance) {
+				rowJSON, _ := json.Marshal(row)
+				resultBytes += len(rowJSON)
+				if err := queryItemData.guard.checkResultBytes(resultBytes); err != nil {
+					return abortableQueryResult(err)
+				}
+				if err := emit(row); err != nil {
+					return errorQueryResult("输出查询结果失败: " + err.Error()), -1, nil
+				}
+				queryResultData.Data = append(queryResultData.Data, row)
+			}
+			// 满足LIMIT，提前结束
+			if limit > 0 && len(queryResultData.Data) >= limit {
+				finished = false
+			}
+		}
+	}
+	// 所有分片都没有的列视为列不存在
+	if finished && len(filePosesSingleDataSet) > 0 {
+		for field, count := range missingCounts {
+			if count == len(filePosesSingleDataSet) {
+				return errorQueryResult(fmt.Sprintf("列 %s 不存在", field)), -1, nil
+			}
+		}
+	}
+
+	queryResultData.Counts = len(queryResultData.Data)
+	queryResultData.Message = "查询成功" + skippedShardsNote(queryItemData.Union.SkipShards)
+	returnData, _ := json.Marshal(queryResultData)
+	return string(returnData), queryResultData.Counts, nil
+}
+
+/**
+ * filterShard 获取、解密并过滤单个分片
+ * @Description: 分片按列重命名映射改名，查询中引用而分片中缺少的列视为空值列；
+ * 类型拓宽只在该分片内判断（只有单个分片，或查询条件都是string类型、不允许类型拓宽时才逐分片过滤，与合并后判断的结果一致）
+ * @param ctx 查询的context
+ * @param filePos 分片位置（CID）
+ * @param mainPos 数据集主CID（列名前缀）
+ * @param queryItemData 查询项（带查询守卫）
+ * @param loader 分片获取函数
+ * @param dateParser 日期解析器
+ * @param limit 大于0时只需要前limit个满足条件的行
+ * @param sources 查询的分片数（与合并分片的表一致，大于1时按类型拓宽策略判断）
+ * @return shardResult 过滤结果
+ */
+func filterShard(ctx context.Context, filePos string, mainPos string, queryItemData QueryItem, loader ShardLoader, dateParser *DateParser, limit int, sources int) shardResult {
+	content, err := loadShard(ctx, filePos, loader)
+	if err != nil {
+		return shardResult{filePos: filePos, err: err}
+	}
+	table, err := DecodeTable(mainPos, content)
+	if err != nil {
+		return shardResult{filePos: filePos, err: fmt.Errorf("%s 解析失败: %s", filePos, err)}
+	}
+	rememberTableSchema(filePos, mainPos, table)
+	if err := renameTableColumns(table, mainPos, shardColumnMapping(queryItemData.Union, filePos), filePos); err != nil {
+		return shardResult{filePos: filePos, err: err}
+	}
+	if queryItemData.WithProvenance {
+		if err := addProvenanceColumn(table, mainPos, 0, slices.Index(queryItemData.FilePos[0], filePos)); err != nil {
+			return shardResult{filePos: filePos, err: err}
+		}
+	}
+	computedPlans, err := compileComputedColumns(queryItemData.ComputedColumns, mainPos, false)
+	if err != nil {
+		return shardResult{filePos: filePos, err: err}
+	}
+	missing := addMissingColumns(table, mainPos, queryItemData, computedPlans)
+	if err := applyComputedColumns(table, computedPlans, make([]bool, len(computedPlans)), true, dateParser); err != nil {
+		return shardResult{filePos: filePos, err: err}
+	}
+
+	// 类型拓宽会修改查询条件，每个分片使用自己的副本
+	shardQuery := QueryItem{QueryConditions: make([][]QueryCondition, len(queryItemData.QueryConditions)), Union: queryItemData.Union}
+	for i, conditionGroup := range queryItemData.QueryConditions {
+		shardQuery.QueryConditions[i] = append([]QueryCondition(nil), conditionGroup...)
+	}
+	table.sources = sources
+	if err := widenQueryTypes(&shardQuery, table, dateParser); err != nil {
+		return shardResult{filePos: filePos, err: err}
+	}
+	rowIdxs, err := filterRows(table, shardQuery.QueryConditions, dateParser, limit, queryItemData.guard)
+	if err != nil {
+		return shardResult{filePos: filePos, err: err}
+	}
+	return shardResult{filePos: filePos, table: table, rowIdxs: rowIdxs, missing: missing}
+}
+
+/**
+ * addMissingColumns 查询条件、返回列和计算列中引用、而分片中没有的列，补为空值列（与按列名合并分片的结果一致）
+ * @param table 分片的表
+ * @param mainPos 数据集主CID
+ * @param queryItemData 查询项
+ * @param computedPlans 编译后的计算列（计算列本身不补）
+ * @return []string 补上的列名
+ */
+func addMissingColumns(table *Table, mainPos string, queryItemData QueryItem, computedPlans []*computedColumnPlan) []string {
+	fields := make([]string, 0)
+	computed := make(map[string]bool)
+	for _, plan := range computedPlans {
+		computed[plan.column] = true
+		for _, ref := range plan.refs {
+			if strings.HasPrefix(ref, mainPos+"_") {
+				fields = append(fields, strings.TrimPrefix(ref, mainPos+"_"))
+			}
+		}
+	}
+	for _, conditionGroup := range queryItemData.QueryConditions {
+		for _, condition := range conditionGroup {
+			if condition.Pos == mainPos {
+				fields = append(fields, condition.Field)
+			}
+		}
+	}
+	for _, returnField := range queryItemData.ReturnField {
+		if strings.HasPrefix(returnField, mainPos+"_") && returnField != mainPos+"_*" {
+			fields = append(fields, strings.TrimPrefix(returnField, mainPos+"_"))
+		}
+	}
+	missing := make([]string, 0)
+	for _, field := range fields {
+		if _, ok := table.HeaderMap[mainPos+"_"+field]; ok || computed[mainPos+"_"+field] {
+			continue
+		}
+		missing = append(missing, field)
+		table.HeaderMap[mainPos+"_"+field] = len(table.Columns)
+		table.Columns = append(table.Columns, mainPos+"_"+field)
+		for i := range table.Rows {
+			table.Rows[i] = append(table.Rows[i], NullCell)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"chainqa_offchain_demo/setting"
+)
+
+// testStreamShards 测试用的数据集：三个分片的列不完全相同，age列在R中为小数
+var testStreamShards = map[string]string{
+	"P": "id\tage\tname\n1\t10\ta\n2\t20\tb\n3\t30\tc\n",
+	"Q": "id\tage\n4\t40\n5\t50\n",
+	"R": "id\tage\tname\tcity\n6\t60.5\tf\tx\n7\t70\tg\ty\n",
+}
+
+// slowFirstLoader 分片获取函数：第一个分片最后返回，使分片的完成顺序与filePos顺序不同
+func slowFirstLoader(ctx context.Context, filePos string) (string, error) {
+	content, ok := testStreamShards[filePos]
+	if !ok {
+		return "", errors.New("分片不存在: " + filePos)
+	}
+	if filePos == "P" {
+		time.Sleep(50 * time.Millisecond)
+	}
+	return content, nil
+}
+
+func TestStreamQueryMatchesBuffered(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	filePos := [][]string{{"P", "Q", "R"}}
+	cases := []struct {
+		name       string
+		queryItem  QueryItem
+		streamable bool
+	}{
+		{"LIMIT按分片顺序截断", QueryItem{QueryConcatType: "single", FilePos: filePos, ReturnField: []string{"P_id"}, Limit: 4}, true},
+		{"LIMIT小于首个分片的行数", QueryItem{QueryConcatType: "single", FilePos: filePos, ReturnField: []string{"P_id", "P_name"}, Limit: 2}, true},
+		{"string条件", QueryItem{QueryConcatType: "single", FilePos: filePos, ReturnField: []string{"P_id"}, Limit: 3,
+			QueryConditions: [][]QueryCondition{{{Pos: "P", Field: "name", Compare: "ne", Val: "b", Type: "string"}}}}, true},
+		{"pos_*返回合并后的全部列", QueryItem{QueryConcatType: "single", FilePos: filePos, ReturnField: []string{"P_*"}, Limit: 5}, false},
+		{"int条件按合并后的列拓宽类型", QueryItem{QueryConcatType: "single", FilePos: filePos, ReturnField: []string{"P_id", "P_age"},
+			QueryConditions: [][]QueryCondition{{{Pos: "P", Field: "age", Compare: "ge", Val: "30", Type: "int"}}}}, false},
+		{"不允许类型拓宽时逐分片输出", QueryItem{QueryConcatType: "single", FilePos: filePos, ReturnField: []string{"P_id"}, Union: UnionOptions{TypeWidening: "none"},
+			QueryConditions: [][]QueryCondition{{{Pos: "P", Field: "id", Compare: "gt", Val: "2", Type: "int"}}}}, true},
+		{"只有一个分片", QueryItem{QueryConcatType: "single", FilePos: [][]string{{"R"}}, ReturnField: []string{"R_*"}, Limit: 1}, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isShardStreamable(tc.queryItem); got != tc.streamable {
+				t.Fatalf("isShardStreamable = %v，期望 %v", got, tc.streamable)
+			}
+			queryItem, _ := json.Marshal(tc.queryItem)
+			buffered, code, err := GetQueryResultContext(context.Background(), string(queryItem), testStreamShards, QueryLimits{})
+			if code == -1 || err != nil {
+				t.Fatalf("GetQueryResultContext 失败: %s, %v", buffered, err)
+			}
+			var bufferedData QueryResult
+			if err := json.Unmarshal([]byte(buffered), &bufferedData); err != nil {
+				t.Fatalf("解析查询结果失败: %v", err)
+			}
+
+			emitted := make([]interface{}, 0)
+			streamed, streamCode, err := StreamQuery(context.Background(), string(queryItem), QueryLimits{}, slowFirstLoader, func(row interface{}) error {
+				emitted = append(emitted, row)
+				return nil
+			})
+			if streamCode == -1 || err != nil {
+				t.Fatalf("StreamQuery 失败: %s, %v", streamed, err)
+			}
+			// 逐行输出的行与非流式结果一致（经JSON往返后比较）
+			emittedJSON, _ := json.Marshal(emitted)
+			var emittedData []interface{}
+			_ = json.Unmarshal(emittedJSON, &emittedData)
+			if !reflect.DeepEqual(emittedData, bufferedData.Data) {
+				t.Errorf("流式输出 = %s，期望 %s", emittedJSON, buffered)
+			}
+		})
+	}
+}
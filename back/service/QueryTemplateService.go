@@ -0,0 +1,679 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------查询模板（QUERY TEMPLATE）-------------------
+// 查询模板是带占位符（如 {{diseaseCode}}）的查询项，保存在服务端，每次修改生成新版本。
+// 执行时按参数类型校验并绑定参数，可选地把每个版本的哈希锚定到链上。
+
+// 占位符：{{参数名}}，只能出现在查询项的字符串值中
+var templatePlaceholderRe = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// 模板名称：字母、数字、汉字、下划线、中划线和点，最长64个字符
+var templateNameRe = regexp.MustCompile(`^[\p{L}\p{N}_.\-]{1,64}$`)
+
+// QueryTemplateParam 模板参数
+type QueryTemplateParam struct {
+	Name        string `json:"name"`        // 参数名（与占位符一致）
+	Type        string `json:"type"`        // 参数类型：string/int/float/date/datetime，加[]后缀表示列表（绑定为JSON数组，用于in/notin）
+	Required    bool   `json:"required"`    // 是否必填
+	Default     string `json:"default"`     // 默认值（非必填参数必须设置，未填写参数时使用；列表类型为JSON数组）
+	Description string `json:"description"` // 说明
+}
+
+// QueryTemplateVersion 模板的一个版本
+type QueryTemplateVersion struct {
+	Version   int                  `json:"version"`   // 版本号（从1开始）
+	QueryItem string               `json:"queryItem"` // 带占位符的查询项
+	Params    []QueryTemplateParam `json:"params"`    // 参数
+	Hash      string               `json:"hash"`      // 模板内容的哈希（sha256）
+	Anchored  bool                 `json:"anchored"`  // 哈希是否已锚定到链上
+	CreatedBy string               `json:"createdBy"` // 创建该版本的用户ID
+	CreatedAt string               `json:"createdAt"` // 创建时间（RFC3339）
+}
+
+// QueryTemplate 查询模板（含所有版本）
+type QueryTemplate struct {
+	Name        string                 `json:"name"`        // 模板名称
+	Description string                 `json:"description"` // 说明
+	Owner       string                 `json:"owner"`       // 创建者用户ID（只有创建者可以修改、删除）
+	Versions    []QueryTemplateVersion `json:"versions"`    // 所有版本（按版本号递增）
+}
+
+// QueryTemplateStore 查询模板的存储
+type QueryTemplateStore interface {
+	SaveQueryTemplate(name string, data []byte) error
+	LoadQueryTemplate(name string) ([]byte, error) // 不存在时返回nil
+	LoadQueryTemplates() (map[string][]byte, error)
+	DeleteQueryTemplate(name string) error
+}
+
+// memoryQueryTemplateStore 内存中的模板存储（索引服务未初始化时使用，重启后丢失）
+type memoryQueryTemplateStore struct {
+	sync.RWMutex
+	templates map[string][]byte
+}
+
+// MemoryQueryTemplateStore 内存中的模板存储
+var MemoryQueryTemplateStore QueryTemplateStore = &memoryQueryTemplateStore{templates: make(map[string][]byte)}
+
+func (s *memoryQueryTemplateStore) SaveQueryTemplate(name string, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.templates[name] = data
+	return nil
+}
+
+func (s *memoryQueryTemplateStore) LoadQueryTemplate(name string) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.templates[name], nil
+}
+
+func (s *memoryQueryTemplateStore) LoadQueryTemplates() (map[string][]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	result := make(map[string][]byte, len(s.templates))
+	for name, data := range s.templates {
+		result[name] = data
+	}
+	return result, nil
+}
+
+func (s *memoryQueryTemplateStore) DeleteQueryTemplate(name string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.templates, name)
+	return nil
+}
+
+// 模板的读改写串行执行，保证版本号递增
+var queryTemplateMu sync.Mutex
+
+/**
+ * Latest 模板的最新版本
+ * @return *QueryTemplateVersion 最新版本
+ */
+func (t *QueryTemplate) Latest() *QueryTemplateVersion {
+	return &t.Versions[len(t.Versions)-1]
+}
+
+/**
+ * FindVersion 查找模板的某个版本
+ * @param version 版本号，为0时返回最新版本
+ * @return *QueryTemplateVersion 版本
+ * @return error 版本不存在时返回错误
+ */
+func (t *QueryTemplate) FindVersion(version int) (*QueryTemplateVersion, error) {
+	if version == 0 {
+		return t.Latest(), nil
+	}
+	for i := range t.Versions {
+		if t.Versions[i].Version == version {
+			return &t.Versions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("模板 %s 不存在版本 %d", t.Name, version)
+}
+
+/**
+ * QueryTemplateHash 计算模板某个版本的哈希：名称、版本号、查询项和参数定义的sha256
+ * @param name 模板名称
+ * @param version 模板版本
+ * @return string 十六进制哈希
+ */
+func QueryTemplateHash(name string, version QueryTemplateVersion) string {
+	content, _ := json.Marshal(struct {
+		Name      string               `json:"name"`
+		Version   int                  `json:"version"`
+		QueryItem string               `json:"queryItem"`
+		Params    []QueryTemplateParam `json:"params"`
+	}{name, version.Version, version.QueryItem, version.Params})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+/**
+ * loadQueryTemplate 从存储中读取模板
+ * @param store 模板存储
+ * @param name 模板名称
+ * @return *QueryTemplate 模板，不存在时为nil
+ * @return error 错误信息
+ */
+func loadQueryTemplate(store QueryTemplateStore, name string) (*QueryTemplate, error) {
+	data, err := store.LoadQueryTemplate(name)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, nil
+	}
+	var template QueryTemplate
+	if err := json.Unmarshal(data, &template); err != nil {
+		return nil, fmt.Errorf("模板 %s 解析失败: %s", name, err)
+	}
+	if len(template.Versions) == 0 {
+		return nil, fmt.Errorf("模板 %s 没有任何版本", name)
+	}
+	return &template, nil
+}
+
+/**
+ * saveQueryTemplate 把模板写入存储
+ * @param store 模板存储
+ * @param template 模板
+ * @return error 错误信息
+ */
+func saveQueryTemplate(store QueryTemplateStore, template *QueryTemplate) error {
+	data, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+	return store.SaveQueryTemplate(template.Name, data)
+}
+
+/**
+ * GetQueryTemplate 获取模板
+ * @param store 模板存储
+ * @param name 模板名称
+ * @return *QueryTemplate 模板
+ * @return error 模板不存在时返回错误
+ */
+func GetQueryTemplate(store QueryTemplateStore, name string) (*QueryTemplate, error) {
+	template, err := loadQueryTemplate(store, name)
+	if err != nil {
+		return nil, err
+	}
+	if template == nil {
+		return nil, fmt.Errorf("模板 %s 不存在", name)
+	}
+	return template, nil
+}
+
+/**
+ * ListQueryTemplates 列出所有模板（按名称排序），解析失败的模板跳过
+ * @param store 模板存储
+ * @return []*QueryTemplate 模板
+ * @return error 错误信息
+ */
+func ListQueryTemplates(store QueryTemplateStore) ([]*QueryTemplate, error) {
+	stored, err := store.LoadQueryTemplates()
+	if err != nil {
+		return nil, err
+	}
+	templates := make([]*QueryTemplate, 0, len(stored))
+	for _, data := range stored {
+		var template QueryTemplate
+		if err := json.Unmarshal(data, &template); err != nil || len(template.Versions) == 0 {
+			continue
+		}
+		templates = append(templates, &template)
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates, nil
+}
+
+/**
+ * SaveQueryTemplateVersion 创建模板或为已有模板增加一个版本
+ * @param store 模板存储
+ * @param name 模板名称
+ * @param description 说明（为空时沿用上一版本的说明）
+ * @param uid 用户ID（修改已有模板时须为创建者）
+ * @param queryItem 带占位符的查询项
+ * @param params 参数定义
+ * @param create true为创建（模板已存在时报错），false为修改（模板不存在时报错）
+ * @return *QueryTemplate 模板
+ * @return *QueryTemplateVersion 新版本
+ * @return error 错误信息
+ */
+func SaveQueryTemplateVersion(store QueryTemplateStore, name string, description string, uid string, queryItem string, params []QueryTemplateParam, create bool) (*QueryTemplate, *QueryTemplateVersion, error) {
+	if !templateNameRe.MatchString(name) || strings.Contains(name, "__") {
+		return nil, nil, errors.New("模板名称只能包含字母、数字、汉字、下划线、中划线和点（最长64个字符，不能包含连续两个下划线）")
+	}
+	if uid == "" {
+		return nil, nil, errors.New("uId 不能为空")
+	}
+	if err := validateQueryTemplate(queryItem, params); err != nil {
+		return nil, nil, err
+	}
+
+	queryTemplateMu.Lock()
+	defer queryTemplateMu.Unlock()
+	template, err := loadQueryTemplate(store, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if create {
+		if template != nil {
+			return nil, nil, fmt.Errorf("模板 %s 已存在", name)
+		}
+		template = &QueryTemplate{Name: name, Owner: uid}
+	} else {
+		if template == nil {
+			return nil, nil, fmt.Errorf("模板 %s 不存在", name)
+		}
+		if template.Owner != uid {
+			return nil, nil, errors.New("只有模板的创建者可以修改模板")
+		}
+	}
+	if description != "" || create {
+		template.Description = description
+	}
+
+	version := QueryTemplateVersion{
+		Version:   len(template.Versions) + 1,
+		QueryItem: queryItem,
+		Params:    params,
+		CreatedBy: uid,
+		CreatedAt: time.Now().Format(time.RFC3339),
+	}
+	if len(template.Versions) > 0 {
+		version.Version = template.Latest().Version + 1
+	}
+	version.Hash = QueryTemplateHash(name, version)
+	template.Versions = append(template.Versions, version)
+	if err := saveQueryTemplate(store, template); err != nil {
+		return nil, nil, err
+	}
+	return template, template.Latest(), nil
+}
+
+/**
+ * MarkQueryTemplateAnchored 记录模板版本的哈希已锚定到链上
+ * @param store 模板存储
+ * @param name 模板名称
+ * @param version 版本号
+ * @return error 错误信息
+ */
+func MarkQueryTemplateAnchored(store QueryTemplateStore, name string, version int) error {
+	queryTemplateMu.Lock()
+	defer queryTemplateMu.Unlock()
+	template, err := GetQueryTemplate(store, name)
+	if err != nil {
+		return err
+	}
+	templateVersion, err := template.FindVersion(version)
+	if err != nil {
+		return err
+	}
+	templateVersion.Anchored = true
+	return saveQueryTemplate(store, template)
+}
+
+/**
+ * DeleteQueryTemplate 删除模板（所有版本）；已上链的哈希和查询日志不受影响
+ * @param store 模板存储
+ * @param name 模板名称
+ * @param uid 用户ID，须为创建者
+ * @return error 错误信息
+ */
+func DeleteQueryTemplate(store QueryTemplateStore, name string, uid string) error {
+	queryTemplateMu.Lock()
+	defer queryTemplateMu.Unlock()
+	template, err := GetQueryTemplate(store, name)
+	if err != nil {
+		return err
+	}
+	if template.Owner != uid {
+		return errors.New("只有模板的创建者可以删除模板")
+	}
+	return store.DeleteQueryTemplate(name)
+}
+
+/**
+ * validateQueryTemplate 校验模板：参数定义合法、占位符都已定义、定义的参数都被使用，且用默认值或示例值绑定后是合法的查询项
+ * @param queryItem 带占位符的查询项
+ * @param params 参数定义
+ * @return error 错误信息
+ */
+func validateQueryTemplate(queryItem string, params []QueryTemplateParam) error {
+	if strings.TrimSpace(queryItem) == "" {
+		return errors.New("queryItem 不能为空")
+	}
+	declared := make(map[string]bool)
+	for _, param := range params {
+		if !templatePlaceholderRe.MatchString("{{" + param.Name + "}}") {
+			return fmt.Errorf("参数名 %s 不合法（只能包含字母、数字和下划线，且不能以数字开头）", param.Name)
+		}
+		if declared[param.Name] {
+			return fmt.Errorf("参数 %s 重复定义", param.Name)
+		}
+		declared[param.Name] = true
+		if !isValidTemplateParamType(param.Type) {
+			return fmt.Errorf("参数 %s 的类型 %s 不支持（string/int/float/date/datetime，列表类型加[]后缀）", param.Name, param.Type)
+		}
+		if param.Required && param.Default != "" {
+			return fmt.Errorf("参数 %s 为必填时不能设置默认值", param.Name)
+		}
+		if !param.Required && param.Default == "" {
+			return fmt.Errorf("参数 %s 不是必填参数，必须设置默认值", param.Name)
+		}
+	}
+
+	used := make(map[string]bool)
+	for _, match := range templatePlaceholderRe.FindAllStringSubmatch(queryItem, -1) {
+		if !declared[match[1]] {
+			return fmt.Errorf("占位符 {{%s}} 没有对应的参数定义", match[1])
+		}
+		used[match[1]] = true
+	}
+	for _, param := range params {
+		if !used[param.Name] {
+			return fmt.Errorf("参数 %s 没有在查询项中使用", param.Name)
+		}
+	}
+
+	// 校验默认值，并用默认值（必填参数用示例值）绑定一次，检查绑定后的查询项
+	var templateItem QueryItem
+	if err := json.Unmarshal([]byte(queryItem), &templateItem); err != nil {
+		return errors.New("queryItem 格式错误: " + err.Error())
+	}
+	dateParser, err := NewDateParser(templateItem.DateOptions)
+	if err != nil {
+		return err
+	}
+	bound := make(map[string]string)
+	for _, param := range params {
+		if param.Required {
+			baseType, isList := templateParamBaseType(param.Type)
+			bound[param.Name] = map[string]string{"string": "a", "int": "1", "float": "1.5", "date": "2006-01-02", "datetime": "2006-01-02 15:04:05"}[baseType]
+			if isList {
+				list, _ := json.Marshal([]string{bound[param.Name]})
+				bound[param.Name] = string(list)
+			}
+			continue
+		}
+		text, err := templateDefaultText(param, dateParser)
+		if err != nil {
+			return err
+		}
+		bound[param.Name] = text
+	}
+	if _, err := substituteTemplate(queryItem, bound); err != nil {
+		return errors.New("模板校验失败: " + err.Error())
+	}
+	return nil
+}
+
+/**
+ * templateDefaultText 校验参数的默认值并转为绑定的文本
+ * @param param 参数定义
+ * @param dateParser 日期解析器
+ * @return string 绑定的文本
+ * @return error 错误信息
+ */
+func templateDefaultText(param QueryTemplateParam, dateParser *DateParser) (string, error) {
+	var value interface{} = param.Default
+	if _, isList := templateParamBaseType(param.Type); isList {
+		var list []interface{}
+		if err := json.Unmarshal([]byte(param.Default), &list); err != nil {
+			return "", fmt.Errorf("参数 %s 的默认值必须为JSON数组", param.Name)
+		}
+		value = list
+	}
+	return templateParamText(param, value, dateParser)
+}
+
+/**
+ * templateParamBaseType 参数类型的元素类型
+ * @param paramType 参数类型
+ * @return string 元素类型（去掉[]后缀）
+ * @return bool 是否为列表类型
+ */
+func templateParamBaseType(paramType string) (string, bool) {
+	if strings.HasSuffix(paramType, "[]") {
+		return strings.TrimSuffix(paramType, "[]"), true
+	}
+	return paramType, false
+}
+
+/**
+ * isValidTemplateParamType 参数类型是否合法
+ * @param paramType 参数类型
+ * @return bool 是否合法
+ */
+func isValidTemplateParamType(paramType string) bool {
+	baseType, _ := templateParamBaseType(paramType)
+	switch baseType {
+	case "string", "int", "float", "date", "datetime":
+		return true
+	}
+	return false
+}
+
+/**
+ * BindQueryTemplate 绑定参数，返回可执行的查询项
+ * @Description: 参数值按类型校验（int/float须为数字，date/datetime须能按查询项的日期选项解析，列表类型须为数组）；
+ * 占位符是整个字符串值时替换为参数值，嵌在其它文本中时参数值不能包含引号和反斜杠
+ * @param version 模板版本
+ * @param values 参数值（字符串、数字或数组），未填写的参数使用默认值
+ * @return string 绑定后的查询项（JSON字符串）
+ * @return error 错误信息，会指明出错的参数
+ */
+func BindQueryTemplate(version *QueryTemplateVersion, values map[string]interface{}) (string, error) {
+	var templateItem QueryItem
+	if err := json.Unmarshal([]byte(version.QueryItem), &templateItem); err != nil {
+		return "", errors.New("模板的查询项格式错误: " + err.Error())
+	}
+	dateParser, err := NewDateParser(templateItem.DateOptions)
+	if err != nil {
+		return "", err
+	}
+
+	declared := make(map[string]bool)
+	bound := make(map[string]string) // 参数名 -> 绑定的文本
+	for _, param := range version.Params {
+		declared[param.Name] = true
+		value, ok := values[param.Name]
+		var text string
+		var err error
+		if ok && value != nil {
+			text, err = templateParamText(param, value, dateParser)
+		} else if param.Required {
+			err = fmt.Errorf("缺少必填参数 %s", param.Name)
+		} else {
+			text, err = templateDefaultText(param, dateParser)
+		}
+		if err != nil {
+			return "", err
+		}
+		bound[param.Name] = text
+	}
+	for name := range values {
+		if !declared[name] {
+			return "", fmt.Errorf("模板没有参数 %s", name)
+		}
+	}
+	return substituteTemplate(version.QueryItem, bound)
+}
+
+/**
+ * substituteTemplate 替换查询项中字符串值的占位符，并检查替换后的查询项
+ * @param templateQueryItem 带占位符的查询项
+ * @param bound 参数名 -> 绑定的文本
+ * @return string 替换后的查询项（JSON字符串）
+ * @return error 错误信息
+ */
+func substituteTemplate(templateQueryItem string, bound map[string]string) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(templateQueryItem)))
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return "", errors.New("模板的查询项格式错误: " + err.Error())
+	}
+	document, err := bindTemplateValue(document, bound)
+	if err != nil {
+		return "", err
+	}
+	queryItem, err := json.Marshal(document)
+	if err != nil {
+		return "", err
+	}
+	var queryItemData QueryItem
+	if err := json.Unmarshal(queryItem, &queryItemData); err != nil {
+		return "", errors.New("绑定参数后的查询项格式错误: " + err.Error())
+	}
+	if len(queryItemData.FilePos) == 0 {
+		return "", errors.New("绑定参数后的查询项中 filePos 不能为空")
+	}
+	return string(queryItem), nil
+}
+
+/**
+ * bindTemplateValue 递归替换JSON值中字符串的占位符
+ * @param value JSON值
+ * @param bound 参数名 -> 绑定的文本
+ * @return interface{} 替换后的值
+ * @return error 错误信息
+ */
+func bindTemplateValue(value interface{}, bound map[string]string) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			boundItem, err := bindTemplateValue(item, bound)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = boundItem
+		}
+		return v, nil
+	case []interface{}:
+		for i, item := range v {
+			boundItem, err := bindTemplateValue(item, bound)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = boundItem
+		}
+		return v, nil
+	case string:
+		// 整个字符串就是一个占位符
+		if match := templatePlaceholderRe.FindStringSubmatch(v); match != nil && match[0] == v {
+			return bound[match[1]], nil
+		}
+		var bindErr error
+		result := templatePlaceholderRe.ReplaceAllStringFunc(v, func(placeholder string) string {
+			name := templatePlaceholderRe.FindStringSubmatch(placeholder)[1]
+			text := bound[name]
+			if strings.ContainsAny(text, "\"\\") && bindErr == nil {
+				bindErr = fmt.Errorf("参数 %s 嵌在其它文本中，其值不能包含引号或反斜杠", name)
+			}
+			return text
+		})
+		if bindErr != nil {
+			return nil, bindErr
+		}
+		return result, nil
+	}
+	return value, nil
+}
+
+/**
+ * templateParamText 按参数类型校验参数值，并转为绑定的文本（列表类型为JSON数组）
+ * @param param 参数定义
+ * @param value 参数值
+ * @param dateParser 日期解析器
+ * @return string 绑定的文本
+ * @return error 错误信息
+ */
+func templateParamText(param QueryTemplateParam, value interface{}, dateParser *DateParser) (string, error) {
+	baseType, isList := templateParamBaseType(param.Type)
+	if !isList {
+		return templateScalarText(param.Name, baseType, value, dateParser)
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return "", fmt.Errorf("参数 %s 的类型为 %s，值必须为数组", param.Name, param.Type)
+	}
+	texts := make([]string, len(items))
+	for i, item := range items {
+		text, err := templateScalarText(param.Name, baseType, item, dateParser)
+		if err != nil {
+			return "", err
+		}
+		texts[i] = text
+	}
+	list, _ := json.Marshal(texts)
+	return string(list), nil
+}
+
+/**
+ * templateScalarText 校验单个参数值并转为文本
+ * @param name 参数名
+ * @param paramType 元素类型
+ * @param value 参数值（字符串或数字）
+ * @param dateParser 日期解析器
+ * @return string 文本
+ * @return error 错误信息
+ */
+func templateScalarText(name string, paramType string, value interface{}, dateParser *DateParser) (string, error) {
+	var text string
+	switch v := value.(type) {
+	case string:
+		text = strings.TrimSpace(v)
+	case float64:
+		text = strconv.FormatFloat(v, 'f', -1, 64)
+	case json.Number:
+		text = v.String()
+	default:
+		return "", fmt.Errorf("参数 %s 的值 %v 不是字符串或数字", name, value)
+	}
+	switch paramType {
+	case "int":
+		if _, err := strconv.ParseInt(text, 10, 64); err != nil {
+			return "", fmt.Errorf("参数 %s 的值 %s 不是整数", name, text)
+		}
+	case "float":
+		if _, err := strconv.ParseFloat(text, 64); err != nil {
+			return "", fmt.Errorf("参数 %s 的值 %s 不是数字", name, text)
+		}
+	case "date", "datetime":
+		if _, err := dateParser.Parse(text); err != nil {
+			return "", fmt.Errorf("参数 %s 的值 %s 不是合法的日期: %s", name, text, err)
+		}
+	default:
+		// 字符串保留原值（不去除首尾空格）
+		if s, ok := value.(string); ok {
+			text = s
+		}
+	}
+	return text, nil
+}
+
+/**
+ * VerifyQueryTemplateAnchor 校验链上锚定的哈希与模板版本的内容一致（防止服务端存储的模板被篡改）
+ * @param contractName 合约名
+ * @param chainServiceUrl 链服务地址
+ * @param name 模板名称
+ * @param version 模板版本
+ * @return error 读取链上哈希失败或哈希不一致时返回错误
+ */
+func VerifyQueryTemplateAnchor(contractName string, chainServiceUrl string, name string, version *QueryTemplateVersion) error {
+	anchorJSON, err := GetQueryTemplateAnchor(contractName, chainServiceUrl, name, version.Version)
+	if err != nil {
+		return errors.New("读取链上模板哈希失败: " + err.Error())
+	}
+	var anchor struct {
+		Hash string `json:"hash"`
+	}
+	if err := json.Unmarshal([]byte(anchorJSON), &anchor); err != nil {
+		return errors.New("链上模板哈希格式错误: " + err.Error())
+	}
+	if hash := QueryTemplateHash(name, *version); anchor.Hash != hash || version.Hash != hash {
+		return fmt.Errorf("模板 %s 版本 %d 的内容与链上锚定的哈希不一致", name, version.Version)
+	}
+	return nil
+}
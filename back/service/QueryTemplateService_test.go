@@ -0,0 +1,123 @@
+package service
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"chainqa_offchain_demo/setting"
+)
+
+// 测试用的模板：疾病代码前缀、年龄下界（默认18）、医院列表
+const testTemplateQueryItem = `{"queryConcatType":"single","filePos":[["T1"]],"returnField":["T1_id"],"queryConditions":[[` +
+	`{"pos":"T1","field":"diseaseCode","val":"{{code}}","compare":"prefix","type":"string"},` +
+	`{"pos":"T1","field":"age","val":"{{minAge}}","compare":"ge","type":"int"},` +
+	`{"pos":"T1","field":"hospital","val":"{{hospitals}}","compare":"in","type":"string"},` +
+	`{"pos":"T1","field":"note","val":"note-{{code}}","compare":"ne","type":"string"}]]}`
+
+var testTemplateParams = []QueryTemplateParam{
+	{Name: "code", Type: "string", Required: true},
+	{Name: "minAge", Type: "int", Default: "18"},
+	{Name: "hospitals", Type: "string[]", Default: `["h1"]`},
+}
+
+func TestBindQueryTemplate(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	version := &QueryTemplateVersion{Version: 1, QueryItem: testTemplateQueryItem, Params: testTemplateParams}
+	cases := []struct {
+		name    string
+		values  map[string]interface{}
+		want    []string // 绑定后各条件的val
+		wantErr string
+	}{
+		{"未填写的参数使用默认值", map[string]interface{}{"code": "E11"}, []string{"E11", "18", `["h1"]`, "note-E11"}, ""},
+		{"数字和数组参数", map[string]interface{}{"code": "E11", "minAge": float64(60), "hospitals": []interface{}{"h2", "h3"}}, []string{"E11", "60", `["h2","h3"]`, "note-E11"}, ""},
+		{"嵌在其它文本中的参数值包含引号", map[string]interface{}{"code": `E"1`, "minAge": "30"}, nil, "嵌在其它文本中"},
+		{"缺少必填参数", map[string]interface{}{"minAge": "30"}, nil, "缺少必填参数 code"},
+		{"整数参数不是整数", map[string]interface{}{"code": "E11", "minAge": "3.5"}, nil, "参数 minAge 的值 3.5 不是整数"},
+		{"列表参数不是数组", map[string]interface{}{"code": "E11", "hospitals": "h1"}, nil, "值必须为数组"},
+		{"未定义的参数", map[string]interface{}{"code": "E11", "other": "1"}, nil, "模板没有参数 other"},
+		{"参数值不是字符串或数字", map[string]interface{}{"code": true}, nil, "不是字符串或数字"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			queryItem, err := BindQueryTemplate(version, tc.values)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("err = %v，期望包含 %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("BindQueryTemplate 失败: %v", err)
+			}
+			var queryItemData QueryItem
+			if err := json.Unmarshal([]byte(queryItem), &queryItemData); err != nil {
+				t.Fatalf("绑定后的查询项格式错误: %v", err)
+			}
+			got := make([]string, 0)
+			for _, condition := range queryItemData.QueryConditions[0] {
+				got = append(got, condition.Val)
+			}
+			if strings.Join(got, "|") != strings.Join(tc.want, "|") {
+				t.Errorf("val = %v，期望 %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSaveQueryTemplateVersion(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	store := &memoryQueryTemplateStore{templates: make(map[string][]byte)}
+	template, version, err := SaveQueryTemplateVersion(store, "diabetes", "糖尿病", "u1", testTemplateQueryItem, testTemplateParams, true)
+	if err != nil || version.Version != 1 || template.Owner != "u1" || version.Hash != QueryTemplateHash("diabetes", *version) {
+		t.Fatalf("创建模板 = %+v, %v", version, err)
+	}
+	if _, _, err := SaveQueryTemplateVersion(store, "diabetes", "", "u1", testTemplateQueryItem, testTemplateParams, true); err == nil {
+		t.Errorf("模板已存在时不能创建")
+	}
+	if _, _, err := SaveQueryTemplateVersion(store, "diabetes", "", "u2", testTemplateQueryItem, testTemplateParams, false); err == nil {
+		t.Errorf("只有创建者可以修改模板")
+	}
+	template, version, err = SaveQueryTemplateVersion(store, "diabetes", "", "u1", strings.Replace(testTemplateQueryItem, `"ge"`, `"gt"`, 1), testTemplateParams, false)
+	if err != nil || version.Version != 2 || template.Description != "糖尿病" || len(template.Versions) != 2 {
+		t.Fatalf("修改模板 = %+v, %v", template, err)
+	}
+	if template.Versions[0].Hash == version.Hash {
+		t.Errorf("不同版本的哈希相同")
+	}
+	if _, err := template.FindVersion(3); err == nil {
+		t.Errorf("版本不存在时应返回错误")
+	}
+
+	invalid := []struct {
+		name      string
+		queryItem string
+		params    []QueryTemplateParam
+		wantErr   string
+	}{
+		{"占位符没有定义", testTemplateQueryItem, testTemplateParams[:2], "占位符 {{hospitals}} 没有对应的参数定义"},
+		{"参数没有使用", testTemplateQueryItem, append(append([]QueryTemplateParam{}, testTemplateParams...), QueryTemplateParam{Name: "x", Type: "int", Required: true}), "参数 x 没有在查询项中使用"},
+		{"非必填参数没有默认值", testTemplateQueryItem, []QueryTemplateParam{testTemplateParams[0], {Name: "minAge", Type: "int"}, testTemplateParams[2]}, "必须设置默认值"},
+		{"默认值类型错误", testTemplateQueryItem, []QueryTemplateParam{testTemplateParams[0], {Name: "minAge", Type: "int", Default: "x"}, testTemplateParams[2]}, "不是整数"},
+		{"参数类型不支持", testTemplateQueryItem, []QueryTemplateParam{testTemplateParams[0], {Name: "minAge", Type: "bool", Default: "x"}, testTemplateParams[2]}, "类型 bool 不支持"},
+		{"绑定后缺少filePos", `{"queryConcatType":"single","returnField":["{{code}}"]}`, testTemplateParams[:1], "filePos 不能为空"},
+	}
+	for _, tc := range invalid {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, _, err := SaveQueryTemplateVersion(store, "t_"+tc.name, "", "u1", tc.queryItem, tc.params, true); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("err = %v，期望包含 %q", err, tc.wantErr)
+			}
+		})
+	}
+
+	if err := DeleteQueryTemplate(store, "diabetes", "u2"); err == nil {
+		t.Errorf("只有创建者可以删除模板")
+	}
+	if err := DeleteQueryTemplate(store, "diabetes", "u1"); err != nil {
+		t.Fatalf("删除模板失败: %v", err)
+	}
+	if _, err := GetQueryTemplate(store, "diabetes"); err == nil {
+		t.Errorf("删除后模板仍存在")
+	}
+}
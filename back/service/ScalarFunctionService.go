@@ -0,0 +1,318 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------标量函数（SCALAR FUNCTIONS）-------------------
+// 计算列表达式中可以调用的内置函数。参数为空值时结果为空值（coalesce除外）。
+
+// exprValueKind 表达式值的类型
+type exprValueKind int
+
+const (
+	exprNull exprValueKind = iota // 空值
+	exprNum                       // 数字
+	exprStr                       // 字符串
+	exprTime                      // 日期时间
+)
+
+// exprValue 表达式的值
+type exprValue struct {
+	kind     exprValueKind
+	num      float64
+	str      string
+	t        time.Time
+	dateOnly bool // 日期时间值是否只有日期部分
+}
+
+// ScalarFunction 标量函数
+type ScalarFunction struct {
+	MinArgs    int    // 最少参数个数
+	MaxArgs    int    // 最多参数个数，-1表示不限
+	NullInput  bool   // 为true时参数中的空值也传给函数，否则有空值参数时直接返回空值
+	ResultType string // 结果类型（float/string/date，为空表示与参数有关）
+	eval       func(args []exprValue, dateParser *DateParser) (exprValue, error)
+}
+
+// scalarFunctions 内置函数注册表（函数名为小写）
+var scalarFunctions = map[string]ScalarFunction{
+	// 数值函数
+	"abs":   numericFunction(1, 1, func(x []float64) float64 { return math.Abs(x[0]) }),
+	"floor": numericFunction(1, 1, func(x []float64) float64 { return math.Floor(x[0]) }),
+	"ceil":  numericFunction(1, 1, func(x []float64) float64 { return math.Ceil(x[0]) }),
+	"sqrt":  numericFunction(1, 1, func(x []float64) float64 { return math.Sqrt(x[0]) }),
+	"pow":   numericFunction(2, 2, func(x []float64) float64 { return math.Pow(x[0], x[1]) }),
+	"round": numericFunction(1, 2, func(x []float64) float64 {
+		if len(x) == 1 {
+			return math.Round(x[0])
+		}
+		scale := math.Pow(10, math.Trunc(x[1]))
+		return math.Round(x[0]*scale) / scale
+	}),
+	"least": numericFunction(1, -1, func(x []float64) float64 {
+		result := x[0]
+		for _, v := range x[1:] {
+			result = math.Min(result, v)
+		}
+		return result
+	}),
+	"greatest": numericFunction(1, -1, func(x []float64) float64 {
+		result := x[0]
+		for _, v := range x[1:] {
+			result = math.Max(result, v)
+		}
+		return result
+	}),
+
+	// 字符串函数
+	"upper":  stringFunction(1, 1, func(s []string) (string, error) { return strings.ToUpper(s[0]), nil }),
+	"lower":  stringFunction(1, 1, func(s []string) (string, error) { return strings.ToLower(s[0]), nil }),
+	"trim":   stringFunction(1, 1, func(s []string) (string, error) { return strings.TrimSpace(s[0]), nil }),
+	"concat": stringFunction(1, -1, func(s []string) (string, error) { return strings.Join(s, ""), nil }),
+	"replace": stringFunction(3, 3, func(s []string) (string, error) {
+		return strings.ReplaceAll(s[0], s[1], s[2]), nil
+	}),
+	"length": {MinArgs: 1, MaxArgs: 1, ResultType: "float", eval: func(args []exprValue, dateParser *DateParser) (exprValue, error) {
+		return numValue(float64(len([]rune(args[0].String(dateParser))))), nil
+	}},
+	"substr": {MinArgs: 2, MaxArgs: 3, ResultType: "string", eval: evalSubstr},
+	"left": {MinArgs: 2, MaxArgs: 2, ResultType: "string", eval: func(args []exprValue, dateParser *DateParser) (exprValue, error) {
+		runes := []rune(args[0].String(dateParser))
+		n, err := args[1].Number()
+		if err != nil {
+			return exprValue{}, err
+		}
+		return strValue(string(runes[:clampIndex(int(n), len(runes))])), nil
+	}},
+	"right": {MinArgs: 2, MaxArgs: 2, ResultType: "string", eval: func(args []exprValue, dateParser *DateParser) (exprValue, error) {
+		runes := []rune(args[0].String(dateParser))
+		n, err := args[1].Number()
+		if err != nil {
+			return exprValue{}, err
+		}
+		return strValue(string(runes[len(runes)-clampIndex(int(n), len(runes)):])), nil
+	}},
+
+	// 日期函数
+	"date": {MinArgs: 1, MaxArgs: 1, ResultType: "date", eval: func(args []exprValue, dateParser *DateParser) (exprValue, error) {
+		t, err := args[0].Time(dateParser)
+		if err != nil {
+			return exprValue{}, err
+		}
+		year, month, day := t.Date()
+		return exprValue{kind: exprTime, t: time.Date(year, month, day, 0, 0, 0, 0, t.Location()), dateOnly: true}, nil
+	}},
+	"year":     datePartFunction(func(t time.Time) int { return t.Year() }),
+	"month":    datePartFunction(func(t time.Time) int { return int(t.Month()) }),
+	"day":      datePartFunction(func(t time.Time) int { return t.Day() }),
+	"datediff": {MinArgs: 2, MaxArgs: 3, ResultType: "float", eval: evalDateDiff},
+
+	// 空值与类型转换
+	"coalesce": {MinArgs: 1, MaxArgs: -1, NullInput: true, eval: func(args []exprValue, dateParser *DateParser) (exprValue, error) {
+		for _, arg := range args {
+			if arg.kind != exprNull {
+				return arg, nil
+			}
+		}
+		return exprValue{kind: exprNull}, nil
+	}},
+	"tonumber": {MinArgs: 1, MaxArgs: 1, ResultType: "float", eval: func(args []exprValue, dateParser *DateParser) (exprValue, error) {
+		n, err := args[0].Number()
+		if err != nil {
+			return exprValue{}, err
+		}
+		return numValue(n), nil
+	}},
+	"tostring": {MinArgs: 1, MaxArgs: 1, ResultType: "string", eval: func(args []exprValue, dateParser *DateParser) (exprValue, error) {
+		return strValue(args[0].String(dateParser)), nil
+	}},
+}
+
+/**
+ * RegisterScalarFunction 注册（或覆盖）计算列表达式中可以调用的函数
+ * @param name 函数名（不区分大小写）
+ * @param minArgs 最少参数个数
+ * @param maxArgs 最多参数个数，-1表示不限
+ * @param fn 函数：参数为字符串形式的值（空值参数不会传入，直接返回空值），返回字符串形式的结果
+ */
+func RegisterScalarFunction(name string, minArgs int, maxArgs int, fn func(args []string) (string, error)) {
+	scalarFunctions[strings.ToLower(name)] = stringFunction(minArgs, maxArgs, fn)
+}
+
+// numericFunction 参数和结果都为数字的函数
+func numericFunction(minArgs int, maxArgs int, fn func(x []float64) float64) ScalarFunction {
+	return ScalarFunction{MinArgs: minArgs, MaxArgs: maxArgs, ResultType: "float", eval: func(args []exprValue, dateParser *DateParser) (exprValue, error) {
+		nums := make([]float64, len(args))
+		for i, arg := range args {
+			n, err := arg.Number()
+			if err != nil {
+				return exprValue{}, err
+			}
+			nums[i] = n
+		}
+		result := fn(nums)
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			return exprValue{kind: exprNull}, nil
+		}
+		return numValue(result), nil
+	}}
+}
+
+// stringFunction 参数和结果都为字符串的函数
+func stringFunction(minArgs int, maxArgs int, fn func(s []string) (string, error)) ScalarFunction {
+	return ScalarFunction{MinArgs: minArgs, MaxArgs: maxArgs, ResultType: "string", eval: func(args []exprValue, dateParser *DateParser) (exprValue, error) {
+		strs := make([]string, len(args))
+		for i, arg := range args {
+			strs[i] = arg.String(dateParser)
+		}
+		result, err := fn(strs)
+		if err != nil {
+			return exprValue{}, err
+		}
+		return strValue(result), nil
+	}}
+}
+
+// datePartFunction 取日期的某一部分（年、月、日）
+func datePartFunction(part func(t time.Time) int) ScalarFunction {
+	return ScalarFunction{MinArgs: 1, MaxArgs: 1, ResultType: "float", eval: func(args []exprValue, dateParser *DateParser) (exprValue, error) {
+		t, err := args[0].Time(dateParser)
+		if err != nil {
+			return exprValue{}, err
+		}
+		return numValue(float64(part(t))), nil
+	}}
+}
+
+// evalSubstr substr(s, start[, length])：start从1开始，按字符计
+func evalSubstr(args []exprValue, dateParser *DateParser) (exprValue, error) {
+	runes := []rune(args[0].String(dateParser))
+	start, err := args[1].Number()
+	if err != nil {
+		return exprValue{}, err
+	}
+	begin := clampIndex(int(start)-1, len(runes))
+	end := len(runes)
+	if len(args) == 3 {
+		length, err := args[2].Number()
+		if err != nil {
+			return exprValue{}, err
+		}
+		end = clampIndex(begin+int(length), len(runes))
+	}
+	if end < begin {
+		end = begin
+	}
+	return strValue(string(runes[begin:end])), nil
+}
+
+// evalDateDiff datediff(d1, d2[, unit])：d1 - d2，unit为day（默认）/hour/minute/second/month/year
+func evalDateDiff(args []exprValue, dateParser *DateParser) (exprValue, error) {
+	t1, err := args[0].Time(dateParser)
+	if err != nil {
+		return exprValue{}, err
+	}
+	t2, err := args[1].Time(dateParser)
+	if err != nil {
+		return exprValue{}, err
+	}
+	unit := "day"
+	if len(args) == 3 {
+		unit = strings.ToLower(args[2].String(dateParser))
+	}
+	switch unit {
+	case "day":
+		// 按日历日计算，不受时分秒影响
+		y1, m1, d1 := t1.Date()
+		y2, m2, d2 := t2.Date()
+		days := time.Date(y1, m1, d1, 0, 0, 0, 0, time.UTC).Sub(time.Date(y2, m2, d2, 0, 0, 0, 0, time.UTC)).Hours() / 24
+		return numValue(math.Round(days)), nil
+	case "hour":
+		return numValue(math.Trunc(t1.Sub(t2).Hours())), nil
+	case "minute":
+		return numValue(math.Trunc(t1.Sub(t2).Minutes())), nil
+	case "second":
+		return numValue(math.Trunc(t1.Sub(t2).Seconds())), nil
+	case "month":
+		return numValue(float64((t1.Year()-t2.Year())*12 + int(t1.Month()) - int(t2.Month()))), nil
+	case "year":
+		return numValue(float64(t1.Year() - t2.Year())), nil
+	}
+	return exprValue{}, errors.New("datediff 不支持的单位 " + unit + "（day/hour/minute/second/month/year）")
+}
+
+// clampIndex 将索引限制在[0, length]内
+func clampIndex(index int, length int) int {
+	if index < 0 {
+		return 0
+	}
+	if index > length {
+		return length
+	}
+	return index
+}
+
+func numValue(n float64) exprValue {
+	return exprValue{kind: exprNum, num: n}
+}
+
+func strValue(s string) exprValue {
+	return exprValue{kind: exprStr, str: s}
+}
+
+// Number 转换为数字
+func (v exprValue) Number() (float64, error) {
+	switch v.kind {
+	case exprNum:
+		return v.num, nil
+	case exprStr:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v.str), 64)
+		if err != nil {
+			return 0, fmt.Errorf("数据 %s 无法转换为数字", v.str)
+		}
+		return n, nil
+	case exprTime:
+		return 0, errors.New("日期不能作为数字计算")
+	}
+	return 0, errors.New("空值不能作为数字计算")
+}
+
+// Time 转换为日期时间
+func (v exprValue) Time(dateParser *DateParser) (time.Time, error) {
+	switch v.kind {
+	case exprTime:
+		return v.t, nil
+	case exprStr:
+		t, err := dateParser.Parse(v.str)
+		if err != nil {
+			return t, fmt.Errorf("数据 %s", err)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("数据 %s 不是日期", v.String(dateParser))
+}
+
+// String 转换为字符串（即存入计算列的单元格值）：整数不带小数点，日期按统一格式输出
+func (v exprValue) String(dateParser *DateParser) string {
+	switch v.kind {
+	case exprNum:
+		if v.num == math.Trunc(v.num) && math.Abs(v.num) < 1e15 {
+			return strconv.FormatInt(int64(v.num), 10)
+		}
+		return strconv.FormatFloat(v.num, 'f', -1, 64)
+	case exprStr:
+		return v.str
+	case exprTime:
+		if v.dateOnly {
+			return dateParser.Format(v.t, "date")
+		}
+		return dateParser.Format(v.t, "datetime")
+	}
+	return NullCell
+}
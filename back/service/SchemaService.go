@@ -0,0 +1,267 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------表结构缓存（SCHEMA CACHE）-------------------
+// 分片的明文加密存储在IPFS上，读取表头需要从链上获取AES密钥。
+// 上传时和查询解密后记录每个分片的表头、推断的列类型与行数，校验查询（explain）和查看表结构（/api/dataset/schema）时直接使用，不再获取密钥。
+// 分片按内容寻址（CID），内容不变，已记录的分片不再重复推断。
+
+// DatasetSchema 单个分片（CID）的表结构
+type DatasetSchema struct {
+	Pos       string   `json:"pos"`       // 分片位置（CID）
+	Columns   []string `json:"columns"`   // 列名（不带pos前缀）
+	Types     []string `json:"types"`     // 推断的列类型（int/float/date/datetime/string），与Columns一一对应
+	RowCount  int      `json:"rowCount"`  // 行数
+	UpdatedAt int64    `json:"updatedAt"` // 记录时间（Unix秒）
+}
+
+var schemaCache = struct {
+	sync.RWMutex
+	schemas map[string]DatasetSchema
+}{schemas: make(map[string]DatasetSchema)}
+
+/**
+ * RememberSchema 记录分片的表结构
+ * @param pos 分片位置（CID）
+ * @param columns 列名（不带pos前缀）
+ * @param types 推断的列类型，与columns一一对应
+ * @param rowCount 行数
+ */
+func RememberSchema(pos string, columns []string, types []string, rowCount int) {
+	schemaCache.Lock()
+	defer schemaCache.Unlock()
+	schemaCache.schemas[pos] = DatasetSchema{
+		Pos:       pos,
+		Columns:   append([]string(nil), columns...),
+		Types:     append([]string(nil), types...),
+		RowCount:  rowCount,
+		UpdatedAt: time.Now().Unix(),
+	}
+}
+
+/**
+ * RememberSchemaFromContent 解析明文并记录分片的表结构（上传时使用）
+ * @param pos 分片位置（CID）
+ * @param content 明文（新格式或旧的空格分隔格式）
+ * @return error 解析错误
+ */
+func RememberSchemaFromContent(pos string, content string) error {
+	table, err := DecodeTable(pos, content)
+	if err != nil {
+		return err
+	}
+	rememberTableSchema(pos, pos, table)
+	return nil
+}
+
+/**
+ * rememberTableSchema 记录解析后的分片的表结构
+ * @param filePos 分片位置（CID）
+ * @param mainPos 解析时使用的列名前缀（数据集主CID）
+ * @param table 该分片解析后的表
+ */
+func rememberTableSchema(filePos string, mainPos string, table *Table) {
+	if _, ok := LookupSchema(filePos); ok {
+		return
+	}
+	columns := make([]string, len(table.Columns))
+	for i, column := range table.Columns {
+		columns[i] = strings.TrimPrefix(column, mainPos+"_")
+	}
+	RememberSchema(filePos, columns, inferColumnTypes(table), len(table.Rows))
+}
+
+/**
+ * inferColumnTypes 推断每列的类型：所有非空值都能解析为int时为int，依次为float、date、datetime，否则为string
+ * @param table 表
+ * @return []string 列类型，与table.Columns一一对应（没有非空值的列为string）
+ */
+func inferColumnTypes(table *Table) []string {
+	dateParser, _ := NewDateParser(DateOptions{})
+	candidates := []string{"int", "float", "date", "datetime"}
+	types := make([]string, len(table.Columns))
+	for index := range table.Columns {
+		possible := map[string]bool{"int": true, "float": true, "date": true, "datetime": true}
+		hasValue := false
+		for _, row := range table.Rows {
+			cellValue := row[index]
+			if isNullCell(cellValue) || cellValue == "" {
+				continue
+			}
+			hasValue = true
+			if possible["int"] {
+				if _, err := strconv.ParseInt(cellValue, 10, 64); err != nil {
+					possible["int"] = false
+				}
+			}
+			if possible["float"] {
+				if _, err := strconv.ParseFloat(cellValue, 64); err != nil {
+					possible["float"] = false
+				}
+			}
+			for _, cellType := range []string{"date", "datetime"} {
+				if possible[cellType] && dateParser != nil {
+					if _, err := dateParser.ParseAs(cellValue, cellType); err != nil {
+						possible[cellType] = false
+					}
+				}
+			}
+			if !possible["int"] && !possible["float"] && !possible["date"] && !possible["datetime"] {
+				break
+			}
+		}
+		types[index] = "string"
+		if !hasValue {
+			continue
+		}
+		for _, cellType := range candidates {
+			if possible[cellType] {
+				types[index] = cellType
+				break
+			}
+		}
+	}
+	return types
+}
+
+/**
+ * LookupSchema 获取已缓存的分片表结构
+ * @param pos 分片位置（CID）
+ * @return DatasetSchema 表结构
+ * @return bool 是否已缓存
+ */
+func LookupSchema(pos string) (DatasetSchema, bool) {
+	schemaCache.RLock()
+	defer schemaCache.RUnlock()
+	schema, ok := schemaCache.schemas[pos]
+	return schema, ok
+}
+
+// ----------------查看数据集的表结构-------------------
+
+// SchemaColumn 数据集的列
+type SchemaColumn struct {
+	Name   string `json:"name"`             // 列名
+	Type   string `json:"type"`             // 推断的类型（各分片类型不一致时拓宽：int与float为float，其余为string）
+	Shards int    `json:"shards"`           // 包含该列的分片数
+	Masked string `json:"masked,omitempty"` // 列权限中的脱敏方式（查询时返回脱敏后的值）
+}
+
+// DatasetShard 数据集中的分片
+type DatasetShard struct {
+	Pos      string `json:"pos"`      // 分片位置（CID）
+	RowCount int    `json:"rowCount"` // 行数
+	Cached   bool   `json:"cached"`   // 表结构是否来自缓存（否则本次获取并解密了该分片）
+}
+
+// DatasetDescription 数据集的表结构
+type DatasetDescription struct {
+	Pos      string         `json:"pos"`      // 数据集主CID（第一个分片）
+	Columns  []SchemaColumn `json:"columns"`  // 列（按分片中出现的顺序，不含无权访问的列）
+	RowCount int            `json:"rowCount"` // 所有分片的总行数
+	Shards   []DatasetShard `json:"shards"`   // 分片列表
+}
+
+/**
+ * DescribeDataset 获取数据集（一个或多个分片）的表结构：已缓存的分片直接使用，其余分片获取并解密一次后缓存
+ * 按context上的列权限去掉无权访问的列，并标注脱敏的列
+ * @param ctx 查询的context（超时、取消，列权限）
+ * @param filePoses 数据集的分片（第一个为主CID），重复的只计一次
+ * @param loader 分片获取函数
+ * @return *DatasetDescription 表结构
+ * @return error 错误信息
+ */
+func DescribeDataset(ctx context.Context, filePoses []string, loader ShardLoader) (*DatasetDescription, error) {
+	poses := make([]string, 0, len(filePoses))
+	for _, filePos := range filePoses {
+		if filePos != "" && !strIsInSlice(poses, filePos) {
+			poses = append(poses, filePos)
+		}
+	}
+	if len(poses) == 0 {
+		return nil, errors.New("filePoses 不能为空")
+	}
+
+	// 未缓存的分片获取并解密一次，记录表结构
+	missing := make([]string, 0)
+	for _, pos := range poses {
+		if _, ok := LookupSchema(pos); !ok {
+			missing = append(missing, pos)
+		}
+	}
+	if len(missing) > 0 {
+		filePosAndDataMap, err := LoadShards(ctx, missing, loader)
+		if err != nil {
+			return nil, err
+		}
+		for _, pos := range missing {
+			table, err := DecodeTable(pos, filePosAndDataMap[pos])
+			if err != nil {
+				return nil, fmt.Errorf("解析分片 %s 失败: %s", pos, err)
+			}
+			rememberTableSchema(pos, pos, table)
+		}
+	}
+
+	var rules *columnRules
+	if policy := columnPolicyFromContext(ctx); policy != nil {
+		rules = &columnRules{policy: policy}
+	}
+	description := &DatasetDescription{Pos: poses[0], Columns: make([]SchemaColumn, 0), Shards: make([]DatasetShard, 0, len(poses))}
+	columnIndexes := make(map[string]int)
+	for _, pos := range poses {
+		schema, ok := LookupSchema(pos)
+		if !ok {
+			return nil, fmt.Errorf("分片 %s 的表结构不存在", pos)
+		}
+		description.Shards = append(description.Shards, DatasetShard{Pos: pos, RowCount: schema.RowCount, Cached: !strIsInSlice(missing, pos)})
+		description.RowCount += schema.RowCount
+		for i, column := range schema.Columns {
+			if rules.hidden(column) {
+				continue
+			}
+			columnType := "string"
+			if i < len(schema.Types) {
+				columnType = schema.Types[i]
+			}
+			index, ok := columnIndexes[column]
+			if !ok {
+				columnIndexes[column] = len(description.Columns)
+				schemaColumn := SchemaColumn{Name: column, Type: columnType, Shards: 1}
+				if mask := rules.mask(column); mask != nil {
+					schemaColumn.Masked = mask.Method
+				}
+				description.Columns = append(description.Columns, schemaColumn)
+				continue
+			}
+			description.Columns[index].Shards++
+			description.Columns[index].Type = mergeSchemaType(description.Columns[index].Type, columnType)
+		}
+	}
+	return description, nil
+}
+
+/**
+ * mergeSchemaType 合并两个分片中同一列的类型
+ * @param type1 类型1
+ * @param type2 类型2
+ * @return string 合并后的类型：相同时不变，int与float为float，其余为string
+ */
+func mergeSchemaType(type1 string, type2 string) string {
+	if type1 == type2 {
+		return type1
+	}
+	if (type1 == "int" || type1 == "float") && (type2 == "int" || type2 == "float") {
+		return "float"
+	}
+	return "string"
+}
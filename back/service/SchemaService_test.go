@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"chainqa_offchain_demo/setting"
+)
+
+func TestDescribeDataset(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	// 表结构缓存是全局的，去掉之前运行时记录的分片
+	schemaCache.Lock()
+	delete(schemaCache.schemas, "DS2")
+	delete(schemaCache.schemas, "DS3")
+	schemaCache.Unlock()
+	RememberSchema("DS1", []string{"id", "age", "name", "idCard"}, []string{"int", "int", "string", "string"}, 3)
+	shards := map[string]string{
+		"DS2": "id\tage\tscore\n4\t40.5\t90\n5\t50\t80\n",
+		"DS3": "id\tname\n6\t2024-01-02\n",
+	}
+	loads := make(map[string]int)
+	loader := func(ctx context.Context, filePos string) (string, error) {
+		loads[filePos]++
+		content, ok := shards[filePos]
+		if !ok {
+			return "", errors.New("分片不存在")
+		}
+		return content, nil
+	}
+
+	description, err := DescribeDataset(context.Background(), []string{"DS1", "DS2", "DS3", "DS2", ""}, loader)
+	if err != nil {
+		t.Fatalf("获取表结构失败: %v", err)
+	}
+	// 各分片的列按出现顺序合并，类型不一致时拓宽
+	columns, _ := json.Marshal(description.Columns)
+	wantColumns := `[{"name":"id","type":"int","shards":3},{"name":"age","type":"float","shards":2},{"name":"name","type":"string","shards":2},` +
+		`{"name":"idCard","type":"string","shards":1},{"name":"score","type":"int","shards":1}]`
+	if string(columns) != wantColumns {
+		t.Errorf("列 = %s，期望 %s", columns, wantColumns)
+	}
+	wantShards := []DatasetShard{{Pos: "DS1", RowCount: 3, Cached: true}, {Pos: "DS2", RowCount: 2}, {Pos: "DS3", RowCount: 1}}
+	if description.Pos != "DS1" || description.RowCount != 6 || len(description.Shards) != len(wantShards) {
+		t.Fatalf("表结构 = %+v", description)
+	}
+	for i, shard := range description.Shards {
+		if shard != wantShards[i] {
+			t.Errorf("第%d个分片 = %+v，期望 %+v", i, shard, wantShards[i])
+		}
+	}
+
+	// 再次获取时全部使用缓存，不再获取分片；按列权限去掉无权访问的列，标注脱敏的列
+	policy := &ColumnPolicy{DenyColumns: []string{"idCard"}, Masks: []ColumnMask{{Column: "age", Method: MaskMethodAgeBand}}}
+	description, err = DescribeDataset(WithColumnPolicy(context.Background(), policy), []string{"DS1", "DS2", "DS3"}, loader)
+	if err != nil {
+		t.Fatalf("获取表结构失败: %v", err)
+	}
+	columns, _ = json.Marshal(description.Columns)
+	wantColumns = `[{"name":"id","type":"int","shards":3},{"name":"age","type":"float","shards":2,"masked":"ageBand"},` +
+		`{"name":"name","type":"string","shards":2},{"name":"score","type":"int","shards":1}]`
+	if string(columns) != wantColumns {
+		t.Errorf("列 = %s，期望 %s", columns, wantColumns)
+	}
+	if loads["DS2"] != 1 || loads["DS3"] != 1 || loads["DS1"] != 0 {
+		t.Errorf("获取分片次数 = %v", loads)
+	}
+	for _, shard := range description.Shards {
+		if !shard.Cached {
+			t.Errorf("分片 %s 的表结构未使用缓存", shard.Pos)
+		}
+	}
+
+	errCases := []struct {
+		filePoses []string
+		want      string
+	}{
+		{[]string{"", ""}, "filePoses 不能为空"},
+		{[]string{"DS1", "DSX"}, "分片不存在"},
+	}
+	for _, tc := range errCases {
+		if _, err := DescribeDataset(context.Background(), tc.filePoses, loader); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("DescribeDataset(%v) 的错误 = %v，期望包含 %s", tc.filePoses, err, tc.want)
+		}
+	}
+}
+
+func TestMergeSchemaType(t *testing.T) {
+	cases := []struct {
+		type1, type2, want string
+	}{
+		{"int", "int", "int"},
+		{"int", "float", "float"},
+		{"float", "int", "float"},
+		{"date", "date", "date"},
+		{"date", "datetime", "string"},
+		{"int", "string", "string"},
+	}
+	for _, tc := range cases {
+		if got := mergeSchemaType(tc.type1, tc.type2); got != tc.want {
+			t.Errorf("mergeSchemaType(%s, %s) = %s，期望 %s", tc.type1, tc.type2, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,1633 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ----------------SQL方言（SQL DIALECT）-------------------
+// 将类SQL语句编译为QueryItem，示例：
+//   SELECT p.name, v.cost FROM patients p JOIN 'QmXXX' AS v ON p.id = v.pid
+//   WHERE p.age BETWEEN 18 AND 30 AND (p.gender = 'F' OR v.date >= DATE '2024-01-01')
+//   ORDER BY v.cost DESC LIMIT 10
+// 数据集可以写作绑定名（由请求中的datasets映射到分片CID数组）或直接写单个CID（字符串或标识符）。
+// 列类型由比较的字面量推断（整数/小数/字符串/DATE/DATETIME），也可以用 列::类型 显式指定（如 p.age::int）。
+// WHERE中的AND/OR/NOT会展开为查询条件组（组间OR，组内AND）。
+
+// SQLError SQL语法或语义错误，携带出错位置
+type SQLError struct {
+	Offset  int    `json:"offset"`  // 出错位置（从0开始的字符偏移）
+	Line    int    `json:"line"`    // 行号（从1开始）
+	Column  int    `json:"column"`  // 列号（从1开始，按字符计）
+	Near    string `json:"near"`    // 出错位置附近的文本
+	Message string `json:"message"` // 错误信息
+}
+
+func (e *SQLError) Error() string {
+	return fmt.Sprintf("SQL第%d行第%d列（%s 附近）: %s", e.Line, e.Column, e.Near, e.Message)
+}
+
+// WHERE展开后的查询条件组数上限，避免AND/OR嵌套过深时组合爆炸
+const sqlMaxConditionGroups = 256
+
+// SQL关键字（不能作为别名）
+var sqlKeywords = map[string]bool{
+	"SELECT": true, "FROM": true, "AS": true, "JOIN": true, "INNER": true, "LEFT": true, "RIGHT": true,
+	"FULL": true, "OUTER": true, "CROSS": true, "ON": true, "WHERE": true, "AND": true, "OR": true,
+	"NOT": true, "IN": true, "BETWEEN": true, "IS": true, "NULL": true, "LIKE": true, "ILIKE": true,
+	"REGEXP": true, "GROUP": true, "BY": true, "ORDER": true, "ASC": true, "DESC": true, "LIMIT": true,
+}
+
+// 聚合函数
+var sqlAggregateFuncs = map[string]bool{"COUNT": true, "SUM": true, "AVG": true, "MIN": true, "MAX": true}
+
+// 日期分桶函数（GROUP BY MONTH(v.date)）
+var sqlBucketFuncs = map[string]string{"DAY": "day", "WEEK": "week", "MONTH": "month", "QUARTER": "quarter", "YEAR": "year"}
+
+// 比较运算符到QueryCondition比较符的映射
+var sqlCompareOps = map[string]string{"=": "eq", "!=": "ne", "<>": "ne", "<": "lt", ">": "gt", "<=": "le", ">=": "ge"}
+
+// 比较符取反（NOT）
+var sqlNegatedCompare = map[string]string{
+	"eq": "ne", "ne": "eq", "lt": "ge", "ge": "lt", "gt": "le", "le": "gt",
+	"in": "notin", "notin": "in", "isnull": "notnull", "notnull": "isnull",
+	"contain": "notcontain", "notcontain": "contain",
+}
+
+// 字面量在左侧时比较符翻转（3 < a 即 a > 3）
+var sqlFlippedCompare = map[string]string{"eq": "eq", "ne": "ne", "lt": "gt", "gt": "lt", "le": "ge", "ge": "le"}
+
+// ======================词法分析======================
+
+type sqlTokenKind int
+
+const (
+	sqlEOF         sqlTokenKind = iota
+	sqlIdent                    // 标识符或关键字
+	sqlQuotedIdent              // "标识符" 或 `标识符`（可包含空格）
+	sqlString                   // '字符串'
+	sqlNumber                   // 数字
+	sqlSymbol                   // 符号
+)
+
+type sqlToken struct {
+	kind sqlTokenKind
+	text string // 内容（字符串、带引号标识符已去掉引号）
+	pos  int    // 起始位置（字符偏移）
+}
+
+/**
+ * tokenizeSQL 词法分析
+ * @param src SQL语句（按字符）
+ * @return []sqlToken token数组，以sqlEOF结尾
+ * @return error 错误信息（*SQLError）
+ */
+func tokenizeSQL(src []rune) ([]sqlToken, error) {
+	tokens := make([]sqlToken, 0)
+	i := 0
+	for i < len(src) {
+		r := src[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '-' && i+1 < len(src) && src[i+1] == '-':
+			// 行注释
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case r == '\'':
+			start := i
+			var sb strings.Builder
+			i++
+			closed := false
+			for i < len(src) {
+				if src[i] == '\'' {
+					// '' 表示一个单引号
+					if i+1 < len(src) && src[i+1] == '\'' {
+						sb.WriteRune('\'')
+						i += 2
+						continue
+					}
+					closed = true
+					i++
+					break
+				}
+				sb.WriteRune(src[i])
+				i++
+			}
+			if !closed {
+				return nil, newSQLError(src, start, "字符串缺少结束的单引号")
+			}
+			tokens = append(tokens, sqlToken{kind: sqlString, text: sb.String(), pos: start})
+		case r == '"' || r == '`':
+			start := i
+			end := i + 1
+			for end < len(src) && src[end] != r {
+				end++
+			}
+			if end >= len(src) {
+				return nil, newSQLError(src, start, "标识符缺少结束的"+string(r))
+			}
+			tokens = append(tokens, sqlToken{kind: sqlQuotedIdent, text: string(src[i+1 : end]), pos: start})
+			i = end + 1
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(src) && unicode.IsDigit(src[i+1])):
+			start := i
+			for i < len(src) && (unicode.IsDigit(src[i]) || src[i] == '.') {
+				i++
+			}
+			// 科学计数法
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				j := i + 1
+				if j < len(src) && (src[j] == '+' || src[j] == '-') {
+					j++
+				}
+				if j < len(src) && unicode.IsDigit(src[j]) {
+					i = j
+					for i < len(src) && unicode.IsDigit(src[i]) {
+						i++
+					}
+				}
+			}
+			tokens = append(tokens, sqlToken{kind: sqlNumber, text: string(src[start:i]), pos: start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(src) && (unicode.IsLetter(src[i]) || unicode.IsDigit(src[i]) || src[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlIdent, text: string(src[start:i]), pos: start})
+		default:
+			start := i
+			// 两个字符的符号
+			if i+1 < len(src) {
+				two := string(src[i : i+2])
+				switch two {
+				case "!=", "<>", "<=", ">=", "::":
+					tokens = append(tokens, sqlToken{kind: sqlSymbol, text: two, pos: start})
+					i += 2
+					continue
+				}
+			}
+			switch r {
+			case '(', ')', ',', '.', '*', '=', '<', '>', '~', '-', ';', '+', '/', '%':
+				tokens = append(tokens, sqlToken{kind: sqlSymbol, text: string(r), pos: start})
+				i++
+			default:
+				return nil, newSQLError(src, start, fmt.Sprintf("无法识别的字符 %q", r))
+			}
+		}
+	}
+	tokens = append(tokens, sqlToken{kind: sqlEOF, pos: len(src)})
+	return tokens, nil
+}
+
+/**
+ * newSQLError 生成带位置的错误
+ * @param src SQL语句（按字符）
+ * @param offset 出错位置（字符偏移）
+ * @param message 错误信息
+ * @return *SQLError 错误
+ */
+func newSQLError(src []rune, offset int, message string) *SQLError {
+	if offset > len(src) {
+		offset = len(src)
+	}
+	line, column := 1, 1
+	for _, r := range src[:offset] {
+		if r == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+	end := offset + 15
+	if end > len(src) {
+		end = len(src)
+	}
+	near := strings.TrimSpace(string(src[offset:end]))
+	if near == "" {
+		near = "语句末尾"
+	}
+	return &SQLError{Offset: offset, Line: line, Column: column, Near: near, Message: message}
+}
+
+// ======================语法分析======================
+
+// sqlColumnRef 列引用：[别名.]列名[::类型]
+type sqlColumnRef struct {
+	alias    string // 数据集别名（可为空）
+	field    string // 列名
+	typeHint string // 显式类型（可为空）
+	pos      int
+}
+
+// sqlLiteral 字面量
+type sqlLiteral struct {
+	text string // 值
+	kind string // string/int/float/date/datetime
+	pos  int
+}
+
+// sqlSelectItem SELECT中的一项
+type sqlSelectItem struct {
+	star      bool          // * 或 别名.*
+	column    *sqlColumnRef // 列（聚合函数的参数，count(*)时为nil）
+	aggregate string        // 聚合函数（小写，可为空）
+	bucket    string        // 日期分桶粒度（可为空），如 SELECT MONTH(v.date)
+	expr      *exprNode     // 表达式（编译为计算列），如 SELECT floor(v.age/10)*10 AS ageGroup
+	alias     string        // AS 别名
+	pos       int
+}
+
+// sqlDataset FROM/JOIN中的数据集
+type sqlDataset struct {
+	name  string // 绑定名或CID
+	alias string
+	pos   int
+}
+
+// sqlJoin JOIN ... ON ...
+type sqlJoin struct {
+	dataset    sqlDataset
+	conditions []sqlJoinCondition // ON 中用 AND 连接的联表条件
+	pos        int
+}
+
+// sqlJoinCondition ON 中的单个联表条件：列 比较符 列
+type sqlJoinCondition struct {
+	left    sqlColumnRef
+	right   sqlColumnRef
+	compare string
+	pos     int
+}
+
+// sqlPredicate WHERE中的单个条件
+type sqlPredicate struct {
+	column  sqlColumnRef
+	compare string       // QueryCondition的比较符
+	vals    []sqlLiteral // 基准值（in为列表，between为上下界，isnull/notnull为空）
+	pos     int
+}
+
+// sqlExpr WHERE表达式树
+type sqlExpr struct {
+	op    string // and/or/not/pred
+	left  *sqlExpr
+	right *sqlExpr
+	pred  *sqlPredicate
+	pos   int
+}
+
+// sqlGroupItem GROUP BY中的一项
+type sqlGroupItem struct {
+	column sqlColumnRef
+	bucket string // 日期分桶粒度（可为空）
+}
+
+// sqlOrderItem ORDER BY中的一项
+type sqlOrderItem struct {
+	column    *sqlColumnRef // 列或别名（aggregate不为空时为聚合参数）
+	aggregate string        // 按聚合函数排序，如 ORDER BY COUNT(*)
+	bucket    string        // 按日期分桶排序，如 ORDER BY MONTH(v.date)
+	desc      bool
+	pos       int
+}
+
+// sqlQuery 语法树
+type sqlQuery struct {
+	selects  []sqlSelectItem
+	from     sqlDataset
+	joins    []sqlJoin
+	where    *sqlExpr
+	groupBys []sqlGroupItem
+	orderBys []sqlOrderItem
+	limit    int
+}
+
+type sqlParser struct {
+	src    []rune
+	tokens []sqlToken
+	i      int
+}
+
+func (p *sqlParser) peek() sqlToken {
+	return p.tokens[p.i]
+}
+
+func (p *sqlParser) peekAt(n int) sqlToken {
+	if p.i+n < len(p.tokens) {
+		return p.tokens[p.i+n]
+	}
+	return p.tokens[len(p.tokens)-1]
+}
+
+func (p *sqlParser) next() sqlToken {
+	tok := p.tokens[p.i]
+	if tok.kind != sqlEOF {
+		p.i++
+	}
+	return tok
+}
+
+func (p *sqlParser) errorAt(pos int, format string, args ...interface{}) *SQLError {
+	return newSQLError(p.src, pos, fmt.Sprintf(format, args...))
+}
+
+// isKeyword 当前token是否为关键字kw（不区分大小写）
+func (p *sqlParser) isKeyword(kw string) bool {
+	tok := p.peek()
+	return tok.kind == sqlIdent && strings.EqualFold(tok.text, kw)
+}
+
+// acceptKeyword 当前token为关键字kw时消费它
+func (p *sqlParser) acceptKeyword(kw string) bool {
+	if p.isKeyword(kw) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expectKeyword(kw string) error {
+	if !p.acceptKeyword(kw) {
+		return p.errorAt(p.peek().pos, "此处应为 %s", kw)
+	}
+	return nil
+}
+
+func (p *sqlParser) isSymbol(symbol string) bool {
+	tok := p.peek()
+	return tok.kind == sqlSymbol && tok.text == symbol
+}
+
+func (p *sqlParser) acceptSymbol(symbol string) bool {
+	if p.isSymbol(symbol) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expectSymbol(symbol string) error {
+	if !p.acceptSymbol(symbol) {
+		return p.errorAt(p.peek().pos, "此处应为 %s", symbol)
+	}
+	return nil
+}
+
+// parseName 解析名称（标识符或带引号的标识符，关键字不能作为名称）
+func (p *sqlParser) parseName(what string) (string, int, error) {
+	tok := p.peek()
+	switch {
+	case tok.kind == sqlQuotedIdent:
+		p.next()
+		return tok.text, tok.pos, nil
+	case tok.kind == sqlIdent && !sqlKeywords[strings.ToUpper(tok.text)]:
+		p.next()
+		return tok.text, tok.pos, nil
+	}
+	return "", tok.pos, p.errorAt(tok.pos, "此处应为%s", what)
+}
+
+// parseAlias 解析可选的别名：[AS] 名称
+func (p *sqlParser) parseAlias() (string, error) {
+	if p.acceptKeyword("AS") {
+		name, _, err := p.parseName("别名")
+		return name, err
+	}
+	tok := p.peek()
+	if tok.kind == sqlQuotedIdent || (tok.kind == sqlIdent && !sqlKeywords[strings.ToUpper(tok.text)]) {
+		p.next()
+		return tok.text, nil
+	}
+	return "", nil
+}
+
+// parseTypeHint 解析可选的 ::类型
+func (p *sqlParser) parseTypeHint() (string, error) {
+	if !p.acceptSymbol("::") {
+		return "", nil
+	}
+	tok := p.peek()
+	if tok.kind != sqlIdent {
+		return "", p.errorAt(tok.pos, "此处应为类型（string/int/float/date/datetime）")
+	}
+	typeName := strings.ToLower(tok.text)
+	switch typeName {
+	case "string", "int", "float", "date", "datetime":
+	default:
+		return "", p.errorAt(tok.pos, "不支持的类型 %s（string/int/float/date/datetime）", tok.text)
+	}
+	p.next()
+	return typeName, nil
+}
+
+// parseColumnRef 解析列引用：[别名.]列名[::类型]
+func (p *sqlParser) parseColumnRef() (sqlColumnRef, error) {
+	first, pos, err := p.parseName("列名")
+	if err != nil {
+		return sqlColumnRef{}, err
+	}
+	column := sqlColumnRef{field: first, pos: pos}
+	if p.isSymbol(".") {
+		p.next()
+		// 别名后的列名可以是关键字（如 v.order）
+		tok := p.peek()
+		if tok.kind != sqlIdent && tok.kind != sqlQuotedIdent {
+			return sqlColumnRef{}, p.errorAt(tok.pos, "此处应为列名")
+		}
+		p.next()
+		column.alias, column.field = first, tok.text
+	}
+	column.typeHint, err = p.parseTypeHint()
+	return column, err
+}
+
+// parseLiteral 解析字面量：'字符串'、[-]数字、DATE '...'、DATETIME/TIMESTAMP '...'
+func (p *sqlParser) parseLiteral() (sqlLiteral, error) {
+	tok := p.peek()
+	switch {
+	case tok.kind == sqlString:
+		p.next()
+		return sqlLiteral{text: tok.text, kind: "string", pos: tok.pos}, nil
+	case tok.kind == sqlNumber || (tok.kind == sqlSymbol && tok.text == "-" && p.peekAt(1).kind == sqlNumber):
+		sign := ""
+		if tok.kind == sqlSymbol {
+			p.next()
+			sign = "-"
+		}
+		num := p.next()
+		text := sign + num.text
+		if _, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return sqlLiteral{text: text, kind: "int", pos: tok.pos}, nil
+		}
+		if _, err := strconv.ParseFloat(text, 64); err == nil {
+			return sqlLiteral{text: text, kind: "float", pos: tok.pos}, nil
+		}
+		return sqlLiteral{}, p.errorAt(num.pos, "无法识别的数字 %s", num.text)
+	case tok.kind == sqlIdent && (strings.EqualFold(tok.text, "DATE") || strings.EqualFold(tok.text, "DATETIME") || strings.EqualFold(tok.text, "TIMESTAMP")):
+		p.next()
+		str := p.peek()
+		if str.kind != sqlString {
+			return sqlLiteral{}, p.errorAt(str.pos, "%s 后应为字符串，如 %s '2024-01-01'", strings.ToUpper(tok.text), strings.ToUpper(tok.text))
+		}
+		p.next()
+		kind := "datetime"
+		if strings.EqualFold(tok.text, "DATE") {
+			kind = "date"
+		}
+		return sqlLiteral{text: str.text, kind: kind, pos: tok.pos}, nil
+	}
+	return sqlLiteral{}, p.errorAt(tok.pos, "此处应为值（字符串、数字或 DATE '...'）")
+}
+
+// isLiteralStart 当前token是否为字面量的开始
+func (p *sqlParser) isLiteralStart() bool {
+	tok := p.peek()
+	if tok.kind == sqlString || tok.kind == sqlNumber {
+		return true
+	}
+	if tok.kind == sqlSymbol && tok.text == "-" && p.peekAt(1).kind == sqlNumber {
+		return true
+	}
+	return tok.kind == sqlIdent && p.peekAt(1).kind == sqlString &&
+		(strings.EqualFold(tok.text, "DATE") || strings.EqualFold(tok.text, "DATETIME") || strings.EqualFold(tok.text, "TIMESTAMP"))
+}
+
+/**
+ * parseQuery 解析完整的查询语句
+ * @return *sqlQuery 语法树
+ * @return error 错误信息（*SQLError）
+ */
+func (p *sqlParser) parseQuery() (*sqlQuery, error) {
+	query := &sqlQuery{}
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+	for {
+		item, err := p.parseSelectItem()
+		if err != nil {
+			return nil, err
+		}
+		query.selects = append(query.selects, item)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	from, err := p.parseDataset()
+	if err != nil {
+		return nil, err
+	}
+	query.from = from
+
+	for {
+		tok := p.peek()
+		if p.isKeyword("LEFT") || p.isKeyword("RIGHT") || p.isKeyword("FULL") || p.isKeyword("CROSS") || p.isKeyword("OUTER") {
+			return nil, p.errorAt(tok.pos, "暂只支持 INNER JOIN")
+		}
+		if p.acceptKeyword("INNER") {
+			if err := p.expectKeyword("JOIN"); err != nil {
+				return nil, err
+			}
+		} else if !p.acceptKeyword("JOIN") {
+			break
+		}
+		join, err := p.parseJoin(tok.pos)
+		if err != nil {
+			return nil, err
+		}
+		query.joins = append(query.joins, join)
+	}
+
+	if p.acceptKeyword("WHERE") {
+		where, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		query.where = where
+	}
+
+	if p.acceptKeyword("GROUP") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			item, err := p.parseGroupItem()
+			if err != nil {
+				return nil, err
+			}
+			query.groupBys = append(query.groupBys, item)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+
+	if p.acceptKeyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			item, err := p.parseOrderItem()
+			if err != nil {
+				return nil, err
+			}
+			query.orderBys = append(query.orderBys, item)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+
+	if p.acceptKeyword("LIMIT") {
+		tok := p.peek()
+		limit, err := strconv.Atoi(tok.text)
+		if tok.kind != sqlNumber || err != nil || limit <= 0 {
+			return nil, p.errorAt(tok.pos, "LIMIT 后应为正整数")
+		}
+		p.next()
+		query.limit = limit
+	}
+
+	p.acceptSymbol(";")
+	if tok := p.peek(); tok.kind != sqlEOF {
+		return nil, p.errorAt(tok.pos, "无法识别的语句内容")
+	}
+	return query, nil
+}
+
+// parseSelectItem 解析SELECT中的一项
+func (p *sqlParser) parseSelectItem() (sqlSelectItem, error) {
+	tok := p.peek()
+	if p.acceptSymbol("*") {
+		return sqlSelectItem{star: true, pos: tok.pos}, nil
+	}
+	// 别名.*
+	if (tok.kind == sqlIdent || tok.kind == sqlQuotedIdent) && p.peekAt(1).kind == sqlSymbol && p.peekAt(1).text == "." &&
+		p.peekAt(2).kind == sqlSymbol && p.peekAt(2).text == "*" {
+		p.next()
+		p.next()
+		p.next()
+		return sqlSelectItem{star: true, column: &sqlColumnRef{alias: tok.text, field: "*", pos: tok.pos}, pos: tok.pos}, nil
+	}
+	item := sqlSelectItem{pos: tok.pos}
+	startIdx := p.i
+	if tok.kind == sqlIdent && sqlAggregateFuncs[strings.ToUpper(tok.text)] && p.peekAt(1).kind == sqlSymbol && p.peekAt(1).text == "(" {
+		column, aggregate, err := p.parseAggregateCall()
+		if err != nil {
+			return item, err
+		}
+		item.column, item.aggregate = column, aggregate
+	} else if sqlBucketFuncs[strings.ToUpper(tok.text)] != "" && tok.kind == sqlIdent && p.peekAt(1).text == "(" {
+		group, err := p.parseGroupItem()
+		if err != nil {
+			return item, err
+		}
+		item.column, item.bucket = &group.column, group.bucket
+	} else if tok.kind == sqlQuotedIdent || (tok.kind == sqlIdent && p.peekAt(1).text != "(") {
+		column, err := p.parseColumnRef()
+		if err != nil {
+			return item, err
+		}
+		item.column = &column
+	}
+	// 其余情况（字面量、函数、带运算的列）按表达式解析
+	if item.aggregate == "" && (item.column == nil || p.isArithmeticSymbol()) {
+		p.i = startIdx
+		expr, err := p.parseExpression()
+		if err != nil {
+			return item, err
+		}
+		item.column, item.bucket, item.expr = nil, "", expr
+	}
+	alias, err := p.parseAlias()
+	item.alias = alias
+	if err == nil && item.expr != nil && alias == "" {
+		return item, p.errorAt(item.pos, "表达式需要别名（表达式 AS 别名）")
+	}
+	return item, err
+}
+
+// isArithmeticSymbol 当前token是否为四则运算符号
+func (p *sqlParser) isArithmeticSymbol() bool {
+	return p.isSymbol("+") || p.isSymbol("-") || p.isSymbol("*") || p.isSymbol("/") || p.isSymbol("%")
+}
+
+// parseAggregateCall 解析聚合函数调用：COUNT(*)、SUM(列) 等
+func (p *sqlParser) parseAggregateCall() (*sqlColumnRef, string, error) {
+	fn := p.next()
+	aggregate := strings.ToLower(fn.text)
+	p.next() // (
+	var column *sqlColumnRef
+	if p.isSymbol("*") {
+		if aggregate != "count" {
+			return nil, "", p.errorAt(p.peek().pos, "只有 COUNT 支持 *")
+		}
+		p.next()
+	} else {
+		ref, err := p.parseColumnRef()
+		if err != nil {
+			return nil, "", err
+		}
+		column = &ref
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, "", err
+	}
+	return column, aggregate, nil
+}
+
+// parseDataset 解析数据集：绑定名/CID [AS 别名]
+func (p *sqlParser) parseDataset() (sqlDataset, error) {
+	tok := p.peek()
+	dataset := sqlDataset{pos: tok.pos}
+	switch {
+	case tok.kind == sqlString || tok.kind == sqlQuotedIdent:
+		p.next()
+		dataset.name = tok.text
+	case tok.kind == sqlIdent && !sqlKeywords[strings.ToUpper(tok.text)]:
+		p.next()
+		dataset.name = tok.text
+	default:
+		return dataset, p.errorAt(tok.pos, "此处应为数据集（绑定名或CID）")
+	}
+	alias, err := p.parseAlias()
+	if err != nil {
+		return dataset, err
+	}
+	dataset.alias = alias
+	if dataset.alias == "" {
+		dataset.alias = dataset.name
+	}
+	return dataset, nil
+}
+
+// parseJoin 解析 JOIN 数据集 ON 列 比较符 列 [AND 列 比较符 列 ...]
+func (p *sqlParser) parseJoin(pos int) (sqlJoin, error) {
+	join := sqlJoin{pos: pos}
+	dataset, err := p.parseDataset()
+	if err != nil {
+		return join, err
+	}
+	join.dataset = dataset
+	if err := p.expectKeyword("ON"); err != nil {
+		return join, err
+	}
+	for {
+		condition := sqlJoinCondition{pos: p.peek().pos}
+		condition.left, err = p.parseColumnRef()
+		if err != nil {
+			return join, err
+		}
+		tok := p.peek()
+		compare, ok := sqlCompareOps[tok.text]
+		if tok.kind != sqlSymbol || !ok {
+			return join, p.errorAt(tok.pos, "此处应为比较运算符（=、!=、<、>、<=、>=）")
+		}
+		p.next()
+		condition.compare = compare
+		condition.right, err = p.parseColumnRef()
+		if err != nil {
+			return join, err
+		}
+		join.conditions = append(join.conditions, condition)
+		if !p.acceptKeyword("AND") {
+			break
+		}
+	}
+	if p.isKeyword("OR") {
+		return join, p.errorAt(p.peek().pos, "ON 中的联表条件只能用 AND 连接")
+	}
+	return join, nil
+}
+
+// parseOr 解析 OR 表达式
+func (p *sqlParser) parseOr() (*sqlExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("OR") {
+		pos := p.next().pos
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlExpr{op: "or", left: left, right: right, pos: pos}
+	}
+	return left, nil
+}
+
+// parseAnd 解析 AND 表达式
+func (p *sqlParser) parseAnd() (*sqlExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("AND") {
+		pos := p.next().pos
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &sqlExpr{op: "and", left: left, right: right, pos: pos}
+	}
+	return left, nil
+}
+
+// parseNot 解析 NOT 表达式、括号和单个条件
+func (p *sqlParser) parseNot() (*sqlExpr, error) {
+	tok := p.peek()
+	if p.acceptKeyword("NOT") {
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlExpr{op: "not", left: inner, pos: tok.pos}, nil
+	}
+	if p.acceptSymbol("(") {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	}
+	pred, err := p.parsePredicate()
+	if err != nil {
+		return nil, err
+	}
+	return &sqlExpr{op: "pred", pred: pred, pos: pred.pos}, nil
+}
+
+// parsePredicate 解析单个条件
+func (p *sqlParser) parsePredicate() (*sqlPredicate, error) {
+	start := p.peek().pos
+	// 字面量在左侧：3 < p.age
+	if p.isLiteralStart() {
+		literal, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		tok := p.peek()
+		compare, ok := sqlCompareOps[tok.text]
+		if tok.kind != sqlSymbol || !ok {
+			return nil, p.errorAt(tok.pos, "此处应为比较运算符（=、!=、<、>、<=、>=）")
+		}
+		p.next()
+		column, err := p.parseColumnRef()
+		if err != nil {
+			return nil, err
+		}
+		return &sqlPredicate{column: column, compare: sqlFlippedCompare[compare], vals: []sqlLiteral{literal}, pos: start}, nil
+	}
+
+	column, err := p.parseColumnRef()
+	if err != nil {
+		return nil, err
+	}
+	pred := &sqlPredicate{column: column, pos: start}
+	tok := p.peek()
+
+	// 比较运算符
+	if compare, ok := sqlCompareOps[tok.text]; ok && tok.kind == sqlSymbol {
+		p.next()
+		literal, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		pred.compare, pred.vals = compare, []sqlLiteral{literal}
+		return pred, nil
+	}
+	// ~ 正则
+	if p.acceptSymbol("~") {
+		literal, err := p.parseStringLiteral()
+		if err != nil {
+			return nil, err
+		}
+		pred.compare, pred.vals = "regexp", []sqlLiteral{literal}
+		return pred, nil
+	}
+	// IS [NOT] NULL
+	if p.acceptKeyword("IS") {
+		pred.compare = "isnull"
+		if p.acceptKeyword("NOT") {
+			pred.compare = "notnull"
+		}
+		if err := p.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+		return pred, nil
+	}
+
+	negated := false
+	notTok := p.peek()
+	if p.acceptKeyword("NOT") {
+		negated = true
+	}
+	opTok := p.peek()
+	switch {
+	case p.acceptKeyword("IN"):
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		for {
+			literal, err := p.parseLiteral()
+			if err != nil {
+				return nil, err
+			}
+			pred.vals = append(pred.vals, literal)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		pred.compare = "in"
+		if negated {
+			pred.compare = "notin"
+		}
+		return pred, nil
+	case p.acceptKeyword("BETWEEN"):
+		if negated {
+			return nil, p.errorAt(notTok.pos, "暂不支持 NOT BETWEEN，请改写为 < OR >")
+		}
+		low, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("AND"); err != nil {
+			return nil, err
+		}
+		high, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		pred.compare, pred.vals = "between", []sqlLiteral{low, high}
+		return pred, nil
+	case p.acceptKeyword("LIKE"), p.acceptKeyword("ILIKE"):
+		literal, err := p.parseStringLiteral()
+		if err != nil {
+			return nil, err
+		}
+		compare, val := likeToCompare(literal.text, strings.EqualFold(opTok.text, "ILIKE"))
+		if negated {
+			negatedCompare, ok := sqlNegatedCompare[compare]
+			if !ok {
+				return nil, p.errorAt(notTok.pos, "NOT %s 只支持 '%%文本%%' 形式或不含通配符的模式", strings.ToUpper(opTok.text))
+			}
+			compare = negatedCompare
+		}
+		literal.text = val
+		pred.compare, pred.vals = compare, []sqlLiteral{literal}
+		return pred, nil
+	case p.acceptKeyword("REGEXP"):
+		if negated {
+			return nil, p.errorAt(notTok.pos, "暂不支持 NOT REGEXP")
+		}
+		literal, err := p.parseStringLiteral()
+		if err != nil {
+			return nil, err
+		}
+		pred.compare, pred.vals = "regexp", []sqlLiteral{literal}
+		return pred, nil
+	}
+	return nil, p.errorAt(opTok.pos, "此处应为比较运算符、IN、BETWEEN、IS NULL、LIKE 或 REGEXP")
+}
+
+// parseStringLiteral 解析字符串字面量
+func (p *sqlParser) parseStringLiteral() (sqlLiteral, error) {
+	tok := p.peek()
+	if tok.kind != sqlString {
+		return sqlLiteral{}, p.errorAt(tok.pos, "此处应为字符串")
+	}
+	p.next()
+	return sqlLiteral{text: tok.text, kind: "string", pos: tok.pos}, nil
+}
+
+// parseGroupItem 解析GROUP BY中的一项：列 或 日期分桶函数(列)
+func (p *sqlParser) parseGroupItem() (sqlGroupItem, error) {
+	tok := p.peek()
+	if bucket, ok := sqlBucketFuncs[strings.ToUpper(tok.text)]; ok && tok.kind == sqlIdent && p.peekAt(1).text == "(" {
+		p.next()
+		p.next()
+		column, err := p.parseColumnRef()
+		if err != nil {
+			return sqlGroupItem{}, err
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return sqlGroupItem{}, err
+		}
+		return sqlGroupItem{column: column, bucket: bucket}, nil
+	}
+	column, err := p.parseColumnRef()
+	return sqlGroupItem{column: column}, err
+}
+
+// parseOrderItem 解析ORDER BY中的一项：列/别名/聚合函数/日期分桶函数 [ASC|DESC]
+func (p *sqlParser) parseOrderItem() (sqlOrderItem, error) {
+	tok := p.peek()
+	item := sqlOrderItem{pos: tok.pos}
+	switch {
+	case tok.kind == sqlIdent && sqlAggregateFuncs[strings.ToUpper(tok.text)] && p.peekAt(1).text == "(":
+		column, aggregate, err := p.parseAggregateCall()
+		if err != nil {
+			return item, err
+		}
+		item.column, item.aggregate = column, aggregate
+	case tok.kind == sqlIdent && sqlBucketFuncs[strings.ToUpper(tok.text)] != "" && p.peekAt(1).text == "(":
+		group, err := p.parseGroupItem()
+		if err != nil {
+			return item, err
+		}
+		item.column, item.bucket = &group.column, group.bucket
+	default:
+		column, err := p.parseColumnRef()
+		if err != nil {
+			return item, err
+		}
+		item.column = &column
+	}
+	if p.acceptKeyword("DESC") {
+		item.desc = true
+	} else {
+		p.acceptKeyword("ASC")
+	}
+	return item, nil
+}
+
+/**
+ * likeToCompare 将LIKE模式转换为比较符：'%x%'为contain，'x%'为prefix，'%x'为suffix，无通配符为eq，其余转为正则
+ * @param pattern LIKE模式（%匹配任意字符串，_匹配单个字符）
+ * @param ignoreCase 是否不区分大小写（ILIKE）
+ * @return string 比较符
+ * @return string 基准值
+ */
+func likeToCompare(pattern string, ignoreCase bool) (string, string) {
+	inner := strings.TrimSuffix(strings.TrimPrefix(pattern, "%"), "%")
+	if !strings.ContainsAny(inner, "%_") {
+		hasPrefix, hasSuffix := strings.HasPrefix(pattern, "%"), strings.HasSuffix(pattern, "%") && len(pattern) > 1
+		switch {
+		case ignoreCase && !hasPrefix && !hasSuffix:
+			return "ieq", inner
+		case ignoreCase && hasPrefix && hasSuffix:
+			return "icontain", inner
+		case ignoreCase:
+			// 不区分大小写的前缀/后缀用正则
+		case hasPrefix && hasSuffix:
+			return "contain", inner
+		case hasSuffix:
+			return "prefix", inner
+		case hasPrefix:
+			return "suffix", inner
+		default:
+			return "eq", inner
+		}
+	}
+	var sb strings.Builder
+	if ignoreCase {
+		sb.WriteString("(?i)")
+	}
+	sb.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			sb.WriteString(".*")
+		case '_':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return "regexp", sb.String()
+}
+
+// ======================编译为QueryItem======================
+
+// sqlCompiler 编译上下文
+type sqlCompiler struct {
+	parser        *sqlParser
+	datasets      map[string][]string // 绑定名 -> 分片CID数组
+	aliases       map[string]string   // 别名 -> 数据集主CID（pos）
+	order         []string            // 数据集主CID，按FROM/JOIN顺序
+	types         map[string]string   // pos_field -> 类型（显式类型或由字面量推断）
+	computed      map[string]string   // 计算列（SELECT 表达式 AS 别名）别名 -> 所属数据集主CID
+	computedTypes map[string]string   // pos_别名 -> 表达式结果类型
+	isMulti       bool
+}
+
+/**
+ * CompileSQL 将SQL语句编译为查询项
+ * @param sql SQL语句
+ * @param datasets 数据集绑定：名称 -> 分片CID数组（FROM/JOIN中的名称），可为空
+ * @return QueryItem 查询项
+ * @return error 错误信息（语法或语义错误为*SQLError，携带出错位置）
+ */
+func CompileSQL(sql string, datasets map[string][]string) (QueryItem, error) {
+	src := []rune(sql)
+	tokens, err := tokenizeSQL(src)
+	if err != nil {
+		return QueryItem{}, err
+	}
+	parser := &sqlParser{src: src, tokens: tokens}
+	query, err := parser.parseQuery()
+	if err != nil {
+		return QueryItem{}, err
+	}
+	compiler := &sqlCompiler{
+		parser:        parser,
+		datasets:      datasets,
+		aliases:       make(map[string]string),
+		types:         make(map[string]string),
+		computed:      make(map[string]string),
+		computedTypes: make(map[string]string),
+		isMulti:       len(query.joins) > 0,
+	}
+	return compiler.compile(query)
+}
+
+// compile 编译语法树
+func (c *sqlCompiler) compile(query *sqlQuery) (QueryItem, error) {
+	queryItem := QueryItem{QueryConcatType: "single", Limit: query.limit}
+	if c.isMulti {
+		queryItem.QueryConcatType = "multi"
+	}
+
+	// 数据集
+	for _, dataset := range append([]sqlDataset{query.from}, joinDatasets(query.joins)...) {
+		shards, err := c.resolveDataset(dataset)
+		if err != nil {
+			return queryItem, err
+		}
+		queryItem.FilePos = append(queryItem.FilePos, shards)
+	}
+
+	// SELECT中的表达式编译为计算列（WHERE、GROUP BY、ORDER BY中可以用别名引用）
+	for _, item := range query.selects {
+		if item.expr == nil {
+			continue
+		}
+		computedColumn, err := c.compileComputedColumn(item)
+		if err != nil {
+			return queryItem, err
+		}
+		queryItem.ComputedColumns = append(queryItem.ComputedColumns, computedColumn)
+	}
+
+	// 先收集列类型：显式类型优先，其次为计算列表达式的类型，再次为WHERE中比较的字面量类型
+	if err := c.collectTypes(query); err != nil {
+		return queryItem, err
+	}
+
+	// 联表条件
+	for _, join := range query.joins {
+		for _, condition := range join.conditions {
+			jointCondition, err := c.compileJoin(condition)
+			if err != nil {
+				return queryItem, err
+			}
+			queryItem.JointConditions = append(queryItem.JointConditions, jointCondition)
+		}
+	}
+
+	// WHERE
+	if query.where != nil {
+		groups, err := c.toConditionGroups(query.where, false)
+		if err != nil {
+			return queryItem, err
+		}
+		queryItem.QueryConditions = groups
+	}
+
+	// GROUP BY
+	groupedKeys := make(map[string]bool)
+	for _, group := range query.groupBys {
+		pos, err := c.resolveColumn(group.column)
+		if err != nil {
+			return queryItem, err
+		}
+		cellType := c.columnType(pos, group.column, "string")
+		if group.bucket != "" {
+			cellType = c.columnType(pos, group.column, "date")
+			if !isDateType(cellType) {
+				return queryItem, c.parser.errorAt(group.column.pos, "%s() 只能用于date/datetime列", strings.ToUpper(group.bucket))
+			}
+		}
+		queryItem.GroupBy = append(queryItem.GroupBy, GroupByItem{Pos: pos, Field: group.column.field, Type: cellType, Bucket: group.bucket})
+		groupedKeys[pos+"_"+group.column.field] = true
+	}
+
+	// SELECT
+	aggregating := len(query.groupBys) > 0
+	for _, item := range query.selects {
+		if item.aggregate != "" {
+			aggregating = true
+		}
+	}
+	for _, item := range query.selects {
+		switch {
+		case item.star && item.column == nil:
+			if aggregating {
+				return queryItem, c.parser.errorAt(item.pos, "分组聚合查询不能 SELECT *")
+			}
+			for _, pos := range c.order {
+				queryItem.ReturnField = append(queryItem.ReturnField, pos+"_*")
+			}
+		case item.star:
+			pos, ok := c.aliases[item.column.alias]
+			if !ok {
+				return queryItem, c.parser.errorAt(item.pos, "数据集别名 %s 不存在", item.column.alias)
+			}
+			if aggregating {
+				return queryItem, c.parser.errorAt(item.pos, "分组聚合查询不能 SELECT %s.*", item.column.alias)
+			}
+			queryItem.ReturnField = append(queryItem.ReturnField, pos+"_*")
+		case item.aggregate != "":
+			aggregate, err := c.compileAggregate(item.aggregate, item.column, item.alias)
+			if err != nil {
+				return queryItem, err
+			}
+			queryItem.Aggregates = append(queryItem.Aggregates, aggregate)
+		case item.expr != nil:
+			key := c.computed[item.alias] + "_" + item.alias
+			if aggregating && !groupedKeys[key] {
+				return queryItem, c.parser.errorAt(item.pos, "表达式 %s 不在 GROUP BY 中", item.alias)
+			}
+			if !aggregating {
+				queryItem.ReturnField = append(queryItem.ReturnField, key)
+			}
+		default:
+			pos, err := c.resolveColumn(*item.column)
+			if err != nil {
+				return queryItem, err
+			}
+			if item.alias != "" {
+				return queryItem, c.parser.errorAt(item.pos, "暂不支持普通列的别名（AS %s）", item.alias)
+			}
+			key := pos + "_" + item.column.field
+			if aggregating && !groupedKeys[key] {
+				return queryItem, c.parser.errorAt(item.pos, "列 %s 不在 GROUP BY 中", item.column.field)
+			}
+			if item.bucket != "" && !aggregating {
+				return queryItem, c.parser.errorAt(item.pos, "%s() 只能在分组查询中使用", strings.ToUpper(item.bucket))
+			}
+			if !aggregating {
+				queryItem.ReturnField = append(queryItem.ReturnField, key)
+			}
+		}
+	}
+
+	// ORDER BY
+	for _, item := range query.orderBys {
+		orderBy, err := c.compileOrderBy(item, queryItem, aggregating)
+		if err != nil {
+			return queryItem, err
+		}
+		queryItem.OrderBy = append(queryItem.OrderBy, orderBy)
+	}
+	return queryItem, nil
+}
+
+// joinDatasets JOIN中的数据集
+func joinDatasets(joins []sqlJoin) []sqlDataset {
+	datasets := make([]sqlDataset, 0, len(joins))
+	for _, join := range joins {
+		datasets = append(datasets, join.dataset)
+	}
+	return datasets
+}
+
+// resolveDataset 将数据集名称解析为分片CID数组，并登记别名
+func (c *sqlCompiler) resolveDataset(dataset sqlDataset) ([]string, error) {
+	shards, ok := c.datasets[dataset.name]
+	if !ok {
+		// 未绑定的名称视为单个CID
+		shards = []string{dataset.name}
+	}
+	if len(shards) == 0 || shards[0] == "" {
+		return nil, c.parser.errorAt(dataset.pos, "数据集 %s 没有分片", dataset.name)
+	}
+	if _, exists := c.aliases[dataset.alias]; exists {
+		return nil, c.parser.errorAt(dataset.pos, "数据集别名 %s 重复", dataset.alias)
+	}
+	for _, pos := range c.order {
+		if pos == shards[0] {
+			return nil, c.parser.errorAt(dataset.pos, "数据集 %s 重复出现，暂不支持自联表", dataset.name)
+		}
+	}
+	c.aliases[dataset.alias] = shards[0]
+	c.order = append(c.order, shards[0])
+	return shards, nil
+}
+
+// resolveColumn 将列引用解析为数据集主CID
+func (c *sqlCompiler) resolveColumn(column sqlColumnRef) (string, error) {
+	if column.alias == "" {
+		if pos, ok := c.computed[column.field]; ok {
+			return pos, nil
+		}
+		if len(c.order) == 1 {
+			return c.order[0], nil
+		}
+		return "", c.parser.errorAt(column.pos, "联表查询中列 %s 需要写明数据集别名，如 别名.%s", column.field, column.field)
+	}
+	pos, ok := c.aliases[column.alias]
+	if !ok {
+		return "", c.parser.errorAt(column.pos, "数据集别名 %s 不存在", column.alias)
+	}
+	return pos, nil
+}
+
+// compileComputedColumn 将 SELECT 表达式 AS 别名 编译为计算列（列引用改为数据集主CID）
+func (c *sqlCompiler) compileComputedColumn(item sqlSelectItem) (ComputedColumn, error) {
+	if _, ok := c.computed[item.alias]; ok {
+		return ComputedColumn{}, c.parser.errorAt(item.pos, "表达式别名 %s 重复", item.alias)
+	}
+	var err error
+	item.expr.walk(func(node *exprNode) {
+		if node.kind != "column" || err != nil {
+			return
+		}
+		node.pos, err = c.resolveColumn(sqlColumnRef{alias: node.pos, field: node.field, pos: node.offset})
+	})
+	if err != nil {
+		return ComputedColumn{}, err
+	}
+	pos := c.order[0]
+	c.computed[item.alias] = pos
+	c.computedTypes[pos+"_"+item.alias] = item.expr.resultType()
+	return ComputedColumn{Alias: item.alias, Expr: item.expr.String(), Pos: pos}, nil
+}
+
+// columnType 列类型：显式类型 > 已收集的类型 > 默认类型
+func (c *sqlCompiler) columnType(pos string, column sqlColumnRef, defaultType string) string {
+	if column.typeHint != "" {
+		return column.typeHint
+	}
+	if cellType, ok := c.types[pos+"_"+column.field]; ok {
+		return cellType
+	}
+	return defaultType
+}
+
+// collectTypes 收集所有列的显式类型和WHERE中字面量推断的类型
+func (c *sqlCompiler) collectTypes(query *sqlQuery) error {
+	refs := make([]sqlColumnRef, 0)
+	for _, item := range query.selects {
+		if item.column != nil && !item.star {
+			refs = append(refs, *item.column)
+		}
+	}
+	for _, join := range query.joins {
+		for _, condition := range join.conditions {
+			refs = append(refs, condition.left, condition.right)
+		}
+	}
+	for _, group := range query.groupBys {
+		refs = append(refs, group.column)
+	}
+	for _, item := range query.orderBys {
+		if item.column != nil {
+			refs = append(refs, *item.column)
+		}
+	}
+	preds := make([]*sqlPredicate, 0)
+	collectPredicates(query.where, &preds)
+	for _, pred := range preds {
+		refs = append(refs, pred.column)
+	}
+
+	// 显式类型
+	for _, ref := range refs {
+		if ref.typeHint == "" || (ref.alias != "" && c.aliases[ref.alias] == "") {
+			continue
+		}
+		pos, err := c.resolveColumn(ref)
+		if err != nil {
+			continue
+		}
+		key := pos + "_" + ref.field
+		if existing, ok := c.types[key]; ok && existing != ref.typeHint {
+			return c.parser.errorAt(ref.pos, "列 %s 的类型前后不一致（%s 与 %s）", ref.field, existing, ref.typeHint)
+		}
+		c.types[key] = ref.typeHint
+	}
+	// 计算列表达式的类型
+	for key, cellType := range c.computedTypes {
+		if _, ok := c.types[key]; !ok && cellType != "" {
+			c.types[key] = cellType
+		}
+	}
+	// 字面量推断
+	for _, pred := range preds {
+		if len(pred.vals) == 0 || pred.column.typeHint != "" {
+			continue
+		}
+		pos, err := c.resolveColumn(pred.column)
+		if err != nil {
+			continue
+		}
+		key := pos + "_" + pred.column.field
+		if _, ok := c.types[key]; !ok {
+			c.types[key] = literalsType(pred.vals)
+		}
+	}
+	return nil
+}
+
+// collectPredicates 收集表达式树中的所有条件
+func collectPredicates(expr *sqlExpr, preds *[]*sqlPredicate) {
+	if expr == nil {
+		return
+	}
+	if expr.op == "pred" {
+		*preds = append(*preds, expr.pred)
+		return
+	}
+	collectPredicates(expr.left, preds)
+	collectPredicates(expr.right, preds)
+}
+
+// literalsType 由字面量推断类型：整数与小数混合时为float
+func literalsType(literals []sqlLiteral) string {
+	cellType := literals[0].kind
+	for _, literal := range literals[1:] {
+		if literal.kind != cellType {
+			if (literal.kind == "int" || literal.kind == "float") && (cellType == "int" || cellType == "float") {
+				cellType = "float"
+			} else {
+				return "string"
+			}
+		}
+	}
+	return cellType
+}
+
+// compileJoin 编译联表条件
+func (c *sqlCompiler) compileJoin(join sqlJoinCondition) (JointCondition, error) {
+	pos1, err := c.resolveColumn(join.left)
+	if err != nil {
+		return JointCondition{}, err
+	}
+	pos2, err := c.resolveColumn(join.right)
+	if err != nil {
+		return JointCondition{}, err
+	}
+	if pos1 == pos2 {
+		return JointCondition{}, c.parser.errorAt(join.right.pos, "联表条件两侧必须是不同的数据集")
+	}
+	type1 := c.columnType(pos1, join.left, "")
+	type2 := c.columnType(pos2, join.right, "")
+	if type1 != "" && type2 != "" && type1 != type2 {
+		return JointCondition{}, c.parser.errorAt(join.pos, "联表条件两侧的类型不一致（%s 与 %s）", type1, type2)
+	}
+	cellType := type1
+	if cellType == "" {
+		cellType = type2
+	}
+	if cellType == "" {
+		cellType = "string"
+	}
+	return JointCondition{
+		Pos1:      pos1,
+		Field1:    join.left.field,
+		Pos2:      pos2,
+		Field2:    join.right.field,
+		Compare:   join.compare,
+		Type:      cellType,
+		JointType: "INNER",
+	}, nil
+}
+
+/**
+ * toConditionGroups 将WHERE表达式展开为查询条件组（析取范式：组间OR，组内AND）
+ * @param expr 表达式
+ * @param negate 是否取反（NOT）
+ * @return [][]QueryCondition 查询条件组
+ * @return error 错误信息
+ */
+func (c *sqlCompiler) toConditionGroups(expr *sqlExpr, negate bool) ([][]QueryCondition, error) {
+	switch expr.op {
+	case "not":
+		return c.toConditionGroups(expr.left, !negate)
+	case "pred":
+		condition, err := c.compilePredicate(expr.pred, negate)
+		if err != nil {
+			return nil, err
+		}
+		return [][]QueryCondition{{condition}}, nil
+	}
+	left, err := c.toConditionGroups(expr.left, negate)
+	if err != nil {
+		return nil, err
+	}
+	right, err := c.toConditionGroups(expr.right, negate)
+	if err != nil {
+		return nil, err
+	}
+	// NOT (a AND b) = NOT a OR NOT b；NOT (a OR b) = NOT a AND NOT b
+	isOr := (expr.op == "or") != negate
+	if isOr {
+		return append(left, right...), nil
+	}
+	// AND：两侧条件组两两组合
+	if len(left)*len(right) > sqlMaxConditionGroups {
+		return nil, c.parser.errorAt(expr.pos, "WHERE 条件展开后超过 %d 组，请简化 AND/OR 嵌套", sqlMaxConditionGroups)
+	}
+	groups := make([][]QueryCondition, 0, len(left)*len(right))
+	for _, l := range left {
+		for _, r := range right {
+			group := make([]QueryCondition, 0, len(l)+len(r))
+			group = append(append(group, l...), r...)
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
+
+// compilePredicate 编译单个条件
+func (c *sqlCompiler) compilePredicate(pred *sqlPredicate, negate bool) (QueryCondition, error) {
+	pos, err := c.resolveColumn(pred.column)
+	if err != nil {
+		return QueryCondition{}, err
+	}
+	compare := pred.compare
+	if negate {
+		negatedCompare, ok := sqlNegatedCompare[compare]
+		if !ok {
+			return QueryCondition{}, c.parser.errorAt(pred.pos, "NOT 暂不支持该条件（%s），请改写", compare)
+		}
+		compare = negatedCompare
+	}
+	defaultType := "string"
+	if len(pred.vals) > 0 {
+		defaultType = literalsType(pred.vals)
+	}
+	cellType := c.columnType(pos, pred.column, defaultType)
+
+	condition := QueryCondition{Field: pred.column.field, Pos: pos, Compare: compare, Type: cellType}
+	switch compare {
+	case "isnull", "notnull":
+	case "in", "notin", "between":
+		vals := make([]string, len(pred.vals))
+		for i, literal := range pred.vals {
+			vals[i] = literal.text
+		}
+		valBytes, _ := json.Marshal(vals)
+		condition.Val = string(valBytes)
+	default:
+		condition.Val = pred.vals[0].text
+	}
+	if cellType != "string" {
+		switch compare {
+		case "regexp", "contain", "notcontain", "icontain", "ieq", "prefix", "suffix":
+			return condition, c.parser.errorAt(pred.pos, "LIKE/REGEXP 只能用于string列，列 %s 的类型为 %s", pred.column.field, cellType)
+		}
+	}
+	return condition, nil
+}
+
+// compileAggregate 编译聚合函数
+func (c *sqlCompiler) compileAggregate(fn string, column *sqlColumnRef, alias string) (AggregateItem, error) {
+	aggregate := AggregateItem{Func: fn, Alias: alias}
+	if column == nil {
+		return aggregate, nil
+	}
+	pos, err := c.resolveColumn(*column)
+	if err != nil {
+		return aggregate, err
+	}
+	aggregate.Pos, aggregate.Field = pos, column.field
+	switch fn {
+	case "sum", "avg":
+		aggregate.Type = c.columnType(pos, *column, "float")
+		if aggregate.Type != "int" && aggregate.Type != "float" {
+			return aggregate, c.parser.errorAt(column.pos, "%s 只能用于int/float列，列 %s 的类型为 %s", strings.ToUpper(fn), column.field, aggregate.Type)
+		}
+	case "min", "max":
+		aggregate.Type = c.columnType(pos, *column, "string")
+	default:
+		aggregate.Type = c.columnType(pos, *column, "string")
+	}
+	return aggregate, nil
+}
+
+// compileOrderBy 编译排序项：聚合函数/结果别名按聚合结果排序，其余按列排序
+func (c *sqlCompiler) compileOrderBy(item sqlOrderItem, queryItem QueryItem, aggregating bool) (OrderByItem, error) {
+	orderBy := OrderByItem{Desc: item.desc}
+
+	// 按聚合函数排序：需与SELECT中的聚合函数一致
+	if item.aggregate != "" {
+		target, err := c.compileAggregate(item.aggregate, item.column, "")
+		if err != nil {
+			return orderBy, err
+		}
+		for _, aggregate := range queryItem.Aggregates {
+			if aggregate.Func == target.Func && aggregate.Pos == target.Pos && aggregate.Field == target.Field {
+				orderBy.Field, orderBy.Type = aggregateAlias(aggregate, c.isMulti), aggregateResultType(aggregate)
+				return orderBy, nil
+			}
+		}
+		return orderBy, c.parser.errorAt(item.pos, "ORDER BY 中的聚合函数需出现在 SELECT 中")
+	}
+
+	column := *item.column
+	// 按聚合结果别名排序
+	if column.alias == "" {
+		for _, aggregate := range queryItem.Aggregates {
+			if aggregate.Alias != "" && aggregate.Alias == column.field {
+				orderBy.Field, orderBy.Type = aggregate.Alias, aggregateResultType(aggregate)
+				return orderBy, nil
+			}
+		}
+	}
+
+	pos, err := c.resolveColumn(column)
+	if err != nil {
+		return orderBy, err
+	}
+	orderBy.Pos, orderBy.Field = pos, column.field
+	orderBy.Type = c.columnType(pos, column, "string")
+	if aggregating {
+		found := false
+		for _, group := range queryItem.GroupBy {
+			if group.Pos == pos && group.Field == column.field {
+				found = true
+				// 分桶后的值（如 2024-03、2024-Q1）按字符串排序
+				if group.Bucket != "" {
+					orderBy.Type = "string"
+				}
+			}
+		}
+		if !found {
+			return orderBy, c.parser.errorAt(item.pos, "分组聚合查询只能按分组列或聚合结果排序")
+		}
+	} else if item.bucket != "" {
+		return orderBy, c.parser.errorAt(item.pos, "%s() 只能在分组查询中用于排序", strings.ToUpper(item.bucket))
+	}
+	return orderBy, nil
+}
+
+// aggregateResultType 聚合结果的类型（用于排序）
+func aggregateResultType(aggregate AggregateItem) string {
+	switch aggregate.Func {
+	case "count":
+		return "int"
+	case "avg":
+		return "float"
+	default:
+		return aggregate.Type
+	}
+}
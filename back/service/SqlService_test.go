@@ -0,0 +1,169 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"chainqa_offchain_demo/setting"
+)
+
+// 测试用的数据集绑定
+var testSQLDatasets = map[string][]string{"patients": {"P1", "P2"}, "visits": {"V1"}}
+
+func TestCompileSQLConditions(t *testing.T) {
+	cases := []struct {
+		name string
+		sql  string
+		want [][]QueryCondition
+	}{
+		{
+			"整数比较",
+			"SELECT * FROM patients WHERE age > 30",
+			[][]QueryCondition{{{Field: "age", Val: "30", Pos: "P1", Compare: "gt", Type: "int"}}},
+		},
+		{
+			"字面量在左侧时翻转比较符",
+			"SELECT * FROM patients WHERE 3 < age",
+			[][]QueryCondition{{{Field: "age", Val: "3", Pos: "P1", Compare: "gt", Type: "int"}}},
+		},
+		{
+			"OR展开为条件组",
+			"SELECT * FROM patients WHERE age BETWEEN 18 AND 30 AND (gender = 'F' OR name IS NULL)",
+			[][]QueryCondition{
+				{
+					{Field: "age", Val: `["18","30"]`, Pos: "P1", Compare: "between", Type: "int"},
+					{Field: "gender", Val: "F", Pos: "P1", Compare: "eq", Type: "string"},
+				},
+				{
+					{Field: "age", Val: `["18","30"]`, Pos: "P1", Compare: "between", Type: "int"},
+					{Field: "name", Val: "", Pos: "P1", Compare: "isnull", Type: "string"},
+				},
+			},
+		},
+		{
+			"NOT IN",
+			"SELECT * FROM patients WHERE NOT age IN (1, 2)",
+			[][]QueryCondition{{{Field: "age", Val: `["1","2"]`, Pos: "P1", Compare: "notin", Type: "int"}}},
+		},
+		{
+			"没有WHERE",
+			"SELECT * FROM patients",
+			nil,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			queryItem, err := CompileSQL(tc.sql, testSQLDatasets)
+			if err != nil {
+				t.Fatalf("CompileSQL 失败: %v", err)
+			}
+			if !reflect.DeepEqual(queryItem.QueryConditions, tc.want) {
+				t.Errorf("queryConditions = %+v，期望 %+v", queryItem.QueryConditions, tc.want)
+			}
+			if !reflect.DeepEqual(queryItem.FilePos, [][]string{{"P1", "P2"}}) {
+				t.Errorf("filePos = %v", queryItem.FilePos)
+			}
+		})
+	}
+}
+
+func TestCompileSQLJoin(t *testing.T) {
+	queryItem, err := CompileSQL("SELECT p.name, v.cost FROM patients p JOIN visits v ON p.id = v.pid WHERE v.cost >= 1.5 ORDER BY v.cost DESC LIMIT 10", testSQLDatasets)
+	if err != nil {
+		t.Fatalf("CompileSQL 失败: %v", err)
+	}
+	if queryItem.QueryConcatType != "multi" || queryItem.Limit != 10 {
+		t.Errorf("queryConcatType = %s, limit = %d", queryItem.QueryConcatType, queryItem.Limit)
+	}
+	if want := [][]string{{"P1", "P2"}, {"V1"}}; !reflect.DeepEqual(queryItem.FilePos, want) {
+		t.Errorf("filePos = %v，期望 %v", queryItem.FilePos, want)
+	}
+	if want := []string{"P1_name", "V1_cost"}; !reflect.DeepEqual(queryItem.ReturnField, want) {
+		t.Errorf("returnField = %v，期望 %v", queryItem.ReturnField, want)
+	}
+	wantJoin := []JointCondition{{Pos1: "P1", Field1: "id", Pos2: "V1", Field2: "pid", Compare: "eq", Type: "string", JointType: "INNER"}}
+	if !reflect.DeepEqual(queryItem.JointConditions, wantJoin) {
+		t.Errorf("jointConditions = %+v，期望 %+v", queryItem.JointConditions, wantJoin)
+	}
+	wantCondition := [][]QueryCondition{{{Field: "cost", Val: "1.5", Pos: "V1", Compare: "ge", Type: "float"}}}
+	if !reflect.DeepEqual(queryItem.QueryConditions, wantCondition) {
+		t.Errorf("queryConditions = %+v，期望 %+v", queryItem.QueryConditions, wantCondition)
+	}
+	if len(queryItem.OrderBy) != 1 || queryItem.OrderBy[0].Pos != "V1" || queryItem.OrderBy[0].Field != "cost" || !queryItem.OrderBy[0].Desc {
+		t.Errorf("orderBy = %+v", queryItem.OrderBy)
+	}
+}
+
+func TestCompileSQLErrorPosition(t *testing.T) {
+	cases := []struct {
+		name        string
+		sql         string
+		wantLine    int
+		wantColumn  int
+		wantMessage string
+	}{
+		{"WHERE后缺少条件", "SELECT * FROM patients WHERE", 1, 29, "此处应为列名"},
+		{"缺少比较值", "SELECT * FROM patients WHERE age >", 1, 35, "此处应为值"},
+		{"缺少返回列", "SELECT FROM patients", 1, 8, "此处应为列名"},
+		{"别名不存在", "SELECT * FROM patients p WHERE q.age = 1", 1, 32, "数据集别名 q 不存在"},
+		{"多行语句中未结束的字符串", "SELECT *\nFROM patients\nWHERE age = 'x", 3, 13, "缺少结束的单引号"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := CompileSQL(tc.sql, testSQLDatasets)
+			var sqlErr *SQLError
+			if !errors.As(err, &sqlErr) {
+				t.Fatalf("err = %v，期望 *SQLError", err)
+			}
+			if sqlErr.Line != tc.wantLine || sqlErr.Column != tc.wantColumn {
+				t.Errorf("位置 = 第%d行第%d列，期望第%d行第%d列", sqlErr.Line, sqlErr.Column, tc.wantLine, tc.wantColumn)
+			}
+			if !strings.Contains(sqlErr.Message, tc.wantMessage) {
+				t.Errorf("message = %q，期望包含 %q", sqlErr.Message, tc.wantMessage)
+			}
+		})
+	}
+}
+
+func TestSQLZeroAndEmptyValues(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	content, err := EncodeTable([]string{"id", "age", "name"}, [][]string{{"1", "0", ""}, {"2", "5", "b"}, {"3", "0", "c"}})
+	if err != nil {
+		t.Fatalf("EncodeTable 失败: %v", err)
+	}
+	shards := map[string]string{"P1": content, "P2": "id\tage\tname\n4\t-1\td\n"}
+	cases := []struct {
+		name string
+		sql  string
+		want []string
+	}{
+		{"等于0", "SELECT id FROM patients WHERE age = 0", []string{"1", "3"}},
+		{"大于0", "SELECT id FROM patients WHERE age > 0", []string{"2"}},
+		{"等于空字符串", "SELECT id FROM patients WHERE name = ''", []string{"1"}},
+		{"不等于空字符串", "SELECT id FROM patients WHERE name <> ''", []string{"2", "3", "4"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			queryItemData, err := CompileSQL(tc.sql, testSQLDatasets)
+			if err != nil {
+				t.Fatalf("CompileSQL 失败: %v", err)
+			}
+			queryItem, _ := json.Marshal(queryItemData)
+			queryResult, counts := GetQueryResult(string(queryItem), shards)
+			var queryResultData QueryResult
+			if err := json.Unmarshal([]byte(queryResult), &queryResultData); err != nil || counts == -1 {
+				t.Fatalf("查询失败: %s", queryResult)
+			}
+			ids := make([]string, 0)
+			for _, row := range queryResultData.Data {
+				ids = append(ids, row.(map[string]interface{})["id"].(string))
+			}
+			if !reflect.DeepEqual(ids, tc.want) {
+				t.Errorf("结果 = %v，期望 %v", ids, tc.want)
+			}
+		})
+	}
+}
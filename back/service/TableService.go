@@ -0,0 +1,214 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ----------------表格序列化格式（TABLE FORMAT）-------------------
+// 加密前的明文采用 JSON Lines：
+//   第一行为格式头：{"format":"chainqa-table","version":1,"columns":["姓名","age","visit date"]}
+//   之后每行为一个JSON数组，元素为字符串或null，如 ["张 三","30",null]
+// 可以无损保存空格、Unicode列名和空值。
+// 旧数据（首行不是格式头）按空格分隔的旧格式读取。
+
+const (
+	TableFormatName    = "chainqa-table" // 格式名
+	TableFormatVersion = 1               // 当前格式版本
+)
+
+// NullCell 表示空值的单元格（内部表示，不会出现在上传的数据中）
+const NullCell = "\x00"
+
+// tableFormatHeader 格式头
+type tableFormatHeader struct {
+	Format  string   `json:"format"`  // 格式名，固定为 chainqa-table
+	Version int      `json:"version"` // 格式版本
+	Columns []string `json:"columns"` // 列名
+}
+
+// Table 解析后的表
+type Table struct {
+	Columns   []string       // 列名（带pos前缀：pos_field）
+	HeaderMap map[string]int // 列名（带pos前缀）到列索引的映射
+	Rows      [][]string     // 行数据，空值为NullCell
+
+	typedColumns map[string]*typedColumn // 按类型解析后的列缓存（key为 列索引_类型）
+	sources      int                     // 合并的分片数（大于1时查询可按类型拓宽策略放宽类型）
+}
+
+/**
+ * newTable 根据列名创建空表
+ * @param pos 位置（数据集主CID），作为列名前缀
+ * @param columns 列名（不带前缀）
+ * @return *Table 空表
+ */
+func newTable(pos string, columns []string) *Table {
+	table := &Table{
+		Columns:   make([]string, len(columns)),
+		HeaderMap: make(map[string]int),
+		Rows:      make([][]string, 0),
+	}
+	for i, column := range columns {
+		table.Columns[i] = pos + "_" + column
+		table.HeaderMap[pos+"_"+column] = i
+	}
+	return table
+}
+
+/**
+ * EncodeTable 将表头和行数据序列化为 chainqa-table 格式
+ * @param columns 列名
+ * @param rows 行数据，值为NullCell的单元格序列化为null
+ * @return string 序列化后的明文
+ * @return error 错误信息（列数不匹配等）
+ */
+func EncodeTable(columns []string, rows [][]string) (string, error) {
+	var sb strings.Builder
+	headerBytes, err := json.Marshal(tableFormatHeader{
+		Format:  TableFormatName,
+		Version: TableFormatVersion,
+		Columns: columns,
+	})
+	if err != nil {
+		return "", err
+	}
+	sb.Write(headerBytes)
+	for i, row := range rows {
+		if len(row) != len(columns) {
+			return "", fmt.Errorf("第 %d 行数据列数（%d）与表头列数（%d）不匹配", i+2, len(row), len(columns))
+		}
+		cells := make([]*string, len(row))
+		for j := range row {
+			if row[j] != NullCell {
+				cells[j] = &row[j]
+			}
+		}
+		rowBytes, err := json.Marshal(cells)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString("\n")
+		sb.Write(rowBytes)
+	}
+	return sb.String(), nil
+}
+
+/**
+ * isTableFormat 判断明文是否为 chainqa-table 格式（首行为格式头）
+ * @param content 明文
+ * @return bool 是否为新格式
+ */
+func isTableFormat(content string) bool {
+	firstLine := content
+	if idx := strings.Index(content, "\n"); idx >= 0 {
+		firstLine = content[:idx]
+	}
+	firstLine = strings.TrimSpace(firstLine)
+	if !strings.HasPrefix(firstLine, "{") {
+		return false
+	}
+	var header tableFormatHeader
+	if err := json.Unmarshal([]byte(firstLine), &header); err != nil {
+		return false
+	}
+	return header.Format == TableFormatName
+}
+
+/**
+ * DecodeTable 解析明文为表，自动识别新格式与旧的空格分隔格式
+ * @param pos 位置（数据集主CID），作为列名前缀
+ * @param content 明文（解密后的文件内容）
+ * @return *Table 表
+ * @return error 错误信息
+ */
+func DecodeTable(pos string, content string) (*Table, error) {
+	if isTableFormat(content) {
+		return decodeTableFormat(pos, content)
+	}
+	return decodeLegacyTable(pos, content), nil
+}
+
+/**
+ * decodeTableFormat 解析 chainqa-table 格式
+ * @param pos 位置（数据集主CID）
+ * @param content 明文
+ * @return *Table 表
+ * @return error 错误信息
+ */
+func decodeTableFormat(pos string, content string) (*Table, error) {
+	lines := strings.Split(content, "\n")
+	var header tableFormatHeader
+	if err := json.Unmarshal([]byte(strings.TrimSpace(lines[0])), &header); err != nil {
+		return nil, fmt.Errorf("表格式头解析失败: %s", err)
+	}
+	if header.Version > TableFormatVersion {
+		return nil, fmt.Errorf("表格式版本 %d 高于当前支持的版本 %d", header.Version, TableFormatVersion)
+	}
+	if len(header.Columns) == 0 {
+		return nil, errors.New("表格式头中没有列")
+	}
+
+	table := newTable(pos, header.Columns)
+	for i, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var cells []*string
+		if err := json.Unmarshal([]byte(line), &cells); err != nil {
+			return nil, fmt.Errorf("第 %d 行数据解析失败: %s", i+2, err)
+		}
+		if len(cells) != len(header.Columns) {
+			return nil, fmt.Errorf("第 %d 行数据列数（%d）与表头列数（%d）不匹配", i+2, len(cells), len(header.Columns))
+		}
+		row := make([]string, len(cells))
+		for j, cell := range cells {
+			if cell == nil {
+				row[j] = NullCell
+			} else {
+				row[j] = *cell
+			}
+		}
+		table.Rows = append(table.Rows, row)
+	}
+	return table, nil
+}
+
+/**
+ * decodeLegacyTable 解析旧的空格分隔格式：第一行是表头，之后每行按空格拆分
+ * @param pos 位置（数据集主CID）
+ * @param content 明文
+ * @return *Table 表
+ */
+func decodeLegacyTable(pos string, content string) *Table {
+	lines := strings.Split(content, "\n")
+	// 获取表头，按空格拆分
+	table := newTable(pos, strings.Fields(lines[0]))
+	for _, line := range lines[1:] {
+		cells := strings.Fields(line)
+		if len(cells) == 0 {
+			continue
+		}
+		// 列数不足的行补空值，避免越界
+		for len(cells) < len(table.Columns) {
+			cells = append(cells, NullCell)
+		}
+		table.Rows = append(table.Rows, cells)
+	}
+	return table
+}
+
+/**
+ * cellOutput 单元格输出到结果JSON中的值，空值输出为null
+ * @param cellValue 单元格值
+ * @return interface{} 字符串或nil
+ */
+func cellOutput(cellValue string) interface{} {
+	if cellValue == NullCell {
+		return nil
+	}
+	return cellValue
+}
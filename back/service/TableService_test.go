@@ -0,0 +1,99 @@
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncodeDecodeTableRoundTrip(t *testing.T) {
+	cases := []struct {
+		name    string
+		columns []string
+		rows    [][]string
+	}{
+		{"空表", []string{"id"}, [][]string{}},
+		{"空格和中文", []string{"姓名", "visit date"}, [][]string{{"张 三", "2024-01-02 08:00"}}},
+		{"空值", []string{"id", "age"}, [][]string{{"1", NullCell}, {NullCell, "30"}}},
+		{"空字符串不是空值", []string{"id", "note"}, [][]string{{"1", ""}}},
+		{"特殊字符", []string{"a\"b", "c\\d"}, [][]string{{"x\ny", "\t"}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			content, err := EncodeTable(tc.columns, tc.rows)
+			if err != nil {
+				t.Fatalf("EncodeTable 失败: %v", err)
+			}
+			table, err := DecodeTable("p", content)
+			if err != nil {
+				t.Fatalf("DecodeTable 失败: %v", err)
+			}
+			wantColumns := make([]string, len(tc.columns))
+			for i, column := range tc.columns {
+				wantColumns[i] = "p_" + column
+			}
+			if !reflect.DeepEqual(table.Columns, wantColumns) {
+				t.Errorf("列名 = %q，期望 %q", table.Columns, wantColumns)
+			}
+			if !reflect.DeepEqual(table.Rows, tc.rows) {
+				t.Errorf("行数据 = %q，期望 %q", table.Rows, tc.rows)
+			}
+		})
+	}
+}
+
+func TestEncodeTableColumnMismatch(t *testing.T) {
+	_, err := EncodeTable([]string{"a", "b"}, [][]string{{"1", "2"}, {"3"}})
+	if err == nil || !strings.Contains(err.Error(), "第 3 行") {
+		t.Fatalf("err = %v，期望第 3 行列数不匹配", err)
+	}
+}
+
+func TestDecodeTableLegacy(t *testing.T) {
+	cases := []struct {
+		name        string
+		content     string
+		wantColumns []string
+		wantRows    [][]string
+	}{
+		{"空格分隔", "id name\n1 a\n2 b", []string{"p_id", "p_name"}, [][]string{{"1", "a"}, {"2", "b"}}},
+		{"制表符和空行", "id\tv\n1\tx\n\n", []string{"p_id", "p_v"}, [][]string{{"1", "x"}}},
+		{"列数不足补空值", "id v\n1", []string{"p_id", "p_v"}, [][]string{{"1", NullCell}}},
+		{"首行是其他JSON", "{\"format\":\"other\"}\n1", []string{"p_{\"format\":\"other\"}"}, [][]string{{"1"}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			table, err := DecodeTable("p", tc.content)
+			if err != nil {
+				t.Fatalf("DecodeTable 失败: %v", err)
+			}
+			if !reflect.DeepEqual(table.Columns, tc.wantColumns) {
+				t.Errorf("列名 = %q，期望 %q", table.Columns, tc.wantColumns)
+			}
+			if !reflect.DeepEqual(table.Rows, tc.wantRows) {
+				t.Errorf("行数据 = %q，期望 %q", table.Rows, tc.wantRows)
+			}
+		})
+	}
+}
+
+func TestDecodeTableFormatErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"版本过高", `{"format":"chainqa-table","version":2,"columns":["a"]}`, "版本 2"},
+		{"没有列", `{"format":"chainqa-table","version":1,"columns":[]}`, "没有列"},
+		{"行不是JSON", "{\"format\":\"chainqa-table\",\"version\":1,\"columns\":[\"a\"]}\nabc", "第 2 行"},
+		{"行列数不匹配", "{\"format\":\"chainqa-table\",\"version\":1,\"columns\":[\"a\"]}\n[\"1\",\"2\"]", "列数"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := DecodeTable("p", tc.content)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("err = %v，期望包含 %q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,379 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ----------------分片合并（SHARD UNION）-------------------
+// 同一个数据集的多个分片按列名合并（union-by-name）：各分片先按列重命名映射改名，
+// 合并后的列为所有分片列的并集（按第一次出现的顺序），分片中缺少的列填空值。
+// 各分片中同一列的数据类型可能不同（如早期为整数、后来有小数），查询时按拓宽策略放宽查询中声明的类型。
+// queryConcatType 为 union 时，多个结构兼容的数据集也按同样的方式合并为一个表查询。
+
+// UnionOptions 合并分片（或union查询中的多个数据集）时的选项
+type UnionOptions struct {
+	ColumnMapping map[string]map[string]string `json:"columnMapping"` // 列重命名：分片CID（"*"表示所有分片）-> {原列名: 新列名}
+	TypeWidening  string                       `json:"typeWidening"`  // 类型拓宽策略：auto（默认，int→float→string，date/datetime→string）、numeric（只允许int→float）、none（不拓宽）
+	SkipShards    []string                     `json:"skipShards"`    // 跳过的分片CID（不获取、不解密；主分片被跳过时仍以其CID作为列名前缀）
+}
+
+/**
+ * shardColumnMapping 获取分片的列重命名映射，分片CID的映射优先于"*"
+ * @param options 合并选项
+ * @param filePos 分片位置（CID）
+ * @return map[string]string 原列名 -> 新列名
+ */
+func shardColumnMapping(options UnionOptions, filePos string) map[string]string {
+	mapping := make(map[string]string)
+	for from, to := range options.ColumnMapping["*"] {
+		mapping[from] = to
+	}
+	for from, to := range options.ColumnMapping[filePos] {
+		mapping[from] = to
+	}
+	return mapping
+}
+
+/**
+ * renameTableColumns 按映射重命名表的列
+ * @param table 表（列名带mainPos前缀）
+ * @param mainPos 列名前缀
+ * @param mapping 原列名 -> 新列名
+ * @param filePos 分片位置（用于错误信息）
+ * @return error 重命名后列名重复时返回错误
+ */
+func renameTableColumns(table *Table, mainPos string, mapping map[string]string, filePos string) error {
+	if len(mapping) == 0 {
+		return nil
+	}
+	headerMap := make(map[string]int, len(table.Columns))
+	for i, column := range table.Columns {
+		field := strings.TrimPrefix(column, mainPos+"_")
+		if to, ok := mapping[field]; ok && to != "" {
+			column = mainPos + "_" + to
+		}
+		if _, exists := headerMap[column]; exists {
+			return fmt.Errorf("分片%s的列重命名后列名重复: %s", filePos, strings.TrimPrefix(column, mainPos+"_"))
+		}
+		table.Columns[i] = column
+		headerMap[column] = i
+	}
+	table.HeaderMap = headerMap
+	return nil
+}
+
+/**
+ * unionTables 按列名合并多个表（列名前缀相同），缺少的列填空值
+ * @param tables 表数组，至少一个
+ * @return *Table 合并后的表
+ */
+func unionTables(tables []*Table) *Table {
+	sameHeader := true
+	for _, table := range tables[1:] {
+		if strings.Join(table.Columns, "\x00") != strings.Join(tables[0].Columns, "\x00") {
+			sameHeader = false
+			break
+		}
+	}
+	result := &Table{Columns: tables[0].Columns, HeaderMap: tables[0].HeaderMap, Rows: tables[0].Rows, sources: len(tables)}
+	if sameHeader {
+		// 表头一致时直接拼接行
+		for _, table := range tables[1:] {
+			result.Rows = append(result.Rows, table.Rows...)
+		}
+		return result
+	}
+
+	// 列为所有表的列的并集，按第一次出现的顺序
+	result.Columns = make([]string, 0)
+	result.HeaderMap = make(map[string]int)
+	for _, table := range tables {
+		for _, column := range table.Columns {
+			if _, ok := result.HeaderMap[column]; !ok {
+				result.HeaderMap[column] = len(result.Columns)
+				result.Columns = append(result.Columns, column)
+			}
+		}
+	}
+	result.Rows = make([][]string, 0)
+	for _, table := range tables {
+		// 合并后的列在该表中的索引，-1表示该表没有这一列
+		sourceIndexes := make([]int, len(result.Columns))
+		for i, column := range result.Columns {
+			sourceIndexes[i] = -1
+			if index, ok := table.HeaderMap[column]; ok {
+				sourceIndexes[i] = index
+			}
+		}
+		for _, row := range table.Rows {
+			newRow := make([]string, len(result.Columns))
+			for i, index := range sourceIndexes {
+				if index < 0 {
+					newRow[i] = NullCell
+				} else {
+					newRow[i] = row[index]
+				}
+			}
+			result.Rows = append(result.Rows, newRow)
+		}
+	}
+	return result
+}
+
+/**
+ * widerType 按拓宽策略返回比cellType更宽的类型，没有更宽的类型时返回空字符串
+ * @param cellType 类型
+ * @param strategy 拓宽策略（auto/numeric/none）
+ * @return string 更宽的类型
+ */
+func widerType(cellType string, strategy string) string {
+	switch strategy {
+	case "none":
+		return ""
+	case "numeric":
+		if cellType == "int" {
+			return "float"
+		}
+		return ""
+	default:
+		switch cellType {
+		case "int":
+			return "float"
+		case "float", "date", "datetime":
+			return "string"
+		}
+		return ""
+	}
+}
+
+/**
+ * checkTypeWidening 校验拓宽策略
+ * @param strategy 拓宽策略
+ * @return error 错误信息
+ */
+func checkTypeWidening(strategy string) error {
+	switch strategy {
+	case "", "auto", "numeric", "none":
+		return nil
+	}
+	return errors.New("不支持的类型拓宽策略 " + strategy + "（auto/numeric/none）")
+}
+
+/**
+ * widenQueryTypes 合并了多个分片的表中，若某列的值无法按查询中声明的类型解析，则按拓宽策略放宽该列在查询中的类型
+ * （查询条件、分组、聚合、排序、联表条件中引用该列的地方一起放宽）
+ * @param queryItemData 查询项（会被修改）
+ * @param table 合并后的表
+ * @param dateParser 日期解析器
+ * @return error 拓宽策略错误
+ */
+func widenQueryTypes(queryItemData *QueryItem, table *Table, dateParser *DateParser) error {
+	strategy := queryItemData.Union.TypeWidening
+	if err := checkTypeWidening(strategy); err != nil {
+		return err
+	}
+	if table.sources <= 1 || strategy == "none" {
+		return nil
+	}
+
+	widened := make(map[string]string) // pos_field + 声明的类型 -> 拓宽后的类型
+	widen := func(pos string, field string, cellType string) string {
+		index, ok := table.HeaderMap[pos+"_"+field]
+		if !ok || cellType == "" || cellType == "string" {
+			return cellType
+		}
+		key := pos + "_" + field + "\x00" + cellType
+		if result, ok := widened[key]; ok {
+			return result
+		}
+		result := cellType
+		for result != "string" && result != "" {
+			if !columnHasParseError(table.typedColumn(index, result, dateParser)) {
+				break
+			}
+			next := widerType(result, strategy)
+			if next == "" {
+				break
+			}
+			result = next
+		}
+		widened[key] = result
+		return result
+	}
+
+	for i := range queryItemData.QueryConditions {
+		for j := range queryItemData.QueryConditions[i] {
+			condition := &queryItemData.QueryConditions[i][j]
+			condition.Type = widen(condition.Pos, condition.Field, condition.Type)
+		}
+	}
+	for i := range queryItemData.GroupBy {
+		groupBy := &queryItemData.GroupBy[i]
+		groupBy.Type = widen(groupBy.Pos, groupBy.Field, groupBy.Type)
+	}
+	for i := range queryItemData.Aggregates {
+		aggregate := &queryItemData.Aggregates[i]
+		aggregate.Type = widen(aggregate.Pos, aggregate.Field, aggregate.Type)
+	}
+	for i := range queryItemData.OrderBy {
+		orderBy := &queryItemData.OrderBy[i]
+		if orderBy.Pos != "" {
+			orderBy.Type = widen(orderBy.Pos, orderBy.Field, orderBy.Type)
+		}
+	}
+	for i := range queryItemData.JointConditions {
+		jointCondition := &queryItemData.JointConditions[i]
+		type1 := widen(jointCondition.Pos1, jointCondition.Field1, jointCondition.Type)
+		type2 := widen(jointCondition.Pos2, jointCondition.Field2, jointCondition.Type)
+		// 联表两侧取更宽的类型
+		if type1 == "string" || type2 == "string" {
+			jointCondition.Type = "string"
+		} else if type1 == "float" || type2 == "float" {
+			jointCondition.Type = "float"
+		}
+	}
+	return nil
+}
+
+// columnHasParseError 列中是否有无法解析的单元格
+func columnHasParseError(column *typedColumn) bool {
+	for _, err := range column.errs {
+		if err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * ReturnQueryUnion 合并多个结构兼容的数据集（按列名）后查询
+ * @param queryItemData 查询项
+ * @param filePosAndDataMap 文件位置和文件内容的map
+ * @return string 查询结果（JSON字符串）
+ * @return int 查询结果数量
+ * @return error 错误信息
+ * @Description: 所有数据集的所有分片按列名合并为一个表，列名前缀为第一个数据集的主CID；
+ * 查询条件、返回列等中引用其他数据集主CID的地方视为引用合并后的表。
+ */
+func ReturnQueryUnion(queryItemData QueryItem, filePosAndDataMap map[string]string) (string, int, error) {
+	if len(queryItemData.FilePos) == 0 || len(queryItemData.FilePos[0]) == 0 {
+		err := errors.New("filePos 不能为空")
+		return errorQueryResult(err.Error()), -1, err
+	}
+	mainPos := queryItemData.FilePos[0][0]
+
+	// 每个数据集先合并自己的分片，检查数据集之间是否有相同的列，再改为以第一个数据集的主CID为前缀
+	tables := make([]*Table, 0, len(queryItemData.FilePos))
+	sources := 0
+	var firstColumns map[string]bool
+	for idx, filePosesSingleDataSet := range queryItemData.FilePos {
+		if len(filePosesSingleDataSet) == 0 {
+			err := fmt.Errorf("第%d个数据集没有分片", idx+1)
+			return errorQueryResult(err.Error()), -1, err
+		}
+		table, err := AggregateSliceINDataSet(filePosesSingleDataSet, filePosAndDataMap, queryItemData.Union, queryItemData.provenanceDataset(idx))
+		if err != nil {
+			return errorQueryResult(err.Error()), -1, err
+		}
+		columns := make(map[string]bool)
+		for _, column := range table.Columns {
+			if !isProvenanceColumn(column) {
+				columns[strings.TrimPrefix(column, filePosesSingleDataSet[0]+"_")] = true
+			}
+		}
+		if idx == 0 {
+			firstColumns = columns
+		} else if !hasCommonColumn(firstColumns, columns) {
+			err := fmt.Errorf("数据集%s与%s没有相同的列，无法合并", filePosesSingleDataSet[0], mainPos)
+			return errorQueryResult(err.Error()), -1, err
+		}
+		if filePosesSingleDataSet[0] != mainPos {
+			for i, column := range table.Columns {
+				table.Columns[i] = mainPos + "_" + strings.TrimPrefix(column, filePosesSingleDataSet[0]+"_")
+			}
+			table.HeaderMap = make(map[string]int, len(table.Columns))
+			for i, column := range table.Columns {
+				table.HeaderMap[column] = i
+			}
+		}
+		tables = append(tables, table)
+		sources += table.sources
+	}
+	table := unionTables(tables)
+	table.sources = sources
+
+	rebaseUnionQuery(&queryItemData)
+
+	dateParser, err := NewDateParser(queryItemData.DateOptions)
+	if err != nil {
+		return errorQueryResult(err.Error()), -1, err
+	}
+	if err := addComputedColumns(table, queryItemData.ComputedColumns, mainPos, true, dateParser); err != nil {
+		return errorQueryResult(err.Error()), -1, err
+	}
+	if err := widenQueryTypes(&queryItemData, table, dateParser); err != nil {
+		return errorQueryResult(err.Error()), -1, err
+	}
+
+	// -----------------查询部分-----------------
+	return QueryModule(queryItemData, table, false, dateParser)
+}
+
+// hasCommonColumn 两个列集合是否有相同的列
+func hasCommonColumn(columns1 map[string]bool, columns2 map[string]bool) bool {
+	for column := range columns2 {
+		if columns1[column] {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * rebaseUnionQuery union查询中，查询条件、分组、聚合、排序、返回列中引用其他数据集主CID的地方改为第一个数据集的主CID
+ * @param queryItemData 查询项（会被修改）
+ */
+func rebaseUnionQuery(queryItemData *QueryItem) {
+	mainPos := queryItemData.FilePos[0][0]
+	datasetPoses := make(map[string]bool)
+	for _, filePosesSingleDataSet := range queryItemData.FilePos {
+		datasetPoses[filePosesSingleDataSet[0]] = true
+	}
+	rebase := func(pos string) string {
+		if datasetPoses[pos] {
+			return mainPos
+		}
+		return pos
+	}
+	for i := range queryItemData.QueryConditions {
+		for j := range queryItemData.QueryConditions[i] {
+			queryItemData.QueryConditions[i][j].Pos = rebase(queryItemData.QueryConditions[i][j].Pos)
+		}
+	}
+	for i := range queryItemData.GroupBy {
+		queryItemData.GroupBy[i].Pos = rebase(queryItemData.GroupBy[i].Pos)
+	}
+	for i := range queryItemData.Aggregates {
+		if queryItemData.Aggregates[i].Pos != "" {
+			queryItemData.Aggregates[i].Pos = rebase(queryItemData.Aggregates[i].Pos)
+		}
+	}
+	for i := range queryItemData.OrderBy {
+		if queryItemData.OrderBy[i].Pos != "" {
+			queryItemData.OrderBy[i].Pos = rebase(queryItemData.OrderBy[i].Pos)
+		}
+	}
+	returnFields := make([]string, 0, len(queryItemData.ReturnField))
+	for _, returnField := range queryItemData.ReturnField {
+		parts := strings.SplitN(returnField, "_", 2)
+		if len(parts) == 2 {
+			returnField = rebase(parts[0]) + "_" + parts[1]
+		}
+		if !strIsInSlice(returnFields, returnField) {
+			returnFields = append(returnFields, returnField)
+		}
+	}
+	queryItemData.ReturnField = returnFields
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"chainqa_offchain_demo/setting"
+)
+
+// 测试用的分片：U2的id列名为pid，U3的age列有小数，W与U没有相同的列
+var testUnionShards = map[string]string{
+	"U1": "id\tage\tname\n1\t10\ta\n2\t20\tb\n",
+	"U2": "pid\tage\n3\t30\n",
+	"U3": "id\tage\tcity\n4\t40.5\tx\n",
+	"V1": "id\tage\n5\t50\n",
+	"W1": "code\n9\n",
+}
+
+// unionQueryRows 执行查询，返回结果行（JSON字符串）或查询失败的信息
+func unionQueryRows(t *testing.T, queryItemData QueryItem) (string, bool) {
+	t.Helper()
+	queryItem, _ := json.Marshal(queryItemData)
+	queryResult, counts := GetQueryResult(string(queryItem), testUnionShards)
+	if counts == -1 {
+		return queryResult, false
+	}
+	var queryResultData QueryResult
+	if err := json.Unmarshal([]byte(queryResult), &queryResultData); err != nil {
+		t.Fatalf("解析查询结果失败: %s", queryResult)
+	}
+	rows, _ := json.Marshal(queryResultData.Data)
+	return string(rows), true
+}
+
+func TestUnionShards(t *testing.T) {
+	setting.Conf = new(setting.AppConfig)
+	rename := map[string]map[string]string{"U2": {"pid": "id"}}
+	ageGe := func(cellType string) [][]QueryCondition {
+		return [][]QueryCondition{{{Pos: "U1", Field: "age", Val: "20", Compare: "ge", Type: cellType}}}
+	}
+	cases := []struct {
+		name      string
+		queryItem QueryItem
+		want      string // 结果行，或期望包含的错误信息
+		wantOK    bool
+	}{
+		{"按列名合并，缺少的列为空值", QueryItem{QueryConcatType: "single", FilePos: [][]string{{"U1", "U2", "U3"}}, ReturnField: []string{"U1_*"},
+			Union: UnionOptions{ColumnMapping: rename}},
+			`[{"age":"10","city":null,"id":"1","name":"a"},{"age":"20","city":null,"id":"2","name":"b"},{"age":"30","city":null,"id":"3","name":null},{"age":"40.5","city":"x","id":"4","name":null}]`, true},
+		{"没有列重命名时保留原列名", QueryItem{QueryConcatType: "single", FilePos: [][]string{{"U1", "U2"}}, ReturnField: []string{"U1_id", "U1_pid"}},
+			`[{"id":"1","pid":null},{"id":"2","pid":null},{"id":null,"pid":"3"}]`, true},
+		{"int拓宽为float", QueryItem{QueryConcatType: "single", FilePos: [][]string{{"U1", "U3"}}, ReturnField: []string{"U1_id"}, QueryConditions: ageGe("int")},
+			`[{"id":"2"},{"id":"4"}]`, true},
+		{"numeric策略", QueryItem{QueryConcatType: "single", FilePos: [][]string{{"U1", "U3"}}, ReturnField: []string{"U1_id"}, QueryConditions: ageGe("int"),
+			Union: UnionOptions{TypeWidening: "numeric"}},
+			`[{"id":"2"},{"id":"4"}]`, true},
+		{"不拓宽时报错", QueryItem{QueryConcatType: "single", FilePos: [][]string{{"U1", "U3"}}, ReturnField: []string{"U1_id"}, QueryConditions: ageGe("int"),
+			Union: UnionOptions{TypeWidening: "none"}}, "40.5", false},
+		{"不支持的拓宽策略", QueryItem{QueryConcatType: "single", FilePos: [][]string{{"U1", "U3"}}, ReturnField: []string{"U1_id"}, QueryConditions: ageGe("int"),
+			Union: UnionOptions{TypeWidening: "all"}}, "不支持的类型拓宽策略", false},
+		{"列重命名后列名重复", QueryItem{QueryConcatType: "single", FilePos: [][]string{{"U1", "U3"}}, ReturnField: []string{"U1_id"},
+			Union: UnionOptions{ColumnMapping: map[string]map[string]string{"*": {"city": "name"}, "U1": {"age": "id"}}}}, "列名重复", false},
+		{"union查询引用其他数据集的主CID", QueryItem{QueryConcatType: "union", FilePos: [][]string{{"U1"}, {"V1"}}, ReturnField: []string{"U1_id", "V1_id"},
+			QueryConditions: [][]QueryCondition{{{Pos: "V1", Field: "age", Val: "20", Compare: "gt", Type: "int"}}}},
+			`[{"id":"5"}]`, true},
+		{"union的数据集没有相同的列", QueryItem{QueryConcatType: "union", FilePos: [][]string{{"U1"}, {"W1"}}, ReturnField: []string{"U1_id"}}, "没有相同的列", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := unionQueryRows(t, tc.queryItem)
+			if ok != tc.wantOK {
+				t.Fatalf("查询结果 = %s", got)
+			}
+			if ok && got != tc.want || !ok && !strings.Contains(got, tc.want) {
+				t.Errorf("结果 = %s，期望 %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWiderType(t *testing.T) {
+	cases := []struct {
+		cellType string
+		strategy string
+		want     string
+	}{
+		{"int", "", "float"},
+		{"float", "auto", "string"},
+		{"date", "auto", "string"},
+		{"string", "auto", ""},
+		{"int", "numeric", "float"},
+		{"float", "numeric", ""},
+		{"int", "none", ""},
+	}
+	got := make([]string, 0, len(cases))
+	want := make([]string, 0, len(cases))
+	for _, tc := range cases {
+		got = append(got, widerType(tc.cellType, tc.strategy))
+		want = append(want, tc.want)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("widerType = %v，期望 %v", got, want)
+	}
+}
@@ -0,0 +1,480 @@
+package service
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------分片统计信息（ZONE MAP）-------------------
+// 上传时明文已知，按列计算每个分片的统计信息：非空值数、空值数、数值最小/最大值、字符串最小/最大值、
+// 不同值个数的估计（HyperLogLog）和布隆过滤器，存储在索引侧（Redis）。
+// 查询时条件不可能在某个分片上成立（如年龄范围在该分片的最小/最大值之外、等值不在布隆过滤器中）时，
+// 该分片记入 union.skipShards，不获取、不解密。
+
+// 统计信息的参数
+const (
+	zoneMapSketchBits   = 8       // HyperLogLog的寄存器数为 2^zoneMapSketchBits
+	zoneMapBloomFPRate  = 0.01    // 布隆过滤器的误判率
+	zoneMapBloomMaxBits = 1 << 20 // 单列布隆过滤器最多的位数
+)
+
+// ZoneMap 单个分片（CID）的统计信息
+type ZoneMap struct {
+	Pos       string                  `json:"pos"`       // 分片位置（CID）
+	RowCount  int                     `json:"rowCount"`  // 行数
+	Columns   map[string]*ColumnStats `json:"columns"`   // 列名（不带pos前缀）-> 统计信息
+	CreatedAt int64                   `json:"createdAt"` // 计算时间（Unix秒）
+}
+
+// ColumnStats 单列的统计信息
+type ColumnStats struct {
+	Count       int     `json:"count"`       // 非空值数（数值比较意义下，""/null/NULL 均为空值）
+	NullCount   int     `json:"nullCount"`   // 空值数
+	Numeric     bool    `json:"numeric"`     // 非空值是否都能解析为浮点数
+	Integral    bool    `json:"integral"`    // 非空值是否都能解析为整数
+	NumMin      float64 `json:"numMin"`      // 数值最小值（Numeric时有效）
+	NumMax      float64 `json:"numMax"`      // 数值最大值（Numeric时有效）
+	StrCount    int     `json:"strCount"`    // 字符串比较意义下的非空值数（只有null单元格为空值）
+	StrMin      string  `json:"strMin"`      // 字符串最小值
+	StrMax      string  `json:"strMax"`      // 字符串最大值
+	Sketch      []byte  `json:"sketch"`      // 不同值个数的HyperLogLog寄存器
+	Bloom       []byte  `json:"bloom"`       // 布隆过滤器
+	BloomHashes int     `json:"bloomHashes"` // 布隆过滤器的哈希函数个数
+}
+
+// ZoneMapStore 分片统计信息的存储（由索引服务实现）
+type ZoneMapStore interface {
+	SaveZoneMap(pos string, data []byte) error
+	LoadZoneMaps(poses []string) (map[string][]byte, error)
+}
+
+var zoneMapCache = struct {
+	sync.RWMutex
+	zoneMaps map[string]*ZoneMap
+}{zoneMaps: make(map[string]*ZoneMap)}
+
+/**
+ * BuildZoneMap 计算分片的统计信息
+ * @param pos 分片位置（CID）
+ * @param content 明文（新格式或旧的空格分隔格式）
+ * @return *ZoneMap 统计信息
+ * @return error 解析错误
+ */
+func BuildZoneMap(pos string, content string) (*ZoneMap, error) {
+	table, err := DecodeTable(pos, content)
+	if err != nil {
+		return nil, err
+	}
+	zoneMap := &ZoneMap{Pos: pos, RowCount: len(table.Rows), Columns: make(map[string]*ColumnStats), CreatedAt: time.Now().Unix()}
+	for index, column := range table.Columns {
+		values := make([]string, len(table.Rows))
+		for i, row := range table.Rows {
+			values[i] = row[index]
+		}
+		zoneMap.Columns[strings.TrimPrefix(column, pos+"_")] = buildColumnStats(values)
+	}
+	return zoneMap, nil
+}
+
+// buildColumnStats 计算单列的统计信息
+func buildColumnStats(values []string) *ColumnStats {
+	stats := &ColumnStats{Numeric: true, Integral: true, Sketch: make([]byte, 1<<zoneMapSketchBits)}
+	strValues := make([]string, 0, len(values))
+	for _, value := range values {
+		if value != NullCell {
+			if stats.StrCount == 0 || value < stats.StrMin {
+				stats.StrMin = value
+			}
+			if stats.StrCount == 0 || value > stats.StrMax {
+				stats.StrMax = value
+			}
+			stats.StrCount++
+			stats.addToSketch(value)
+			strValues = append(strValues, value)
+		}
+		if isNullCell(value) {
+			stats.NullCount++
+			continue
+		}
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			stats.Integral = false
+		}
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			stats.Numeric, stats.Integral = false, false
+		} else if stats.Numeric {
+			if stats.Count == 0 || number < stats.NumMin {
+				stats.NumMin = number
+			}
+			if stats.Count == 0 || number > stats.NumMax {
+				stats.NumMax = number
+			}
+		}
+		stats.Count++
+	}
+	if stats.Count == 0 {
+		stats.Numeric, stats.Integral = false, false
+	}
+
+	// 布隆过滤器按不同值个数的估计确定大小
+	n := float64(max(stats.DistinctEstimate(), 1))
+	m := int(math.Ceil(-n * math.Log(zoneMapBloomFPRate) / (math.Ln2 * math.Ln2)))
+	m = min(max(m, 64), zoneMapBloomMaxBits)
+	stats.Bloom = make([]byte, (m+7)/8)
+	stats.BloomHashes = max(1, int(math.Round(float64(len(stats.Bloom)*8)/n*math.Ln2)))
+	for _, value := range strValues {
+		h1, h2 := zoneMapHash(value)
+		for i := 0; i < stats.BloomHashes; i++ {
+			bit := (h1 + uint64(i)*h2) % uint64(len(stats.Bloom)*8)
+			stats.Bloom[bit/8] |= 1 << (bit % 8)
+		}
+	}
+	return stats
+}
+
+// zoneMapHash 字符串的两个64位哈希（FNV-1a后用splitmix64混合）
+func zoneMapHash(value string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	x := h.Sum64()
+	mix := func(z uint64) uint64 {
+		z += 0x9e3779b97f4a7c15
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		return z ^ (z >> 31)
+	}
+	h1 := mix(x)
+	return h1, mix(h1) | 1
+}
+
+// addToSketch 将值加入HyperLogLog
+func (stats *ColumnStats) addToSketch(value string) {
+	h, _ := zoneMapHash(value)
+	index := h >> (64 - zoneMapSketchBits)
+	rank := byte(bits.LeadingZeros64(h<<zoneMapSketchBits|1<<(zoneMapSketchBits-1)) + 1)
+	if rank > stats.Sketch[index] {
+		stats.Sketch[index] = rank
+	}
+}
+
+/**
+ * DistinctEstimate 不同值个数的估计（HyperLogLog，小基数时按线性计数修正）
+ * @return int 估计值
+ */
+func (stats *ColumnStats) DistinctEstimate() int {
+	m := float64(len(stats.Sketch))
+	if m == 0 {
+		return 0
+	}
+	sum, zeros := 0.0, 0
+	for _, register := range stats.Sketch {
+		sum += math.Pow(2, -float64(register))
+		if register == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int(math.Round(estimate))
+}
+
+/**
+ * MightContain 布隆过滤器判断值是否可能存在（返回false时一定不存在）
+ * @param value 值
+ * @return bool 是否可能存在
+ */
+func (stats *ColumnStats) MightContain(value string) bool {
+	if len(stats.Bloom) == 0 {
+		return true
+	}
+	h1, h2 := zoneMapHash(value)
+	for i := 0; i < stats.BloomHashes; i++ {
+		bit := (h1 + uint64(i)*h2) % uint64(len(stats.Bloom)*8)
+		if stats.Bloom[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * SaveZoneMapFromContent 计算并保存分片的统计信息（上传时使用）
+ * @param pos 分片位置（CID）
+ * @param content 明文
+ * @param store 存储（为nil时只缓存在内存中）
+ * @return error 错误信息
+ */
+func SaveZoneMapFromContent(pos string, content string, store ZoneMapStore) error {
+	zoneMap, err := BuildZoneMap(pos, content)
+	if err != nil {
+		return err
+	}
+	zoneMapCache.Lock()
+	zoneMapCache.zoneMaps[pos] = zoneMap
+	zoneMapCache.Unlock()
+	if store == nil {
+		return nil
+	}
+	data, err := json.Marshal(zoneMap)
+	if err != nil {
+		return err
+	}
+	return store.SaveZoneMap(pos, data)
+}
+
+/**
+ * LookupZoneMaps 获取分片的统计信息：先查内存缓存，其余的从存储中读取
+ * @param poses 分片位置（CID）数组
+ * @param store 存储（可为nil）
+ * @return map[string]*ZoneMap 有统计信息的分片
+ */
+func LookupZoneMaps(poses []string, store ZoneMapStore) map[string]*ZoneMap {
+	zoneMaps := make(map[string]*ZoneMap)
+	missing := make([]string, 0)
+	zoneMapCache.RLock()
+	for _, pos := range poses {
+		if zoneMap, ok := zoneMapCache.zoneMaps[pos]; ok {
+			zoneMaps[pos] = zoneMap
+		} else if !strIsInSlice(missing, pos) {
+			missing = append(missing, pos)
+		}
+	}
+	zoneMapCache.RUnlock()
+	if len(missing) == 0 || store == nil {
+		return zoneMaps
+	}
+
+	stored, err := store.LoadZoneMaps(missing)
+	if err != nil {
+		return zoneMaps
+	}
+	zoneMapCache.Lock()
+	defer zoneMapCache.Unlock()
+	for pos, data := range stored {
+		var zoneMap ZoneMap
+		if err := json.Unmarshal(data, &zoneMap); err != nil {
+			continue
+		}
+		zoneMapCache.zoneMaps[pos] = &zoneMap
+		zoneMaps[pos] = &zoneMap
+	}
+	return zoneMaps
+}
+
+/**
+ * ZoneMapShards 按分片统计信息跳过不可能满足条件的分片（只用于单表查询）
+ * @param queryItem 查询项（JSON字符串）
+ * @param store 统计信息的存储（可为nil）
+ * @return string 查询项（有跳过的分片时为加入union.skipShards后的查询项，否则原样返回）
+ * @return []string 本次跳过的分片
+ * @return error 查询项格式错误
+ */
+func ZoneMapShards(queryItem string, store ZoneMapStore) (string, []string, error) {
+	var queryItemData QueryItem
+	if err := json.Unmarshal([]byte(queryItem), &queryItemData); err != nil {
+		return queryItem, nil, err
+	}
+	if queryItemData.QueryConcatType != "single" || len(queryItemData.FilePos) == 0 || len(queryItemData.FilePos[0]) == 0 ||
+		len(queryItemData.QueryConditions) == 0 {
+		return queryItem, nil, nil
+	}
+	mainPos := queryItemData.FilePos[0][0]
+	zoneMaps := LookupZoneMaps(queryItemData.FilePos[0], store)
+	if len(zoneMaps) == 0 {
+		return queryItem, nil, nil
+	}
+
+	// 各分片的列名按列重命名映射改名：改名后的列名 -> 统计信息
+	shardStats := make(map[string]map[string]*ColumnStats)
+	for filePos, zoneMap := range zoneMaps {
+		mapping := shardColumnMapping(queryItemData.Union, filePos)
+		columns := make(map[string]*ColumnStats)
+		for column, stats := range zoneMap.Columns {
+			if renamed, ok := mapping[column]; ok {
+				column = renamed
+			}
+			columns[column] = stats
+		}
+		shardStats[filePos] = columns
+	}
+	// 数值条件只在所有分片都有统计信息、且该列都能按声明的类型解析时使用（否则查询时会拓宽类型，比较方式改变）
+	numericSafe := func(field string, cellType string) bool {
+		for _, filePos := range queryItemData.FilePos[0] {
+			columns, ok := shardStats[filePos]
+			if !ok {
+				return false
+			}
+			stats, ok := columns[field]
+			if ok && stats.Count > 0 && !(stats.Integral || (cellType == "float" && stats.Numeric)) {
+				return false
+			}
+		}
+		return true
+	}
+	computed := make(map[string]bool)
+	for _, computedColumn := range queryItemData.ComputedColumns {
+		computed[computedColumn.Alias] = true
+	}
+
+	skipped := skipShards(&queryItemData, mainPos, func(filePos string) bool {
+		columns, ok := shardStats[filePos]
+		if !ok {
+			return false
+		}
+		// 所有条件组都不可能成立时才跳过
+		for _, conditionGroup := range queryItemData.QueryConditions {
+			groupImpossible := false
+			for _, condition := range conditionGroup {
+				if (condition.Pos != "" && condition.Pos != mainPos) || computed[condition.Field] {
+					continue
+				}
+				stats, ok := columns[condition.Field]
+				if !ok {
+					continue
+				}
+				if conditionImpossible(condition, stats, numericSafe) {
+					groupImpossible = true
+					break
+				}
+			}
+			if !groupImpossible {
+				return false
+			}
+		}
+		return true
+	})
+	if len(skipped) == 0 {
+		return queryItem, nil, nil
+	}
+	prunedQueryItem, err := json.Marshal(queryItemData)
+	if err != nil {
+		return queryItem, nil, err
+	}
+	return string(prunedQueryItem), skipped, nil
+}
+
+/**
+ * conditionImpossible 根据列的统计信息判断条件在分片上是否一定不成立
+ * @param condition 查询条件
+ * @param stats 列的统计信息
+ * @param numericSafe 能否按数值比较使用统计信息
+ * @return bool 是否一定不成立（无法判断时返回false）
+ */
+func conditionImpossible(condition QueryCondition, stats *ColumnStats, numericSafe func(field string, cellType string) bool) bool {
+	switch condition.Compare {
+	case "isnull":
+		return stats.NullCount == 0
+	case "notnull":
+		return stats.Count == 0
+	}
+	switch condition.Type {
+	case "int", "float":
+		if !numericSafe(condition.Field, condition.Type) {
+			return false
+		}
+		if stats.Count == 0 {
+			return true // 空值与任何数字比较都不成立
+		}
+		return rangeImpossible(condition, stats.NumMin, stats.NumMax)
+	case "string":
+		if stats.StrCount == 0 {
+			return true // 空值与任何字符串比较都不成立
+		}
+		switch condition.Compare {
+		case "eq":
+			return !stats.MightContain(condition.Val) || condition.Val < stats.StrMin || condition.Val > stats.StrMax
+		case "in":
+			vals, err := parseCondValList(condition.Val)
+			if err != nil {
+				return false
+			}
+			for _, val := range vals {
+				if stats.MightContain(val) && val >= stats.StrMin && val <= stats.StrMax {
+					return false
+				}
+			}
+			return true
+		case "lt":
+			return stats.StrMin >= condition.Val
+		case "le":
+			return stats.StrMin > condition.Val
+		case "gt":
+			return stats.StrMax <= condition.Val
+		case "ge":
+			return stats.StrMax < condition.Val
+		case "between":
+			bounds, err := parseCondValBetween(condition.Val)
+			return err == nil && (bounds[1] < stats.StrMin || bounds[0] > stats.StrMax)
+		case "prefix":
+			return stats.StrMax < condition.Val
+		}
+	}
+	return false
+}
+
+/**
+ * rangeImpossible 数值条件与 [minVal, maxVal] 区间是否不相交
+ * @param condition 查询条件
+ * @param minVal 最小值
+ * @param maxVal 最大值
+ * @return bool 是否一定不成立（基准值无法解析时返回false）
+ */
+func rangeImpossible(condition QueryCondition, minVal float64, maxVal float64) bool {
+	parse := func(val string) (float64, bool) {
+		number, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+		return number, err == nil
+	}
+	outside := func(val string) bool {
+		number, ok := parse(val)
+		return ok && (number < minVal || number > maxVal)
+	}
+	switch condition.Compare {
+	case "eq":
+		return outside(condition.Val)
+	case "in":
+		vals, err := parseCondValList(condition.Val)
+		if err != nil {
+			return false
+		}
+		for _, val := range vals {
+			if !outside(val) {
+				return false
+			}
+		}
+		return true
+	case "between":
+		bounds, err := parseCondValBetween(condition.Val)
+		if err != nil {
+			return false
+		}
+		low, ok1 := parse(bounds[0])
+		high, ok2 := parse(bounds[1])
+		return ok1 && ok2 && (high < minVal || low > maxVal)
+	case "ne":
+		val, ok := parse(condition.Val)
+		return ok && minVal == maxVal && val == minVal
+	}
+	val, ok := parse(condition.Val)
+	if !ok {
+		return false
+	}
+	switch condition.Compare {
+	case "gt":
+		return maxVal <= val
+	case "ge":
+		return maxVal < val
+	case "lt":
+		return minVal >= val
+	case "le":
+		return minVal > val
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testZoneMapStore 测试用的统计信息存储
+type testZoneMapStore map[string][]byte
+
+func (s testZoneMapStore) SaveZoneMap(pos string, data []byte) error {
+	s[pos] = data
+	return nil
+}
+
+func (s testZoneMapStore) LoadZoneMaps(poses []string) (map[string][]byte, error) {
+	result := make(map[string][]byte)
+	for _, pos := range poses {
+		if data, ok := s[pos]; ok {
+			result[pos] = data
+		}
+	}
+	return result, nil
+}
+
+func TestBuildZoneMap(t *testing.T) {
+	zoneMap, err := BuildZoneMap("zm_build", "id\tage\tcity\n1\t10\tbj\n2\t2.5\tsh\n3\tNULL\tbj\n")
+	if err != nil {
+		t.Fatalf("BuildZoneMap 失败: %v", err)
+	}
+	if zoneMap.RowCount != 3 {
+		t.Errorf("rowCount = %d，期望 3", zoneMap.RowCount)
+	}
+	age := zoneMap.Columns["age"]
+	if age.Count != 2 || age.NullCount != 1 || !age.Numeric || age.Integral || age.NumMin != 2.5 || age.NumMax != 10 {
+		t.Errorf("age 统计信息 = %+v", age)
+	}
+	city := zoneMap.Columns["city"]
+	if city.StrCount != 3 || city.StrMin != "bj" || city.StrMax != "sh" || city.Numeric {
+		t.Errorf("city 统计信息 = %+v", city)
+	}
+}
+
+func TestZoneMapShards(t *testing.T) {
+	store := testZoneMapStore{}
+	shards := map[string]string{
+		"zm_a": "id\tage\tcity\n1\t10\tbj\n2\t20\tsh\n",
+		"zm_b": "id\tage\tcity\n3\t40\tgz\n4\t50\tsz\n",
+		"zm_c": "id\tage\tcity\n5\t60\tbj\n6\t\t\n",
+	}
+	for pos, content := range shards {
+		if err := SaveZoneMapFromContent(pos, content, store); err != nil {
+			t.Fatalf("SaveZoneMapFromContent 失败: %v", err)
+		}
+	}
+
+	cases := []struct {
+		name       string
+		filePos    string
+		conditions string
+		want       []string
+	}{
+		{"数值范围之外", `["zm_a","zm_b","zm_c"]`, `[[{"field":"age","val":"30","pos":"zm_a","compare":"gt","type":"int"}]]`, []string{"zm_a"}},
+		{"between与范围相交", `["zm_a","zm_b","zm_c"]`, `[[{"field":"age","val":"[\"15\",\"45\"]","pos":"zm_a","compare":"between","type":"int"}]]`, []string{"zm_c"}},
+		{"等值不在布隆过滤器中", `["zm_a","zm_b","zm_c"]`, `[[{"field":"city","val":"gz","pos":"zm_a","compare":"eq","type":"string"}]]`, []string{"zm_a", "zm_c"}},
+		{"in的值都不在布隆过滤器中", `["zm_a","zm_b","zm_c"]`, `[[{"field":"city","val":"[\"bj\",\"xx\"]","pos":"zm_a","compare":"in","type":"string"}]]`, []string{"zm_b"}},
+		{"任一条件组可能成立时不跳过", `["zm_a","zm_b","zm_c"]`,
+			`[[{"field":"age","val":"30","pos":"zm_a","compare":"gt","type":"int"}],[{"field":"city","val":"bj","pos":"zm_a","compare":"eq","type":"string"}]]`, []string{}},
+		{"isnull跳过没有空值的分片", `["zm_a","zm_b","zm_c"]`, `[[{"field":"age","val":"","pos":"zm_a","compare":"isnull","type":"int"}]]`, []string{"zm_a", "zm_b"}},
+		{"分片没有该列时不跳过", `["zm_a","zm_b","zm_c"]`, `[[{"field":"other","val":"1","pos":"zm_a","compare":"eq","type":"string"}]]`, []string{}},
+		{"有分片没有统计信息时不按数值跳过", `["zm_a","zm_b","zm_none"]`, `[[{"field":"age","val":"30","pos":"zm_a","compare":"gt","type":"int"}]]`, []string{}},
+		{"全部可跳过时保留主分片", `["zm_a","zm_b"]`, `[[{"field":"age","val":"100","pos":"zm_a","compare":"gt","type":"int"}]]`, []string{"zm_b"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			queryItem := `{"queryConcatType":"single","filePos":[` + tc.filePos + `],"queryConditions":` + tc.conditions + `}`
+			_, skipped, err := ZoneMapShards(queryItem, store)
+			if err != nil {
+				t.Fatalf("ZoneMapShards 失败: %v", err)
+			}
+			if skipped == nil {
+				skipped = []string{}
+			}
+			if !reflect.DeepEqual(skipped, tc.want) {
+				t.Errorf("跳过的分片 = %v，期望 %v", skipped, tc.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"errors"
 
 	"chainqa_offchain_demo/chain"
@@ -31,6 +32,25 @@ func ExecBlockchain4Chainmaker(contractName string, method string, params map[st
 	}
 }
 
+// ExecBlockchain4ChainmakerContext 执行区块链操作，ctx结束时不再等待（SDK调用无法中断，其结果被丢弃）
+func ExecBlockchain4ChainmakerContext(ctx context.Context, contractName string, method string, params map[string]interface{}) (string, error) {
+	type chainResult struct {
+		result string
+		err    error
+	}
+	done := make(chan chainResult, 1)
+	go func() {
+		result, err := ExecBlockchain4Chainmaker(contractName, method, params)
+		done <- chainResult{result: result, err: err}
+	}()
+	select {
+	case res := <-done:
+		return res.result, res.err
+	case <-ctx.Done():
+		return "", errors.New("调用区块链错误：" + ctx.Err().Error())
+	}
+}
+
 // ------------------------ 以下为业务函数 ------------------------
 func GetPublicKeyFromBlockchain4Chainmaker(contractName string) (string, error) {
 	// ====================== 构造响应 ======================
@@ -92,6 +112,11 @@ func UploadEnvelopeToBlockchainWithDomain4Chainmaker(contractName string, envelo
 }
 
 func GetAesKeyFromBlockchain4Chainmaker(contractName string, chainServiceUrl string, pos string) (string, error) {
+	return GetAesKeyFromBlockchain4ChainmakerContext(context.Background(), contractName, chainServiceUrl, pos)
+}
+
+// GetAesKeyFromBlockchain4ChainmakerContext 获取AES密钥，ctx结束时不再等待
+func GetAesKeyFromBlockchain4ChainmakerContext(ctx context.Context, contractName string, chainServiceUrl string, pos string) (string, error) {
 	// ====================== 构造响应 ======================
 
 	// 创建请求数据
@@ -104,11 +129,11 @@ func GetAesKeyFromBlockchain4Chainmaker(contractName string, chainServiceUrl str
 	}
 
 	// ======================= 发送请求 =====================
-	return ExecBlockchain4Chainmaker(data.ContractName, data.MethodName, data.Args)
+	return ExecBlockchain4ChainmakerContext(ctx, data.ContractName, data.MethodName, data.Args)
 }
 
 // UpdateQueryLog 更新查询日志
-func UpdateQueryLog4Chainmaker(contractName string, chainServiceUrl string, uId string, queryItem string, queryStatus int, queryResult string) error {
+func UpdateQueryLog4Chainmaker(contractName string, chainServiceUrl string, uId string, queryItem string, queryStatus int, queryResult string, options QueryLogOptions) error {
 	// ====================== 构造响应 ======================
 
 	queryStatusStr := strconv.Itoa(queryStatus)
@@ -124,6 +149,7 @@ func UpdateQueryLog4Chainmaker(contractName string, chainServiceUrl string, uId
 			"queryResult": queryResult,
 		},
 	}
+	options.applyTo(data.Args)
 
 	// ======================= 发送请求 ======================
 
@@ -284,3 +310,121 @@ func QueryDomainInfo4Chainmaker(contractName string, chainServiceUrl string, nam
 	}
 	return ExecBlockchain4Chainmaker(data.ContractName, data.MethodName, data.Args)
 }
+
+func AnchorQueryTemplate4Chainmaker(contractName string, chainServiceUrl string, uId string, name string, version int, hash string) error {
+	// ====================== 构造响应 ======================
+
+	// 创建请求数据
+	data := chainDTO{
+		ContractName: contractName,
+		MethodName:   "anchorQueryTemplate",
+		Args: map[string]interface{}{
+			"uId":     uId,
+			"name":    name,
+			"version": strconv.Itoa(version),
+			"hash":    hash,
+		},
+	}
+	_, err := ExecBlockchain4Chainmaker(data.ContractName, data.MethodName, data.Args)
+	return err
+}
+
+func GetQueryTemplateAnchor4Chainmaker(contractName string, chainServiceUrl string, name string, version int) (string, error) {
+	// ====================== 构造响应 ======================
+
+	// 创建请求数据
+	data := chainDTO{
+		ContractName: contractName,
+		MethodName:   "getQueryTemplateAnchor",
+		Args: map[string]interface{}{
+			"name":    name,
+			"version": strconv.Itoa(version),
+		},
+	}
+	return ExecBlockchain4Chainmaker(data.ContractName, data.MethodName, data.Args)
+}
+
+func AnchorCohort4Chainmaker(contractName string, chainServiceUrl string, uId string, orgId string, name string, hash string, definition string, counts int) error {
+	// ====================== 构造响应 ======================
+
+	// 创建请求数据
+	data := chainDTO{
+		ContractName: contractName,
+		MethodName:   "anchorCohort",
+		Args: map[string]interface{}{
+			"uId":        uId,
+			"orgId":      orgId,
+			"name":       name,
+			"hash":       hash,
+			"definition": definition,
+			"counts":     strconv.Itoa(counts),
+		},
+	}
+	_, err := ExecBlockchain4Chainmaker(data.ContractName, data.MethodName, data.Args)
+	return err
+}
+
+func GetCohortAnchor4Chainmaker(contractName string, chainServiceUrl string, orgId string, name string, hash string) (string, error) {
+	// ====================== 构造响应 ======================
+
+	// 创建请求数据
+	data := chainDTO{
+		ContractName: contractName,
+		MethodName:   "getCohortAnchor",
+		Args: map[string]interface{}{
+			"orgId": orgId,
+			"name":  name,
+			"hash":  hash,
+		},
+	}
+	return ExecBlockchain4Chainmaker(data.ContractName, data.MethodName, data.Args)
+}
+
+func GetColumnPolicy4Chainmaker(contractName string, chainServiceUrl string, name string, orgId string, role string) (string, error) {
+	// ====================== 构造响应 ======================
+
+	// 创建请求数据
+	data := chainDTO{
+		ContractName: contractName,
+		MethodName:   "getColumnPolicy",
+		Args: map[string]interface{}{
+			"name":  name,
+			"orgId": orgId,
+			"role":  role,
+		},
+	}
+	return ExecBlockchain4Chainmaker(data.ContractName, data.MethodName, data.Args)
+}
+
+func ConsumePrivacyBudget4Chainmaker(contractName string, chainServiceUrl string, name string, orgId string, role string, uId string, epsilon float64) (string, error) {
+	// ====================== 构造响应 ======================
+
+	// 创建请求数据
+	data := chainDTO{
+		ContractName: contractName,
+		MethodName:   "consumePrivacyBudget",
+		Args: map[string]interface{}{
+			"name":    name,
+			"orgId":   orgId,
+			"role":    role,
+			"uId":     uId,
+			"epsilon": strconv.FormatFloat(epsilon, 'f', -1, 64),
+		},
+	}
+	return ExecBlockchain4Chainmaker(data.ContractName, data.MethodName, data.Args)
+}
+
+func GetPrivacyBudget4Chainmaker(contractName string, chainServiceUrl string, name string, orgId string) (string, error) {
+	// ====================== 构造响应 ======================
+
+	// 创建请求数据
+	data := chainDTO{
+		ContractName: contractName,
+		MethodName:   "getPrivacyBudget",
+		Args: map[string]interface{}{
+			"name":  name,
+			"orgId": orgId,
+		},
+	}
+	return ExecBlockchain4Chainmaker(data.ContractName, data.MethodName, data.Args)
+}
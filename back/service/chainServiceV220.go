@@ -2,6 +2,7 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -30,11 +31,16 @@ type ChainSuccessResponse struct {
 
 // ExecBlockchain 执行区块链操作
 func ExecBlockchain(chainServiceUrl string, jsonData []byte) (string, error) {
+	return ExecBlockchainContext(context.Background(), chainServiceUrl, jsonData)
+}
+
+// ExecBlockchainContext 执行区块链操作，ctx结束时中断请求
+func ExecBlockchainContext(ctx context.Context, chainServiceUrl string, jsonData []byte) (string, error) {
 	// 创建HTTP客户端
 	client := &http.Client{}
 
 	// 创建请求对象
-	req, err := http.NewRequest("POST", chainServiceUrl, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", chainServiceUrl, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return "", errors.New("创建请求失败" + err.Error())
 	}
@@ -171,10 +177,15 @@ func UploadEnvelopeToBlockchainWithDomain(contractName string, chainServiceUrl s
 }
 
 func GetAesKeyFromBlockchain(contractName string, chainServiceUrl string, pos string) (string, error) {
+	return GetAesKeyFromBlockchainContext(context.Background(), contractName, chainServiceUrl, pos)
+}
+
+// GetAesKeyFromBlockchainContext 获取AES密钥，ctx结束时中断请求
+func GetAesKeyFromBlockchainContext(ctx context.Context, contractName string, chainServiceUrl string, pos string) (string, error) {
 	// ====================== 构造响应 ======================
 	if chainServiceUrl == "" {
 		// chainServiceUrl = "http://host.docker.internal:9001/tencent-chainapi/exec"
-		return GetAesKeyFromBlockchain4Chainmaker(contractName, chainServiceUrl, pos)
+		return GetAesKeyFromBlockchain4ChainmakerContext(ctx, contractName, chainServiceUrl, pos)
 	}
 
 	// 创建请求数据
@@ -193,15 +204,25 @@ func GetAesKeyFromBlockchain(contractName string, chainServiceUrl string, pos st
 		return "", errors.New("转换JSON失败" + err.Error())
 	}
 
-	return ExecBlockchain(chainServiceUrl, jsonData)
+	return ExecBlockchainContext(ctx, chainServiceUrl, jsonData)
 }
 
 // UpdateQueryLog 更新查询日志
 func UpdateQueryLog(contractName string, chainServiceUrl string, uId string, queryItem string, queryStatus int, queryResult string) error {
+	return UpdateQueryLogWithAction(contractName, chainServiceUrl, uId, queryItem, queryStatus, queryResult, "")
+}
+
+// UpdateQueryLogWithAction 更新查询日志，并记录操作类型（query/export/metadata/search，为空时合约记为query）
+func UpdateQueryLogWithAction(contractName string, chainServiceUrl string, uId string, queryItem string, queryStatus int, queryResult string, action string) error {
+	return UpdateQueryLogWithOptions(contractName, chainServiceUrl, uId, queryItem, queryStatus, queryResult, QueryLogOptions{Action: action})
+}
+
+// UpdateQueryLogWithOptions 更新查询日志，并记录附加信息（操作类型、执行的查询模板等）
+func UpdateQueryLogWithOptions(contractName string, chainServiceUrl string, uId string, queryItem string, queryStatus int, queryResult string, options QueryLogOptions) error {
 	// ====================== 构造响应 ======================
 	if chainServiceUrl == "" {
 		// chainServiceUrl = "http://host.docker.internal:9001/tencent-chainapi/exec"
-		return UpdateQueryLog4Chainmaker(contractName, chainServiceUrl, uId, queryItem, queryStatus, queryResult)
+		return UpdateQueryLog4Chainmaker(contractName, chainServiceUrl, uId, queryItem, queryStatus, queryResult, options)
 	}
 
 	queryStatusStr := strconv.Itoa(queryStatus)
@@ -217,6 +238,7 @@ func UpdateQueryLog(contractName string, chainServiceUrl string, uId string, que
 			"queryResult": queryResult,
 		},
 	}
+	options.applyTo(data.Args)
 
 	// ======================= 发送请求 ======================
 	// 将结构体转换为JSON
@@ -453,3 +475,205 @@ func QueryDomainInfo(contractName string, chainServiceUrl string, name string, o
 
 	return ExecBlockchain(chainServiceUrl, jsonData)
 }
+
+// AnchorQueryTemplate 锚定查询模板某个版本的哈希
+func AnchorQueryTemplate(contractName string, chainServiceUrl string, uId string, name string, version int, hash string) error {
+	// ====================== 构造响应 ======================
+	if chainServiceUrl == "" {
+		return AnchorQueryTemplate4Chainmaker(contractName, chainServiceUrl, uId, name, version, hash)
+	}
+
+	// 创建请求数据
+	data := chainDTO{
+		ContractName: contractName,
+		MethodName:   "anchorQueryTemplate",
+		Args: map[string]interface{}{
+			"uId":     uId,
+			"name":    name,
+			"version": strconv.Itoa(version),
+			"hash":    hash,
+		},
+	}
+
+	// ======================= 发送请求 ======================
+	// 将结构体转换为JSON
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return errors.New("转换JSON失败" + err.Error())
+	}
+
+	_, err = ExecBlockchain(chainServiceUrl, jsonData)
+	return err
+}
+
+// GetQueryTemplateAnchor 获取查询模板某个版本锚定的哈希（JSON：name、version、hash、uId、timestamp）
+func GetQueryTemplateAnchor(contractName string, chainServiceUrl string, name string, version int) (string, error) {
+	// ====================== 构造响应 ======================
+	if chainServiceUrl == "" {
+		return GetQueryTemplateAnchor4Chainmaker(contractName, chainServiceUrl, name, version)
+	}
+
+	// 创建请求数据
+	data := chainDTO{
+		ContractName: contractName,
+		MethodName:   "getQueryTemplateAnchor",
+		Args: map[string]interface{}{
+			"name":    name,
+			"version": strconv.Itoa(version),
+		},
+	}
+
+	// ======================= 发送请求 ======================
+	// 将结构体转换为JSON
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return "", errors.New("转换JSON失败" + err.Error())
+	}
+
+	return ExecBlockchain(chainServiceUrl, jsonData)
+}
+
+// AnchorCohort 锚定队列的定义和哈希
+func AnchorCohort(contractName string, chainServiceUrl string, uId string, orgId string, name string, hash string, definition string, counts int) error {
+	// ====================== 构造响应 ======================
+	if chainServiceUrl == "" {
+		return AnchorCohort4Chainmaker(contractName, chainServiceUrl, uId, orgId, name, hash, definition, counts)
+	}
+
+	// 创建请求数据
+	data := chainDTO{
+		ContractName: contractName,
+		MethodName:   "anchorCohort",
+		Args: map[string]interface{}{
+			"uId":        uId,
+			"orgId":      orgId,
+			"name":       name,
+			"hash":       hash,
+			"definition": definition,
+			"counts":     strconv.Itoa(counts),
+		},
+	}
+
+	// ======================= 发送请求 ======================
+	// 将结构体转换为JSON
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return errors.New("转换JSON失败" + err.Error())
+	}
+
+	_, err = ExecBlockchain(chainServiceUrl, jsonData)
+	return err
+}
+
+// GetCohortAnchor 获取队列锚定的定义和哈希（JSON：name、orgId、hash、definition、counts、uId、timestamp）
+func GetCohortAnchor(contractName string, chainServiceUrl string, orgId string, name string, hash string) (string, error) {
+	// ====================== 构造响应 ======================
+	if chainServiceUrl == "" {
+		return GetCohortAnchor4Chainmaker(contractName, chainServiceUrl, orgId, name, hash)
+	}
+
+	// 创建请求数据
+	data := chainDTO{
+		ContractName: contractName,
+		MethodName:   "getCohortAnchor",
+		Args: map[string]interface{}{
+			"orgId": orgId,
+			"name":  name,
+			"hash":  hash,
+		},
+	}
+
+	// ======================= 发送请求 ======================
+	// 将结构体转换为JSON
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return "", errors.New("转换JSON失败" + err.Error())
+	}
+
+	return ExecBlockchain(chainServiceUrl, jsonData)
+}
+
+// GetColumnPolicy 获取角色读取数据域时生效的列权限（JSON：allowColumns、denyColumns、masks）
+func GetColumnPolicy(contractName string, chainServiceUrl string, name string, orgId string, role string) (string, error) {
+	// ====================== 构造响应 ======================
+	if chainServiceUrl == "" {
+		return GetColumnPolicy4Chainmaker(contractName, chainServiceUrl, name, orgId, role)
+	}
+
+	// 创建请求数据
+	data := chainDTO{
+		ContractName: contractName,
+		MethodName:   "getColumnPolicy",
+		Args: map[string]interface{}{
+			"name":  name,
+			"orgId": orgId,
+			"role":  role,
+		},
+	}
+
+	// ======================= 发送请求 ======================
+	// 将结构体转换为JSON
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return "", errors.New("转换JSON失败" + err.Error())
+	}
+
+	return ExecBlockchain(chainServiceUrl, jsonData)
+}
+
+// ConsumePrivacyBudget 使用组织在数据域中的隐私预算，超过预算时返回错误（JSON：name、orgId、limit、spent、queries、uId、timestamp）
+func ConsumePrivacyBudget(contractName string, chainServiceUrl string, name string, orgId string, role string, uId string, epsilon float64) (string, error) {
+	// ====================== 构造响应 ======================
+	if chainServiceUrl == "" {
+		return ConsumePrivacyBudget4Chainmaker(contractName, chainServiceUrl, name, orgId, role, uId, epsilon)
+	}
+
+	// 创建请求数据
+	data := chainDTO{
+		ContractName: contractName,
+		MethodName:   "consumePrivacyBudget",
+		Args: map[string]interface{}{
+			"name":    name,
+			"orgId":   orgId,
+			"role":    role,
+			"uId":     uId,
+			"epsilon": strconv.FormatFloat(epsilon, 'f', -1, 64),
+		},
+	}
+
+	// ======================= 发送请求 ======================
+	// 将结构体转换为JSON
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return "", errors.New("转换JSON失败" + err.Error())
+	}
+
+	return ExecBlockchain(chainServiceUrl, jsonData)
+}
+
+// GetPrivacyBudget 获取组织在数据域中的隐私预算使用情况
+func GetPrivacyBudget(contractName string, chainServiceUrl string, name string, orgId string) (string, error) {
+	// ====================== 构造响应 ======================
+	if chainServiceUrl == "" {
+		return GetPrivacyBudget4Chainmaker(contractName, chainServiceUrl, name, orgId)
+	}
+
+	// 创建请求数据
+	data := chainDTO{
+		ContractName: contractName,
+		MethodName:   "getPrivacyBudget",
+		Args: map[string]interface{}{
+			"name":  name,
+			"orgId": orgId,
+		},
+	}
+
+	// ======================= 发送请求 ======================
+	// 将结构体转换为JSON
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return "", errors.New("转换JSON失败" + err.Error())
+	}
+
+	return ExecBlockchain(chainServiceUrl, jsonData)
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"io/ioutil"
 	"strings"
@@ -16,6 +17,18 @@ import (
  * @return error 错误信息
  */
 func HandleGetIPFSFile(cid, ipfsServiceUrl string) (string, error) {
+	return HandleGetIPFSFileContext(context.Background(), cid, ipfsServiceUrl)
+}
+
+/**
+ * @Description: 从IPFS获取文件，ctx结束时中断请求
+ * @param ctx context
+ * @param cid IPFS文件CID
+ * @param ipfsServiceUrl IPFS服务地址
+ * @return string 文件内容
+ * @return error 错误信息
+ */
+func HandleGetIPFSFileContext(ctx context.Context, cid, ipfsServiceUrl string) (string, error) {
 
 	var IPFSNodeAddr = "http://47.113.204.64:5001"
 	if ipfsServiceUrl != "" {
@@ -32,11 +45,16 @@ func HandleGetIPFSFile(cid, ipfsServiceUrl string) (string, error) {
 	// cid := "QmRGpFDBtctKnFTDwLTVY8yocgvCE1M8J2e2E3g5DEvvTt"
 
 	// 从IPFS获取文件
-	rc, err := sh.Cat(cid)
+	resp, err := sh.Request("cat", cid).Send(ctx)
 	if err != nil {
 
 		return "", errors.New("从IPFS获取文件失败:" + err.Error())
 	}
+	if resp.Error != nil {
+		resp.Close()
+		return "", errors.New("从IPFS获取文件失败:" + resp.Error.Error())
+	}
+	rc := resp.Output
 	body, err := ioutil.ReadAll(rc)
 
 	if err != nil {
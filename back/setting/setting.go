@@ -11,6 +11,9 @@ type AppConfig struct {
 	Release bool        `ini:"release"`
 	Port    int         `ini:"port"`
 	Redis   RedisConfig `ini:"redis"`
+	Query   QueryConfig `ini:"query"`
+
+	QueryCache QueryCacheConfig `ini:"query_cache"`
 }
 
 // RedisConfig Redis 配置
@@ -25,6 +28,33 @@ type RedisConfig struct {
 	WriteTimeout int    `ini:"write_timeout"`
 }
 
+// QueryConfig 查询配置
+type QueryConfig struct {
+	DateLayouts      []string `ini:"date_layouts" delim:"|"` // 日期输入格式（Go layout），多个用|分隔
+	TimeZone         string   `ini:"time_zone"`              // 日期时区，如 Asia/Shanghai
+	ShardParallelism int      `ini:"shard_parallelism"`      // 并发获取、解密、过滤的分片数，不填写时为4
+	TimeoutSeconds   int      `ini:"timeout_seconds"`        // 单个查询的最长执行时间（秒，含获取分片），不填写或为0时不限制
+	MaxRowsScanned   int      `ini:"max_rows_scanned"`       // 单个查询最多扫描的行数，不填写或为0时不限制
+	MaxJoinedRows    int      `ini:"max_joined_rows"`        // 联表结果最多行数，不填写或为0时不限制
+	MaxResultBytes   int      `ini:"max_result_bytes"`       // 查询结果最多字节数，不填写或为0时不限制
+	DPMaxEpsilon     float64  `ini:"dp_max_epsilon"`         // 差分隐私查询单次最多使用的隐私预算，不填写或为0时不限制
+	DPMinGroupCount  int      `ini:"dp_min_group_count"`     // 差分隐私分组查询中加噪后计数小于该值的分组不返回，不填写时为0（只去掉计数为0的分组）
+	MaxPageSize      int      `ini:"max_page_size"`          // 分页查询每页最多行数（或交易ID数），不填写时为1000
+	PageTTL          int      `ini:"page_ttl"`               // 分页查询状态的有效期（秒，每次翻页后重新计算），不填写时为600
+	MaxPagedQueries  int      `ini:"max_paged_queries"`      // 同时保存的分页查询最多个数（超过时淘汰最早过期的），不填写时为64
+	CursorSecret     string   `ini:"cursor_secret"`          // 分页游标的签名密钥，不填写时每次启动随机生成（重启后旧游标失效）
+}
+
+// QueryCacheConfig 查询结果缓存配置
+type QueryCacheConfig struct {
+	Enabled       bool   `ini:"enabled"`         // 是否启用
+	Backend       string `ini:"backend"`         // 存储：memory（默认）/redis
+	TTL           int    `ini:"ttl"`             // 过期时间（秒），不填写时为600
+	MaxEntries    int    `ini:"max_entries"`     // 内存缓存最多条数，不填写时为256
+	MaxBytes      int    `ini:"max_bytes"`       // 内存缓存最多字节数，不填写时为64MB
+	MaxEntryBytes int    `ini:"max_entry_bytes"` // 单条结果最多字节数（超过时不缓存），不填写时为4MB
+}
+
 func Init(file string) error {
 	return ini.MapTo(Conf, file)
 }
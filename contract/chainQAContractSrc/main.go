@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
 
 	"chainmaker.org/chainmaker/contract-sdk-go/v2/pb/protogo"
 	"chainmaker.org/chainmaker/contract-sdk-go/v2/sandbox"
@@ -50,6 +51,20 @@ func (f *ChainQA) InvokeContract(method string) protogo.Response {
 		return f.queryMyManagedDomains()
 	case "queryDomainInfo":
 		return f.queryDomainInfo()
+	case "anchorQueryTemplate":
+		return f.anchorQueryTemplate()
+	case "getQueryTemplateAnchor":
+		return f.getQueryTemplateAnchor()
+	case "getColumnPolicy":
+		return f.getColumnPolicy()
+	case "consumePrivacyBudget":
+		return f.consumePrivacyBudget()
+	case "getPrivacyBudget":
+		return f.getPrivacyBudget()
+	case "anchorCohort":
+		return f.anchorCohort()
+	case "getCohortAnchor":
+		return f.getCohortAnchor()
 	default:
 		return sdk.Error("invalid method")
 	}
@@ -198,6 +213,16 @@ type QueryLog struct {
 	QueryItem   string //查询项
 	QueryStatus int    //查询状态
 	QueryResult string //查询结果
+	Action      string //操作类型：query（查询，为空时也表示查询）/export（导出）/metadata（查看表结构）/search（索引查询）/cohort（队列操作）
+
+	TemplateName    string //执行的查询模板名称（不是通过模板执行时为空）
+	TemplateVersion int    //执行的查询模板版本
+	ColumnMasks     string //查询时生效的列权限（禁止的列和脱敏规则，没有时为空）
+	Privacy         string //差分隐私查询的噪声机制和隐私预算（不是差分隐私查询时为空）
+	Anonymity       string //触发的k-匿名策略及隐藏、泛化的情况（未触发时为空）
+	PagedQueryId    string //分页查询ID，同一分页查询每一页的日志相同（不是分页查询时为空）
+	PageOffset      int    //分页查询中本页的偏移量
+	Cohort          string //构建的队列，或查询限定的队列（名称@哈希，没有时为空）
 }
 
 /**
@@ -206,6 +231,15 @@ type QueryLog struct {
  * @param queryItem 查询项
  * @param queryStatus 查询状态
  * @param queryResult 查询结果
+ * @param action 操作类型（选填）：query/export/metadata/search/cohort
+ * @param templateName 执行的查询模板名称（选填）
+ * @param templateVersion 执行的查询模板版本（选填）
+ * @param columnMasks 查询时生效的列权限（选填）
+ * @param privacy 差分隐私查询的噪声机制和隐私预算（选填）
+ * @param anonymity 触发的k-匿名策略（选填）
+ * @param pagedQueryId 分页查询ID（选填）
+ * @param pageOffset 分页查询中本页的偏移量（选填）
+ * @param cohort 构建的队列或查询限定的队列（选填）
  */
 func (f *ChainQA) updateQueryLog() protogo.Response {
 	params := sdk.Instance.GetArgs()
@@ -214,6 +248,18 @@ func (f *ChainQA) updateQueryLog() protogo.Response {
 	queryStatus := string(params["queryStatus"])
 	queryStatusInt, _ := strconv.Atoi(queryStatus)
 	queryResult := string(params["queryResult"])
+	action := string(params["action"])
+	if action == "" {
+		action = "query"
+	}
+	templateName := string(params["templateName"])
+	templateVersion, _ := strconv.Atoi(string(params["templateVersion"]))
+	columnMasks := string(params["columnMasks"])
+	privacy := string(params["privacy"])
+	anonymity := string(params["anonymity"])
+	pagedQueryId := string(params["pagedQueryId"])
+	pageOffset, _ := strconv.Atoi(string(params["pageOffset"]))
+	cohort := string(params["cohort"])
 	timestampNumberStr, err := sdk.Instance.GetTxTimeStamp()
 	if err != nil {
 		return sdk.Error("[chainqa updateQueryLog CONTRACT]时间戳获取失败")
@@ -230,6 +276,16 @@ func (f *ChainQA) updateQueryLog() protogo.Response {
 		QueryItem:   queryItem,
 		QueryStatus: queryStatusInt,
 		QueryResult: queryResult,
+		Action:      action,
+
+		TemplateName:    templateName,
+		TemplateVersion: templateVersion,
+		ColumnMasks:     columnMasks,
+		Privacy:         privacy,
+		Anonymity:       anonymity,
+		PagedQueryId:    pagedQueryId,
+		PageOffset:      pageOffset,
+		Cohort:          cohort,
 	}
 	QueryLogBytes, err := json.Marshal(QueryLog)
 	if err != nil {
@@ -391,9 +447,12 @@ type TrustedDataDomain struct {
 }
 
 // AccessPolicy 访问策略容器
+// 只被授予dpQuery（没有read）的角色只能执行差分隐私查询；metadata允许查看数据集的表结构（不能查询数据）
 type AccessPolicy struct {
-	Version      string                  `json:"version"`
-	PolicyGrants map[string][]RolePolicy `json:"policyGrants"` // Key: OrgId
+	Version        string                  `json:"version"`
+	PolicyGrants   map[string][]RolePolicy `json:"policyGrants"`             // Key: OrgId
+	PrivacyBudgets map[string]float64      `json:"privacyBudgets,omitempty"` // Key: OrgId，该组织在数据域中累计可用的隐私预算（epsilon），未设置时不能执行差分隐私查询
+	Anonymity      *AnonymityPolicy        `json:"anonymity,omitempty"`      // k-匿名策略，对数据域的所有查询生效
 }
 
 // RolePolicy 角色策略
@@ -403,9 +462,39 @@ type RolePolicy struct {
 }
 
 // Permission 权限详情
+// 列权限对read和dpQuery生效：AllowColumns为空时允许所有列，DenyColumns优先于AllowColumns，Masks为返回前的脱敏规则
 type Permission struct {
-	Effect  string   `json:"effect"`
-	Actions []string `json:"actions"`
+	Effect       string       `json:"effect"`
+	Actions      []string     `json:"actions"`
+	AllowColumns []string     `json:"allowColumns,omitempty"`
+	DenyColumns  []string     `json:"denyColumns,omitempty"`
+	Masks        []ColumnMask `json:"masks,omitempty"`
+}
+
+// ColumnMask 列脱敏规则
+type ColumnMask struct {
+	Column     string `json:"column"`               // 列名
+	Method     string `json:"method"`               // 脱敏方式：hash（哈希）/partial（部分遮盖）/ageBand（年龄分段）
+	KeepPrefix int    `json:"keepPrefix,omitempty"` // partial：保留的前缀字符数
+	KeepSuffix int    `json:"keepSuffix,omitempty"` // partial：保留的后缀字符数
+	BandWidth  int    `json:"bandWidth,omitempty"`  // ageBand：每段的宽度
+	Salt       string `json:"salt,omitempty"`       // hash：盐
+}
+
+// AnonymityPolicy k-匿名策略：按准标识符列划分的等价类少于K行时不返回（或先泛化准标识符）
+type AnonymityPolicy struct {
+	K                int          `json:"k"`                    // 最小等价类大小
+	QuasiIdentifiers []string     `json:"quasiIdentifiers"`     // 准标识符列，如医院、科室、疾病代码
+	Mode             string       `json:"mode,omitempty"`       // suppress（隐藏，默认）/generalize（先泛化再隐藏）
+	Generalize       []ColumnMask `json:"generalize,omitempty"` // generalize：准标识符的泛化规则（ageBand/partial）
+}
+
+// ColumnPolicy 某个角色读取数据时生效的列权限（由该角色所有允许read的权限合并），附带数据域的k-匿名策略
+type ColumnPolicy struct {
+	AllowColumns []string         `json:"allowColumns"` // 为空时允许所有列
+	DenyColumns  []string         `json:"denyColumns"`
+	Masks        []ColumnMask     `json:"masks"`
+	Anonymity    *AnonymityPolicy `json:"anonymity,omitempty"`
 }
 
 // UserAttributes 用于 CheckAccess 的入参
@@ -611,6 +700,195 @@ func (f *ChainQA) verifyPolicy(policy AccessPolicy, user UserAttributes, action
 	return false
 }
 
+// getColumnPolicy 获取调用者读取数据域时生效的列权限
+// 参数: name, orgId, role
+// 合并该角色所有允许read或dpQuery的权限，并附带数据域的k-匿名策略：任一权限不限制列时允许所有列，否则为各权限允许列的并集；禁止的列和脱敏规则取并集（同一列取第一条脱敏规则）
+func (f *ChainQA) getColumnPolicy() protogo.Response {
+	args := sdk.Instance.GetArgs()
+	domainID := "DOMAIN_" + string(args["name"])
+	orgId := string(args["orgId"])
+	role := string(args["role"])
+	if orgId == "" || role == "" {
+		return sdk.Error("orgId and role are required")
+	}
+
+	domainBytes, err := sdk.Instance.GetStateByte(domainID, "")
+	if err != nil || len(domainBytes) == 0 {
+		return sdk.Error("Domain not found")
+	}
+	var domain TrustedDataDomain
+	if err := json.Unmarshal(domainBytes, &domain); err != nil {
+		return sdk.Error("Data corruption")
+	}
+	if domain.Status != "Active" {
+		return sdk.Error("Domain is not active")
+	}
+	user := UserAttributes{OrgId: orgId, Role: role}
+	if !f.verifyPolicy(domain.AccessPolicy, user, "read") && !f.verifyPolicy(domain.AccessPolicy, user, "dpQuery") {
+		return sdk.Error("Unauthorized: no read permission")
+	}
+
+	policy := ColumnPolicy{AllowColumns: []string{}, DenyColumns: []string{}, Masks: []ColumnMask{}, Anonymity: domain.AccessPolicy.Anonymity}
+	allowAll := false
+	masked := make(map[string]bool)
+	for _, rp := range domain.AccessPolicy.PolicyGrants[orgId] {
+		if rp.Role != role {
+			continue
+		}
+		for _, perm := range rp.Permissions {
+			if perm.Effect != "Allow" || (!stringInSlice(perm.Actions, "read") && !stringInSlice(perm.Actions, "dpQuery")) {
+				continue
+			}
+			if len(perm.AllowColumns) == 0 {
+				allowAll = true
+			}
+			for _, column := range perm.AllowColumns {
+				if !stringInSlice(policy.AllowColumns, column) {
+					policy.AllowColumns = append(policy.AllowColumns, column)
+				}
+			}
+			for _, column := range perm.DenyColumns {
+				if !stringInSlice(policy.DenyColumns, column) {
+					policy.DenyColumns = append(policy.DenyColumns, column)
+				}
+			}
+			for _, mask := range perm.Masks {
+				if !masked[mask.Column] {
+					masked[mask.Column] = true
+					policy.Masks = append(policy.Masks, mask)
+				}
+			}
+		}
+	}
+	if allowAll {
+		policy.AllowColumns = []string{}
+	}
+
+	policyBytes, err := json.Marshal(policy)
+	if err != nil {
+		return sdk.Error("Marshal error")
+	}
+	return sdk.Success(policyBytes)
+}
+
+// PrivacyBudget 组织在数据域中的隐私预算使用情况
+type PrivacyBudget struct {
+	Name      string  `json:"name"`      // 数据域名称
+	OrgId     string  `json:"orgId"`     // 组织ID
+	Limit     float64 `json:"limit"`     // 累计可用的隐私预算（epsilon）
+	Spent     float64 `json:"spent"`     // 已使用的隐私预算
+	Queries   int     `json:"queries"`   // 已执行的差分隐私查询次数
+	Uid       string  `json:"uId"`       // 最近一次使用的用户ID
+	Timestamp string  `json:"timestamp"` // 最近一次使用的时间戳
+}
+
+// loadPrivacyBudget 读取数据域和组织在其中的隐私预算（上限取自数据域当前的访问策略）
+func (f *ChainQA) loadPrivacyBudget(name string, orgId string) (PrivacyBudget, TrustedDataDomain, error) {
+	budget := PrivacyBudget{Name: name, OrgId: orgId}
+	var domain TrustedDataDomain
+	domainBytes, err := sdk.Instance.GetStateByte("DOMAIN_"+name, "")
+	if err != nil || len(domainBytes) == 0 {
+		return budget, domain, fmt.Errorf("Domain not found")
+	}
+	if err := json.Unmarshal(domainBytes, &domain); err != nil {
+		return budget, domain, fmt.Errorf("Data corruption")
+	}
+	if domain.Status != "Active" {
+		return budget, domain, fmt.Errorf("Domain is not active")
+	}
+
+	budgetBytes, err := sdk.Instance.GetStateByte("chain_privacy_budget", name+"__"+orgId)
+	if err != nil {
+		return budget, domain, fmt.Errorf("Failed to read state")
+	}
+	if len(budgetBytes) > 0 {
+		if err := json.Unmarshal(budgetBytes, &budget); err != nil {
+			return budget, domain, fmt.Errorf("Data corruption")
+		}
+	}
+	budget.Limit = domain.AccessPolicy.PrivacyBudgets[orgId]
+	return budget, domain, nil
+}
+
+// consumePrivacyBudget 使用隐私预算：累计使用量超过数据域为该组织设置的预算时拒绝
+// 参数: name, orgId, role, epsilon, uId
+func (f *ChainQA) consumePrivacyBudget() protogo.Response {
+	args := sdk.Instance.GetArgs()
+	name := string(args["name"])
+	orgId := string(args["orgId"])
+	role := string(args["role"])
+	uId := string(args["uId"])
+	epsilon, err := strconv.ParseFloat(string(args["epsilon"]), 64)
+	if name == "" || orgId == "" || role == "" {
+		return sdk.Error("name, orgId and role are required")
+	}
+	if err != nil || epsilon <= 0 {
+		return sdk.Error("epsilon must be a positive number")
+	}
+
+	budget, domain, err := f.loadPrivacyBudget(name, orgId)
+	if err != nil {
+		return sdk.Error(err.Error())
+	}
+	user := UserAttributes{OrgId: orgId, Role: role}
+	if !f.verifyPolicy(domain.AccessPolicy, user, "dpQuery") && !f.verifyPolicy(domain.AccessPolicy, user, "read") {
+		return sdk.Error("Unauthorized: no dpQuery permission")
+	}
+	if budget.Limit <= 0 {
+		return sdk.Error("Privacy budget is not set for this org")
+	}
+	if budget.Spent+epsilon > budget.Limit+1e-9 {
+		return sdk.Error(fmt.Sprintf("Privacy budget exceeded: spent %g, requested %g, limit %g", budget.Spent, epsilon, budget.Limit))
+	}
+
+	timestamp, err := sdk.Instance.GetTxTimeStamp()
+	if err != nil {
+		return sdk.Error("Failed to get timestamp")
+	}
+	budget.Spent += epsilon
+	budget.Queries++
+	budget.Uid = uId
+	budget.Timestamp = timestamp
+	budgetBytes, err := json.Marshal(budget)
+	if err != nil {
+		return sdk.Error("Marshal error")
+	}
+	if err := sdk.Instance.PutStateByte("chain_privacy_budget", name+"__"+orgId, budgetBytes); err != nil {
+		return sdk.Error("PutState error")
+	}
+	return sdk.Success(budgetBytes)
+}
+
+// getPrivacyBudget 获取组织在数据域中的隐私预算使用情况
+// 参数: name, orgId
+func (f *ChainQA) getPrivacyBudget() protogo.Response {
+	args := sdk.Instance.GetArgs()
+	name := string(args["name"])
+	orgId := string(args["orgId"])
+	if name == "" || orgId == "" {
+		return sdk.Error("name and orgId are required")
+	}
+	budget, _, err := f.loadPrivacyBudget(name, orgId)
+	if err != nil {
+		return sdk.Error(err.Error())
+	}
+	budgetBytes, err := json.Marshal(budget)
+	if err != nil {
+		return sdk.Error("Marshal error")
+	}
+	return sdk.Success(budgetBytes)
+}
+
+// stringInSlice 字符串是否在数组中
+func stringInSlice(slice []string, str string) bool {
+	for _, s := range slice {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
 // ===================================================================================
 // Part 4: 查询功能扩展
 // ===================================================================================
@@ -763,6 +1041,163 @@ func (f *ChainQA) queryDomainInfo() protogo.Response {
 	return sdk.Success(domainBytes)
 }
 
+//////////////////////查询模板//////////////////////
+
+// QueryTemplateAnchor 查询模板某个版本的哈希（模板存储在链下，链上只存哈希用于校验）
+type QueryTemplateAnchor struct {
+	Name      string `json:"name"`      // 模板名称
+	Version   int    `json:"version"`   // 模板版本
+	Hash      string `json:"hash"`      // 模板内容的哈希
+	Uid       string `json:"uId"`       // 上链的用户ID
+	Timestamp string `json:"timestamp"` // 时间戳
+}
+
+/**
+ * 锚定查询模板的哈希：同一模板的同一版本只能锚定一次
+ * @param name 模板名称
+ * @param version 模板版本
+ * @param hash 模板内容的哈希
+ * @param uId 用户ID
+ */
+func (f *ChainQA) anchorQueryTemplate() protogo.Response {
+	params := sdk.Instance.GetArgs()
+	name := string(params["name"])
+	version := string(params["version"])
+	hash := string(params["hash"])
+	uId := string(params["uId"])
+	versionInt, err := strconv.Atoi(version)
+	if name == "" || hash == "" || err != nil || versionInt <= 0 {
+		return sdk.Error("[chainqa anchorQueryTemplate CONTRACT]模板名称、版本和哈希不能为空")
+	}
+	existingBytes, err := sdk.Instance.GetStateByte("chain_query_template", name+"__"+version)
+	if err != nil {
+		return sdk.Error(fmt.Sprintf("[chainqa anchorQueryTemplate CONTRACT]读取区块链失败：: %s", err))
+	}
+	if len(existingBytes) > 0 {
+		return sdk.Error("[chainqa anchorQueryTemplate CONTRACT]该模板版本已锚定")
+	}
+	timestamp, err := sdk.Instance.GetTxTimeStamp()
+	if err != nil {
+		return sdk.Error("[chainqa anchorQueryTemplate CONTRACT]时间戳获取失败")
+	}
+	anchorBytes, err := json.Marshal(QueryTemplateAnchor{Name: name, Version: versionInt, Hash: hash, Uid: uId, Timestamp: timestamp})
+	if err != nil {
+		return sdk.Error(fmt.Sprintf("[chainqa anchorQueryTemplate CONTRACT]序列化失败：: %s", err))
+	}
+	if err := sdk.Instance.PutStateByte("chain_query_template", name+"__"+version, anchorBytes); err != nil {
+		return sdk.Error(fmt.Sprintf("[chainqa anchorQueryTemplate CONTRACT]写入区块链失败：: %s", err))
+	}
+	return sdk.Success(anchorBytes)
+}
+
+/**
+ * 获取查询模板某个版本锚定的哈希
+ * @param name 模板名称
+ * @param version 模板版本
+ */
+func (f *ChainQA) getQueryTemplateAnchor() protogo.Response {
+	params := sdk.Instance.GetArgs()
+	name := string(params["name"])
+	version := string(params["version"])
+	if name == "" || version == "" {
+		return sdk.Error("[chainqa getQueryTemplateAnchor CONTRACT]模板名称和版本不能为空")
+	}
+	anchorBytes, err := sdk.Instance.GetStateByte("chain_query_template", name+"__"+version)
+	if err != nil {
+		return sdk.Error(fmt.Sprintf("[chainqa getQueryTemplateAnchor CONTRACT]读取区块链失败：: %s", err))
+	}
+	if len(anchorBytes) == 0 {
+		return sdk.Error("[chainqa getQueryTemplateAnchor CONTRACT]该模板版本未锚定")
+	}
+	return sdk.Success(anchorBytes)
+}
+
+//////////////////////队列//////////////////////
+
+// CohortAnchor 队列的定义和哈希（成员存储在链下，链上存定义和哈希用于复现和校验）
+type CohortAnchor struct {
+	Name       string `json:"name"`       // 队列名称
+	OrgId      string `json:"orgId"`      // 所属组织ID
+	Hash       string `json:"hash"`       // 队列定义和成员的哈希
+	Definition string `json:"definition"` // 队列的定义（JSON：来源的索引查询、查询项或集合运算的操作数）
+	Counts     int    `json:"counts"`     // 成员数量
+	Uid        string `json:"uId"`        // 上链的用户ID
+	Timestamp  string `json:"timestamp"`  // 时间戳
+}
+
+/**
+ * 锚定队列的定义和哈希：同一组织的同名队列，相同哈希只能锚定一次
+ * @param orgId 所属组织ID
+ * @param name 队列名称
+ * @param hash 队列定义和成员的哈希
+ * @param definition 队列的定义（JSON）
+ * @param counts 成员数量
+ * @param uId 用户ID
+ */
+func (f *ChainQA) anchorCohort() protogo.Response {
+	params := sdk.Instance.GetArgs()
+	orgId := string(params["orgId"])
+	name := string(params["name"])
+	hash := string(params["hash"])
+	definition := string(params["definition"])
+	counts, _ := strconv.Atoi(string(params["counts"]))
+	uId := string(params["uId"])
+	if orgId == "" || name == "" || hash == "" || definition == "" {
+		return sdk.Error("[chainqa anchorCohort CONTRACT]组织ID、队列名称、哈希和定义不能为空")
+	}
+	// 键以两个下划线分隔，组织ID和队列名称不能包含连续两个下划线
+	if strings.Contains(orgId, "__") || strings.Contains(name, "__") {
+		return sdk.Error("[chainqa anchorCohort CONTRACT]组织ID和队列名称不能包含连续两个下划线")
+	}
+	key := orgId + "__" + name + "__" + hash
+	existingBytes, err := sdk.Instance.GetStateByte("chain_cohort", key)
+	if err != nil {
+		return sdk.Error(fmt.Sprintf("[chainqa anchorCohort CONTRACT]读取区块链失败：: %s", err))
+	}
+	if len(existingBytes) > 0 {
+		return sdk.Error("[chainqa anchorCohort CONTRACT]该队列已锚定")
+	}
+	timestamp, err := sdk.Instance.GetTxTimeStamp()
+	if err != nil {
+		return sdk.Error("[chainqa anchorCohort CONTRACT]时间戳获取失败")
+	}
+	anchorBytes, err := json.Marshal(CohortAnchor{Name: name, OrgId: orgId, Hash: hash, Definition: definition, Counts: counts, Uid: uId, Timestamp: timestamp})
+	if err != nil {
+		return sdk.Error(fmt.Sprintf("[chainqa anchorCohort CONTRACT]序列化失败：: %s", err))
+	}
+	if err := sdk.Instance.PutStateByte("chain_cohort", key, anchorBytes); err != nil {
+		return sdk.Error(fmt.Sprintf("[chainqa anchorCohort CONTRACT]写入区块链失败：: %s", err))
+	}
+	return sdk.Success(anchorBytes)
+}
+
+/**
+ * 获取队列锚定的定义和哈希
+ * @param orgId 所属组织ID
+ * @param name 队列名称
+ * @param hash 队列定义和成员的哈希
+ */
+func (f *ChainQA) getCohortAnchor() protogo.Response {
+	params := sdk.Instance.GetArgs()
+	orgId := string(params["orgId"])
+	name := string(params["name"])
+	hash := string(params["hash"])
+	if orgId == "" || name == "" || hash == "" {
+		return sdk.Error("[chainqa getCohortAnchor CONTRACT]组织ID、队列名称和哈希不能为空")
+	}
+	if strings.Contains(orgId, "__") || strings.Contains(name, "__") {
+		return sdk.Error("[chainqa getCohortAnchor CONTRACT]组织ID和队列名称不能包含连续两个下划线")
+	}
+	anchorBytes, err := sdk.Instance.GetStateByte("chain_cohort", orgId+"__"+name+"__"+hash)
+	if err != nil {
+		return sdk.Error(fmt.Sprintf("[chainqa getCohortAnchor CONTRACT]读取区块链失败：: %s", err))
+	}
+	if len(anchorBytes) == 0 {
+		return sdk.Error("[chainqa getCohortAnchor CONTRACT]该队列未锚定")
+	}
+	return sdk.Success(anchorBytes)
+}
+
 func main() {
 	err := sandbox.Start(new(ChainQA))
 	if err != nil {